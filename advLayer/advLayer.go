@@ -8,6 +8,7 @@ If a protocol is not based on http layer, then maybe it should be on Proxy Layer
 package advLayer
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
 	"net"
@@ -96,6 +97,26 @@ type MuxClient interface {
 	DialSubConn(underlay any) (net.Conn, error)
 }
 
+// A Client that needs to dial extra tls connections by itself (like splithttp in http/1.1 mode) can implement this.
+// proxy package will call it after the tls layer of the dial side is configured.
+type TlsConfigSetter interface {
+	SetTlsConfig(*tls.Config)
+}
+
+// A Client that needs to dial extra connections by itself (like splithttp in http/1.1 mode) can implement this,
+// so that these connections are dialed the same way as the main one (sockopt, sendThrough, utls, ech).
+// The given dial function returns a conn whose tls layer (if any) has already been handshaked.
+// proxy package will call it after the dial side is fully configured.
+type UnderlayDialerSetter interface {
+	SetUnderlayDialer(dial func(ctx context.Context) (net.Conn, error))
+}
+
+// 可以 用 不可靠的 数据报 传输 udp 数据 的 子连接 (如 开启了 datagram 的 quic stream) 可以实现 该接口.
+// 在 代理协议 于 该子连接 上 完成 udp 握手 后, 调用者 用 WrapMsgConn 包装 得到的 MsgConn.
+type DatagramConn interface {
+	WrapMsgConn(netLayer.MsgConn) netLayer.MsgConn
+}
+
 type Server interface {
 	Common
 
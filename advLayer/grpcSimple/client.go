@@ -131,6 +131,11 @@ func (c *ClientConn) Write(b []byte) (n int, err error) {
 
 }
 
+// 结束 请求体, 服务端 会 读到 EOF, 而 响应 依然 可以 继续 读取. 实现 netLayer.CloseWriter
+func (c *ClientConn) CloseWrite() error {
+	return c.writer.Close()
+}
+
 func (c *ClientConn) Close() error {
 	c.shouldClose.Store(true)
 	if r := c.response; r != nil {
@@ -0,0 +1,266 @@
+package h2
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// implements advLayer.MuxClient
+type Client struct {
+	Creator
+	Config
+
+	requestHeader  http.Header
+	responseHeader map[string][]string
+
+	transport http2.Transport
+
+	mu       sync.Mutex
+	cachedCC *http2.ClientConn //一个 ClientConn 对应 一个 dial好的 tls 连接, 作为 CommonConn
+}
+
+func NewClient(conf Config, headers *httpLayer.HeaderPreset) *Client {
+	c := &Client{
+		Config:        conf,
+		requestHeader: http.Header{},
+		transport: http2.Transport{
+			DisableCompression: true,
+		},
+	}
+	if headers != nil && headers.Request != nil && len(headers.Request.Headers) > 0 {
+		c.requestHeader = http.Header(headers.Request.Headers).Clone()
+	}
+	if headers != nil && headers.Response != nil && len(headers.Response.Headers) > 0 {
+		c.responseHeader = headers.Response.Headers
+	}
+	return c
+}
+
+func (c *Client) GetPath() string {
+	return c.Path
+}
+
+func (c *Client) IsEarly() bool {
+	return false
+}
+
+func (c *Client) getCached() *http2.ClientConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cachedCC != nil && !c.cachedCC.CanTakeNewRequest() {
+		c.cachedCC = nil
+	}
+	return c.cachedCC
+}
+
+// 若 cc 为当前缓存的 ClientConn, 则将其清除
+func (c *Client) dropCached(cc *http2.ClientConn) {
+	c.mu.Lock()
+	if c.cachedCC == cc {
+		c.cachedCC = nil
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) dealErr(cc *http2.ClientConn, err error) {
+	if errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "use of closed") {
+		c.dropCached(cc)
+	}
+}
+
+func (c *Client) GetCommonConn(underlay net.Conn) (any, error) {
+	if underlay != nil {
+		return underlay, nil
+	}
+	if cc := c.getCached(); cc != nil {
+		return cc, nil
+	}
+	return nil, errors.New("h2.GetCommonConn: underlay==nil and no cached conn")
+}
+
+func (c *Client) DialSubConn(underlay any) (net.Conn, error) {
+	if underlay == nil {
+		return nil, utils.ErrNilParameter
+	}
+
+	var cc *http2.ClientConn
+	var la, ra net.Addr
+
+	switch u := underlay.(type) {
+	case *http2.ClientConn:
+		cc = u
+	case net.Conn:
+		la, ra = u.LocalAddr(), u.RemoteAddr()
+
+		//直接在 u 上 建立 ClientConn, 而不是用 Transport 的连接池, 防止 Transport 在连接不可用时 重新 dial 到同一个 u 上
+		var err error
+		cc, err = c.transport.NewClientConn(u)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.cachedCC = cc
+		c.mu.Unlock()
+	default:
+		return nil, utils.ErrInvalidData
+	}
+
+	host := ""
+	if len(c.Hosts) > 0 {
+		host = c.Hosts[rand.Intn(len(c.Hosts))]
+	}
+
+	reader, writer := io.Pipe()
+
+	request := &http.Request{
+		Method: c.Method,
+		URL: &url.URL{
+			Scheme: "https",
+			Host:   host,
+			Path:   c.Path,
+		},
+		Host:          host,
+		Proto:         "HTTP/2",
+		ProtoMajor:    2,
+		Header:        c.requestHeader.Clone(),
+		Body:          reader,
+		ContentLength: -1,
+	}
+
+	conn := &ClientConn{
+		client:  c,
+		cc:      cc,
+		request: request,
+		writer:  writer,
+		ready:   make(chan struct{}),
+		la:      la,
+		ra:      ra,
+	}
+	conn.InitEasyDeadline()
+
+	go conn.handshake() //RoundTrip 要等到 服务端响应 才返回, 所以要用 goroutine
+
+	return conn, nil
+}
+
+// implements net.Conn
+type ClientConn struct {
+	netLayer.EasyDeadline
+
+	client  *Client
+	cc      *http2.ClientConn
+	request *http.Request
+
+	writer *io.PipeWriter
+	body   io.ReadCloser
+
+	ready chan struct{}
+	err   error
+
+	closeOnce sync.Once
+
+	la, ra net.Addr
+}
+
+func (c *ClientConn) handshake() {
+	defer close(c.ready)
+
+	response, err := c.cc.RoundTrip(c.request)
+	if err != nil {
+		c.err = err
+		c.writer.CloseWithError(err)
+		c.client.dropCached(c.cc) //RoundTrip出错 一般说明 连接已不可用
+		return
+	}
+
+	var notOKReason string
+
+	if response.StatusCode != http.StatusOK {
+		notOKReason = "h2 Client got non-200 status"
+	} else if len(c.client.responseHeader) > 0 {
+		if ok, firstNotMatchKey := httpLayer.AllHeadersIn(c.client.responseHeader, response.Header); !ok {
+			notOKReason = "h2 Client configured custom header, but the server response doesn't have all of them: " + firstNotMatchKey
+		}
+	}
+
+	if notOKReason != "" {
+		if ce := utils.CanLogWarn(notOKReason); ce != nil {
+			ce.Write(zap.Int("status", response.StatusCode))
+		}
+		response.Body.Close()
+		c.err = utils.ErrInErr{ErrDesc: notOKReason, ErrDetail: utils.ErrInvalidData}
+		c.writer.CloseWithError(c.err)
+		return
+	}
+
+	c.body = response.Body
+}
+
+func (c *ClientConn) Read(b []byte) (n int, err error) {
+	select {
+	case <-c.ready:
+	case <-c.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	select {
+	case <-c.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return c.body.Read(b)
+	}
+}
+
+func (c *ClientConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		n, err = c.writer.Write(b)
+		if err == io.ErrClosedPipe && c.err != nil {
+			err = c.err
+		}
+		if err != nil {
+			c.client.dealErr(c.cc, err)
+		}
+		return
+	}
+}
+
+// 结束 请求体, 服务端 会 读到 EOF, 而 响应 依然 可以 继续 读取. 实现 netLayer.CloseWriter
+func (c *ClientConn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *ClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.writer.Close()
+		go func() {
+			<-c.ready
+			if c.body != nil {
+				c.body.Close()
+			}
+		}()
+	})
+	return nil
+}
+
+func (c *ClientConn) LocalAddr() net.Addr  { return c.la }
+func (c *ClientConn) RemoteAddr() net.Addr { return c.ra }
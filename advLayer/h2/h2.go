@@ -0,0 +1,112 @@
+/*
+Package h2 implements the "h2" (http2) transport of v2ray/xray.
+
+每一个 子连接 都是一个 http2 请求, 请求体 为 上行数据, 响应体 为 下行数据, 不像grpc那样 有额外的分包格式。
+
+v2ray 的 h2 使用 PUT 方法, host 可以配置多个, 客户端 每次请求 随机选一个, 服务端 则验证 请求的 host 是否在列表中.
+
+# Config
+
+path 即 dial/listen 的 path, 默认为 "/".
+
+客户端的 host 默认为 dial 的 host; 若 extra.h2_hosts 给出, 则使用它 (客户端随机选取, 服务端 进行验证).
+
+extra.h2_method 可以指定 http方法, 默认为 PUT.
+
+# Fallback
+
+path, method, host 或 自定义 header 不匹配的请求 会被回落, 与 grpcSimple 一样, 也可以回落 h1 请求.
+*/
+package h2
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+)
+
+const defaultMethod = http.MethodPut
+
+func init() {
+	advLayer.ProtocolsMap["h2"] = Creator{}
+}
+
+type Creator struct{}
+
+func (Creator) PackageID() string {
+	return "h2"
+}
+
+func (Creator) ProtocolName() string {
+	return "h2"
+}
+
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	return "h2", true
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return true
+}
+
+func (Creator) IsSuper() bool {
+	return false
+}
+
+func (Creator) IsMux() bool {
+	return true
+}
+
+type Config struct {
+	Path   string
+	Hosts  []string
+	Method string
+}
+
+func getConfig(conf *advLayer.Conf, isClient bool) (c Config) {
+	c.Path = conf.Path
+	if c.Path == "" {
+		c.Path = "/"
+	} else if !strings.HasPrefix(c.Path, "/") {
+		c.Path = "/" + c.Path
+	}
+	c.Method = defaultMethod
+
+	if len(conf.Extra) > 0 {
+		if thing := conf.Extra["h2_method"]; thing != nil {
+			if str, ok := thing.(string); ok && str != "" {
+				c.Method = strings.ToUpper(str)
+			}
+		}
+		if thing := conf.Extra["h2_hosts"]; thing != nil {
+			switch v := thing.(type) {
+			case string:
+				c.Hosts = strings.Split(v, ",")
+			case []string:
+				c.Hosts = v
+			case []any:
+				for _, h := range v {
+					if s, ok := h.(string); ok {
+						c.Hosts = append(c.Hosts, s)
+					}
+				}
+			}
+		}
+	}
+	if len(c.Hosts) == 0 && isClient && conf.Host != "" {
+		c.Hosts = []string{conf.Host}
+	}
+	for i, h := range c.Hosts {
+		c.Hosts[i] = strings.TrimSpace(h)
+	}
+	return
+}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	return NewClient(getConfig(conf, true), conf.Headers), nil
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	return NewServer(getConfig(conf, false), conf.Headers), nil
+}
@@ -0,0 +1,139 @@
+package h2_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/advLayer/h2"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+)
+
+// 通过本地 tls 连接 测试 h2 的 读写, 连接复用, 以及 path 不匹配时的回落
+func TestH2(t *testing.T) {
+	headers := &httpLayer.HeaderPreset{
+		Request:  &httpLayer.RequestHeader{Headers: map[string][]string{"X-Test": {"abc"}}},
+		Response: &httpLayer.ResponseHeader{Headers: map[string][]string{"X-Resp": {"def"}}},
+	}
+	headers.Prepare()
+
+	conf := &advLayer.Conf{
+		Path:    "/thepath",
+		Host:    "example.com",
+		Headers: headers,
+		Extra:   map[string]any{"h2_hosts": []any{"example.com", "www.example.com"}},
+	}
+	creator := advLayer.ProtocolsMap["h2"]
+
+	ser, err := creator.NewServerFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ser.Stop()
+	cli, err := creator.NewClientFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxC := cli.(advLayer.MuxClient)
+
+	tlsS, err := tlsLayer.NewServer(tlsLayer.Conf{Host: "example.com", AlpnList: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsC := tlsLayer.NewClient(tlsLayer.Conf{Host: "example.com", Insecure: true, AlpnList: []string{"h2"}})
+
+	listener, err := net.Listen("tcp", netLayer.GetRandLocalAddr(true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	fallbackPath := make(chan string, 1)
+
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		tc, err := tlsS.Handshake(c)
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		ser.(advLayer.MuxServer).StartHandle(tc, func(sc net.Conn) {
+			go func() {
+				defer sc.Close()
+				io.Copy(sc, sc)
+			}()
+		}, func(fm httpLayer.FallbackMeta) {
+			fallbackPath <- fm.Path
+			fm.H2RW.WriteHeader(http.StatusNotFound)
+		})
+	}()
+
+	rawC, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, err := tlsC.Handshake(rawC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo := func(underlay net.Conn, data []byte) {
+		cc, err := muxC.GetCommonConn(underlay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := muxC.DialSubConn(cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+
+		go sub.Write(data)
+
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(sub, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("data not equal")
+		}
+	}
+
+	echo(tc, []byte("hello"))
+	echo(nil, bytes.Repeat([]byte("world"), 10000)) //复用 第一个 tls 连接
+
+	//path 不匹配, 应回落
+	wrongConf := *conf
+	wrongConf.Path = "/wrong"
+	wrongCli, _ := creator.NewClientFromConf(&wrongConf)
+	sub, err := wrongCli.(advLayer.MuxClient).DialSubConn(cachedConn(t, muxC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.Read(make([]byte, 1)); err == nil {
+		t.Fatal("should fail for wrong path")
+	}
+	if p := <-fallbackPath; p != "/wrong" {
+		t.Fatal("fallback got wrong path", p)
+	}
+}
+
+// 取出 muxC 缓存的 transport
+func cachedConn(t *testing.T, muxC advLayer.MuxClient) any {
+	c, err := muxC.GetCommonConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+var _ advLayer.MuxClient = (*h2.Client)(nil)
+var _ advLayer.MuxServer = (*h2.Server)(nil)
@@ -0,0 +1,277 @@
+package h2
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/http2"
+)
+
+var clientPreface = []byte(http2.ClientPreface)
+
+// implements advLayer.MuxServer
+type Server struct {
+	Creator
+	Config
+	http2.Server
+	netLayer.ConnList
+
+	Headers *httpLayer.HeaderPreset
+
+	closed bool
+}
+
+func NewServer(conf Config, headers *httpLayer.HeaderPreset) *Server {
+	return &Server{
+		Config:  conf,
+		Headers: headers,
+	}
+}
+
+func (s *Server) GetPath() string {
+	return s.Path
+}
+
+func (s *Server) Stop() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	s.CloseDeleteAll()
+}
+
+// 返回空字符串 表示 匹配
+func (s *Server) checkRequest(rq *http.Request) (failReason string) {
+	if rq.URL.Path != s.Path {
+		return "wrong path"
+	}
+	if rq.Method != s.Method {
+		return "wrong method"
+	}
+	if len(s.Hosts) > 0 && !slices.Contains(s.Hosts, rq.Host) {
+		return "wrong host"
+	}
+	if s.Headers != nil && s.Headers.Request != nil && len(s.Headers.Request.Headers) > 0 {
+		if ok, fnmk := httpLayer.AllHeadersIn(s.Headers.Request.Headers, rq.Header); !ok {
+			return "header not match: " + fnmk
+		}
+	}
+	return ""
+}
+
+// 阻塞
+func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) {
+	s.closed = false
+
+	oldUnderlay := underlay
+	s.Insert(oldUnderlay)
+
+	//与 grpcSimple 一样, 先过滤 preface, 不是h2的话 依然可以试图回落到 h1.
+
+	bs := utils.GetPacket()
+	netLayer.SetCommonReadTimeout(underlay)
+
+	n, err := underlay.Read(bs)
+	if err != nil {
+		if ce := utils.CanLogDebug("h2 try read preface failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		s.CloseDelete(oldUnderlay)
+		return
+	}
+	netLayer.PersistConn(underlay)
+
+	firstBuf := bytes.NewBuffer(bs[:n])
+
+	if n < len(clientPreface) || !bytes.Equal(bs[:len(clientPreface)], clientPreface) {
+		//回落 仍要使用 underlay, 所以 只从列表中删除, 不关闭
+		s.Delete(oldUnderlay)
+
+		if ce := utils.CanLogInfo("h2 got not h2 request"); ce != nil {
+			ce.Write()
+		}
+
+		if fallbackFunc != nil {
+			fm := httpLayer.FallbackMeta{
+				Conn:         underlay,
+				H1RequestBuf: firstBuf,
+			}
+			_, method, path, _, failreason := httpLayer.ParseH1Request(bs, false)
+			if failreason == 0 {
+				fm.Path = path
+				fm.Method = method
+			}
+			go fallbackFunc(fm)
+		} else {
+			underlay.Write([]byte(httpLayer.Err403response))
+			underlay.Close()
+		}
+		return
+	}
+
+	underlay = &netLayer.ReadWrapper{
+		Conn:              underlay,
+		OptionalReader:    io.MultiReader(firstBuf, underlay),
+		RemainFirstBufLen: n,
+	}
+
+	defer s.CloseDelete(oldUnderlay)
+
+	//阻塞
+	s.Server.ServeConn(underlay, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			if s.closed {
+				return
+			}
+
+			if reason := s.checkRequest(rq); reason != "" {
+				if ce := utils.CanLogWarn("h2 Server got not matched request"); ce != nil {
+					ce.Write(zap.String("reason", reason), zap.String("path", rq.URL.Path), zap.String("method", rq.Method), zap.String("host", rq.Host))
+				}
+
+				if fallbackFunc == nil {
+					rw.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				fm := httpLayer.FallbackMeta{
+					Path:   rq.URL.Path,
+					Method: rq.Method,
+					Conn: &netLayer.IOWrapper{
+						Reader:   rq.Body,
+						Writer:   rw,
+						Rejecter: httpLayer.RejectConn{ResponseWriter: rw},
+					},
+					IsH2:      true,
+					H2Request: rq,
+					H2RW:      rw,
+				}
+				fallbackFunc(fm)
+				return
+			}
+
+			headerMap := rw.Header()
+			headerMap.Set("Cache-Control", "no-store")
+
+			if s.Headers != nil && s.Headers.Response != nil && len(s.Headers.Response.Headers) > 0 {
+				for k, vs := range httpLayer.TrimHeaders(s.Headers.Response.Headers) {
+					if len(vs) > 0 {
+						headerMap.Add(k, vs[0])
+					}
+				}
+			}
+			rw.WriteHeader(http.StatusOK)
+			rw.(http.Flusher).Flush()
+
+			sc := newServerConn(rw, rq)
+			if s.closed {
+				return
+			}
+			newSubConnFunc(sc)
+
+			//handler 返回后 响应流就结束了, 所以要等 子连接 关闭 或 客户端 断开
+			select {
+			case <-sc.done:
+			case <-rq.Context().Done():
+				sc.Close()
+			}
+		}),
+	})
+}
+
+func newServerConn(rw http.ResponseWriter, rq *http.Request) *ServerConn {
+	sc := &ServerConn{
+		body:   rq.Body,
+		writer: rw,
+		done:   make(chan struct{}),
+	}
+	sc.InitEasyDeadline()
+
+	if ta, e := net.ResolveTCPAddr("tcp", rq.RemoteAddr); e == nil {
+		sc.ra = ta
+	} else if xffs := rq.Header.Values(httpLayer.XForwardStr); len(xffs) > 0 {
+		//从 nginx 回落过来时, RemoteAddr 可能无法解析
+		if ta, e := net.ResolveIPAddr("ip", xffs[0]); e == nil {
+			sc.ra = ta
+		}
+	}
+	return sc
+}
+
+// implements net.Conn
+type ServerConn struct {
+	netLayer.EasyDeadline
+
+	body   io.ReadCloser
+	writer http.ResponseWriter
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+
+	ra net.Addr
+}
+
+// implements netLayer.RejectConn, 模仿nginx响应
+func (sc *ServerConn) Reject() {
+	httpLayer.SetNginx400Response(sc.writer)
+}
+
+// implements netLayer.RejectConn, return true
+func (*ServerConn) HasOwnDefaultRejectBehavior() bool {
+	return true
+}
+
+func (sc *ServerConn) Read(b []byte) (int, error) {
+	select {
+	case <-sc.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return sc.body.Read(b)
+	}
+}
+
+func (sc *ServerConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-sc.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	//handler 返回后 再调用 rw 会 panic, 所以要加锁 判断 closed
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return 0, net.ErrClosed
+	}
+	n, err = sc.writer.Write(b)
+	if err == nil {
+		sc.writer.(http.Flusher).Flush()
+	}
+	return
+}
+
+func (sc *ServerConn) Close() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return nil
+	}
+	sc.closed = true
+	sc.body.Close()
+	close(sc.done)
+	return nil
+}
+
+func (sc *ServerConn) LocalAddr() net.Addr  { return nil }
+func (sc *ServerConn) RemoteAddr() net.Addr { return sc.ra }
@@ -0,0 +1,227 @@
+package httpupgrade
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+var headerEndMark = []byte("\r\n\r\n")
+
+// implements advLayer.SingleClient
+type Client struct {
+	Creator
+	host         string
+	path         string
+	UseEarlyData bool
+
+	headers *httpLayer.HeaderPreset
+}
+
+// 若path为空，本函数 将自动使用 "/"
+func NewClient(host, path string, headers *httpLayer.HeaderPreset, isEarly bool) *Client {
+	if path == "" {
+		path = "/"
+	}
+	return &Client{
+		host:         host,
+		path:         path,
+		headers:      headers,
+		UseEarlyData: isEarly,
+	}
+}
+
+func (c *Client) GetPath() string {
+	return c.path
+}
+
+func (c *Client) IsEarly() bool {
+	return c.UseEarlyData
+}
+
+func (c *Client) buildRequest(earlyData []byte) *bytes.Buffer {
+	buf := utils.GetBuf()
+	buf.WriteString("GET ")
+	buf.WriteString(c.path)
+	buf.WriteString(" HTTP/1.1\r\n")
+	if c.host != "" {
+		buf.WriteString("Host: ")
+		buf.WriteString(c.host)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("Connection: Upgrade\r\nUpgrade: websocket\r\n")
+
+	if c.headers != nil && c.headers.Request != nil && len(c.headers.Request.Headers) > 0 {
+		for k, vs := range httpLayer.TrimHeaders(c.headers.Request.Headers) {
+			switch k {
+			case "Host", "Connection", "Upgrade", earlyDataHeader:
+				continue
+			}
+			buf.WriteString(k)
+			buf.WriteString(": ")
+			buf.WriteString(vs[0])
+			buf.WriteString("\r\n")
+		}
+	}
+	if len(earlyData) > 0 {
+		buf.WriteString(earlyDataHeader)
+		buf.WriteString(": ")
+		buf.WriteString(base64.RawURLEncoding.EncodeToString(earlyData))
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	return buf
+}
+
+// 读取服务端的 101 响应, 返回 可直接读写原始数据的 net.Conn
+func (c *Client) readResponse(underlay net.Conn) (net.Conn, error) {
+	bs := utils.GetPacket()
+	defer utils.PutPacket(bs)
+
+	total := 0
+	headerEnd := -1
+	for headerEnd < 0 {
+		if total == len(bs) {
+			return nil, utils.ErrInErr{ErrDesc: "httpupgrade response header too long", ErrDetail: utils.ErrInvalidData}
+		}
+		n, err := underlay.Read(bs[total:])
+		total += n
+		headerEnd = bytes.Index(bs[:total], headerEndMark)
+		if err != nil && headerEnd < 0 {
+			return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade read response", ErrDetail: err}
+		}
+	}
+	headerEnd += len(headerEndMark)
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(bs[:headerEnd])), nil)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade parse response", ErrDetail: err}
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, utils.ErrInErr{ErrDesc: "httpupgrade got wrong status", ErrDetail: utils.ErrInvalidData, Data: resp.Status}
+	}
+	if c.headers != nil && c.headers.Response != nil && len(c.headers.Response.Headers) > 0 {
+		if ok, firstNotMatchKey := httpLayer.AllHeadersIn(c.headers.Response.Headers, resp.Header); !ok {
+			return nil, utils.ErrInErr{ErrDesc: "httpupgrade response headers not match", ErrDetail: utils.ErrInvalidData, Data: firstNotMatchKey}
+		}
+	}
+
+	var first []byte
+	if total > headerEnd {
+		//服务端 可能紧跟着 101 就发来了数据
+		first = append([]byte(nil), bs[headerEnd:total]...)
+	}
+	return newConn(underlay, first, nil), nil
+}
+
+// 与服务端进行握手，并返回可直接读写 原始数据的 net.Conn
+func (c *Client) Handshake(underlay net.Conn, firstPayloadLen int) (net.Conn, error) {
+	if c.UseEarlyData && firstPayloadLen > 0 && firstPayloadLen <= MaxEarlyDataLen {
+		// 先返回一个 Conn, 等第一次Write 拿到 内层协议的握手数据后, 与之一起 发送 http请求
+		return &EarlyDataConn{
+			Conn:   underlay,
+			client: c,
+		}, nil
+	}
+
+	buf := c.buildRequest(nil)
+	_, err := underlay.Write(buf.Bytes())
+	utils.PutBuf(buf)
+	if err != nil {
+		return nil, err
+	}
+	return c.readResponse(underlay)
+}
+
+// 第一次Write时 将数据 作为 earlydata 与 http请求 一同发送; 第一次Read时 读取 服务端响应.
+//
+// 因为 不需要等待响应 就可以写入, 所以是真正的 0-rtt.
+//
+// 实现 net.Conn, io.ReaderFrom, netLayer.Splicer, netLayer.SpliceReader
+type EarlyDataConn struct {
+	net.Conn
+	client *Client
+
+	requestSent bool
+
+	readOnce sync.Once
+	realConn net.Conn
+	readErr  error
+}
+
+func (edc *EarlyDataConn) Write(p []byte) (int, error) {
+	if edc.requestSent {
+		return edc.Conn.Write(p)
+	}
+	edc.requestSent = true
+
+	//内层协议的头部 加上 firstPayload 有可能 超过 MaxEarlyDataLen, 此时 就 紧跟在 请求后面 发送
+	var buf *bytes.Buffer
+	if len(p) <= MaxEarlyDataLen {
+		buf = edc.client.buildRequest(p)
+	} else {
+		buf = edc.client.buildRequest(nil)
+		buf.Write(p)
+	}
+	_, err := edc.Conn.Write(buf.Bytes())
+	utils.PutBuf(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (edc *EarlyDataConn) Read(p []byte) (int, error) {
+	edc.readOnce.Do(func() {
+		edc.realConn, edc.readErr = edc.client.readResponse(edc.Conn)
+		if edc.readErr != nil {
+			if ce := utils.CanLogErr("httpupgrade early data handshake failed"); ce != nil {
+				ce.Write(zap.Error(edc.readErr))
+			}
+		}
+	})
+	if edc.readErr != nil {
+		return 0, edc.readErr
+	}
+	return edc.realConn.Read(p)
+}
+
+func (edc *EarlyDataConn) EverPossibleToSpliceRead() bool {
+	return netLayer.IsTCP(edc.Conn) != nil || netLayer.IsUnix(edc.Conn) != nil
+}
+
+// 读取完响应后 才可以splice
+func (edc *EarlyDataConn) CanSpliceRead() (bool, *net.TCPConn, *net.UnixConn) {
+	if edc.realConn == nil {
+		return false, nil, nil
+	}
+	return netLayer.ReturnSpliceRead(edc.realConn)
+}
+
+func (edc *EarlyDataConn) EverPossibleToSpliceWrite() bool {
+	return netLayer.IsTCP(edc.Conn) != nil
+}
+
+// 发送完请求后 才可以splice
+func (edc *EarlyDataConn) CanSpliceWrite() (bool, *net.TCPConn) {
+	if !edc.requestSent {
+		return false, nil
+	}
+	tc := netLayer.IsTCP(edc.Conn)
+	return tc != nil, tc
+}
+
+func (edc *EarlyDataConn) ReadFrom(r io.Reader) (int64, error) {
+	return netLayer.TryReadFrom_withSplice(edc, edc.Conn, r, func() bool {
+		return edc.requestSent
+	})
+}
@@ -0,0 +1,78 @@
+package httpupgrade
+
+import (
+	"io"
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+// 握手时 多读到的数据 (或服务端收到的 earlydata) 会先被读出, 之后的读写 直接作用于 底层连接.
+//
+// 实现 net.Conn, io.ReaderFrom, netLayer.Splicer, netLayer.SpliceReader, netLayer.CloseWriter
+type Conn struct {
+	net.Conn
+
+	first []byte
+
+	realRaddr net.Addr //可从 X-Forwarded-For 读取用户真实ip
+}
+
+// 若没有需要额外处理的东西, 则直接返回 underlay, 这样 其它部分 可以直接识别出 基础连接 进行 splice
+func newConn(underlay net.Conn, first []byte, realRaddr net.Addr) net.Conn {
+	if len(first) == 0 && realRaddr == nil {
+		return underlay
+	}
+	return &Conn{
+		Conn:      underlay,
+		first:     first,
+		realRaddr: realRaddr,
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.first) > 0 {
+		n := copy(p, c.first)
+		c.first = c.first[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.realRaddr != nil {
+		return c.realRaddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) CloseWrite() error {
+	return netLayer.CloseWrite(c.Conn)
+}
+
+func (c *Conn) EverPossibleToSpliceRead() bool {
+	return netLayer.IsTCP(c.Conn) != nil || netLayer.IsUnix(c.Conn) != nil
+}
+
+func (c *Conn) CanSpliceRead() (bool, *net.TCPConn, *net.UnixConn) {
+	if len(c.first) > 0 {
+		return false, nil, nil
+	}
+	tc, uc := netLayer.IsTCP(c.Conn), netLayer.IsUnix(c.Conn)
+	return tc != nil || uc != nil, tc, uc
+}
+
+func (c *Conn) EverPossibleToSpliceWrite() bool {
+	return netLayer.IsTCP(c.Conn) != nil
+}
+
+func (c *Conn) CanSpliceWrite() (bool, *net.TCPConn) {
+	tc := netLayer.IsTCP(c.Conn)
+	return tc != nil, tc
+}
+
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	return netLayer.TryReadFrom_withSplice(c.Conn, c.Conn, r, func() bool {
+		return true
+	})
+}
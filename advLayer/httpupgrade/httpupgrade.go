@@ -0,0 +1,65 @@
+/*
+Package httpupgrade implements the "httpupgrade" transport of xray/v2ray.
+
+握手与 websocket 相同 (GET + Connection: Upgrade + Upgrade: websocket, 服务端返回 101),
+但握手完成后 直接传输原始数据, 没有 websocket 的分帧与掩码.
+
+这样 既可以穿过 只认 websocket握手 的 CDN, 又省去了 ws 每次写入的开销;
+而且 握手后 我们返回的就是 底层连接 本身 (或只包了一层 首包缓存), 所以 裸奔时 依然可以 splice.
+
+earlydata 与 ws 相同, 放在 Sec-WebSocket-Protocol 头里 (base64 RawURLEncoding), 最大 2048 字节.
+*/
+package httpupgrade
+
+import (
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+)
+
+const (
+	MaxEarlyDataLen        = 2048
+	MaxEarlyDataLen_Base64 = 2732
+
+	earlyDataHeader = "Sec-WebSocket-Protocol"
+)
+
+func init() {
+	advLayer.ProtocolsMap["httpupgrade"] = Creator{}
+}
+
+type Creator struct{}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	hn := conf.Host
+	if conf.Addr.Network == "unix" {
+		hn = ""
+	}
+	return NewClient(hn, conf.Path, conf.Headers, conf.IsEarly), nil
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	return NewServer(conf.Path, conf.Headers, conf.IsEarly), nil
+}
+
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	return
+}
+
+func (Creator) PackageID() string {
+	return "httpupgrade"
+}
+
+func (Creator) ProtocolName() string {
+	return "httpupgrade"
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return true
+}
+
+func (Creator) IsMux() bool {
+	return false
+}
+
+func (Creator) IsSuper() bool {
+	return false
+}
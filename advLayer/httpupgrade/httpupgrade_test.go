@@ -0,0 +1,124 @@
+package httpupgrade_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/advLayer/httpupgrade"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+func TestHttpUpgrade(t *testing.T) {
+	testHttpUpgrade(t, false)
+}
+
+func TestHttpUpgrade_earlydata(t *testing.T) {
+	testHttpUpgrade(t, true)
+}
+
+func testHttpUpgrade(t *testing.T, early bool) {
+	const thePath = "/thepath"
+	headers := &httpLayer.HeaderPreset{
+		Request:  &httpLayer.RequestHeader{Headers: map[string][]string{"X-Test": {"abc"}}},
+		Response: &httpLayer.ResponseHeader{Headers: map[string][]string{"X-Resp": {"def"}}},
+	}
+	headers.Prepare()
+
+	s := httpupgrade.NewServer(thePath, headers, early)
+	c := httpupgrade.NewClient("example.com", thePath, headers, early)
+
+	listener, err := net.Listen("tcp", netLayer.GetRandLocalAddr(true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	serverConnChan := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		sc, err := s.Handshake(conn)
+		if err != nil {
+			t.Log(err)
+			conn.Close()
+			return
+		}
+		serverConnChan <- sc
+		defer sc.Close()
+		io.Copy(sc, sc)
+	}()
+
+	rawC, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawC.Close()
+
+	hello := []byte("hello")
+	cc, err := c.Handshake(rawC, len(hello))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cc.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	sc := <-serverConnChan
+	if !early {
+		//没有 earlydata 时 应直接返回 底层连接, 以便 splice
+		if _, ok := sc.(*net.TCPConn); !ok {
+			t.Fatalf("server conn should be *net.TCPConn, got %T", sc)
+		}
+	}
+
+	for _, data := range [][]byte{hello, bytes.Repeat([]byte("world"), 10000)} {
+		if !bytes.Equal(data, hello) {
+			if _, err := cc.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(cc, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("data not equal")
+		}
+	}
+}
+
+// path 不匹配时 应返回 ErrShouldFallback 以及 原始请求
+func TestHttpUpgrade_fallback(t *testing.T) {
+	s := httpupgrade.NewServer("/thepath", nil, false)
+	c := httpupgrade.NewClient("example.com", "/wrong", nil, false)
+
+	cConn, sConn := net.Pipe()
+	defer cConn.Close()
+	defer sConn.Close()
+
+	go c.Handshake(cConn, 0)
+
+	result, err := s.Handshake(sConn)
+	if !errors.Is(err, httpLayer.ErrShouldFallback) {
+		t.Fatal("should fallback, got", err)
+	}
+	fm, ok := result.(httpLayer.FallbackMeta)
+	if !ok {
+		t.Fatalf("should return FallbackMeta, got %T", result)
+	}
+	if fm.Path != "/wrong" || fm.H1RequestBuf == nil || fm.H1RequestBuf.Len() == 0 {
+		t.Fatal("wrong fallback meta", fm.Path)
+	}
+}
+
+var _ advLayer.SingleClient = (*httpupgrade.Client)(nil)
+var _ advLayer.SingleServer = (*httpupgrade.Server)(nil)
@@ -0,0 +1,153 @@
+package httpupgrade
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// implements advLayer.SingleServer
+type Server struct {
+	Creator
+	UseEarlyData bool
+	Thepath      string
+
+	requestHeaders  map[string][]string
+	responseHeaders map[string][]string
+}
+
+// 若path为空，本函数 将自动使用 "/"
+func NewServer(path string, headers *httpLayer.HeaderPreset, UseEarlyData bool) *Server {
+	if path == "" {
+		path = "/"
+	}
+	s := &Server{
+		Thepath:      path,
+		UseEarlyData: UseEarlyData,
+	}
+	if headers != nil && headers.Request != nil && len(headers.Request.Headers) > 0 {
+		s.requestHeaders = headers.Request.Headers
+	}
+	if headers != nil && headers.Response != nil && len(headers.Response.Headers) > 0 {
+		s.responseHeaders = headers.Response.Headers
+	}
+	return s
+}
+
+func (s *Server) GetPath() string {
+	return s.Thepath
+}
+
+func (*Server) Stop() {}
+
+// 检查请求是否为合法的 upgrade 请求, 返回 空字符串 表示 合法
+func (s *Server) checkRequest(rp *httpLayer.H1RequestParser, h http.Header) (notReason string) {
+	if rp.Method != "GET" || rp.Path != s.Thepath {
+		return "wrong method or path"
+	}
+
+	hasUpgrade := false
+	for _, v := range strings.Split(h.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			hasUpgrade = true
+			break
+		}
+	}
+	if !hasUpgrade || !strings.EqualFold(h.Get("Upgrade"), "websocket") {
+		return "not an upgrade request"
+	}
+
+	if len(s.requestHeaders) > 0 {
+		if ok, fnmk := httpLayer.AllHeadersIn(s.requestHeaders, h); !ok {
+			return "header not match: " + fnmk
+		}
+	}
+	return ""
+}
+
+// 如果遇到不符合的http1.1请求，会返回 httpLayer.FallbackMeta 和 httpLayer.ErrShouldFallback
+func (s *Server) Handshake(underlay net.Conn) (net.Conn, error) {
+	var rp httpLayer.H1RequestParser
+	re := rp.ReadAndParse_2(underlay)
+	if re != nil {
+		if errors.Is(re, httpLayer.ErrNotHTTP_Request) {
+			return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade check parse http", ErrDetail: re, ExtraIs: []error{httpLayer.ErrNotHTTP_Request}, Data: rp.Failreason}
+		}
+		return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade check handshake read", ErrDetail: re}
+	}
+
+	h := make(http.Header, len(rp.Headers))
+	for _, rh := range rp.Headers {
+		h.Add(string(rh.Head), string(bytes.TrimSpace(rh.Value)))
+	}
+
+	var realAddr net.Addr
+	if xff := h.Get(httpLayer.XForwardStr); xff != "" {
+		xffs := strings.SplitN(xff, ",", 2)
+		if ta, e := net.ResolveIPAddr("ip", strings.TrimSpace(xffs[0])); e == nil {
+			realAddr = ta
+		} else if ce := utils.CanLogWarn("Failed in httpupgrade parse X-Forwarded-For"); ce != nil {
+			ce.Write(zap.Error(e), zap.String(httpLayer.XForwardStr, xff))
+		}
+	}
+
+	fallback := func(reason string) (net.Conn, error) {
+		return httpLayer.FallbackMeta{
+			Conn:         underlay,
+			H1RequestBuf: rp.WholeRequestBuf,
+			Path:         rp.Path,
+			Method:       rp.Method,
+			Reason:       reason,
+			XFF:          realAddr,
+		}, httpLayer.ErrShouldFallback
+	}
+
+	if notReason := s.checkRequest(&rp, h); notReason != "" {
+		return fallback(notReason)
+	}
+
+	var first []byte
+
+	if s.UseEarlyData {
+		if ed := h.Get(earlyDataHeader); ed != "" {
+			if len(ed) > MaxEarlyDataLen_Base64 {
+				return fallback("early data too long")
+			}
+			bs, err := base64.RawURLEncoding.DecodeString(ed)
+			if err != nil {
+				return fallback("early data not base64")
+			}
+			first = bs
+		}
+	}
+
+	//请求头后面 可能紧跟着 数据
+	whole := rp.WholeRequestBuf.Bytes()
+	if i := bytes.Index(whole, headerEndMark); i >= 0 && i+len(headerEndMark) < len(whole) {
+		first = append(first, whole[i+len(headerEndMark):]...)
+	}
+
+	buf := utils.GetBuf()
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n")
+	for k, vs := range httpLayer.TrimHeaders(s.responseHeaders) {
+		buf.WriteString(k)
+		buf.WriteString(": ")
+		buf.WriteString(vs[0])
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	_, err := underlay.Write(buf.Bytes())
+	utils.PutBuf(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(underlay, first, realAddr), nil
+}
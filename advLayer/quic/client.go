@@ -129,29 +129,53 @@ func (c *Client) getCommonConn(_ net.Conn) (*connState, error) {
 	if err != nil {
 		return nil, err
 	}
-	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-	if err != nil {
-		return nil, err
+	var udpConn net.PacketConn
+	var hopConn *hopPacketConn
+
+	if len(c.hopPorts) > 0 {
+		hopConn, err = newHopPacketConn(rudpAddr, c.hopPorts, c.hopInterval)
+		if err != nil {
+			return nil, err
+		}
+		udpConn = hopConn
+	} else {
+		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	dialConf := common_DialConfig
+	dialConf.EnableDatagrams = c.datagram || c.connHandler != nil
+
 	if c.early {
 		utils.Debug("quic Dialing Early")
 		//conn, err = quic.DialAddrEarly(c.serverAddrStr, &c.tlsConf, &common_DialConfig)
-		conn, err = quic.DialEarly(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &common_DialConfig)
+		conn, err = quic.DialEarly(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &dialConf)
 
 	} else {
 
 		utils.Debug("quic Dialing Connection")
 		//conn, err = quic.DialAddr(c.serverAddrStr, &c.tlsConf, &common_DialConfig)
-		conn, err = quic.Dial(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &common_DialConfig)
+		conn, err = quic.Dial(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &dialConf)
 
 	}
 
 	if err != nil {
-
+		if hopConn != nil {
+			hopConn.Close()
+		}
 		return nil, err
 	}
 
+	if hopConn != nil {
+		//quic-go 不会关闭 我们传入的 PacketConn, 而 hopConn 有自己的 goroutine, 所以要 在连接结束后 手动关闭
+		go func() {
+			<-conn.Context().Done()
+			hopConn.Close()
+		}()
+	}
+
 	if c.useHysteria {
 
 		if c.hysteria_manual {
@@ -168,6 +192,12 @@ func (c *Client) getCommonConn(_ net.Conn) (*connState, error) {
 	id := utils.GenerateUUID()
 
 	var result = &connState{Connection: conn, id: id}
+	if c.datagram && conn.ConnectionState().SupportsDatagrams {
+		result.dgram = newDatagramDemux(conn)
+	}
+	if c.connHandler != nil {
+		c.connHandler(conn, nil)
+	}
 	c.connMapMutex.Lock()
 	c.clientconns[id] = result
 	c.connMapMutex.Unlock()
@@ -225,7 +255,7 @@ func (c *Client) dialSubConn(theState *connState) (net.Conn, error) {
 
 	atomic.AddInt32(&theState.openedStreamCount, 1)
 
-	return &StreamConn{Stream: stream, laddr: theState.LocalAddr(), raddr: theState.RemoteAddr(), relatedConnState: theState}, nil
+	return &StreamConn{Stream: stream, laddr: theState.LocalAddr(), raddr: theState.RemoteAddr(), relatedConnState: theState, dgram: theState.dgram, conn: theState.Connection}, nil
 }
 
 func (c *Client) IsEarly() bool {
@@ -4,6 +4,7 @@ import (
 	"net"
 	"sync/atomic"
 
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/lucas-clemente/quic-go"
 )
 
@@ -16,6 +17,8 @@ type connState struct {
 	openedStreamCount int32
 
 	redialing bool
+
+	dgram *datagramDemux //开启 datagram 且 对端 支持 时 不为 nil
 }
 
 //implements net.Conn.
@@ -27,6 +30,23 @@ type StreamConn struct {
 	laddr, raddr     net.Addr
 	relatedConnState *connState
 	isclosed         bool
+	writeClosed      atomic.Bool
+
+	dgram *datagramDemux
+	conn  quic.Connection
+}
+
+// 返回 该 stream 所属的 quic连接. 用于 tuic 这种 需要 直接使用 quic连接 的 代理协议.
+func (sc *StreamConn) Connection() quic.Connection {
+	return sc.conn
+}
+
+// implements advLayer.DatagramConn. 若 没有开启 datagram, 则 原样返回 mc.
+func (sc *StreamConn) WrapMsgConn(mc netLayer.MsgConn) netLayer.MsgConn {
+	if sc.dgram == nil || mc == nil {
+		return mc
+	}
+	return newDatagramMsgConn(sc.dgram, uint64(sc.StreamID()), mc, sc.relatedConnState != nil)
 }
 
 func (sc *StreamConn) LocalAddr() net.Addr {
@@ -46,6 +66,12 @@ func (sc *StreamConn) Reject() {
 
 }
 
+// 只 关闭 发送方向 (发送 FIN), 依然 可以 继续 读取. 实现 netLayer.CloseWriter
+func (sc *StreamConn) CloseWrite() error {
+	sc.writeClosed.Store(true)
+	return sc.Stream.Close()
+}
+
 func (sc *StreamConn) Close() error {
 	if sc.isclosed {
 		return nil
@@ -58,7 +84,10 @@ func (sc *StreamConn) Close() error {
 	// 看 quic-go包中的 quic.SendStream 的注释就知道了.
 
 	sc.CancelRead(quic.StreamErrorCode(quic.ConnectionRefused))
-	sc.CancelWrite(quic.StreamErrorCode(quic.ConnectionRefused))
+	if !sc.writeClosed.Load() {
+		//已经 CloseWrite 的话, 再 CancelWrite 可能会 丢弃 还未被确认的 数据
+		sc.CancelWrite(quic.StreamErrorCode(quic.ConnectionRefused))
+	}
 
 	if state := sc.relatedConnState; state != nil { //服务端没有 relatedConnState
 
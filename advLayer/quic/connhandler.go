@@ -0,0 +1,47 @@
+package quic
+
+import (
+	"net"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+/*
+ConnHandler
+
+tuic 这种 代理协议 不只使用 双向stream, 还要 直接使用 quic连接 的 单向stream 与 datagram, 所以 需要 拿到 quic.Connection 本身.
+
+设置了 ConnHandler 后, 每个 新建立的 quic连接 都会 先交给 ConnHandler, 然后 双向stream 依然 按原来的方式 处理.
+此时 quic 会 开启 datagram 与 对端的 单向stream, 而 本包 自己的 quic_datagram (见 datagram.go) 会被关闭,
+因为 ReceiveMessage 与 AcceptUniStream 都 交给 ConnHandler 处理了.
+*/
+
+// ConnHandler 必须是 非阻塞的. 服务端 会传入 newSubConnFunc, 以便 ConnHandler 自己 产生 新的 子连接; 客户端 传入的 newSubConnFunc 为 nil.
+type ConnHandler func(conn quic.Connection, newSubConnFunc func(net.Conn))
+
+const default_connHandler_maxStreamsInOneConn = 32
+
+// 要在 GetCommonConn 之前 调用.
+func (c *Client) SetConnHandler(h ConnHandler) {
+	c.connHandler = h
+	c.datagram = false
+}
+
+// 要在 StartListen 之前 调用.
+func (s *Server) SetConnHandler(h ConnHandler) {
+	s.args.connHandler = h
+	s.args.datagram = false
+}
+
+// 设置 ConnHandler 后, 服务端 要 允许 对端 打开 单向stream.
+// tuic 的客户端 一般 会在 一个连接中 并发 很多 stream, 所以 没有 配置 maxStreamsInOneConn 时 放宽 默认值.
+func configListenForConnHandler(qc *quic.Config, arg arguments) {
+	if arg.connHandler == nil {
+		return
+	}
+	qc.EnableDatagrams = true
+	qc.MaxIncomingUniStreams = 0 //quic-go 的默认值
+	if arg.customMaxStreamsInOneConn <= 0 {
+		qc.MaxIncomingStreams = default_connHandler_maxStreamsInOneConn
+	}
+}
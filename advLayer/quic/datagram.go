@@ -0,0 +1,389 @@
+package quic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"go.uber.org/zap"
+)
+
+/*
+UDP over QUIC datagram (RFC 9221)
+
+开启 quic_datagram 后, 通过 quic stream 进行的 udp 代理, 在 代理协议(vless/trojan等) 握手之后, 其 udp数据 会 改为 使用 quic datagram 发送,
+这样 丢包 不会 造成 队头阻塞.
+
+代理协议 的握手 以及 第一个包 依然 走 stream, 以保证 认证 可靠完成; stream 的 StreamID 在 两端 是相同的, 所以 我们用它 作为 session id.
+
+服务端 收到 某session 的 第一个 datagram 后, 才会 改用 datagram 回复, 在此之前 依然 用 stream 回复, 所以 客户端 开启 而 服务端 未开启 时 依然可用.
+
+datagram 格式:
+
+	[session id, quic varint][packet id, 2字节][fragment index, 1字节][fragment count, 1字节][ 若 index == 0: port(2) atyp addr (同 vless) ][payload]
+
+超过 单个 datagram 大小 的 包 会被 分片, 接收端 重组.
+*/
+
+const (
+	maxDatagramSize     = 1150 //quic-go 的 MaxDatagramFrameSize 为 1200, 还要 留出 帧头 与 包头 的 空间
+	maxFragmentCount    = 255
+	maxReassemblePerSes = 64
+	reassembleTimeout   = time.Second * 10
+
+	maxPendingSessions    = 64
+	maxPendingPerSession  = 8
+	datagramRecvQueueSize = 256
+)
+
+var errDatagramSessionClosed = errors.New("quic datagram session closed")
+
+type datagramPacket struct {
+	data []byte
+	addr netLayer.Addr
+}
+
+// 将 一个 quic.Connection 收到的 datagram 分发到 各 session.
+type datagramDemux struct {
+	conn quic.Connection
+
+	mu       sync.Mutex
+	sessions map[uint64]*datagramMsgConn
+	pending  map[uint64][][]byte //session 注册之前 就收到的 datagram
+
+	nextPacketID uint32
+}
+
+func newDatagramDemux(conn quic.Connection) *datagramDemux {
+	d := &datagramDemux{
+		conn:     conn,
+		sessions: make(map[uint64]*datagramMsgConn),
+		pending:  make(map[uint64][][]byte),
+	}
+	go d.run()
+	return d
+}
+
+// 阻塞, 直到 连接 关闭
+func (d *datagramDemux) run() {
+	for {
+		msg, err := d.conn.ReceiveMessage()
+		if err != nil {
+			if ce := utils.CanLogDebug("quic datagram receive loop end"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			return
+		}
+		r := bytes.NewReader(msg)
+		id, err := quicvarint.Read(r)
+		if err != nil {
+			continue
+		}
+		rest := msg[len(msg)-r.Len():]
+
+		d.mu.Lock()
+		s := d.sessions[id]
+		if s == nil {
+			if len(d.pending) >= maxPendingSessions {
+				d.pending = make(map[uint64][][]byte)
+			}
+			if ps := d.pending[id]; len(ps) < maxPendingPerSession {
+				d.pending[id] = append(ps, rest)
+			}
+		}
+		d.mu.Unlock()
+
+		if s != nil {
+			s.handleDatagram(rest)
+		}
+	}
+}
+
+func (d *datagramDemux) register(s *datagramMsgConn) {
+	d.mu.Lock()
+	d.sessions[s.id] = s
+	ps := d.pending[s.id]
+	delete(d.pending, s.id)
+	d.mu.Unlock()
+
+	for _, p := range ps {
+		s.handleDatagram(p)
+	}
+}
+
+func (d *datagramDemux) unregister(id uint64) {
+	d.mu.Lock()
+	delete(d.sessions, id)
+	d.mu.Unlock()
+}
+
+type fragmentBuf struct {
+	parts   [][]byte
+	got     int
+	addr    netLayer.Addr
+	created time.Time
+}
+
+// implements netLayer.MsgConn. 包装 代理协议 在 stream 上 建立的 MsgConn, 以 datagram 收发 数据.
+type datagramMsgConn struct {
+	netLayer.EasyDeadline
+
+	demux    *datagramDemux
+	id       uint64
+	inner    netLayer.MsgConn
+	isClient bool
+
+	//客户端 在 第一次写入 之后 使用 datagram; 服务端 在 收到 第一个 datagram 之后 使用 datagram
+	useDatagram int32
+	written     int32
+
+	recvCh    chan datagramPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	fragMu sync.Mutex
+	frags  map[uint16]*fragmentBuf
+}
+
+func newDatagramMsgConn(demux *datagramDemux, id uint64, inner netLayer.MsgConn, isClient bool) *datagramMsgConn {
+	mc := &datagramMsgConn{
+		demux:    demux,
+		id:       id,
+		inner:    inner,
+		isClient: isClient,
+		recvCh:   make(chan datagramPacket, datagramRecvQueueSize),
+		closed:   make(chan struct{}),
+		frags:    make(map[uint16]*fragmentBuf),
+	}
+	mc.InitEasyDeadline()
+
+	demux.register(mc)
+	go mc.readInnerLoop()
+	return mc
+}
+
+// 从 stream 上 读取 数据 (服务端 在 收到 datagram 之前 的回复, 或 未开启 datagram 的 对端 发来的数据)
+func (mc *datagramMsgConn) readInnerLoop() {
+	for {
+		bs, addr, err := mc.inner.ReadMsg()
+		if err != nil {
+			mc.Close()
+			return
+		}
+		select {
+		case mc.recvCh <- datagramPacket{data: bs, addr: addr}:
+		case <-mc.closed:
+			return
+		}
+	}
+}
+
+func (mc *datagramMsgConn) handleDatagram(p []byte) {
+	if len(p) < 4 {
+		return
+	}
+	packetID := binary.BigEndian.Uint16(p)
+	index, count := p[2], p[3]
+	p = p[4:]
+	if count == 0 || index >= count {
+		return
+	}
+
+	var addr netLayer.Addr
+	if index == 0 {
+		r := bytes.NewReader(p)
+		var err error
+		addr, err = netLayer.V2rayGetAddrFrom(r)
+		if err != nil {
+			if ce := utils.CanLogDebug("quic datagram got invalid addr"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			return
+		}
+		addr.Network = "udp"
+		p = p[len(p)-r.Len():]
+	}
+
+	if !mc.isClient {
+		atomic.StoreInt32(&mc.useDatagram, 1)
+	}
+
+	if count == 1 {
+		mc.deliver(datagramPacket{data: p, addr: addr})
+		return
+	}
+
+	mc.fragMu.Lock()
+	fb := mc.frags[packetID]
+	if fb == nil {
+		if len(mc.frags) >= maxReassemblePerSes {
+			now := time.Now()
+			for k, v := range mc.frags {
+				if now.Sub(v.created) > reassembleTimeout {
+					delete(mc.frags, k)
+				}
+			}
+			if len(mc.frags) >= maxReassemblePerSes {
+				mc.frags = make(map[uint16]*fragmentBuf)
+			}
+		}
+		fb = &fragmentBuf{parts: make([][]byte, count), created: time.Now()}
+		mc.frags[packetID] = fb
+	}
+	if int(count) != len(fb.parts) || fb.parts[index] != nil {
+		mc.fragMu.Unlock()
+		return
+	}
+	fb.parts[index] = p
+	fb.got++
+	if index == 0 {
+		fb.addr = addr
+	}
+	complete := fb.got == len(fb.parts)
+	if complete {
+		delete(mc.frags, packetID)
+	}
+	mc.fragMu.Unlock()
+
+	if complete {
+		mc.deliver(datagramPacket{data: bytes.Join(fb.parts, nil), addr: fb.addr})
+	}
+}
+
+func (mc *datagramMsgConn) deliver(dp datagramPacket) {
+	select {
+	case mc.recvCh <- dp:
+	case <-mc.closed:
+	default:
+		//接收队列满了 就 丢包, 与 udp 的行为 一致
+	}
+}
+
+func (mc *datagramMsgConn) ReadMsg() ([]byte, netLayer.Addr, error) {
+	select {
+	case dp := <-mc.recvCh:
+		return dp.data, dp.addr, nil
+	case <-mc.closed:
+		return nil, netLayer.Addr{}, errDatagramSessionClosed
+	case <-mc.ReadTimeoutChan():
+		return nil, netLayer.Addr{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (mc *datagramMsgConn) WriteMsg(data []byte, peer netLayer.Addr) error {
+	select {
+	case <-mc.closed:
+		return errDatagramSessionClosed
+	case <-mc.WriteTimeoutChan():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+
+	if mc.isClient {
+		//第一次写入 要走 stream, 因为 代理协议 的 握手 可能 是在 第一次写入时 才发送的
+		if atomic.CompareAndSwapInt32(&mc.written, 0, 1) {
+			return mc.inner.WriteMsg(data, peer)
+		}
+	} else if atomic.LoadInt32(&mc.useDatagram) == 0 {
+		return mc.inner.WriteMsg(data, peer)
+	}
+
+	return mc.sendDatagrams(data, peer)
+}
+
+func (mc *datagramMsgConn) sendDatagrams(data []byte, peer netLayer.Addr) error {
+	var header bytes.Buffer
+	quicvarint.Write(&header, mc.id)
+	idLen := header.Len()
+
+	addrBs, atyp := peer.AddressBytes()
+	addrLen := 2 + 1 + len(addrBs)
+
+	firstCap := maxDatagramSize - idLen - 4 - addrLen
+	restCap := maxDatagramSize - idLen - 4
+
+	count := 1
+	if len(data) > firstCap {
+		count += (len(data) - firstCap + restCap - 1) / restCap
+	}
+	if count > maxFragmentCount {
+		return utils.ErrInErr{ErrDesc: "quic datagram packet too large", ErrDetail: utils.ErrInvalidData, Data: len(data)}
+	}
+
+	packetID := uint16(atomic.AddUint32(&mc.demux.nextPacketID, 1))
+
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	for i := 0; i < count; i++ {
+		buf.Reset()
+		buf.Write(header.Bytes())
+		buf.WriteByte(byte(packetID >> 8))
+		buf.WriteByte(byte(packetID))
+		buf.WriteByte(byte(i))
+		buf.WriteByte(byte(count))
+
+		var part []byte
+		if i == 0 {
+			buf.WriteByte(byte(peer.Port >> 8))
+			buf.WriteByte(byte(peer.Port))
+			buf.WriteByte(atyp)
+			buf.Write(addrBs)
+
+			part = data
+			if len(part) > firstCap {
+				part = part[:firstCap]
+			}
+		} else {
+			start := firstCap + (i-1)*restCap
+			end := start + restCap
+			if end > len(data) {
+				end = len(data)
+			}
+			part = data[start:end]
+		}
+		buf.Write(part)
+
+		if err := mc.demux.conn.SendMessage(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mc *datagramMsgConn) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return mc.inner.CloseConnWithRaddr(raddr)
+}
+
+func (mc *datagramMsgConn) Close() error {
+	mc.closeOnce.Do(func() {
+		close(mc.closed)
+		mc.demux.unregister(mc.id)
+		mc.inner.Close()
+	})
+	return nil
+}
+
+func (mc *datagramMsgConn) Fullcone() bool {
+	return mc.inner.Fullcone()
+}
+
+func getDatagramExtra(extra map[string]any) bool {
+	if thing := extra["quic_datagram"]; thing != nil {
+		if is, ok := utils.AnyToBool(thing); ok && is {
+			if ce := utils.CanLogInfo("Quic udp over datagram enabled"); ce != nil {
+				ce.Write()
+			}
+			return true
+		}
+	}
+	return false
+}
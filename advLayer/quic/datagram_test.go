@@ -0,0 +1,100 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+)
+
+func TestDatagram(t *testing.T) {
+	port := getFreeUDPPorts(t, 1)[0]
+	addrStr := "127.0.0.1:" + strconv.Itoa(port)
+
+	target := netLayer.Addr{Network: "udp", Name: "example.com", Port: 53}
+
+	serverTlsConf := tls.Config{Certificates: tlsLayer.GenerateRandomTLSCert(), NextProtos: DefaultAlpnList}
+
+	serverMCChan := make(chan *datagramMsgConn, 1)
+
+	closer := ListenInitialLayers(addrStr, serverTlsConf, arguments{datagram: true}, func(c net.Conn) {
+		mc := c.(*StreamConn).WrapMsgConn(netLayer.UniTargetMsgConn{Conn: c, Target: target})
+		dmc, ok := mc.(*datagramMsgConn)
+		if !ok {
+			t.Error("server should use datagram")
+			return
+		}
+		serverMCChan <- dmc
+		defer mc.Close()
+		for {
+			bs, raddr, err := mc.ReadMsg()
+			if err != nil {
+				return
+			}
+			if err = mc.WriteMsg(bs, raddr); err != nil {
+				return
+			}
+		}
+	})
+	if closer == nil {
+		t.Fatal("quic listen failed")
+	}
+	defer closer.Close()
+
+	a, err := netLayer.NewAddr(addrStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(&a, tls.Config{InsecureSkipVerify: true, NextProtos: DefaultAlpnList}, arguments{datagram: true})
+
+	state, err := client.GetCommonConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := client.DialSubConn(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := sc.(*StreamConn).WrapMsgConn(netLayer.UniTargetMsgConn{Conn: sc, Target: target})
+	if _, ok := mc.(*datagramMsgConn); !ok {
+		t.Fatal("client should use datagram")
+	}
+	defer mc.Close()
+
+	//第一个包 走 stream, 之后的 走 datagram; 大于 maxDatagramSize 的包 会被分片
+	for i, size := range []int{100, 100, 1000, 5000, 20000, 100} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		var got []byte
+		var raddr netLayer.Addr
+		for try := 0; try < 5 && got == nil; try++ {
+			if err := mc.WriteMsg(data, target); err != nil {
+				t.Fatal(err)
+			}
+			mc.SetReadDeadline(time.Now().Add(time.Second))
+			got, raddr, err = mc.ReadMsg()
+			if err != nil {
+				got = nil
+				t.Log("retry", i, err)
+			}
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("echo data not equal", i, len(got), size)
+		}
+		if raddr.String() != target.String() {
+			t.Fatal("wrong addr", raddr.String())
+		}
+	}
+
+	if atomic.LoadInt32(&(<-serverMCChan).useDatagram) != 1 {
+		t.Fatal("server should have received datagrams")
+	}
+}
@@ -0,0 +1,400 @@
+package quic
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+/*
+端口跳跃 (port hopping)
+
+长时间 使用 同一个 udp 五元组 容易被 中间设备 限速, 所以 客户端 可以 定时 换一个 新的 本地udp socket, 并 随机 发往 服务端 端口列表 中的 另一个端口.
+
+quic-go 只看到 一个 固定远程地址 的 net.PacketConn (hopPacketConn), 所以 这一切 对 connState 与 trimBadConns 是透明的;
+服务端 使用的 apernet/quic-go 支持 连接迁移, 会 向 最新的 客户端地址 回复.
+
+服务端 有两种方式 接收 一个端口范围:
+
+1. 默认 在 每个端口 上 都监听 一个 udp socket (multiPacketConn), 从哪个 socket 收到 客户端 的包, 就从 哪个 socket 回复.
+2. quic_hopRedirect = true 时 只监听 主端口, 其它端口 由 nftables/iptables 重定向 到 主端口, 此时 回复的源端口 由 conntrack 负责 改写.
+*/
+
+const (
+	defaultHopInterval = time.Second * 30
+	minHopInterval     = time.Second * 5
+
+	maxHopRoutes = 4096
+)
+
+var errHopConnClosed = errors.New("quic hop packet conn closed")
+
+type hopPacket struct {
+	buf  []byte
+	n    int
+	addr net.Addr
+	from *net.UDPConn
+}
+
+// 将多个 udp socket 收到的包 汇总 到 一个 channel 中
+type packetFanIn struct {
+	netLayer.EasyDeadline
+
+	recvCh    chan hopPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (f *packetFanIn) init() {
+	f.InitEasyDeadline()
+	f.recvCh = make(chan hopPacket, 256)
+	f.closed = make(chan struct{})
+}
+
+// 阻塞, 直到 conn 被关闭
+func (f *packetFanIn) readLoop(conn *net.UDPConn) {
+	for {
+		bs := utils.GetPacket()
+		n, addr, err := conn.ReadFromUDP(bs)
+		if err != nil {
+			utils.PutPacket(bs)
+			return
+		}
+		select {
+		case f.recvCh <- hopPacket{buf: bs, n: n, addr: addr, from: conn}:
+		case <-f.closed:
+			utils.PutPacket(bs)
+			return
+		}
+	}
+}
+
+func (f *packetFanIn) read(p []byte) (n int, hp hopPacket, err error) {
+	select {
+	case hp = <-f.recvCh:
+		n = copy(p, hp.buf[:hp.n])
+		utils.PutPacket(hp.buf)
+		return
+	case <-f.closed:
+		err = errHopConnClosed
+	case <-f.ReadTimeoutChan():
+		err = os.ErrDeadlineExceeded
+	}
+	return
+}
+
+// 返回 true 表示 本次调用 关闭了 f
+func (f *packetFanIn) close() (first bool) {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		first = true
+	})
+	return
+}
+
+// implements net.PacketConn, 用于 客户端.
+type hopPacketConn struct {
+	packetFanIn
+
+	serverIP    net.IP
+	ports       []int
+	virtualAddr *net.UDPAddr //交给 quic-go 的 远程地址, 不随 跳跃 改变
+
+	mu        sync.Mutex
+	cur, prev *net.UDPConn
+	curAddr   *net.UDPAddr
+}
+
+func newHopPacketConn(serverAddr *net.UDPAddr, ports []int, interval time.Duration) (*hopPacketConn, error) {
+	hc := &hopPacketConn{
+		serverIP:    serverAddr.IP,
+		ports:       ports,
+		virtualAddr: serverAddr,
+	}
+	hc.init()
+
+	if err := hc.hop(); err != nil {
+		return nil, err
+	}
+
+	go hc.hopLoop(interval)
+	return hc, nil
+}
+
+// 新建一个 本地socket, 并随机 选择 一个 服务端端口. 上上次的 socket 会被关闭, 上次的 socket 保留 到 下次跳跃, 以接收 在途的包.
+func (hc *hopPacketConn) hop() error {
+	newConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	newAddr := &net.UDPAddr{IP: hc.serverIP, Port: hc.ports[rand.Intn(len(hc.ports))]}
+
+	hc.mu.Lock()
+	if hc.prev != nil {
+		hc.prev.Close()
+	}
+	hc.prev = hc.cur
+	hc.cur = newConn
+	hc.curAddr = newAddr
+	hc.mu.Unlock()
+
+	go hc.readLoop(newConn)
+
+	if ce := utils.CanLogDebug("quic hop"); ce != nil {
+		ce.Write(zap.String("local", newConn.LocalAddr().String()), zap.String("remote", newAddr.String()))
+	}
+	return nil
+}
+
+func (hc *hopPacketConn) hopLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := hc.hop(); err != nil {
+				if ce := utils.CanLogWarn("quic hop failed, keep using old socket"); ce != nil {
+					ce.Write(zap.Error(err))
+				}
+			}
+		case <-hc.closed:
+			return
+		}
+	}
+}
+
+func (hc *hopPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, _, err = hc.read(p)
+	if err == nil {
+		addr = hc.virtualAddr
+	}
+	return
+}
+
+func (hc *hopPacketConn) WriteTo(p []byte, _ net.Addr) (n int, err error) {
+	select {
+	case <-hc.closed:
+		return 0, errHopConnClosed
+	case <-hc.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	hc.mu.Lock()
+	conn, addr := hc.cur, hc.curAddr
+	hc.mu.Unlock()
+
+	return conn.WriteToUDP(p, addr)
+}
+
+func (hc *hopPacketConn) Close() error {
+	if !hc.close() {
+		return nil
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.prev != nil {
+		hc.prev.Close()
+	}
+	return hc.cur.Close()
+}
+
+func (hc *hopPacketConn) LocalAddr() net.Addr {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.cur.LocalAddr()
+}
+
+// implements net.PacketConn, 用于 服务端 在多个端口上 监听.
+type multiPacketConn struct {
+	packetFanIn
+
+	conns []*net.UDPConn
+
+	mu     sync.Mutex
+	routes map[string]*net.UDPConn //客户端地址 -> 最后一次 收到该客户端的包 的 socket
+}
+
+func newMultiPacketConn(conns []*net.UDPConn) *multiPacketConn {
+	mc := &multiPacketConn{
+		conns:  conns,
+		routes: make(map[string]*net.UDPConn),
+	}
+	mc.init()
+	for _, c := range conns {
+		go mc.readLoop(c)
+	}
+	return mc
+}
+
+func (mc *multiPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var hp hopPacket
+	n, hp, err = mc.read(p)
+	if err != nil {
+		return
+	}
+	addr = hp.addr
+
+	if hp.from != mc.conns[0] {
+		mc.mu.Lock()
+		if len(mc.routes) >= maxHopRoutes {
+			mc.routes = make(map[string]*net.UDPConn)
+		}
+		mc.routes[addr.String()] = hp.from
+		mc.mu.Unlock()
+	}
+	return
+}
+
+func (mc *multiPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-mc.closed:
+		return 0, errHopConnClosed
+	case <-mc.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	mc.mu.Lock()
+	conn := mc.routes[addr.String()]
+	mc.mu.Unlock()
+	if conn == nil {
+		conn = mc.conns[0]
+	}
+	return conn.WriteTo(p, addr)
+}
+
+func (mc *multiPacketConn) Close() error {
+	if !mc.close() {
+		return nil
+	}
+	for _, c := range mc.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (mc *multiPacketConn) LocalAddr() net.Addr {
+	return mc.conns[0].LocalAddr()
+}
+
+// 在 主socket 之外, 为 ports 中 其余的端口 各监听 一个 socket.
+func listenHopPorts(mainConn *net.UDPConn, ip net.IP, ports []int) *multiPacketConn {
+	mainPort := mainConn.LocalAddr().(*net.UDPAddr).Port
+
+	conns := []*net.UDPConn{mainConn}
+	for _, p := range ports {
+		if p == mainPort {
+			continue
+		}
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: p})
+		if err != nil {
+			if ce := utils.CanLogWarn("quic listen hop port failed, skipped"); ce != nil {
+				ce.Write(zap.Int("port", p), zap.Error(err))
+			}
+			continue
+		}
+		conns = append(conns, c)
+	}
+
+	if ce := utils.CanLogInfo("quic listening on hop ports"); ce != nil {
+		ce.Write(zap.Int("count", len(conns)))
+	}
+	return newMultiPacketConn(conns)
+}
+
+// 打印 重定向 的 配置方法, 并 尝试 检测 是否 已经配置好了.
+func checkHopRedirect(mainPort int, ports []int) {
+	from, to := ports[0], ports[0]
+	for _, p := range ports {
+		if p < from {
+			from = p
+		}
+		if p > to {
+			to = p
+		}
+	}
+	portRange := strconv.Itoa(from) + "-" + strconv.Itoa(to)
+
+	if ce := utils.CanLogInfo("quic hop redirect mode, only main port is listened. Other ports should be redirected by firewall, for example"); ce != nil {
+		ce.Write(
+			zap.String("nftables", "nft add table inet vs_hop; nft add chain inet vs_hop prerouting '{ type nat hook prerouting priority dstnat; }'; nft add rule inet vs_hop prerouting udp dport "+portRange+" redirect to :"+strconv.Itoa(mainPort)),
+			zap.String("iptables", "iptables -t nat -A PREROUTING -p udp --dport "+strconv.Itoa(from)+":"+strconv.Itoa(to)+" -j REDIRECT --to-ports "+strconv.Itoa(mainPort)),
+		)
+	}
+
+	if detected, ok := detectHopRedirect(mainPort, portRange); ok {
+		if detected {
+			if ce := utils.CanLogInfo("quic hop redirect rule detected"); ce != nil {
+				ce.Write(zap.String("range", portRange), zap.Int("to", mainPort))
+			}
+		} else {
+			if ce := utils.CanLogWarn("quic hop redirect rule not detected, clients hopping to other ports may fail"); ce != nil {
+				ce.Write(zap.String("range", portRange), zap.Int("to", mainPort))
+			}
+		}
+	}
+}
+
+// 可以 同时关闭 quic listener 与 我们自己 创建的 PacketConn
+type hopListenerCloser struct {
+	listener io.Closer
+	conn     io.Closer
+}
+
+func (hl hopListenerCloser) Close() error {
+	err := hl.listener.Close()
+	hl.conn.Close()
+	return err
+}
+
+// 从 extra 中 读取 端口跳跃 的 配置.
+func getHopExtra(extra map[string]any) (ports []int, interval time.Duration, redirect bool) {
+	if len(extra) == 0 {
+		return
+	}
+
+	if thing := extra["quic_hopPorts"]; thing != nil {
+		var str string
+		switch v := thing.(type) {
+		case string:
+			str = v
+		default:
+			if i, ok := utils.AnyToInt64(v); ok {
+				str = strconv.FormatInt(i, 10)
+			}
+		}
+		var err error
+		ports, err = netLayer.ParsePortList(str)
+		if err != nil {
+			if ce := utils.CanLogErr("quic_hopPorts invalid, port hopping disabled"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			return nil, 0, false
+		}
+	}
+
+	interval = defaultHopInterval
+	if thing := extra["quic_hopInterval"]; thing != nil {
+		if d, ok := utils.AnyToDuration(thing); ok && d > 0 {
+			interval = d
+			if interval < minHopInterval {
+				interval = minHopInterval
+			}
+		}
+	}
+
+	if thing := extra["quic_hopRedirect"]; thing != nil {
+		redirect, _ = utils.AnyToBool(thing)
+	}
+	return
+}
@@ -0,0 +1,32 @@
+package quic
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// 检查 nftables 或 iptables 中 是否有 将 portRange 重定向到 mainPort 的规则. ok 为 false 表示 无法检测.
+func detectHopRedirect(mainPort int, portRange string) (detected, ok bool) {
+	mainPortStr := strconv.Itoa(mainPort)
+
+	if out, err := exec.Command("nft", "list", "ruleset").Output(); err == nil {
+		ok = true
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.Contains(line, "udp dport "+portRange) && strings.Contains(line, "redirect to :"+mainPortStr) {
+				return true, true
+			}
+		}
+	}
+
+	if out, err := exec.Command("iptables", "-t", "nat", "-S", "PREROUTING").Output(); err == nil {
+		ok = true
+		iptRange := strings.Replace(portRange, "-", ":", 1)
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.Contains(line, "-p udp") && strings.Contains(line, "--dport "+iptRange) && strings.Contains(line, "--to-ports "+mainPortStr) {
+				return true, true
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package quic
+
+// 非linux系统 无法检测
+func detectHopRedirect(mainPort int, portRange string) (detected, ok bool) {
+	return
+}
@@ -0,0 +1,147 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func init() {
+	utils.InitLog("") //client.go 中 直接调用了 utils.Debug, 需要 初始化 日志
+}
+
+// 获取 n 个 当前可用的 本地udp端口
+// 把 c 读到的 数据 原样 写回, 读完 后 关闭 c
+func echoConn(c net.Conn) {
+	io.Copy(c, c)
+	c.Close()
+}
+
+func getFreeUDPPorts(t *testing.T, n int) (ports []int) {
+	for i := 0; i < n; i++ {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, c.LocalAddr().(*net.UDPAddr).Port)
+		c.Close()
+	}
+	return
+}
+
+func TestHopPacketConn(t *testing.T) {
+	mainConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainPort := mainConn.LocalAddr().(*net.UDPAddr).Port
+
+	ports := append([]int{mainPort}, getFreeUDPPorts(t, 3)...)
+
+	server := listenHopPorts(mainConn, net.IPv4(127, 0, 0, 1), ports)
+	defer server.Close()
+
+	//echo
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: mainPort}
+	client, err := newHopPacketConn(serverAddr, ports, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	localAddrs := make(map[string]bool)
+	buf := make([]byte, 1500)
+	for i := 0; i < 20; i++ {
+		data := []byte{byte(i), 1, 2, 3}
+		if _, err := client.WriteTo(data, serverAddr); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, addr, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if addr.String() != serverAddr.String() {
+			t.Fatal("remote addr should not change when hopping", addr)
+		}
+		if !bytes.Equal(buf[:n], data) {
+			t.Fatal("echo data not equal")
+		}
+		localAddrs[client.LocalAddr().String()] = true
+		time.Sleep(15 * time.Millisecond)
+	}
+	if len(localAddrs) < 2 {
+		t.Fatal("client should have hopped")
+	}
+}
+
+func TestGetHopExtra(t *testing.T) {
+	ports, interval, redirect := getHopExtra(map[string]any{
+		"quic_hopPorts":    "20000-20002,443",
+		"quic_hopInterval": "1s",
+		"quic_hopRedirect": true,
+	})
+	if len(ports) != 4 || interval != minHopInterval || !redirect {
+		t.Fatal("wrong result", ports, interval, redirect)
+	}
+}
+
+func TestQuicPortHopping(t *testing.T) {
+	ports := getFreeUDPPorts(t, 3)
+	addrStr := "127.0.0.1:" + strconv.Itoa(ports[0])
+
+	serverTlsConf := tls.Config{Certificates: tlsLayer.GenerateRandomTLSCert(), NextProtos: DefaultAlpnList}
+
+	closer := ListenInitialLayers(addrStr, serverTlsConf, arguments{hopPorts: ports}, echoConn)
+	if closer == nil {
+		t.Fatal("quic listen failed")
+	}
+	defer closer.Close()
+
+	a, err := netLayer.NewAddr(addrStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(&a, tls.Config{InsecureSkipVerify: true, NextProtos: DefaultAlpnList}, arguments{hopPorts: ports, hopInterval: 100 * time.Millisecond})
+
+	state, err := client.GetCommonConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := client.DialSubConn(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	buf := make([]byte, 5)
+	for i := 0; i < 20; i++ {
+		if _, err := sc.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		sc.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := io.ReadFull(sc, buf); err != nil {
+			t.Fatal(i, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -96,6 +96,14 @@ type arguments struct {
 	useHysteria, hysteria_manual, early bool
 	customMaxStreamsInOneConn           int64
 	hysteriaMaxByteCount                int
+
+	hopPorts    []int //端口跳跃, 见 hop.go
+	hopInterval time.Duration
+	hopRedirect bool
+
+	datagram bool //用 quic datagram 传输 udp, 见 datagram.go
+
+	connHandler ConnHandler //见 connhandler.go
 }
 
 type Creator struct{}
@@ -136,8 +144,14 @@ func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
 	var useHysteria, hysteria_manual bool
 	var maxbyteCount int
 
+	var hopPorts []int
+	var hopInterval time.Duration
+	var datagram bool
+
 	if conf.Extra != nil {
 		useHysteria, hysteria_manual, maxbyteCount, _ = getExtra(conf.Extra)
+		hopPorts, hopInterval, _ = getHopExtra(conf.Extra)
+		datagram = getDatagramExtra(conf.Extra)
 	}
 
 	var tConf tls.Config
@@ -152,6 +166,9 @@ func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
 		useHysteria:          useHysteria,
 		hysteria_manual:      hysteria_manual,
 		hysteriaMaxByteCount: maxbyteCount,
+		hopPorts:             hopPorts,
+		hopInterval:          hopInterval,
+		datagram:             datagram,
 	}), nil
 }
 
@@ -160,6 +177,9 @@ func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
 	var useHysteria, hysteria_manual bool
 	var maxbyteCount int
 	var maxStreamCountInOneConn int64
+	var hopPorts []int
+	var hopRedirect bool
+	var datagram bool
 
 	tlsConf := *conf.TlsConf
 	if len(tlsConf.NextProtos) == 0 {
@@ -169,6 +189,8 @@ func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
 	if conf.Extra != nil {
 
 		useHysteria, hysteria_manual, maxbyteCount, maxStreamCountInOneConn = getExtra(conf.Extra)
+		hopPorts, _, hopRedirect = getHopExtra(conf.Extra)
+		datagram = getDatagramExtra(conf.Extra)
 
 	}
 
@@ -181,6 +203,9 @@ func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
 			hysteriaMaxByteCount:      maxbyteCount,
 			customMaxStreamsInOneConn: maxStreamCountInOneConn,
 			early:                     conf.IsEarly,
+			hopPorts:                  hopPorts,
+			hopRedirect:               hopRedirect,
+			datagram:                  datagram,
 		},
 	}, nil
 }
@@ -204,8 +229,17 @@ func getExtra(extra map[string]any) (useHysteria, hysteria_manual bool,
 
 	}
 
+	//congestion_control 可选 cubic (quic-go 默认), hy / brutal (hysteria 的 brutal 阻控)
 	if thing := extra["congestion_control"]; thing != nil {
-		if use, ok := thing.(string); ok && use == "hy" {
+		use, _ := thing.(string)
+		switch use {
+		case "hy", "brutal", "cubic":
+		default:
+			if ce := utils.CanLogErr("unknown congestion_control, will use cubic"); ce != nil {
+				ce.Write(zap.String("given", use))
+			}
+		}
+		if use == "hy" || use == "brutal" {
 			useHysteria = true
 
 			if thing := extra["mbps"]; thing != nil {
@@ -50,7 +50,7 @@ func (s *Server) StartListen(newSubConnFunc func(net.Conn)) (baseConn io.Closer)
 
 // 阻塞，不支持回落。
 func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), _ func(httpLayer.FallbackMeta)) {
-	dealNewConn(underlay.(quic.Connection), newSubConnFunc)
+	dealNewConn(underlay.(quic.Connection), newSubConnFunc, nil)
 }
 
 // non-blocking
@@ -60,6 +60,8 @@ func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubC
 	if arg.customMaxStreamsInOneConn > 0 {
 		thisConfig.MaxIncomingStreams = arg.customMaxStreamsInOneConn
 	}
+	thisConfig.EnableDatagrams = arg.datagram
+	configListenForConnHandler(&thisConfig, arg)
 
 	var listener quic.Listener
 	var elistener quic.EarlyListener
@@ -82,19 +84,34 @@ func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubC
 		return
 	}
 
+	var pconn net.PacketConn = conn
+	var hopConn *multiPacketConn
+
+	if len(arg.hopPorts) > 0 {
+		if arg.hopRedirect {
+			checkHopRedirect(udpAddr.Port, arg.hopPorts)
+		} else {
+			hopConn = listenHopPorts(conn, udpAddr.IP, arg.hopPorts)
+			pconn = hopConn
+		}
+	}
+
 	if arg.early {
 		utils.Info("quic Listen Early")
-		elistener, err = quic.ListenEarly(conn, &tlsConf, &thisConfig)
+		elistener, err = quic.ListenEarly(pconn, &tlsConf, &thisConfig)
 
 	} else {
 
-		listener, err = quic.Listen(conn, &tlsConf, &thisConfig)
+		listener, err = quic.Listen(pconn, &tlsConf, &thisConfig)
 
 	}
 	if err != nil {
 		if ce := utils.CanLogErr("Failed in QUIC listen"); ce != nil {
 			ce.Write(zap.Error(err))
 		}
+		if hopConn != nil {
+			hopConn.Close()
+		}
 		return
 	}
 
@@ -105,19 +122,23 @@ func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubC
 	}
 
 	if arg.early {
-		go loopAcceptEarly(elistener, newSubConnFunc, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount)
+		go loopAcceptEarly(elistener, newSubConnFunc, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount, arg.datagram, arg.connHandler)
 		returnCloser = elistener
 	} else {
-		go loopAccept(listener, newSubConnFunc, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount)
+		go loopAccept(listener, newSubConnFunc, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount, arg.datagram, arg.connHandler)
 
 		returnCloser = listener
 	}
 
+	if hopConn != nil {
+		returnCloser = hopListenerCloser{listener: returnCloser, conn: hopConn}
+	}
+
 	return
 }
 
 // 阻塞
-func loopAccept(l quic.Listener, newSubConnFunc func(net.Conn), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int) {
+func loopAccept(l quic.Listener, newSubConnFunc func(net.Conn), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int, datagram bool, connHandler ConnHandler) {
 	for {
 
 		conn, err := l.Accept(context.Background())
@@ -133,13 +154,17 @@ func loopAccept(l quic.Listener, newSubConnFunc func(net.Conn), useHysteria bool
 			configHyForConn(conn, hysteria_manual, hysteriaMaxByteCount)
 		}
 
-		go dealNewConn(conn, newSubConnFunc)
+		if connHandler != nil {
+			connHandler(conn, newSubConnFunc)
+		}
+
+		go dealNewConn(conn, newSubConnFunc, getDatagramDemux(conn, datagram))
 
 	}
 }
 
 // 阻塞
-func loopAcceptEarly(el quic.EarlyListener, newSubConnFunc func(net.Conn), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int) {
+func loopAcceptEarly(el quic.EarlyListener, newSubConnFunc func(net.Conn), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int, datagram bool, connHandler ConnHandler) {
 
 	for {
 
@@ -155,7 +180,11 @@ func loopAcceptEarly(el quic.EarlyListener, newSubConnFunc func(net.Conn), useHy
 			configHyForConn(conn, hysteria_manual, hysteriaMaxByteCount)
 		}
 
-		go dealNewConn(conn, newSubConnFunc)
+		if connHandler != nil {
+			connHandler(conn, newSubConnFunc)
+		}
+
+		go dealNewConn(conn, newSubConnFunc, getDatagramDemux(conn, datagram))
 
 	}
 }
@@ -172,8 +201,15 @@ func configHyForConn(conn quic.Connection, hysteria_manual bool, hysteriaMaxByte
 	}
 }
 
-// 阻塞
-func dealNewConn(conn quic.Connection, newSubConnFunc func(net.Conn)) {
+func getDatagramDemux(conn quic.Connection, datagram bool) *datagramDemux {
+	if datagram && conn.ConnectionState().SupportsDatagrams {
+		return newDatagramDemux(conn)
+	}
+	return nil
+}
+
+// 阻塞. dgram 可为 nil
+func dealNewConn(conn quic.Connection, newSubConnFunc func(net.Conn), dgram *datagramDemux) {
 
 	for {
 		stream, err := conn.AcceptStream(context.Background())
@@ -192,6 +228,6 @@ func dealNewConn(conn quic.Connection, newSubConnFunc func(net.Conn)) {
 			break
 		}
 		// theChan <- &StreamConn{stream, conn.LocalAddr(), conn.RemoteAddr(), nil, false}
-		go newSubConnFunc(&StreamConn{stream, conn.LocalAddr(), conn.RemoteAddr(), nil, false})
+		go newSubConnFunc(&StreamConn{Stream: stream, laddr: conn.LocalAddr(), raddr: conn.RemoteAddr(), dgram: dgram, conn: conn})
 	}
 }
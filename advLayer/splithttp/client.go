@@ -0,0 +1,475 @@
+package splithttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// 关闭子连接后, 最多等待 这么久 让 剩余的上行数据 发送完毕
+const closeWaitTimeout = 10 * time.Second
+
+type roundTripper interface {
+	RoundTrip(*http.Request) (*http.Response, error)
+}
+
+// 在 一个 h1 连接上 只发送 一个请求 (即 GET), 用于 h1 模式的 下行
+type h1ConnRoundTripper struct {
+	conn net.Conn
+}
+
+func (rt h1ConnRoundTripper) RoundTrip(rq *http.Request) (*http.Response, error) {
+	if err := rq.Write(rt.conn); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(rt.conn), rq)
+}
+
+// implements advLayer.MuxClient
+type Client struct {
+	Creator
+	Config
+
+	host           string
+	requestHeader  http.Header
+	responseHeader map[string][]string
+
+	h2transport http2.Transport
+
+	tlsConf     *tls.Config     //为nil 则 h1 模式的 POST 使用 明文http
+	h1transport *http.Transport //h1 模式下 用于 发送 POST, 自带 keep-alive 连接池
+
+	//由 SetUnderlayDialer 给出 时, h1 模式的 POST 用它 拨号 (已包含 tls握手), 否则 自行拨号 并 使用 标准库的 tls
+	underlayDialer func(context.Context) (net.Conn, error)
+
+	mu       sync.Mutex
+	cachedCC *http2.ClientConn //h2 模式下 一个 ClientConn 对应 一个 dial好的 tls 连接, 作为 CommonConn
+}
+
+// aconf.Addr 与 aconf.TlsConf 用于 h1 模式下 拨号 发送 POST 的连接. TlsConf 也可以 之后 通过 SetTlsConfig 给出.
+//
+// proxy 包 会 通过 SetUnderlayDialer 给出 与 主流程 相同的 拨号函数, 此时 不再 使用 aconf.Addr 自行拨号.
+func NewClient(conf Config, aconf *advLayer.Conf) *Client {
+	c := &Client{
+		Config:        conf,
+		host:          aconf.Host,
+		requestHeader: http.Header{},
+		h2transport: http2.Transport{
+			DisableCompression: true,
+		},
+	}
+	if c.host == "" {
+		c.host = aconf.Addr.String()
+	}
+	if headers := aconf.Headers; headers != nil {
+		if headers.Request != nil && len(headers.Request.Headers) > 0 {
+			c.requestHeader = http.Header(headers.Request.Headers).Clone()
+		}
+		if headers.Response != nil && len(headers.Response.Headers) > 0 {
+			c.responseHeader = headers.Response.Headers
+		}
+	}
+
+	//Addr.Dial 会修改 Addr 本身, 所以每次 都要 复制一份
+	addr := aconf.Addr
+	dial := func() (net.Conn, error) {
+		a := addr
+		return a.Dial(nil, nil)
+	}
+
+	c.h1transport = &http.Transport{
+		DisableCompression:  true,
+		MaxConnsPerHost:     conf.MaxConcurrentPosts,
+		MaxIdleConnsPerHost: conf.MaxConcurrentPosts,
+		IdleConnTimeout:     90 * time.Second,
+
+		//不为nil 的空map 可以 禁用 h2
+		TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			if c.underlayDialer != nil {
+				return c.underlayDialer(ctx)
+			}
+			return dial()
+		},
+		DialTLSContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			if c.underlayDialer != nil {
+				return c.underlayDialer(ctx)
+			}
+			conn, err := dial()
+			if err != nil {
+				return nil, err
+			}
+			tc := tls.Client(conn, c.tlsConf)
+			if err = tc.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tc, nil
+		},
+	}
+
+	if aconf.TlsConf != nil {
+		c.SetTlsConfig(aconf.TlsConf)
+	}
+
+	return c
+}
+
+// implements advLayer.TlsConfigSetter
+func (c *Client) SetTlsConfig(conf *tls.Config) {
+	c.tlsConf = conf.Clone()
+	c.tlsConf.NextProtos = []string{"http/1.1"}
+}
+
+// implements advLayer.UnderlayDialerSetter
+func (c *Client) SetUnderlayDialer(dial func(context.Context) (net.Conn, error)) {
+	c.underlayDialer = dial
+}
+
+func (c *Client) GetPath() string {
+	return c.Path
+}
+
+func (c *Client) IsEarly() bool {
+	return false
+}
+
+func (c *Client) getCached() *http2.ClientConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cachedCC != nil && !c.cachedCC.CanTakeNewRequest() {
+		c.cachedCC = nil
+	}
+	return c.cachedCC
+}
+
+// 若 cc 为当前缓存的 ClientConn, 则将其清除
+func (c *Client) dropCached(cc *http2.ClientConn) {
+	if cc == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.cachedCC == cc {
+		c.cachedCC = nil
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) dealErr(cc *http2.ClientConn, err error) {
+	if errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "use of closed") {
+		c.dropCached(cc)
+	}
+}
+
+// h1 模式 每个子连接 都要 新的 underlay, 所以 只有 h2 模式 才能 返回缓存的连接
+func (c *Client) GetCommonConn(underlay net.Conn) (any, error) {
+	if underlay != nil {
+		return underlay, nil
+	}
+	if cc := c.getCached(); cc != nil {
+		return cc, nil
+	}
+	return nil, errors.New("splithttp.GetCommonConn: underlay==nil and no cached conn")
+}
+
+func (c *Client) newHeader() http.Header {
+	h := c.requestHeader.Clone()
+	if p := c.padding(); p != "" {
+		h.Set(paddingHeader, p)
+	}
+	return h
+}
+
+func (c *Client) DialSubConn(underlay any) (net.Conn, error) {
+	if underlay == nil {
+		return nil, utils.ErrNilParameter
+	}
+
+	conn := &ClientConn{
+		client: c,
+		ready:  make(chan struct{}),
+		sem:    make(chan struct{}, c.MaxConcurrentPosts),
+	}
+
+	switch u := underlay.(type) {
+	case *http2.ClientConn:
+		conn.cc = u
+	case net.Conn:
+		conn.la, conn.ra = u.LocalAddr(), u.RemoteAddr()
+
+		if ac, ok := u.(interface{ GetAlpn() string }); ok && ac.GetAlpn() == "h2" {
+			cc, err := c.h2transport.NewClientConn(u)
+			if err != nil {
+				return nil, err
+			}
+			c.mu.Lock()
+			c.cachedCC = cc
+			c.mu.Unlock()
+			conn.cc = cc
+		} else {
+			conn.underlay = u
+		}
+	default:
+		return nil, utils.ErrInvalidData
+	}
+
+	scheme := "https"
+	if conn.cc != nil {
+		conn.getRT, conn.postRT = conn.cc, conn.cc
+	} else {
+		conn.getRT, conn.postRT = h1ConnRoundTripper{conn: conn.underlay}, c.h1transport
+		if c.tlsConf == nil {
+			scheme = "http"
+		}
+	}
+
+	sessionID := make([]byte, 16)
+	rand.Read(sessionID)
+	conn.url = scheme + "://" + c.host + c.Path + hex.EncodeToString(sessionID)
+
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	conn.upCond = sync.NewCond(&conn.upMu)
+	conn.InitEasyDeadline()
+
+	go conn.download() //RoundTrip 要等到 服务端响应 才返回, 所以要用 goroutine
+	go conn.uploadLoop()
+
+	return conn, nil
+}
+
+// implements net.Conn
+type ClientConn struct {
+	netLayer.EasyDeadline
+
+	client   *Client
+	cc       *http2.ClientConn //h2 模式
+	underlay net.Conn          //h1 模式 下行所用的连接
+
+	getRT, postRT roundTripper
+
+	url    string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	ready chan struct{}
+	body  io.ReadCloser
+	err   error
+
+	upMu     sync.Mutex
+	upCond   *sync.Cond
+	upBuf    []byte
+	upErr    error
+	upClosed bool
+	seq      uint64
+	sem      chan struct{} //限制 同时发出的 POST 数量
+
+	closeOnce sync.Once
+
+	la, ra net.Addr
+}
+
+func (c *ClientConn) newRequest(method, url string, body io.Reader) *http.Request {
+	rq, _ := http.NewRequestWithContext(c.ctx, method, url, body)
+	rq.Host = c.client.host
+	rq.Header = c.client.newHeader()
+	return rq
+}
+
+func (c *ClientConn) download() {
+	defer close(c.ready)
+
+	response, err := c.getRT.RoundTrip(c.newRequest(http.MethodGet, c.url, nil))
+	if err != nil {
+		c.err = err
+		c.client.dropCached(c.cc) //RoundTrip出错 一般说明 连接已不可用
+		return
+	}
+
+	var notOKReason string
+
+	if response.StatusCode != http.StatusOK {
+		notOKReason = "splithttp Client got non-200 status"
+	} else if len(c.client.responseHeader) > 0 {
+		if ok, firstNotMatchKey := httpLayer.AllHeadersIn(c.client.responseHeader, response.Header); !ok {
+			notOKReason = "splithttp Client configured custom header, but the server response doesn't have all of them: " + firstNotMatchKey
+		}
+	}
+
+	if notOKReason != "" {
+		if ce := utils.CanLogWarn(notOKReason); ce != nil {
+			ce.Write(zap.Int("status", response.StatusCode))
+		}
+		response.Body.Close()
+		c.err = utils.ErrInErr{ErrDesc: notOKReason, ErrDetail: utils.ErrInvalidData}
+		return
+	}
+
+	c.body = response.Body
+}
+
+func (c *ClientConn) post(seq uint64, data []byte) error {
+	rq := c.newRequest(http.MethodPost, c.url+"/"+strconv.FormatUint(seq, 10), bytes.NewReader(data))
+	rq.ContentLength = int64(len(data))
+
+	response, err := c.postRT.RoundTrip(rq)
+	if err != nil {
+		c.client.dealErr(c.cc, err)
+		return err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return utils.ErrInErr{ErrDesc: "splithttp Client post got non-200 status", ErrDetail: utils.ErrInvalidData, Data: response.StatusCode}
+	}
+	return nil
+}
+
+// 将 Write 写入的数据 合并后 分段 POST 出去. 在途的POST 已满时, 新写入的数据 会在 缓存中 积累, 下次 一起发送.
+func (c *ClientConn) uploadLoop() {
+	defer func() {
+		//等待 所有在途的 POST 完成
+		for i := 0; i < cap(c.sem); i++ {
+			c.sem <- struct{}{}
+		}
+		c.cancel()
+	}()
+
+	for {
+		c.sem <- struct{}{}
+
+		c.upMu.Lock()
+		for len(c.upBuf) == 0 && !c.upClosed && c.upErr == nil {
+			c.upCond.Wait()
+		}
+		if c.upErr != nil || len(c.upBuf) == 0 {
+			c.upMu.Unlock()
+			<-c.sem
+			return
+		}
+
+		n := len(c.upBuf)
+		if n > c.client.MaxPostSize {
+			n = c.client.MaxPostSize
+		}
+		chunk := make([]byte, n)
+		copy(chunk, c.upBuf)
+		c.upBuf = c.upBuf[n:]
+		if len(c.upBuf) == 0 {
+			c.upBuf = nil
+		}
+		seq := c.seq
+		c.seq++
+
+		c.upCond.Broadcast()
+		c.upMu.Unlock()
+
+		go func() {
+			defer func() { <-c.sem }()
+
+			if err := c.post(seq, chunk); err != nil {
+				if ce := utils.CanLogDebug("splithttp post failed"); ce != nil {
+					ce.Write(zap.Error(err))
+				}
+				c.upMu.Lock()
+				if c.upErr == nil {
+					c.upErr = err
+				}
+				c.upCond.Broadcast()
+				c.upMu.Unlock()
+				c.Close()
+			}
+		}()
+	}
+}
+
+func (c *ClientConn) Read(b []byte) (n int, err error) {
+	select {
+	case <-c.ready:
+	case <-c.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	select {
+	case <-c.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return c.body.Read(b)
+	}
+}
+
+func (c *ClientConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	c.upMu.Lock()
+	defer c.upMu.Unlock()
+
+	//缓存已满 则等待, 以便 限制内存占用
+	for len(c.upBuf) >= c.client.MaxPostSize && !c.upClosed && c.upErr == nil {
+		c.upCond.Wait()
+	}
+	if c.upErr != nil {
+		return 0, c.upErr
+	}
+	if c.upClosed {
+		return 0, net.ErrClosed
+	}
+
+	c.upBuf = append(c.upBuf, b...)
+	c.upCond.Broadcast()
+	return len(b), nil
+}
+
+func (c *ClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.upMu.Lock()
+		c.upClosed = true
+		c.upCond.Broadcast()
+		c.upMu.Unlock()
+
+		time.AfterFunc(closeWaitTimeout, c.cancel)
+
+		if c.underlay != nil {
+			//h1 的响应体 Close时 会试图 读完剩余数据, 所以 要先关闭 底层连接
+			c.underlay.Close()
+		}
+		go func() {
+			<-c.ready
+			if c.body != nil {
+				c.body.Close()
+			}
+		}()
+	})
+	return nil
+}
+
+func (c *ClientConn) LocalAddr() net.Addr  { return c.la }
+func (c *ClientConn) RemoteAddr() net.Addr { return c.ra }
@@ -0,0 +1,120 @@
+package splithttp
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// 服务端 用于 将 乱序到达的 上行POST 按 seq 重新拼接.
+//
+// 为了 限制 内存占用 并 给客户端 施加 背压, 每个 POST 在 读取请求体 之前 要先 Reserve;
+// 已缓存 与 已预留 的 字节数 或 包数 达到上限 时 Reserve 会阻塞, 直到 Read 将 缓存的包 取走.
+// 但 正好是 下一个需要的包 (seq == next) 时 不会阻塞, 否则 可能死锁.
+type uploadQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	pending map[uint64][]byte
+	next    uint64
+	cur     []byte
+	closed  bool
+
+	//已缓存 与 已预留 的 包数 和 字节数
+	count, size       int
+	maxCount, maxSize int
+}
+
+func newUploadQueue(maxCount, maxSize int) *uploadQueue {
+	q := &uploadQueue{
+		pending:  make(map[uint64][]byte),
+		maxCount: maxCount,
+		maxSize:  maxSize,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// 为 seq 的包 预留 n 字节. 返回 nil 后 必须 调用 Push 或 Cancel.
+func (q *uploadQueue) Reserve(seq uint64, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	//什么都没缓存 时 总是 允许, 这样 n 大于 maxSize 也不会 一直阻塞
+	for !q.closed && seq != q.next && q.count > 0 && (q.count >= q.maxCount || q.size+n > q.maxSize) {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return net.ErrClosed
+	}
+	q.count++
+	q.size += n
+	return nil
+}
+
+// 取消 Reserve 预留的 n 字节
+func (q *uploadQueue) Cancel(n int) {
+	q.mu.Lock()
+	q.count--
+	q.size -= n
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// reserved 为 Reserve 时 预留的 字节数, 会被 换成 data 的 实际长度.
+func (q *uploadQueue) Push(seq uint64, data []byte, reserved int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.count--
+	q.size -= reserved
+	q.cond.Broadcast()
+
+	if q.closed {
+		return net.ErrClosed
+	}
+	if seq < q.next {
+		return nil //重复的包, 直接丢弃
+	}
+	if _, has := q.pending[seq]; has {
+		return nil
+	}
+	q.pending[seq] = data
+	q.count++
+	q.size += len(data)
+	return nil
+}
+
+func (q *uploadQueue) Read(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if len(q.cur) > 0 {
+			n := copy(p, q.cur)
+			q.cur = q.cur[n:]
+			return n, nil
+		}
+		if data, ok := q.pending[q.next]; ok {
+			delete(q.pending, q.next)
+			q.count--
+			q.size -= len(data)
+			q.next++
+			q.cur = data
+			q.cond.Broadcast()
+			continue
+		}
+		if q.closed {
+			return 0, io.EOF
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *uploadQueue) Close() error {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,60 @@
+package splithttp
+
+import (
+	"testing"
+	"time"
+)
+
+// 乱序缓存的 字节数 达到上限后, 新的 乱序包 要等到 Read 取走数据 才能 预留; 下一个需要的包 则 不受限制.
+func TestUploadQueueMaxSize(t *testing.T) {
+	q := newUploadQueue(100, 10)
+	defer q.Close()
+
+	if err := q.Reserve(1, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(1, make([]byte, 8), 8); err != nil {
+		t.Fatal(err)
+	}
+
+	reserved := make(chan error, 1)
+	go func() {
+		reserved <- q.Reserve(2, 8)
+	}()
+
+	select {
+	case <-reserved:
+		t.Fatal("Reserve should block when buffered bytes exceed maxSize")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := q.Reserve(0, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(0, make([]byte, 8), 8); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	for read := 0; read < 16; {
+		n, err := q.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += n
+	}
+
+	select {
+	case err := <-reserved:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reserve should return after Read")
+	}
+	q.Cancel(8)
+
+	if q.count != 0 || q.size != 0 {
+		t.Fatal("wrong count or size", q.count, q.size)
+	}
+}
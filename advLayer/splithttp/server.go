@@ -0,0 +1,521 @@
+package splithttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// 只收到POST 而 迟迟没有收到GET 的 session, 在这个时间后 被清除
+const sessionWaitGetTimeout = 30 * time.Second
+
+var clientPreface = []byte(http2.ClientPreface)
+
+var errPostTooLarge = errors.New("splithttp post body too large")
+
+type session struct {
+	queue *uploadQueue
+	conn  *ServerConn //收到 GET 之前 为 nil
+	timer *time.Timer
+}
+
+// implements advLayer.MuxServer.
+//
+// 同一个session的 GET 与 POST 可能来自 不同的 underlay (如 h1, 或 CDN 开了多个连接 回源), 所以 session表 是 Server 全局的.
+type Server struct {
+	Creator
+	Config
+	http2.Server
+	netLayer.ConnList
+
+	Headers *httpLayer.HeaderPreset
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	closed   bool //由 mu 保护
+}
+
+func NewServer(conf Config, headers *httpLayer.HeaderPreset) *Server {
+	return &Server{
+		Config:   conf,
+		Headers:  headers,
+		sessions: make(map[string]*session),
+	}
+}
+
+func (s *Server) GetPath() string {
+	return s.Path
+}
+
+func (s *Server) Stop() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	ss := s.sessions
+	s.sessions = make(map[string]*session)
+	s.mu.Unlock()
+
+	for _, sess := range ss {
+		sess.timer.Stop()
+		sess.queue.Close()
+		if sess.conn != nil {
+			sess.conn.Close()
+		}
+	}
+
+	s.CloseDeleteAll()
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// session 数量 已达 MaxSessions 或 Server 已关闭 时, 对于 新的 id 返回 nil
+func (s *Server) getSession(id string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	sess := s.sessions[id]
+	if sess == nil {
+		if len(s.sessions) >= s.MaxSessions {
+			return nil
+		}
+		sess = &session{queue: newUploadQueue(s.MaxConcurrentPosts, s.MaxBufferedSize)}
+		sess.timer = time.AfterFunc(sessionWaitGetTimeout, func() {
+			s.mu.Lock()
+			noGet := sess.conn == nil
+			if noGet && s.sessions[id] == sess {
+				delete(s.sessions, id)
+			}
+			s.mu.Unlock()
+			if noGet {
+				sess.queue.Close()
+			}
+		})
+		s.sessions[id] = sess
+	}
+	return sess
+}
+
+func (s *Server) removeSession(id string, sess *session) {
+	s.mu.Lock()
+	if s.sessions[id] == sess {
+		delete(s.sessions, id)
+	}
+	s.mu.Unlock()
+}
+
+// 解析 {path}/{session} 或 {path}/{session}/{seq}. failReason 为空 表示 匹配
+func (s *Server) checkRequest(rq *http.Request) (id string, seq uint64, failReason string) {
+	p := rq.URL.Path
+	if !strings.HasPrefix(p, s.Path) {
+		failReason = "wrong path"
+		return
+	}
+	parts := strings.Split(p[len(s.Path):], "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] != "" && rq.Method == http.MethodGet:
+	case len(parts) == 2 && parts[0] != "" && rq.Method == http.MethodPost:
+		var err error
+		if seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			failReason = "wrong seq"
+			return
+		}
+	default:
+		failReason = "wrong path or method"
+		return
+	}
+	id = parts[0]
+
+	if s.Headers != nil && s.Headers.Request != nil && len(s.Headers.Request.Headers) > 0 {
+		if ok, fnmk := httpLayer.AllHeadersIn(s.Headers.Request.Headers, rq.Header); !ok {
+			failReason = "header not match: " + fnmk
+		}
+	}
+	return
+}
+
+// 阻塞
+func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) {
+	oldUnderlay := underlay
+	s.Insert(oldUnderlay)
+
+	//与 h2 一样, 先读 首包 判断 是不是 h2. 不是的话 检查 h1 请求的 path, 不匹配 则回落.
+
+	bs := utils.GetPacket()
+	netLayer.SetCommonReadTimeout(underlay)
+
+	n, err := underlay.Read(bs)
+	if err != nil {
+		if ce := utils.CanLogDebug("splithttp try read first packet failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		s.CloseDelete(oldUnderlay)
+		return
+	}
+	netLayer.PersistConn(underlay)
+
+	firstBuf := bytes.NewBuffer(bs[:n])
+
+	isH2 := n >= len(clientPreface) && bytes.Equal(bs[:len(clientPreface)], clientPreface)
+
+	if !isH2 {
+		_, method, path, _, failreason := httpLayer.ParseH1Request(bs[:n], false)
+		if failreason != 0 || !strings.HasPrefix(path, s.Path) {
+			//回落 仍要使用 underlay, 所以 只从列表中删除, 不关闭
+			s.Delete(oldUnderlay)
+
+			if ce := utils.CanLogInfo("splithttp got not matched h1 request"); ce != nil {
+				ce.Write(zap.String("path", path), zap.Int("failreason", failreason))
+			}
+
+			if fallbackFunc != nil {
+				fm := httpLayer.FallbackMeta{
+					Conn:         underlay,
+					H1RequestBuf: firstBuf,
+				}
+				if failreason == 0 {
+					fm.Path = path
+					fm.Method = method
+				}
+				go fallbackFunc(fm)
+			} else {
+				underlay.Write([]byte(httpLayer.Err403response))
+				underlay.Close()
+			}
+			return
+		}
+	}
+
+	underlay = &netLayer.ReadWrapper{
+		Conn:              underlay,
+		OptionalReader:    io.MultiReader(firstBuf, underlay),
+		RemainFirstBufLen: n,
+	}
+
+	defer s.CloseDelete(oldUnderlay)
+
+	handler := s.newHandler(isH2, newSubConnFunc, fallbackFunc)
+
+	//阻塞
+	if isH2 {
+		s.Server.ServeConn(underlay, &http2.ServeConnOpts{
+			Handler: handler,
+		})
+		return
+	}
+
+	//h1 的 keep-alive, chunked 等 细节 交给 标准库 处理
+	l := newOneConnListener(underlay)
+	hs := &http.Server{
+		Handler: handler,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+	hs.Serve(l)
+}
+
+func (s *Server) setCommonHeaders(rw http.ResponseWriter) {
+	headerMap := rw.Header()
+	headerMap.Set("Cache-Control", "no-store")
+
+	if p := s.padding(); p != "" {
+		headerMap.Set(paddingHeader, p)
+	}
+	if s.Headers != nil && s.Headers.Response != nil && len(s.Headers.Response.Headers) > 0 {
+		for k, vs := range httpLayer.TrimHeaders(s.Headers.Response.Headers) {
+			if len(vs) > 0 {
+				headerMap.Add(k, vs[0])
+			}
+		}
+	}
+}
+
+func (s *Server) newHandler(isH2 bool, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, rq *http.Request) {
+		if s.isClosed() {
+			return
+		}
+
+		id, seq, reason := s.checkRequest(rq)
+		if reason != "" {
+			if ce := utils.CanLogWarn("splithttp Server got not matched request"); ce != nil {
+				ce.Write(zap.String("reason", reason), zap.String("path", rq.URL.Path), zap.String("method", rq.Method), zap.Bool("h2", isH2))
+			}
+
+			//h1 的 首个请求 已经在 StartHandle 中 检查过了, 后续 keep-alive 请求 不再回落
+			if !isH2 || fallbackFunc == nil {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			fm := httpLayer.FallbackMeta{
+				Path:   rq.URL.Path,
+				Method: rq.Method,
+				Conn: &netLayer.IOWrapper{
+					Reader:   rq.Body,
+					Writer:   rw,
+					Rejecter: httpLayer.RejectConn{ResponseWriter: rw},
+				},
+				IsH2:      true,
+				H2Request: rq,
+				H2RW:      rw,
+			}
+			fallbackFunc(fm)
+			return
+		}
+
+		s.setCommonHeaders(rw)
+
+		if rq.Method == http.MethodPost {
+			s.handleUpload(rw, rq, id, seq)
+		} else {
+			s.handleDownload(rw, rq, id, newSubConnFunc)
+		}
+	}
+}
+
+func (s *Server) rejectNewSession(rw http.ResponseWriter, id string) {
+	if ce := utils.CanLogWarn("splithttp Server reached maxSessions"); ce != nil {
+		ce.Write(zap.String("session", id), zap.Int("maxSessions", s.MaxSessions))
+	}
+	rw.WriteHeader(http.StatusTooManyRequests)
+}
+
+func (s *Server) handleUpload(rw http.ResponseWriter, rq *http.Request, id string, seq uint64) {
+	if rq.ContentLength > int64(s.MaxPostSize) {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	sess := s.getSession(id)
+	if sess == nil {
+		s.rejectNewSession(rw, id)
+		return
+	}
+
+	//先 预留 缓存 再 读取 请求体, 这样 缓存满了 时 阻塞的 请求 不会 占用 内存
+	reserved := s.MaxPostSize
+	if rq.ContentLength >= 0 {
+		reserved = int(rq.ContentLength)
+	}
+	err := sess.queue.Reserve(seq, reserved)
+	if err == nil {
+		var data []byte
+		data, err = io.ReadAll(io.LimitReader(rq.Body, int64(reserved)+1))
+		if err == nil && len(data) > reserved {
+			err = errPostTooLarge
+		}
+		if err != nil {
+			sess.queue.Cancel(reserved)
+		} else {
+			err = sess.queue.Push(seq, data, reserved)
+		}
+	}
+	if err != nil {
+		if err == errPostTooLarge {
+			rw.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if ce := utils.CanLogDebug("splithttp push upload failed"); ce != nil {
+			ce.Write(zap.String("session", id), zap.Uint64("seq", seq), zap.Error(err))
+		}
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleDownload(rw http.ResponseWriter, rq *http.Request, id string, newSubConnFunc func(net.Conn)) {
+	sess := s.getSession(id)
+	if sess == nil {
+		s.rejectNewSession(rw, id)
+		return
+	}
+
+	s.mu.Lock()
+	if sess.conn != nil {
+		s.mu.Unlock()
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+	sc := newServerConn(sess.queue, rw, rq)
+	sc.onClose = func() {
+		s.removeSession(id, sess)
+	}
+	sess.conn = sc
+	sess.timer.Stop()
+	s.mu.Unlock()
+
+	headerMap := rw.Header()
+	headerMap.Set("Content-Type", "text/event-stream")
+	headerMap.Set("X-Accel-Buffering", "no")
+
+	rw.WriteHeader(http.StatusOK)
+	rw.(http.Flusher).Flush()
+
+	if s.isClosed() {
+		sc.Close()
+		return
+	}
+	newSubConnFunc(sc)
+
+	//handler 返回后 响应流就结束了, 所以要等 子连接 关闭 或 客户端 断开
+	select {
+	case <-sc.done:
+	case <-rq.Context().Done():
+		sc.Close()
+	}
+}
+
+func newServerConn(queue *uploadQueue, rw http.ResponseWriter, rq *http.Request) *ServerConn {
+	sc := &ServerConn{
+		queue:  queue,
+		writer: rw,
+		done:   make(chan struct{}),
+	}
+	sc.InitEasyDeadline()
+
+	if ta, e := net.ResolveTCPAddr("tcp", rq.RemoteAddr); e == nil {
+		sc.ra = ta
+	} else if xffs := rq.Header.Values(httpLayer.XForwardStr); len(xffs) > 0 {
+		//从 nginx 回落过来时, RemoteAddr 可能无法解析
+		if ta, e := net.ResolveIPAddr("ip", xffs[0]); e == nil {
+			sc.ra = ta
+		}
+	}
+	return sc
+}
+
+// implements net.Conn
+type ServerConn struct {
+	netLayer.EasyDeadline
+
+	queue  *uploadQueue
+	writer http.ResponseWriter
+
+	mu      sync.Mutex
+	closed  bool
+	done    chan struct{}
+	onClose func()
+
+	ra net.Addr
+}
+
+// implements netLayer.RejectConn, 模仿nginx响应
+func (sc *ServerConn) Reject() {
+	httpLayer.SetNginx400Response(sc.writer)
+}
+
+// implements netLayer.RejectConn, return true
+func (*ServerConn) HasOwnDefaultRejectBehavior() bool {
+	return true
+}
+
+func (sc *ServerConn) Read(b []byte) (int, error) {
+	select {
+	case <-sc.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return sc.queue.Read(b)
+	}
+}
+
+func (sc *ServerConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-sc.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	//handler 返回后 再调用 rw 会 panic, 所以要加锁 判断 closed
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return 0, net.ErrClosed
+	}
+	n, err = sc.writer.Write(b)
+	if err == nil {
+		sc.writer.(http.Flusher).Flush()
+	}
+	return
+}
+
+func (sc *ServerConn) Close() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return nil
+	}
+	sc.closed = true
+	sc.queue.Close()
+	if sc.onClose != nil {
+		sc.onClose()
+	}
+	close(sc.done)
+	return nil
+}
+
+func (sc *ServerConn) LocalAddr() net.Addr  { return nil }
+func (sc *ServerConn) RemoteAddr() net.Addr { return sc.ra }
+
+// 只 Accept 一次 的 net.Listener, 用于 让 http.Server 处理 单个 h1 连接
+type oneConnListener struct {
+	conn      net.Conn
+	addr      net.Addr
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newOneConnListener(c net.Conn) *oneConnListener {
+	return &oneConnListener{
+		conn: c,
+		addr: c.LocalAddr(),
+		done: make(chan struct{}),
+	}
+}
+
+// http.Server.Serve 是 串行调用 Accept 的
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return c, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.addr
+}
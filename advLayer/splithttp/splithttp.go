@@ -0,0 +1,203 @@
+/*
+Package splithttp implements the "splithttp" transport (xray 中也叫 xhttp 的 packet-up 模式).
+
+有些 CDN 会 缓存完整的请求体 才转发, 并且 禁止 websocket, 这样 ws, grpc 以及 流式的 h2 都无法使用.
+
+splithttp 将 一条 子连接 拆成 多个 普通的 http 请求:
+
+	下行: GET  {path}/{session}          , 服务端 以 一个 长时间流式的 响应体 发送 下行数据
+	上行: POST {path}/{session}/{seq}    , 每个请求体 为 一段 上行数据, 服务端 按 seq 重新排序拼接
+
+session 为 客户端 随机生成的 id; seq 从 0 开始 依次递增.
+
+同时支持 http/1.1 和 h2: 若 tls 协商出的 alpn 为 h2, 则 所有请求 都复用 同一个 h2 连接;
+否则 GET 使用 主流程 拨号好的 连接, POST 则由 本包 自行拨号 (带 keep-alive 连接池).
+
+额外拨号的连接 由 proxy 包 通过 advLayer.UnderlayDialerSetter 给出 的 拨号函数 建立, 与 主流程 一样 使用 sockopt, sendThrough 以及 utls 和 ech;
+单独 使用 本包 时 则 用 advLayer.Conf 的 Addr 和 TlsConf 自行拨号, 使用 标准库的 tls.
+
+# Config
+
+path 即 dial/listen 的 path, 默认为 "/".
+
+alpn 由 用户 在 dial/listen 中配置, 如 alpn = ["h2"] 则使用 h2 模式; 服务端 两种模式 都支持.
+
+extra.splithttp_maxPostSize 单个 POST请求体 的 最大长度, 默认 1000000. 服务端 会拒绝 超过该长度的 请求体, 所以 服务端的值 不应小于 客户端的值.
+
+extra.splithttp_maxConcurrentPosts 客户端 最多 同时发出 多少个 POST; 服务端 每个 session 最多 缓存 多少个 乱序的 上行包. 默认 100.
+
+extra.splithttp_maxBufferedSize 服务端 每个 session 最多 缓存 多少字节 的 乱序上行数据, 达到后 新的 POST 会 等待 而 不读取 请求体. 默认 10000000, 不会 小于 maxPostSize.
+
+extra.splithttp_maxSessions 服务端 最多 同时存在 多少个 session, 超过后 新 session 的 请求 会 收到 429. 默认 1000.
+
+extra.splithttp_padding 每个 请求与响应 都会带上一个 随机长度的 X-Padding 头, 以 混淆 长度特征, 格式为 "最小长度-最大长度", 默认为 "100-1000", 设为 "0" 表示 不填充.
+
+# Fallback
+
+与 h2, grpcSimple 一样, 不是 {path}/ 开头 的 h1 请求 以及 不匹配的 h2 请求 会被回落.
+*/
+package splithttp
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultMaxPostSize        = 1000000
+	DefaultMaxConcurrentPosts = 100
+	DefaultMaxBufferedSize    = 10000000
+	DefaultMaxSessions        = 1000
+
+	paddingHeader = "X-Padding"
+)
+
+func init() {
+	advLayer.ProtocolsMap["splithttp"] = Creator{}
+}
+
+type Creator struct{}
+
+func (Creator) PackageID() string {
+	return "splithttp"
+}
+
+func (Creator) ProtocolName() string {
+	return "splithttp"
+}
+
+// h1 与 h2 都可用, 由用户 自行配置 alpn
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	return
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return true
+}
+
+func (Creator) IsSuper() bool {
+	return false
+}
+
+func (Creator) IsMux() bool {
+	return true
+}
+
+type Config struct {
+	Path string //总是以 "/" 结尾
+
+	MaxPostSize        int
+	MaxConcurrentPosts int
+
+	MaxBufferedSize int //for server
+	MaxSessions     int //for server
+
+	PaddingMin, PaddingMax int
+}
+
+// 生成 随机长度的 填充, 若 不填充 则 返回 空字符串
+func (c *Config) padding() string {
+	if c.PaddingMax <= 0 {
+		return ""
+	}
+	n := c.PaddingMin
+	if c.PaddingMax > c.PaddingMin {
+		n += rand.Intn(c.PaddingMax - c.PaddingMin + 1)
+	}
+	return strings.Repeat("0", n)
+}
+
+func getConfig(conf *advLayer.Conf) (c Config) {
+	c.Path = conf.Path
+	if !strings.HasPrefix(c.Path, "/") {
+		c.Path = "/" + c.Path
+	}
+	if !strings.HasSuffix(c.Path, "/") {
+		c.Path += "/"
+	}
+	c.MaxPostSize = DefaultMaxPostSize
+	c.MaxConcurrentPosts = DefaultMaxConcurrentPosts
+	c.MaxBufferedSize = DefaultMaxBufferedSize
+	c.MaxSessions = DefaultMaxSessions
+	c.PaddingMin, c.PaddingMax = 100, 1000
+
+	defer func() {
+		if c.MaxBufferedSize < c.MaxPostSize {
+			c.MaxBufferedSize = c.MaxPostSize
+		}
+	}()
+
+	if len(conf.Extra) == 0 {
+		return
+	}
+
+	if thing := conf.Extra["splithttp_maxPostSize"]; thing != nil {
+		if i, ok := utils.AnyToInt64(thing); ok && i > 0 {
+			c.MaxPostSize = int(i)
+		} else if ce := utils.CanLogErr("parse splithttp_maxPostSize failed"); ce != nil {
+			ce.Write(zap.Any("given", thing))
+		}
+	}
+	if thing := conf.Extra["splithttp_maxConcurrentPosts"]; thing != nil {
+		if i, ok := utils.AnyToInt64(thing); ok && i > 0 {
+			c.MaxConcurrentPosts = int(i)
+		} else if ce := utils.CanLogErr("parse splithttp_maxConcurrentPosts failed"); ce != nil {
+			ce.Write(zap.Any("given", thing))
+		}
+	}
+	if thing := conf.Extra["splithttp_maxBufferedSize"]; thing != nil {
+		if i, ok := utils.AnyToInt64(thing); ok && i > 0 {
+			c.MaxBufferedSize = int(i)
+		} else if ce := utils.CanLogErr("parse splithttp_maxBufferedSize failed"); ce != nil {
+			ce.Write(zap.Any("given", thing))
+		}
+	}
+	if thing := conf.Extra["splithttp_maxSessions"]; thing != nil {
+		if i, ok := utils.AnyToInt64(thing); ok && i > 0 {
+			c.MaxSessions = int(i)
+		} else if ce := utils.CanLogErr("parse splithttp_maxSessions failed"); ce != nil {
+			ce.Write(zap.Any("given", thing))
+		}
+	}
+	if thing := conf.Extra["splithttp_padding"]; thing != nil {
+		if min, max, ok := parseRange(thing); ok {
+			c.PaddingMin, c.PaddingMax = min, max
+		} else if ce := utils.CanLogErr("parse splithttp_padding failed"); ce != nil {
+			ce.Write(zap.Any("given", thing))
+		}
+	}
+	return
+}
+
+// 解析 "100-1000" 或 单个数字
+func parseRange(thing any) (min, max int, ok bool) {
+	if i, isInt := utils.AnyToInt64(thing); isInt {
+		return int(i), int(i), i >= 0
+	}
+	str, isStr := thing.(string)
+	if !isStr {
+		return
+	}
+	minStr, maxStr, hasDash := strings.Cut(str, "-")
+	if !hasDash {
+		maxStr = minStr
+	}
+	var e1, e2 error
+	min, e1 = strconv.Atoi(strings.TrimSpace(minStr))
+	max, e2 = strconv.Atoi(strings.TrimSpace(maxStr))
+	ok = e1 == nil && e2 == nil && min >= 0 && max >= min
+	return
+}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	return NewClient(getConfig(conf), conf), nil
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	return NewServer(getConfig(conf), conf.Headers), nil
+}
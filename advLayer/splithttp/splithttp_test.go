@@ -0,0 +1,201 @@
+package splithttp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/advLayer/splithttp"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+)
+
+// h1 模式: 明文tcp, GET 使用 拨号好的连接, POST 由 Client 自行拨号
+func TestSplitHTTP_h1(t *testing.T) {
+	testSplitHTTP(t, false)
+}
+
+// h2 模式: tls 协商出 h2, 所有请求 复用 同一个连接
+func TestSplitHTTP_h2(t *testing.T) {
+	testSplitHTTP(t, true)
+}
+
+func testSplitHTTP(t *testing.T, useH2 bool) {
+	listener, err := net.Listen("tcp", netLayer.GetRandLocalAddr(true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	addr, err := netLayer.NewAddr(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := &httpLayer.HeaderPreset{
+		Request:  &httpLayer.RequestHeader{Headers: map[string][]string{"X-Test": {"abc"}}},
+		Response: &httpLayer.ResponseHeader{Headers: map[string][]string{"X-Resp": {"def"}}},
+	}
+	headers.Prepare()
+
+	conf := &advLayer.Conf{
+		Path:    "/thepath",
+		Host:    "example.com",
+		Addr:    addr,
+		Headers: headers,
+		Extra: map[string]any{
+			"splithttp_maxPostSize":        1000, //使 上行数据 分成 很多个POST
+			"splithttp_maxConcurrentPosts": 8,
+			"splithttp_padding":            "10-20",
+		},
+	}
+	creator := advLayer.ProtocolsMap["splithttp"]
+
+	ser, err := creator.NewServerFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ser.Stop()
+	cli, err := creator.NewClientFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxC := cli.(advLayer.MuxClient)
+
+	var tlsS *tlsLayer.Server
+	var tlsC *tlsLayer.Client
+	if useH2 {
+		tlsS, err = tlsLayer.NewServer(tlsLayer.Conf{Host: "example.com", AlpnList: []string{"h2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsC = tlsLayer.NewClient(tlsLayer.Conf{Host: "example.com", Insecure: true, AlpnList: []string{"h2"}})
+	}
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if tlsS != nil {
+					tc, err := tlsS.Handshake(c)
+					if err != nil {
+						t.Log(err)
+						return
+					}
+					c = tc
+				}
+				ser.(advLayer.MuxServer).StartHandle(c, func(sc net.Conn) {
+					go func() {
+						defer sc.Close()
+						io.Copy(sc, sc)
+					}()
+				}, nil)
+			}()
+		}
+	}()
+
+	echo := func(muxC advLayer.MuxClient, underlay net.Conn) {
+		cc, err := muxC.GetCommonConn(underlay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := muxC.DialSubConn(cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+
+		data := make([]byte, 100000)
+		rand.Read(data)
+
+		go func() {
+			for i := 0; i < len(data); i += 3000 {
+				end := i + 3000
+				if end > len(data) {
+					end = len(data)
+				}
+				sub.Write(data[i:end])
+			}
+		}()
+
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(sub, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("data not equal")
+		}
+	}
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tlsC != nil {
+			tc, err := tlsC.Handshake(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tc
+		}
+		return c
+	}
+
+	echo(muxC, dial())
+	if useH2 {
+		echo(muxC, nil) //复用 第一个 tls 连接
+		return
+	}
+	echo(muxC, dial())
+
+	//给出 拨号函数 后 (proxy 包 会 这样做), POST 的连接 都 由它 拨号
+	cli2, err := creator.NewClientFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialed int32
+	cli2.(advLayer.UnderlayDialerSetter).SetUnderlayDialer(func(context.Context) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		return net.Dial("tcp", listener.Addr().String())
+	})
+	echo(cli2.(advLayer.MuxClient), dial())
+	if atomic.LoadInt32(&dialed) == 0 {
+		t.Fatal("h1 posts should be dialed by the given underlay dialer")
+	}
+}
+
+// 不是 path 开头的 h1 请求 应回落
+func TestSplitHTTP_fallback(t *testing.T) {
+	ser, _ := advLayer.ProtocolsMap["splithttp"].NewServerFromConf(&advLayer.Conf{Path: "/thepath"})
+	defer ser.Stop()
+
+	cConn, sConn := net.Pipe()
+	defer cConn.Close()
+
+	go cConn.Write([]byte("GET /wrong HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+	fmChan := make(chan httpLayer.FallbackMeta, 1)
+	ser.(advLayer.MuxServer).StartHandle(sConn, func(net.Conn) {
+		t.Error("should not get sub conn")
+	}, func(fm httpLayer.FallbackMeta) {
+		fmChan <- fm
+	})
+
+	fm := <-fmChan
+	if fm.Path != "/wrong" || fm.H1RequestBuf == nil || fm.H1RequestBuf.Len() == 0 {
+		t.Fatal("wrong fallback meta", fm.Path)
+	}
+}
+
+var _ advLayer.MuxClient = (*splithttp.Client)(nil)
+var _ advLayer.MuxServer = (*splithttp.Server)(nil)
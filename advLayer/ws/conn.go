@@ -13,6 +13,9 @@ import (
 // 实现 net.Conn, io.ReaderFrom, utils.MultiWriter, netLayer.Splicer
 // 因为 gobwas/ws 不包装conn，在写入和读取二进制时需要使用 较为底层的函数才行，并未被提供标准的Read和Write。
 // 因此我们包装一下，统一使用Read和Write函数 来读写 二进制数据。因为我们这里是代理，
+//
+// 不实现 netLayer.CloseWriter: ws 的 close帧 表示 完全关闭, 没有 半关闭 的 语义,
+// 所以 开启 netLayer.RelayHalfClose 时, 一方向 结束 后 依然会 直接 关闭 双方.
 type Conn struct {
 	net.Conn
 
@@ -9,6 +9,7 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/advLayer/ws"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
 func TestBase64Len(t *testing.T) {
@@ -121,4 +122,10 @@ func TestWs(t *testing.T) {
 		t.Log("not equal", n)
 		t.FailNow()
 	}
+
+	//ws 没有 半关闭, Relay 会 回退到 直接关闭 双方
+	if err = netLayer.CloseWrite(wsConn); err != utils.ErrUnImplemented {
+		t.Log("ws conn should not support CloseWrite", err)
+		t.FailNow()
+	}
 }
@@ -7,10 +7,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/e1732a364fed/v2ray_simple"
 	"github.com/e1732a364fed/v2ray_simple/machine"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
@@ -76,6 +78,10 @@ func init() {
 		"【热加载】新配置文件", func() { interactively_hotLoadConfigFile(mainM) },
 	}, &CliCmd{
 		"【热加载】新配置url", func() { interactively_hotLoadUrlConfig(mainM) },
+	}, &CliCmd{
+		"查看当前连接", func() { interactively_listConns(mainM) },
+	}, &CliCmd{
+		"关闭连接", func() { interactively_closeConns(mainM) },
 	}, &CliCmd{
 		"调节日志等级", interactively_adjust_loglevel,
 	})
@@ -510,6 +516,69 @@ func interactively_hotLoadConfigFile(m *machine.M) {
 	m.PrintAllState(os.Stdout, false)
 }
 
+// 输入 形如 inTag=my_socks&target=google 的 筛选条件, 键名 见 v2ray_simple.ConnFilterFromQuery
+func interactively_inputConnFilter() (f v2ray_simple.ConnFilter, ok bool) {
+	utils.PrintStr("请输入筛选条件, 如 inTag=my_socks&target=google , 可用的键有 id, inTag, outTag, user, network, source, target, domain; 留空表示全部连接\n")
+
+	promptFilter := promptui.Prompt{
+		Label: "筛选条件",
+		Validate: func(s string) error {
+			q, err := url.ParseQuery(s)
+			if err != nil {
+				return err
+			}
+			f, err = v2ray_simple.ConnFilterFromQuery(q)
+			return err
+		},
+	}
+
+	_, err := promptFilter.Run()
+
+	if err != nil {
+		fmt.Printf("Prompt failed %v\n", err)
+		return
+	}
+	ok = true
+	return
+}
+
+func interactively_listConns(m *machine.M) {
+	f, ok := interactively_inputConnFilter()
+	if !ok {
+		return
+	}
+	utils.PrintStr(delimiter)
+	m.PrintConnsForHuman(os.Stdout, &f)
+}
+
+func interactively_closeConns(m *machine.M) {
+	f, ok := interactively_inputConnFilter()
+	if !ok {
+		return
+	}
+
+	list := m.Conns.List(&f)
+	if len(list) == 0 {
+		utils.PrintStr("没有匹配的连接\n")
+		return
+	}
+	utils.PrintStr(delimiter)
+	machine.PrintConnsForHuman(os.Stdout, list)
+
+	promptConfirm := promptui.Prompt{
+		Label:     "确定要关闭 以上连接吗",
+		IsConfirm: true,
+	}
+
+	if _, err := promptConfirm.Run(); err != nil {
+		utils.PrintStr("已取消\n")
+		return
+	}
+
+	list = m.Conns.Kill(&f)
+	fmt.Printf("关闭了 %d 个连接\n", len(list))
+}
+
 func interactively_adjust_loglevel() {
 	fmt.Println("当前日志等级为：", utils.LogLevelStr(utils.LogLevel))
 
@@ -267,6 +267,9 @@ func interactively_generateConf(confClient, confServer *proxy.StandardConf) {
 			"无",
 			"ws",
 			"grpc",
+			"h2",
+			"httpupgrade",
+			"splithttp",
 			"quic",
 		},
 	}
@@ -282,13 +285,13 @@ func interactively_generateConf(confClient, confServer *proxy.StandardConf) {
 	default:
 		clientDial.AdvancedLayer = result
 		switch i4 {
-		case 1, 2:
+		case 1, 2, 3, 4, 5:
 			clientlisten.Tag += "_" + result
 			promptPath := promptui.Prompt{
 				Label: "Path",
 				Validate: func(s string) error {
-					if result == "ws" && !strings.HasPrefix(s, "/") {
-						return errors.New("ws path must start with /")
+					if (result == "ws" || result == "h2" || result == "httpupgrade" || result == "splithttp") && !strings.HasPrefix(s, "/") {
+						return errors.New(result + " path must start with /")
 					}
 					return nil
 				},
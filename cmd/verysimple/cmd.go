@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
@@ -140,6 +141,35 @@ func generateRandomSSlCert() {
 	}
 }
 
+// 生成 ech.pem (服务端用, 配置在 tls_echKeyFile) 与 ech_config.pem (客户端用, 配置在 tls_ech),
+// 并打印 ECHConfigList 的 base64, 可直接填到 tls_ech 或 dns 的 HTTPS 记录 的 ech 参数中.
+func generateECHKeys(publicName string) {
+	const keyFn = "ech.pem"
+	const configFn = "ech_config.pem"
+	if utils.FileExist(keyFn) {
+		utils.PrintStr(keyFn)
+		utils.PrintStr(" 已存在！\n")
+		return
+	}
+
+	keys, configs, err := tlsLayer.GenerateECHKeyPair(publicName)
+	if err == nil {
+		err = os.WriteFile(keyFn, keys, 0600)
+	}
+	if err == nil {
+		err = os.WriteFile(configFn, configs, 0644)
+	}
+	if err != nil {
+		utils.PrintStr("生成失败,")
+		utils.PrintStr(err.Error())
+		utils.PrintStr("\n")
+		return
+	}
+	list, _ := tlsLayer.ParseECHConfigList(configFn)
+
+	fmt.Printf("生成成功！请查看目录中的 %s 和 %s\nECHConfigList: %s\n", keyFn, configFn, base64.StdEncoding.EncodeToString(list))
+}
+
 func printSupportedProtocols() {
 	proxy.PrintAllServerNames()
 	proxy.PrintAllClientNames()
@@ -20,6 +20,7 @@ func init() {
 	extraExitCmds := []exitCmd{
 		{name: "gu", desc: "automatically generate a uuid for you", f: generateAndPrintUUID},
 		{name: "gc", desc: "automatically generate random certificate for you", f: generateRandomSSlCert},
+		{name: "gech", isStr: true, desc: "generate ech key and config for given public name", fs: generateECHKeys},
 
 		{name: "cvqxtvs", isStr: true, desc: "if given, convert qx server config string to vs toml config", fs: convertQxToVs},
 		{name: "eqxrs", isStr: true, desc: "if given, automatically extract remote servers from quantumultX config for you", fs: extractQxRemoteServers},
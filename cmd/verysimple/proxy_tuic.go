@@ -0,0 +1,7 @@
+//go:build !noquic
+
+package main
+
+import _ "github.com/e1732a364fed/v2ray_simple/proxy/tuic"
+
+// tuic 依赖 quic, 所以 与 quic 使用 同一个 build tag.
@@ -0,0 +1,7 @@
+//go:build !nowireguard
+
+package main
+
+import _ "github.com/e1732a364fed/v2ray_simple/proxy/wireguard"
+
+// wireguard 引入了 wireguard-go 与 gvisor 网络栈, 不需要的话 可以 用 nowireguard 这个 build tag 去掉.
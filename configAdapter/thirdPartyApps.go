@@ -440,6 +440,17 @@ func ToClash(dc *proxy.DialConf) string {
 				sb.WriteString("\n    grpc-opts:")
 				sb.WriteString("\n      grpc-service-name: ")
 				sb.WriteString(dc.Path)
+			case "h2":
+				sb.WriteString("\n    h2-opts:")
+				if dc.Host != "" {
+					sb.WriteString("\n      host: [")
+					sb.WriteString(dc.Host)
+					sb.WriteString("]")
+				}
+				if dc.Path != "" {
+					sb.WriteString("\n      path: ")
+					sb.WriteString(dc.Path)
+				}
 
 			}
 
@@ -0,0 +1,235 @@
+package v2ray_simple
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// ConnInfo 是 一个 正在转发的 连接 的 信息快照
+type ConnInfo struct {
+	ID       uint32    `json:"id"` //即 iics 的 id, 与 日志中的 connid 相同
+	InTag    string    `json:"inTag,omitempty"`
+	OutTag   string    `json:"outTag,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Network  string    `json:"network"`
+	Source   string    `json:"source,omitempty"`
+	Target   string    `json:"target"`
+	Domain   string    `json:"domain,omitempty"` //嗅探到的域名
+	InChain  string    `json:"inChain,omitempty"`
+	OutChain string    `json:"outChain"`
+	Start    time.Time `json:"start"`
+	Download uint64    `json:"download"`
+	Upload   uint64    `json:"upload"`
+}
+
+/*
+ConnFilter 用于 筛选 ConnInfo, 零值 匹配 所有连接.
+
+ID, InTag, OutTag, User, Network 须 完全相同; Source, Target, Domain 只需 包含 给出的 字符串 即可.
+*/
+type ConnFilter struct {
+	ID      uint32
+	InTag   string
+	OutTag  string
+	User    string
+	Network string
+	Source  string
+	Target  string
+	Domain  string
+}
+
+// 从 url query 中 读取 筛选条件, 键名 与 ConnInfo 的 json 键名 相同.
+func ConnFilterFromQuery(q url.Values) (f ConnFilter, err error) {
+	if idStr := q.Get("id"); idStr != "" {
+		var id uint64
+		id, err = strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			err = utils.ErrInErr{ErrDesc: "ConnFilter parse id failed", ErrDetail: utils.ErrInvalidNumber, Data: idStr}
+			return
+		}
+		f.ID = uint32(id)
+	}
+	f.InTag = q.Get("inTag")
+	f.OutTag = q.Get("outTag")
+	f.User = q.Get("user")
+	f.Network = q.Get("network")
+	f.Source = q.Get("source")
+	f.Target = q.Get("target")
+	f.Domain = q.Get("domain")
+	return
+}
+
+func (f *ConnFilter) IsEmpty() bool {
+	return f == nil || *f == ConnFilter{}
+}
+
+func (f *ConnFilter) Match(ci *ConnInfo) bool {
+	if f == nil {
+		return true
+	}
+	if f.ID != 0 && f.ID != ci.ID {
+		return false
+	}
+	if f.InTag != "" && f.InTag != ci.InTag {
+		return false
+	}
+	if f.OutTag != "" && f.OutTag != ci.OutTag {
+		return false
+	}
+	if f.User != "" && f.User != ci.User {
+		return false
+	}
+	if f.Network != "" && f.Network != ci.Network {
+		return false
+	}
+	if f.Source != "" && !strings.Contains(ci.Source, f.Source) {
+		return false
+	}
+	if f.Target != "" && !strings.Contains(ci.Target, f.Target) {
+		return false
+	}
+	if f.Domain != "" && !strings.Contains(ci.Domain, f.Domain) {
+		return false
+	}
+	return true
+}
+
+type trackedConn struct {
+	info    ConnInfo //info 中的 Download 和 Upload 不使用, 以 counter 为准
+	counter netLayer.LiveCounter
+	closers []io.Closer
+}
+
+func (tc *trackedConn) snapshot() ConnInfo {
+	ci := tc.info
+	ci.Download = atomic.LoadUint64(&tc.counter.Download)
+	ci.Upload = atomic.LoadUint64(&tc.counter.Upload)
+	return ci
+}
+
+func (tc *trackedConn) close() {
+	for _, c := range tc.closers {
+		c.Close()
+	}
+}
+
+// ConnTable 记录 所有 正在转发的 连接, 可以 查询 和 关闭 它们. 零值 可用.
+type ConnTable struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+// closers 为 关闭该连接 时 要关闭的 对象, 一般为 转发的 两端.
+func (t *ConnTable) add(info ConnInfo, closers ...io.Closer) *trackedConn {
+	tc := &trackedConn{info: info}
+	for _, c := range closers {
+		if c != nil {
+			tc.closers = append(tc.closers, c)
+		}
+	}
+
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[*trackedConn]struct{})
+	}
+	t.conns[tc] = struct{}{}
+	t.mu.Unlock()
+	return tc
+}
+
+func (t *ConnTable) remove(tc *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, tc)
+	t.mu.Unlock()
+}
+
+func (t *ConnTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+func (t *ConnTable) match(f *ConnFilter) (list []*trackedConn) {
+	t.mu.Lock()
+	for tc := range t.conns {
+		if f.Match(&tc.info) {
+			list = append(list, tc)
+		}
+	}
+	t.mu.Unlock()
+	return
+}
+
+func snapshots(list []*trackedConn) []ConnInfo {
+	result := make([]ConnInfo, 0, len(list))
+	for _, tc := range list {
+		result = append(result, tc.snapshot())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+	return result
+}
+
+// 返回 所有 与 f 匹配的 连接, 按 开始时间 排序. f 可为 nil.
+func (t *ConnTable) List(f *ConnFilter) []ConnInfo {
+	return snapshots(t.match(f))
+}
+
+// 关闭 所有 与 f 匹配的 连接, 并返回 它们 被关闭前 的 信息. f 为 nil 或 空 时 会关闭 所有连接.
+func (t *ConnTable) Kill(f *ConnFilter) []ConnInfo {
+	list := t.match(f)
+	result := snapshots(list)
+	for _, tc := range list {
+		tc.close()
+	}
+	return result
+}
+
+// 开始 记录 一个 连接, 在 转发结束后 必须 调用 untrackConn. gi 为 nil 时 返回 nil.
+func (iics *incomingInserverConnState) trackConn(client proxy.Client, targetAddr netLayer.Addr, wlc net.Conn, udp_wlc netLayer.MsgConn, closers ...io.Closer) *trackedConn {
+	gi := iics.GlobalInfo
+	if gi == nil {
+		return nil
+	}
+
+	info := ConnInfo{
+		ID:       iics.id,
+		InTag:    iics.inTag,
+		OutTag:   client.GetTag(),
+		Network:  targetAddr.Network,
+		Source:   iics.getRealRAddr(),
+		Target:   targetAddr.String(),
+		Domain:   iics.sniffedDomain,
+		OutChain: proxy.GetVSI_url(client, targetAddr.Network),
+		Start:    time.Now(),
+	}
+	if iics.inServer != nil {
+		info.InTag = iics.inServer.GetTag()
+		info.InChain = proxy.GetVSI_url(iics.inServer, "")
+	}
+	if uc, ok := wlc.(utils.User); ok {
+		info.User = uc.IdentityStr()
+	} else if uc, ok := udp_wlc.(utils.User); ok {
+		info.User = uc.IdentityStr()
+	}
+
+	return gi.Conns.add(info, closers...)
+}
+
+func (iics *incomingInserverConnState) untrackConn(tc *trackedConn) {
+	if tc != nil {
+		iics.GlobalInfo.Conns.remove(tc)
+	}
+}
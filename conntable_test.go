@@ -0,0 +1,122 @@
+package v2ray_simple_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// dokodemo 连接 回显服务器, 然后 在 ConnTable 中 查询 并 关闭 连接
+func TestConnTable(t *testing.T) {
+	if utils.ZapLogger == nil {
+		utils.InitLog("")
+	}
+
+	const confFormatStr = `
+[[listen]]
+protocol = "dokodemo"
+tag = "doko"
+host = "127.0.0.1"
+port = %s
+target = "tcp://127.0.0.1:%s"
+
+[[dial]]
+protocol = "direct"
+`
+
+	echoLn := listenEcho(t)
+	defer echoLn.Close()
+	echoPort := fmt.Sprint(echoLn.Addr().(*net.TCPAddr).Port)
+	listenPort := netLayer.RandPortStr(true, false)
+
+	conf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(confFormatStr, listenPort, echoPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := proxy.NewServer(conf.Listen[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := proxy.NewClient(conf.Dial[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gi v2ray_simple.GlobalInfo
+	c := v2ray_simple.ListenSer(server, client, nil, &gi)
+	if c == nil {
+		t.Fatal("listen failed")
+	}
+	defer c.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+listenPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg := []byte("hello conn table")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+
+	list := gi.Conns.List(&v2ray_simple.ConnFilter{InTag: "doko"})
+	if len(list) != 1 {
+		t.Fatal("should have one conn", list)
+	}
+	ci := list[0]
+	if ci.Target != "127.0.0.1:"+echoPort || ci.Network != "tcp" || ci.Source != conn.LocalAddr().String() {
+		t.Fatal("conn info wrong", ci)
+	}
+
+	big := make([]byte, 1024*1024)
+	go conn.Write(big)
+	if _, err = io.ReadFull(conn, make([]byte, len(big))); err != nil {
+		t.Fatal(err)
+	}
+
+	//splice 时 按块 计数 (见 netLayer 的 spliceCountChunkLen), 最后 不足 一块 的 部分 要 等 连接 结束 才 计入
+	const spliceChunk = 256 * 1024
+	all := uint64(len(msg) + len(big))
+	spliced := all / spliceChunk * spliceChunk
+	for i := 0; ; i++ {
+		ci = gi.Conns.List(&v2ray_simple.ConnFilter{ID: ci.ID})[0]
+		if (ci.Upload == all || ci.Upload == spliced) && ci.Upload == ci.Download {
+			break
+		}
+		if i > 50 {
+			t.Fatal("wrong counter", ci.Upload, ci.Download)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if l := gi.Conns.List(&v2ray_simple.ConnFilter{InTag: "other"}); len(l) != 0 {
+		t.Fatal("filter should not match", l)
+	}
+
+	if l := gi.Conns.Kill(&v2ray_simple.ConnFilter{ID: ci.ID}); len(l) != 1 {
+		t.Fatal("should kill one conn", l)
+	}
+
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("conn should be closed")
+	}
+
+	for i := 0; gi.Conns.Len() > 0; i++ {
+		if i > 50 {
+			t.Fatal("conn not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,93 @@
+package v2ray_simple
+
+import (
+	"net"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+/*
+tun 与 tproxy 的 dns劫持 (见 proxy.DNSHijack).
+
+被劫持 的 dns请求 不会 被 分流 与 转发, 而是 直接 由 DNSMachine.Answer 应答, 所以 会 使用 dns配置 中 的 rules, hosts, 缓存 与 特殊服务器.
+*/
+
+// 劫持的 dns连接 在 这段时间 内 没有 新请求 就 关闭
+var DNSHijackIdleTimeout = time.Second * 30
+
+// 若 inServer 对 target 开启了 dns劫持, 返回 应答 所用的 DNSMachine
+func dnsHijackMachine(inServer proxy.Server, env *proxy.RoutingEnv, target netLayer.Addr) *netLayer.DNSMachine {
+	h, ok := inServer.(proxy.DNSHijacker)
+	if !ok || !h.ShouldHijackDNS(target) {
+		return nil
+	}
+	if env == nil || env.DnsMachine == nil {
+		if ce := utils.CanLogWarn("dns hijack enabled but no dns config given, will relay it"); ce != nil {
+			ce.Write(zap.String("target", target.String()))
+		}
+		return nil
+	}
+	if env.DnsMachine.IsServerAddr(target) {
+		//DnsMachine 自己 发往 上游 的 请求 (如 tun 开启了 auto_route 时), 不能 再 劫持
+		if ce := utils.CanLogDebug("dns hijack skipped for dns server of DnsMachine"); ce != nil {
+			ce.Write(zap.String("target", target.String()))
+		}
+		return nil
+	}
+	return env.DnsMachine
+}
+
+func hijackDNS_udp(mc netLayer.MsgConn, dm *netLayer.DNSMachine) {
+	defer mc.Close()
+
+	for {
+		mc.SetReadDeadline(time.Now().Add(DNSHijackIdleTimeout))
+		bs, peer, err := mc.ReadMsg()
+		if err != nil {
+			return
+		}
+		r := new(dns.Msg)
+		err = r.Unpack(bs)
+		utils.PutPacket(bs)
+		if err != nil {
+			if ce := utils.CanLogDebug("dns hijack got invalid udp msg"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			continue
+		}
+		var src net.Addr
+		if ra, ok := mc.(interface{ RemoteAddr() net.Addr }); ok {
+			src = ra.RemoteAddr()
+		}
+
+		//上游 查询 可能 较慢, 不要 阻塞 后面的 请求
+		go func() {
+			out, err := dm.Answer(r, src).Pack()
+			if err != nil {
+				return
+			}
+			mc.WriteMsg(out, peer)
+		}()
+	}
+}
+
+func hijackDNS_tcp(c net.Conn, dm *netLayer.DNSMachine) {
+	defer c.Close()
+
+	dc := &dns.Conn{Conn: c}
+	for {
+		c.SetReadDeadline(time.Now().Add(DNSHijackIdleTimeout))
+		r, err := dc.ReadMsg()
+		if err != nil {
+			return
+		}
+		if err = dc.WriteMsg(dm.Answer(r, c.RemoteAddr())); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package v2ray_simple_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+)
+
+// 模拟 tun/tproxy 这种 自监听 的 Server, 由 测试 直接 调用 tcpFunc 与 udpFunc
+type fakeSelfListenServer struct {
+	proxy.Base
+	*proxy.DNSHijack
+
+	tcpFunc func(netLayer.TCPRequestInfo)
+	udpFunc func(netLayer.UDPRequestInfo)
+}
+
+func (*fakeSelfListenServer) Name() string { return "fake" }
+
+func (*fakeSelfListenServer) SelfListen() (is bool, tcp, udp int) { return true, 1, 1 }
+
+func (s *fakeSelfListenServer) StartListen(tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) io.Closer {
+	s.tcpFunc = tcpFunc
+	s.udpFunc = udpFunc
+	return s
+}
+
+func (*fakeSelfListenServer) Close() error { return nil }
+
+func (*fakeSelfListenServer) Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error) {
+	return nil, nil, netLayer.Addr{}, utils.ErrUnImplemented
+}
+
+func TestDNSHijack(t *testing.T) {
+	if utils.ZapLogger == nil {
+		utils.InitLog("")
+	}
+
+	h, err := proxy.NewDNSHijackFromExtra(map[string]any{"dns_hijack": true, "dns_hijack_except": []any{"9.9.9.9", "10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]bool{
+		"8.8.8.8:53":   true,
+		"9.9.9.9:53":   false,
+		"10.1.2.3:53":  false,
+		"8.8.8.8:853":  false,
+		"[2001::1]:53": true,
+	} {
+		a, _ := netLayer.NewAddr(target)
+		if got := h.ShouldHijackDNS(a); got != want {
+			t.Fatal("wrong ShouldHijackDNS", target, got)
+		}
+	}
+
+	s := &fakeSelfListenServer{DNSHijack: h}
+	env := &proxy.RoutingEnv{DnsMachine: netLayer.LoadDnsMachine(&netLayer.DnsConf{Hosts: map[string]any{"www.myfake.com": "11.22.33.44"}})}
+
+	closer := v2ray_simple.ListenSer(s, v2ray_simple.DirectClient, env, nil)
+	if closer == nil || s.tcpFunc == nil {
+		t.Fatal("listen failed")
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go s.tcpFunc(netLayer.TCPRequestInfo{Conn: c2, Target: netLayer.Addr{Network: "tcp", IP: net.IPv4(8, 8, 8, 8), Port: 53}})
+
+	dc := &dns.Conn{Conn: c1}
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+
+	//同一连接 上 可以 有 多个 请求
+	for i := 0; i < 2; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("www.myfake.com.", dns.TypeA)
+		if err = dc.WriteMsg(q); err != nil {
+			t.Fatal(err)
+		}
+		r, err := dc.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != q.Id || len(r.Answer) != 1 {
+			t.Fatal("wrong answer", r)
+		}
+		if a, ok := r.Answer[0].(*dns.A); !ok || a.A.String() != "11.22.33.44" {
+			t.Fatal("wrong A record", r.Answer[0])
+		}
+	}
+}
+
+func TestDNSHijackUDP(t *testing.T) {
+	if utils.ZapLogger == nil {
+		utils.InitLog("")
+	}
+
+	h, err := proxy.NewDNSHijackFromExtra(map[string]any{"dns_hijack": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSelfListenServer{DNSHijack: h}
+	env := &proxy.RoutingEnv{DnsMachine: netLayer.LoadDnsMachine(&netLayer.DnsConf{Hosts: map[string]any{"www.myfake.com": "11.22.33.44"}})}
+
+	closer := v2ray_simple.ListenSer(s, v2ray_simple.DirectClient, env, nil)
+	if closer == nil || s.udpFunc == nil {
+		t.Fatal("listen failed")
+	}
+
+	//tun/tproxy 拿到的 udp 连接
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.udpFunc(netLayer.UDPRequestInfo{MsgConn: &netLayer.MsgConnForPacketConn{PacketConn: pc}, Target: netLayer.Addr{Network: "udp", IP: net.IPv4(8, 8, 8, 8), Port: 53}})
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dc := &dns.Conn{Conn: c}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for i := 0; i < 2; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("www.myfake.com.", dns.TypeA)
+		if err = dc.WriteMsg(q); err != nil {
+			t.Fatal(err)
+		}
+		r, err := dc.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != q.Id || len(r.Answer) != 1 {
+			t.Fatal("wrong answer", r)
+		}
+		if a, ok := r.Answer[0].(*dns.A); !ok || a.A.String() != "11.22.33.44" {
+			t.Fatal("wrong A record", r.Answer[0])
+		}
+	}
+}
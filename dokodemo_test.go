@@ -0,0 +1,94 @@
+package v2ray_simple_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// dokodemo 监听 两个 端口, 第一个 目标 无法连接, 应 自动 换到 第二个 目标.
+func TestDokodemoPortRangeFailover(t *testing.T) {
+	if utils.ZapLogger == nil {
+		utils.InitLog("")
+	}
+
+	const confFormatStr = `
+[[listen]]
+protocol = "dokodemo"
+tag = "fwd"
+host = "127.0.0.1"
+target = "tcp://127.0.0.1:%d"
+extra.ports = "%d-%d"
+extra.targets = ["tcp://127.0.0.1:%d"]
+
+[[dial]]
+protocol = "direct"
+`
+
+	echoL := listenEcho(t)
+	defer echoL.Close()
+
+	closedL, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := closedL.Addr().(*net.TCPAddr).Port
+	closedL.Close()
+
+	p1, _ := netLayer.RandPort_andStr(true, false)
+	p2 := p1 + 1
+
+	conf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(confFormatStr, closedPort, p1, p2, echoL.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lcs, err := proxy.ExpandListenConf(conf.Listen[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lcs) != 2 {
+		t.Fatal("should expand to 2 listens", len(lcs))
+	}
+
+	client, err := proxy.NewClient(conf.Dial[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lc := range lcs {
+		server, err := proxy.NewServer(lc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.GetTag() != "fwd_"+strconv.Itoa(lc.Port) {
+			t.Fatal("wrong tag", server.GetTag())
+		}
+		c := v2ray_simple.ListenSer(server, client, nil, nil)
+		if c == nil {
+			t.Fatal("listen failed", lc.Port)
+		}
+		defer c.Close()
+	}
+
+	for _, port := range []int{p1, p2} {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err = conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatal("echo wrong", port, string(buf), err)
+		}
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/dustin/go-humanize v1.0.0
 	github.com/e1732a364fed/ui v0.0.1-alpha.13
 	github.com/gobwas/ws v1.1.0
+	github.com/hashicorp/yamux v0.1.1
 	github.com/lucas-clemente/quic-go v0.0.0-00010101000000-000000000000
 	github.com/manifoldco/promptui v0.9.0
 	github.com/marten-seemann/qtls v0.10.0
@@ -2,9 +2,11 @@ package v2ray_simple
 
 import (
 	"bytes"
+	"crypto/tls"
 	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
@@ -12,6 +14,8 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/proxy"
 	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -73,6 +77,10 @@ type incomingInserverConnState struct {
 
 	cachedRemoteAddr string
 
+	sniffedDomain string
+
+	proxyHeader *proxyproto.Header //监听时 收到的 PROXY protocol 头
+
 	inServerTlsConn            tlsLayer.Conn
 	inServerTlsRawReadRecorder *tlsLayer.Recorder
 
@@ -82,7 +90,7 @@ type incomingInserverConnState struct {
 	fallbackRW          http.ResponseWriter
 	fallbackFirstBuffer *bytes.Buffer
 
-	fallbackXver int //若大于等于0，则证明该进项已经被确定需要进行fallback。
+	fallbackXver int //若大于等于0，则证明该进项已经被确定需要进行fallback。-1 表示 未回落, 构造时 就要 设为 -1, 见 tcpXver
 
 	firstPayload   []byte
 	udpFirstTarget netLayer.Addr
@@ -93,6 +101,8 @@ type incomingInserverConnState struct {
 
 	routedToDirect bool
 
+	dnsResolved bool //targetAddr 的 ip 是否 是 在 dns解析阶段 由 DNSMachine 得到的
+
 	routingEnv *proxy.RoutingEnv //used in passToOutClient
 
 	heapObj *heapObj
@@ -294,6 +304,93 @@ func (iics *incomingInserverConnState) CanLogLevel(level int, msg string) *iicsZ
 		return nil
 	}
 }
+
+// 拨号 域名 时 所用的 DNSMachine, 可为 nil
+func (iics *incomingInserverConnState) dnsMachine() *netLayer.DNSMachine {
+	if iics.routingEnv != nil {
+		return iics.routingEnv.DnsMachine
+	}
+	return nil
+}
+
+/*
+tcp 拨号后 要发送的 PROXY protocol 头 的 版本, 0 表示 不发送.
+
+回落 时 使用 回落配置的 xver; 否则 若 client 为 direct, 或 在 dialClient 中 拨号 (dialhere),
+则 使用 dial 配置的 xver, 这样 后端 或 远程 vs 可以 得知 客户端的 真实地址.
+*/
+func (iics *incomingInserverConnState) tcpXver(client proxy.Client, dialhere bool) int {
+	if iics.fallbackXver >= 0 {
+		return iics.fallbackXver
+	}
+	if dialhere || client.Name() == proxy.DirectName {
+		return client.GetXver()
+	}
+	return 0
+}
+
+/*
+生成 发送 PROXY protocol v2 头 时 附带的 TLV.
+
+收到的 PROXY 头 中的 TLV 会被 原样 转发; 若 本连接 的 tls 是在 inServer 解开的, 则 用 本连接 的
+ALPN, SNI (AUTHORITY) 和 SSL 信息 (版本, 加密套件, 客户端证书的 CN) 替换 同类型的 TLV.
+若 没有 收到 UNIQUE_ID, 则 使用 连接的 id.
+*/
+func (iics *incomingInserverConnState) proxyTLVs() (tlvs []proxyproto.TLV) {
+	if iics.proxyHeader != nil {
+		tlvs, _ = iics.proxyHeader.TLVs()
+	}
+
+	set := func(t proxyproto.PP2Type, v []byte, override bool) {
+		for i := range tlvs {
+			if tlvs[i].Type == t {
+				if override {
+					tlvs[i].Value = v
+				}
+				return
+			}
+		}
+		tlvs = append(tlvs, proxyproto.TLV{Type: t, Value: v})
+	}
+
+	set(proxyproto.PP2_TYPE_UNIQUE_ID, []byte(strconv.FormatUint(uint64(iics.id), 10)), false)
+
+	tc := iics.inServerTlsConn
+	if tc == nil {
+		return
+	}
+	if alpn := tc.GetAlpn(); alpn != "" {
+		set(proxyproto.PP2_TYPE_ALPN, []byte(alpn), true)
+	}
+	if sni := tc.GetSni(); sni != "" {
+		set(proxyproto.PP2_TYPE_AUTHORITY, []byte(sni), true)
+	}
+
+	ssl := tlvparse.PP2SSL{
+		Client: tlvparse.PP2_BITFIELD_CLIENT_SSL,
+		Verify: 1,
+	}
+	if v := tlsLayer.VersionName(tc.GetTlsVersion()); v != "" {
+		ssl.TLV = append(ssl.TLV, proxyproto.TLV{Type: proxyproto.PP2_SUBTYPE_SSL_VERSION, Value: []byte(v)})
+	}
+	if cs := tc.GetCipherSuite(); cs != 0 {
+		ssl.TLV = append(ssl.TLV, proxyproto.TLV{Type: proxyproto.PP2_SUBTYPE_SSL_CIPHER, Value: []byte(tls.CipherSuiteName(cs))})
+	}
+	if certs, verified := tc.GetPeerCertificates(); len(certs) > 0 {
+		ssl.Client |= tlvparse.PP2_BITFIELD_CLIENT_CERT_CONN | tlvparse.PP2_BITFIELD_CLIENT_CERT_SESS
+		if verified {
+			ssl.Verify = 0
+		}
+		if cn := certs[0].Subject.CommonName; cn != "" {
+			ssl.TLV = append(ssl.TLV, proxyproto.TLV{Type: proxyproto.PP2_SUBTYPE_SSL_CN, Value: []byte(cn)})
+		}
+	}
+	if t, err := ssl.Marshal(); err == nil {
+		set(proxyproto.PP2_TYPE_SSL, t.Value, true)
+	}
+	return
+}
+
 func (iics *incomingInserverConnState) getRealRAddr() (raddr string) {
 	raddr = iics.cachedRemoteAddr
 	if iics.wrappedConn != nil {
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/e1732a364fed/v2ray_simple"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
 	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
@@ -22,6 +24,10 @@ const eIllegalParameter = "illegal parameter"
 
 /*
 curl -k https://127.0.0.1:48345/api/allstate
+
+curl -k "https://127.0.0.1:48345/api/conns?inTag=my_socks"
+
+curl -k "https://127.0.0.1:48345/api/closeConns?id=123456"
 */
 
 type ApiServerConf struct {
@@ -300,6 +306,44 @@ func (m *M) runApiServer() {
 
 	})
 
+	//列出 正在转发的 连接, 可用 id, inTag, outTag, user, network, source, target, domain 参数 筛选. 返回 json
+	ser.addServerHandle(mux, "conns", func(w http.ResponseWriter, r *http.Request) {
+		f, err := v2ray_simple.ConnFilterFromQuery(r.URL.Query())
+		if err != nil {
+			failBadRequest(err, eIllegalParameter, w)
+			w.Write([]byte(eIllegalParameter))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.Conns.List(&f))
+	})
+
+	//关闭 正在转发的 连接, 参数与 conns 相同. 为防止误操作, 没有 筛选参数 时 须给出 all=true 才会 关闭 所有连接. 返回 被关闭的 连接 的 json
+	ser.addServerHandle(mux, "closeConns", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f, err := v2ray_simple.ConnFilterFromQuery(q)
+		if err != nil {
+			failBadRequest(err, eIllegalParameter, w)
+			w.Write([]byte(eIllegalParameter))
+			return
+		}
+		if f.IsEmpty() && !utils.QueryPositive(q, "all") {
+			failBadRequest(utils.ErrInvalidData, "api server got closeConns request without filter", w)
+			w.Write([]byte("no filter given, use all=true to close all connections"))
+			return
+		}
+
+		list := m.Conns.Kill(&f)
+
+		if ce := utils.CanLogInfo("api server closed connections"); ce != nil {
+			ce.Write(zap.Any("filter", f), zap.Int("count", len(list)))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	})
+
 	tlsConf := &tls.Config{}
 
 	if m.PlainHttp {
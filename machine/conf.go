@@ -35,6 +35,12 @@ type AppConf struct {
 	DialTimeoutSeconds *int `toml:"dial_timeout"` //秒
 	ReadTimeoutSeconds *int `toml:"read_timeout"` //秒
 
+	RelayIdleTimeoutSeconds         *int `toml:"relay_idle_timeout"`          //秒, tcp 转发 双向 都没有数据 的 超时
+	RelayUplinkOnlyTimeoutSeconds   *int `toml:"relay_uplink_only_timeout"`   //秒, 下行 结束后 上行 的 空闲超时
+	RelayDownlinkOnlyTimeoutSeconds *int `toml:"relay_downlink_only_timeout"` //秒, 上行 结束后 下行 的 空闲超时
+
+	HalfClose bool `toml:"half_close"` //tcp 转发 时 某一方向 结束 后 只 半关闭 另一端, 继续 转发 另一方向. 开启后 不会再 splice
+
 	GeoipFile     *string `toml:"geoip_file"`
 	GeositeFolder *string `toml:"geosite_folder"`
 
@@ -81,6 +87,22 @@ func GetAppConfByCurrentState() (ac AppConf) {
 		to := int(netLayer.CommonReadTimeout / time.Second)
 		ac.ReadTimeoutSeconds = &to
 	}
+
+	if netLayer.RelayIdleTimeout > 0 {
+		to := int(netLayer.RelayIdleTimeout / time.Second)
+		ac.RelayIdleTimeoutSeconds = &to
+	}
+	if netLayer.RelayUplinkOnlyTimeout != netLayer.DefaultRelayUplinkOnlyTimeout {
+		to := int(netLayer.RelayUplinkOnlyTimeout / time.Second)
+		ac.RelayUplinkOnlyTimeoutSeconds = &to
+	}
+	if netLayer.RelayDownlinkOnlyTimeout != netLayer.DefaultRelayDownlinkOnlyTimeout {
+		to := int(netLayer.RelayDownlinkOnlyTimeout / time.Second)
+		ac.RelayDownlinkOnlyTimeoutSeconds = &to
+	}
+	if netLayer.RelayHalfClose {
+		ac.HalfClose = true
+	}
 	return
 }
 
@@ -123,6 +145,19 @@ func (ac *AppConf) Setup() {
 		}
 	}
 
+	if ac.RelayIdleTimeoutSeconds != nil {
+		netLayer.RelayIdleTimeout = time.Duration(*ac.RelayIdleTimeoutSeconds) * time.Second
+	}
+	if ac.RelayUplinkOnlyTimeoutSeconds != nil {
+		netLayer.RelayUplinkOnlyTimeout = time.Duration(*ac.RelayUplinkOnlyTimeoutSeconds) * time.Second
+	}
+	if ac.RelayDownlinkOnlyTimeoutSeconds != nil {
+		netLayer.RelayDownlinkOnlyTimeout = time.Duration(*ac.RelayDownlinkOnlyTimeoutSeconds) * time.Second
+	}
+	if ac.HalfClose {
+		netLayer.RelayHalfClose = true
+	}
+
 	if ac.GeoipFile != nil {
 		netLayer.GeoipFileName = *ac.GeoipFile
 	}
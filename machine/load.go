@@ -59,7 +59,20 @@ func (m *M) LoadListenConf(conf []*proxy.ListenConf, hot bool) (ok bool) {
 
 	h_r := hot && m.running
 
+	var expanded []*proxy.ListenConf
 	for _, l := range conf {
+		lcs, err := proxy.ExpandListenConf(l)
+		if err != nil {
+			if ce := utils.CanLogErr("Can not create listen server"); ce != nil {
+				ce.Write(zap.Error(err), zap.Any("raw", l))
+			}
+			ok = false
+			continue
+		}
+		expanded = append(expanded, lcs...)
+	}
+
+	for _, l := range expanded {
 		if l.UUID == "" && m.DefaultUUID != "" {
 			l.UUID = m.DefaultUUID
 		}
@@ -210,6 +210,15 @@ func (m *M) printState_proxy(w io.Writer) {
 	}
 	for i, c := range m.allClients {
 		fmt.Fprintln(w, "outClient", i, proxy.GetVSI_url(c, ""))
+
+		if b := c.GetBase(); b != nil && b.WarmPool != nil {
+			idle, hits, misses, discarded := b.WarmPool.Stats()
+			var hitRate float64
+			if total := hits + misses; total > 0 {
+				hitRate = float64(hits) / float64(total)
+			}
+			fmt.Fprintf(w, "\twarmPool idle %d hits %d misses %d hitRate %.2f discarded %d\n", idle, hits, misses, hitRate, discarded)
+		}
 	}
 }
 
@@ -258,6 +267,28 @@ func (m *M) PrintAllStateForHuman(w io.Writer, printRouteEnv bool) {
 
 }
 
+// 打印 与 f 匹配的 所有 正在转发的 连接. f 可为 nil.
+func (m *M) PrintConnsForHuman(w io.Writer, f *v2ray_simple.ConnFilter) {
+	if w == nil {
+		w = os.Stdout
+	}
+	PrintConnsForHuman(w, m.Conns.List(f))
+}
+
+func PrintConnsForHuman(w io.Writer, list []v2ray_simple.ConnInfo) {
+	now := time.Now()
+	for _, ci := range list {
+		fmt.Fprintln(w, ci.ID, ci.Network, ci.Source, "->", ci.Target, ci.Domain)
+		fmt.Fprintln(w, "\tin", ci.InTag, ci.InChain)
+		fmt.Fprintln(w, "\tout", ci.OutTag, ci.OutChain)
+		if ci.User != "" {
+			fmt.Fprintln(w, "\tuser", ci.User)
+		}
+		fmt.Fprintln(w, "\tduration", now.Sub(ci.Start).Round(time.Second), "download", humanize.Bytes(ci.Download), "upload", humanize.Bytes(ci.Upload))
+	}
+	fmt.Fprintln(w, "count", len(list))
+}
+
 func (m *M) GetRoutePolicy() *netLayer.RoutePolicy {
 	return m.routingEnv.RoutePolicy
 }
@@ -19,6 +19,7 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
 	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
@@ -28,6 +29,8 @@ type GlobalInfo struct {
 	ActiveConnectionCount      int32
 	AllDownloadBytesSinceStart uint64
 	AllUploadBytesSinceStart   uint64
+
+	Conns ConnTable //所有 正在转发的 连接
 }
 
 var (
@@ -87,6 +90,10 @@ func ListenSer(inServer proxy.Server, defaultOutClient proxy.Client, env *proxy.
 		if tcp == 1 {
 
 			tcpFunc = func(tcpInfo netLayer.TCPRequestInfo) {
+				if dm := dnsHijackMachine(inServer, env, tcpInfo.Target); dm != nil {
+					hijackDNS_tcp(tcpInfo.Conn, dm)
+					return
+				}
 				passToOutClient(incomingInserverConnState{
 					inTag:         inServer.GetTag(),
 					useSniffing:   inServer.Sniffing(),
@@ -94,6 +101,7 @@ func ListenSer(inServer proxy.Server, defaultOutClient proxy.Client, env *proxy.
 					defaultClient: defaultOutClient,
 					routingEnv:    env,
 					GlobalInfo:    gi,
+					fallbackXver:  -1,
 				}, false, tcpInfo.Conn, nil, tcpInfo.Target)
 			}
 
@@ -101,12 +109,17 @@ func ListenSer(inServer proxy.Server, defaultOutClient proxy.Client, env *proxy.
 		if udp == 1 {
 
 			udpFunc = func(udpInfo netLayer.UDPRequestInfo) {
+				if dm := dnsHijackMachine(inServer, env, udpInfo.Target); dm != nil {
+					hijackDNS_udp(udpInfo.MsgConn, dm)
+					return
+				}
 				passToOutClient(incomingInserverConnState{
 					inTag:         inServer.GetTag(),
 					useSniffing:   inServer.Sniffing(),
 					defaultClient: defaultOutClient,
 					routingEnv:    env,
 					GlobalInfo:    gi,
+					fallbackXver:  -1,
 				}, false, nil, udpInfo.MsgConn, udpInfo.Target)
 			}
 		}
@@ -142,6 +155,7 @@ func ListenSer(inServer proxy.Server, defaultOutClient proxy.Client, env *proxy.
 				defaultClient: defaultOutClient,
 				routingEnv:    env,
 				GlobalInfo:    gi,
+				fallbackXver:  -1,
 			}
 			iics.genID()
 
@@ -232,11 +246,17 @@ func handleNewIncomeConnection(inServer proxy.Server, defaultClientForThis proxy
 		routingEnv:         env,
 		isTlsLazyServerEnd: inServer.IsLazyTls() && CanLazyEncrypt(inServer),
 		GlobalInfo:         gi,
+		fallbackXver:       -1,
 	}
 	iics.genID()
 
 	wrappedConn := thisLocalConnectionInstance
 
+	//监听 配置了 xver 时, RemoteAddr 已经是 PROXY protocol 头中的 源地址 了
+	if pg, ok := thisLocalConnectionInstance.(netLayer.PROXYHeaderGetter); ok {
+		iics.proxyHeader = pg.ProxyHeader()
+	}
+
 	if ce := iics.CanLogInfo("New Accepted Conn"); ce != nil {
 		var addrstr string
 
@@ -247,10 +267,18 @@ func handleNewIncomeConnection(inServer proxy.Server, defaultClientForThis proxy
 			addrstr = wrappedConn.RemoteAddr().String()
 
 		}
-		ce.Write(
-			zap.String("from", addrstr),
-			zap.String("handler", proxy.GetVSI_url(inServer, "")),
-		)
+		if iics.proxyHeader != nil {
+			ce.Write(
+				zap.String("from", addrstr),
+				zap.String("handler", proxy.GetVSI_url(inServer, "")),
+				zap.Uint8("PROXY protocol", iics.proxyHeader.Version),
+			)
+		} else {
+			ce.Write(
+				zap.String("from", addrstr),
+				zap.String("handler", proxy.GetVSI_url(inServer, "")),
+			)
+		}
 
 		iics.cachedRemoteAddr = addrstr
 	}
@@ -500,6 +528,12 @@ func handshakeInserver(iics *incomingInserverConnState) (wlc net.Conn, udp_wlc n
 
 		return
 	}
+	if udp_wlc != nil {
+		//如 开启了 datagram 的 quic, udp数据 会 改用 datagram 传输
+		if dc, ok := iics.wrappedConn.(advLayer.DatagramConn); ok {
+			udp_wlc = dc.WrapMsgConn(udp_wlc)
+		}
+	}
 	if udp_wlc != nil && inServer.Name() == "socks5" {
 		// socks5的 udp associate返回的是 clientFutureAddr, 而不是实际客户的第一个请求.
 		//所以我们要读一次才能进行下一步。
@@ -559,7 +593,7 @@ func handshakeInserver(iics *incomingInserverConnState) (wlc net.Conn, udp_wlc n
 		go func() {
 
 			for {
-				if ce := iics.CanLogDebug("Try inServer accept smux stream "); ce != nil {
+				if ce := iics.CanLogDebug("Try inServer accept mux stream "); ce != nil {
 					ce.Write()
 				}
 
@@ -577,8 +611,22 @@ func handshakeInserver(iics *incomingInserverConnState) (wlc net.Conn, udp_wlc n
 				}
 
 				go func() {
-
-					wlc1, udp_wlc1, targetAddr1, err1 := innerSer.Handshake(stream)
+					var wlc1 net.Conn
+					var udp_wlc1 netLayer.MsgConn
+					var targetAddr1 netLayer.Addr
+					var err1 error
+
+					if as, ok := stream.(innermux.AddrStream); ok {
+						//mux.cool 的 子连接 自带 目标地址, 没有 内层代理协议
+						targetAddr1 = as.Target()
+						if targetAddr1.IsUDP() {
+							udp_wlc1 = as.(netLayer.MsgConn)
+						} else {
+							wlc1 = as
+						}
+					} else {
+						wlc1, udp_wlc1, targetAddr1, err1 = innerSer.Handshake(stream)
+					}
 
 					if err1 != nil {
 						if ce := iics.CanLogDebug("Failed inServer mux inner proxy handshake"); ce != nil {
@@ -869,7 +917,9 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 		} else {
 
-			if !isudp && wlc != nil {
+			_, isBind := wlc.(proxy.BindRequest)
+
+			if !isudp && wlc != nil && !isBind { //bind 时 客户端 在 收到 第二个回复 之前 不会 发送 数据
 
 				bs := utils.GetMTU()
 
@@ -997,6 +1047,7 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 				}
 
 				targetAddr.Name = sni
+				iics.sniffedDomain = sni
 			}
 		}
 
@@ -1018,6 +1069,7 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 		if ip != nil {
 			targetAddr.IP = ip
+			iics.dnsResolved = true
 
 			if ce2 := iics.CanLogDebug("Dns result"); ce2 != nil {
 				ce2.Write(zap.String("domain", targetAddr.Name), zap.String("ip", ip.String()))
@@ -1048,6 +1100,9 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 		} else if uc, ok := udp_wlc.(utils.User); ok {
 			desc.UserIdentityStr = uc.IdentityStr()
 		}
+		if sa, err := netLayer.NewAddr(iics.getRealRAddr()); err == nil {
+			desc.Source = sa
+		}
 
 		if ce := iics.CanLogDebug("Try routing"); ce != nil {
 			ce.Write(zap.Any("source", desc))
@@ -1095,6 +1150,11 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 	////////////////////////////// 特殊处理阶段 /////////////////////////////////////
 
+	if br, ok := wlc.(proxy.BindRequest); ok {
+		relayBind(iics, client, br, targetAddr)
+		return
+	}
+
 	// 下面几段用于处理 tls lazy
 
 	var isTlsLazy_clientEnd bool
@@ -1163,8 +1223,56 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 	dialClient_andRelay(iics, targetAddr, client, isTlsLazy_clientEnd, wlc, udp_wlc)
 }
 
+// 处理 socks 的 BIND 请求. 只有 实现了 proxy.BindClient 的 client (即 direct) 才能 处理.
+func relayBind(iics incomingInserverConnState, client proxy.Client, br proxy.BindRequest, targetAddr netLayer.Addr) {
+	defer br.Close()
+
+	bc, ok := client.(proxy.BindClient)
+	if !ok {
+		if ce := iics.CanLogWarn("Got bind request but client doesn't support bind"); ce != nil {
+			ce.Write(
+				zap.String("target", targetAddr.String()),
+				zap.String("client", proxy.GetFullName(client)),
+			)
+		}
+		br.WriteBindReply(netLayer.Addr{}, utils.ErrUnImplemented)
+		return
+	}
+
+	rc, err := bc.Bind(br, targetAddr)
+	if err != nil {
+		if ce := iics.CanLogErr("Bind failed"); ce != nil {
+			ce.Write(
+				zap.String("target", targetAddr.String()),
+				zap.Error(err),
+			)
+		}
+		return
+	}
+
+	if ce := iics.CanLogInfo("Bind accepted"); ce != nil {
+		ce.Write(
+			zap.String("target", targetAddr.String()),
+			zap.String("from", rc.RemoteAddr().String()),
+		)
+	}
+
+	if gi := iics.GlobalInfo; gi != nil {
+		atomic.AddInt32(&gi.ActiveConnectionCount, 1)
+		tc := iics.trackConn(client, targetAddr, br, nil, rc, br)
+
+		netLayer.RelayWithCounter(&targetAddr, rc, br, iics.id, &gi.AllDownloadBytesSinceStart, &gi.AllUploadBytesSinceStart, &tc.counter)
+
+		iics.untrackConn(tc)
+		atomic.AddInt32(&gi.ActiveConnectionCount, -1)
+	} else {
+		netLayer.Relay(&targetAddr, rc, br, iics.id, nil, nil)
+	}
+}
+
 // dialClient 对实际client进行拨号，处理传输层, tls层, 高级层等所有层级后，进行代理层握手。
 // result = 0 表示拨号成功, result = -1 表示 拨号失败, result = 1 表示 拨号成功 并 已经自行处理了转发阶段(用于lazy和 innerMux ); -10 标识 因为 client为reject 而关闭了连接。
+// result = -2 表示 直接 拨号 targetAddr 本身 失败 (没有 经过 代理服务器), 此时 可以 换一个 目标 重试.
 // 在 dialClient_andRelay 中被调用。在udp为multi channel时也有用到.
 func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 	client proxy.Client,
@@ -1203,10 +1311,20 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 
 			//先过滤掉 innermux 通道已经建立的情况, 此时我们不必再次外部拨号，而是直接进行内层拨号.
 
-			client.Lock()
-
-			if client.InnerMuxEstablished() {
-				client.Unlock()
+			//在实测时 发现，可能出现并发问题，比如在加载图多的网页时，很容易碰到
+			//此时如果是两个连接同时 发出，而且 尚未 建立 innerMux, 两个连接 会同时 试图拨号 innerMux,
+			// 拨号 超过 extra.mux_maxConnections 个 innerMux 连接。
+			//所以 PickInnerMuxSession 返回 nil 时 会 预留 拨号名额, 名额 用完后 其它连接 会 复用 已有的 session 或 等待 拨号完成;
+			// 拨号 本身 不持有 任何锁, 拨号 结束后 要 释放 名额.
+
+			//选出的 session 直接 用于 dialInnerProxy, 不要 再 选一次, 因为 session池 可能 已经 改变.
+			// 选出的 session 失败 时 再选 一次, 失败的 session 若 已被移除, 就会 拨号 新的.
+			for i := 0; ; i++ {
+				muxSession := client.PickInnerMuxSession()
+				if muxSession == nil {
+					defer client.InnerMuxDialDone()
+					break
+				}
 
 				if ce := iics.CanLogInfo("Mux Request"); ce != nil {
 
@@ -1217,7 +1335,7 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 					)
 				}
 
-				wrc1, realudp_wrc, result1 := dialInnerProxy(iics, client, wlc, nil, innerProxyName, targetAddr, isudp)
+				wrc1, realudp_wrc, result1 := dialInnerProxy(iics, client, wlc, nil, muxSession, innerProxyName, targetAddr, isudp)
 
 				if result1 == 0 {
 					if wrc1 != nil {
@@ -1228,23 +1346,14 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 					}
 					result = result1
 					return
-				} else {
-					if ce := iics.CanLogDebug("Failed in client inner mux dialing innerProxy , will redial"); ce != nil {
-						ce.Write()
-					}
 				}
-
-			} else {
-				//在实测时 发现，可能出现并发问题，比如在加载图多的网页时，很容易碰到
-				//此时如果是两个连接同时 发出，而且 尚未 建立 innerMux，
-				// 则如果不加锁的话 ，两个连接 会同时 获取到 client.InnerMuxEstablished() 为 false
-				// 这会导致同时试图拨号 innerMux，而这是错误的
-				//我们只允许有一个 innerMux 连接存在，如果有多个的话，那么最新拨号的innerMux 会覆盖以前的拨号，
-				// 导致 以前的 innerMux 成为了 悬垂连接，而且会导致 相关联的请求卡住。
-
-				// 所以使用defer, 来确保同一时间只有一个smux的拨号
-
-				defer client.Unlock()
+				if i > 0 {
+					result = result1
+					return
+				}
+				if ce := iics.CanLogDebug("Failed in client inner mux dialing innerProxy , will retry"); ce != nil {
+					ce.Write()
+				}
 			}
 		}
 	}
@@ -1302,15 +1411,30 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 
 	var dialedCommonConn any
 
+	fromWarmPool := false //clientConn 是否 取自 预连接池
+
+	//预连接 在 探测后 依然 可能 被 服务端 关闭, 所以 在其上 握手 失败 时 关闭 它 并 重新拨号, 返回 是否 拨号成功
+	redialWarmConn := func() bool {
+		if ce := iics.CanLogDebug("Handshake on preconnected conn failed, redial"); ce != nil {
+			ce.Write(zap.String("target", realTargetAddr.String()))
+		}
+		clientConn.Close()
+		fromWarmPool = false
+
+		var e error
+		clientConn, _, e = dialWarmConn(client, realTargetAddr, iics.dnsMachine())
+		return e == nil
+	}
+
 	switch realTargetAddr.Network {
 	case netLayer.DualNetworkName:
 		realTargetAddr.Network = targetAddr.Network
 	}
 
-	dialhere := !(client.Name() == proxy.DirectName)
+	dialhere := !client.SelfDial()
 
 	/*
-		direct的udp是自己拨号的，因为它用到了udp的fullcone
+		direct的udp是自己拨号的，因为它用到了udp的fullcone; wireguard 则 通过 自己的 用户态网络栈 拨号
 
 		不是的话，也要分情况:
 		如果是单路的, 则我们在此dial, 如果是多路复用, 则不行, 因为要复用同一个连接
@@ -1352,6 +1476,24 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 			}
 		}
 
+		if iics.canUseWarmPool(client, realTargetAddr, isTlsLazy_clientEnd) {
+			pool := client.GetBase().WarmPool
+
+			rta, dm := realTargetAddr, iics.dnsMachine()
+			pool.SetDialFunc(func() (net.Conn, net.Conn, error) {
+				return dialWarmConn(client, rta, dm)
+			})
+
+			if c := pool.Get(); c != nil {
+				if ce := iics.CanLogDebug("Got preconnected conn from WarmPool"); ce != nil {
+					ce.Write(zap.String("target", realTargetAddr.String()))
+				}
+				clientConn = c
+				fromWarmPool = true
+				goto shakeStep
+			}
+		}
+
 		var na net.Addr
 		switch realTargetAddr.Network {
 		case "tcp":
@@ -1360,7 +1502,7 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 			na = client.LocalUDPAddr()
 		}
 
-		clientConn, err = realTargetAddr.Dial(client.GetSockopt(), na)
+		clientConn, err = realTargetAddr.DialWithResolver(client.GetSockopt(), na, iics.dnsMachine(), client.GetDomainStrategy())
 
 		if err != nil {
 			if err == netLayer.ErrMachineCantConnectToIpv6 {
@@ -1382,6 +1524,35 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 				}
 			}
 			result = -1
+			if client.AddrStr() == "" {
+				result = -2
+			}
+			return
+		}
+
+	} else if !isudp && client.Name() == proxy.DirectName {
+		//direct 的 tcp 也在这里拨号, 这样 可以 通过 DNSMachine 进行 Happy Eyeballs 拨号, 也可以 写入 PROXY protocol 头
+
+		dialAddr := targetAddr
+		if iics.dnsResolved {
+			//dns解析阶段 只取了 一个ip 用于分流, 拨号时 重新 按 DomainStrategy 解析, 以便 尝试 所有地址
+			dialAddr.IP = nil
+		}
+
+		var na net.Addr
+		if lta := client.LocalTCPAddr(); lta != nil {
+			na = lta
+		}
+
+		clientConn, err = dialAddr.DialWithResolver(client.GetSockopt(), na, iics.dnsMachine(), client.GetDomainStrategy())
+		if err != nil {
+			if ce := iics.CanLogWarn("Failed dialing"); ce != nil {
+				ce.Write(
+					zap.String("target", dialAddr.String()),
+					zap.Error(err),
+				)
+			}
+			result = -2
 			return
 		}
 
@@ -1389,7 +1560,7 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 		goto shakeStep
 	}
 
-	if xver := iics.fallbackXver; xver > 0 && xver < 3 {
+	if xver := iics.tcpXver(client, dialhere); xver > 0 && xver < 3 && wlc != nil {
 		if clientConn == nil {
 			clientConn, err = realTargetAddr.Dial(nil, nil)
 
@@ -1399,7 +1570,7 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 			}
 		}
 
-		_, err = netLayer.WritePROXYprotocol(xver, wlc, clientConn)
+		_, err = netLayer.WritePROXYprotocolWithTLVs(xver, wlc, clientConn, iics.proxyTLVs())
 
 		if err != nil {
 			if ce := iics.CanLogErr("Failed in WritePROXYprotocol"); ce != nil {
@@ -1439,7 +1610,12 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 			}
 		}
 
-		tlsConn, err2 := client.GetTLS_Client().Handshake(clientConn)
+		tlsClient := client.GetTLS_Client()
+		if tlsClient.NeedECHResolver() && iics.routingEnv != nil && iics.routingEnv.DnsMachine != nil {
+			tlsClient.SetECHResolver(iics.routingEnv.DnsMachine)
+		}
+
+		tlsConn, err2 := tlsClient.Handshake(clientConn)
 		if err2 != nil {
 			if ce := iics.CanLogErr("Failed in handshake outClient tls"); ce != nil {
 				ce.Write(zap.String("target", targetAddr.String()), zap.Error(err2))
@@ -1577,6 +1753,9 @@ shakeStep:
 		}
 
 		wrc, err = client.Handshake(clientConn, ed, targetAddr)
+		if err != nil && fromWarmPool && redialWarmConn() {
+			wrc, err = client.Handshake(clientConn, ed, targetAddr)
+		}
 		if err != nil {
 			if ce := iics.CanLogErr("Failed in Handshake client"); ce != nil {
 				ce.Write(
@@ -1595,7 +1774,30 @@ shakeStep:
 			theAddr = iics.udpFirstTarget
 		}
 
-		udp_wrc, err = client.EstablishUDPChannel(clientConn, iics.firstPayload, theAddr)
+		//direct 的 xver 为2 时, 在 每个 udp包 前 加上 PROXY protocol 头; 所以 firstPayload 要在 包装后 再写入
+		var proxyMC *netLayer.PROXYMsgConn
+		var ed = iics.firstPayload
+		if client.Name() == proxy.DirectName && client.GetXver() > 0 {
+			if client.GetXver() == 2 {
+				src, _ := netLayer.NewAddr(iics.getRealRAddr())
+				proxyMC = &netLayer.PROXYMsgConn{Src: src, TLVs: iics.proxyTLVs()}
+				ed = nil
+			} else if ce := iics.CanLogWarn("PROXY protocol v1 doesn't support udp, ignored"); ce != nil {
+				ce.Write(zap.String("client", client.GetTag()))
+			}
+		}
+
+		udp_wrc, err = client.EstablishUDPChannel(clientConn, ed, theAddr)
+		if err != nil && fromWarmPool && redialWarmConn() {
+			udp_wrc, err = client.EstablishUDPChannel(clientConn, ed, theAddr)
+		}
+		if err == nil && proxyMC != nil {
+			proxyMC.MsgConn = udp_wrc
+			udp_wrc = proxyMC
+			if len(iics.firstPayload) > 0 {
+				err = udp_wrc.WriteMsg(iics.firstPayload, theAddr)
+			}
+		}
 		if err != nil {
 			if ce := iics.CanLogErr("Failed in EstablishUDPChannel"); ce != nil {
 				ce.Write(
@@ -1606,33 +1808,65 @@ shakeStep:
 			result = -1
 			return
 		}
+
+		if dc, ok := clientConn.(advLayer.DatagramConn); ok {
+			udp_wrc = dc.WrapMsgConn(udp_wrc)
+		}
 	}
 
 	////////////////////////////// 建立内层 mux 阶段 /////////////////////////////////////
 	if hasInnerMux {
-		//我们目前的实现中，mux统一使用smux v1, 即 smux.DefaultConfig返回的值。这可以兼容trojan-go的实现。
+		//mux 默认使用 smux v1, 这可以兼容trojan-go的实现; 也可以通过 extra.mux_type 选用 smux2, yamux, h2mux, 见 proxy/innermuxConfig.go
 
-		wrc, udp_wrc, result = dialInnerProxy(iics, client, wlc, wrc, innerProxyName, targetAddr, isudp)
+		wrc, udp_wrc, result = dialInnerProxy(iics, client, wlc, wrc, nil, innerProxyName, targetAddr, isudp)
 	}
 
 	return
 } //dialClient
 
 // 在 dialClient 中调用。 如果调用不成功，则result < 0. 若成功, 则 result == 0.
-func dialInnerProxy(iics incomingInserverConnState, client proxy.Client, wlc net.Conn, wrc io.ReadWriteCloser, innerProxyName string, targetAddr netLayer.Addr, isudp bool) (realwrc io.ReadWriteCloser, realudp_wrc netLayer.MsgConn, result int) {
+// muxSession 为 nil 时, 在 wrc 上 新建 session.
+func dialInnerProxy(iics incomingInserverConnState, client proxy.Client, wlc net.Conn, wrc io.ReadWriteCloser, muxSession innermux.Session, innerProxyName string, targetAddr netLayer.Addr, isudp bool) (realwrc io.ReadWriteCloser, realudp_wrc netLayer.MsgConn, result int) {
 
-	smuxSession := client.GetClientInnerMuxSession(wrc)
-	if smuxSession == nil {
+	if muxSession == nil {
+		muxSession = client.GetClientInnerMuxSession(wrc)
+	}
+	if muxSession == nil {
 		result = -1
-		if ce := iics.CanLogErr("Failed dialInnerProxy, smuxSession == nil"); ce != nil {
+		if ce := iics.CanLogErr("Failed dialInnerProxy, muxSession == nil"); ce != nil {
 			ce.Write()
 		}
 		return
 	}
 
-	stream, err := smuxSession.OpenStream()
+	//mux.cool 的 子连接 自带 目标地址, 不需要 内层代理
+	if as, ok := muxSession.(innermux.AddrSession); ok {
+		var err error
+		if isudp {
+			theAddr := targetAddr
+			if len(iics.firstPayload) > 0 {
+				theAddr = iics.udpFirstTarget
+			}
+			realudp_wrc, err = as.DialUDP(theAddr, iics.firstPayload)
+		} else {
+			var c net.Conn
+			c, err = as.DialTCP(targetAddr, iics.firstPayload)
+			if err == nil {
+				realwrc = c
+			}
+		}
+		if err != nil {
+			if ce := iics.CanLogWarn("Failed dialInnerProxy with mux.cool"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			result = -1
+		}
+		return
+	}
+
+	stream, err := muxSession.OpenStream()
 	if err != nil {
-		client.CloseInnerMuxSession() //发现就算 OpenStream 失败, session也不会自动被关闭, 需要我们手动关一下。
+		client.CloseInnerMuxSession(muxSession) //发现就算 OpenStream 失败, session也不会自动被关闭, 需要我们手动关一下。
 
 		if ce := iics.CanLogWarn("Failed dialInnerProxy"); ce != nil {
 			ce.Write(zap.Error(err))
@@ -1705,12 +1939,38 @@ func dialClient_andRelay(iics incomingInserverConnState, targetAddr netLayer.Add
 	}
 
 	wrc, udp_wrc, realTargetAddr, clientEndRemoteClientTlsRawReadRecorder, result := dialClient(iics, targetAddr, client, wlc, udp_wlc, isTlsLazy_clientEnd)
+
+	//有 多个 目标 的 inServer, 直接 拨号 目标 失败 时 换 下一个 目标 重试.
+	// 经过 代理服务器 时 失败的 可能 是 代理服务器, 换 目标 没有 意义, 所以 不 重试
+	if fs, ok := iics.inServer.(proxy.FailoverServer); ok && !targetAddr.IsUDP() {
+		for tried := 1; result == -2; tried++ {
+			if wrc != nil {
+				wrc.Close()
+			}
+			if udp_wrc != nil {
+				udp_wrc.Close()
+			}
+			next, ok := fs.NextTarget(targetAddr, tried)
+			if !ok {
+				break
+			}
+			if ce := iics.CanLogInfo("dial failed, try next target"); ce != nil {
+				ce.Write(zap.String("failed", targetAddr.String()), zap.String("next", next.String()))
+			}
+			targetAddr = next
+			wrc, udp_wrc, realTargetAddr, clientEndRemoteClientTlsRawReadRecorder, result = dialClient(iics, targetAddr, client, wlc, udp_wlc, isTlsLazy_clientEnd)
+		}
+	}
 	if result != 0 {
 		return
 	}
 
 	////////////////////////////// 实际转发阶段 /////////////////////////////////////
 
+	//记录该连接, 以便 查询 和 关闭. tls lazy 时 无法 统计 流量, 但 依然 可以 关闭.
+	tc := iics.trackConn(client, targetAddr, wlc, udp_wlc, wrc, wlc, udp_wrc, udp_wlc)
+	defer iics.untrackConn(tc)
+
 	if !targetAddr.IsUDP() {
 
 		if !iics.routedToDirect {
@@ -1743,7 +2003,7 @@ func dialClient_andRelay(iics incomingInserverConnState, targetAddr netLayer.Add
 		if gi := iics.GlobalInfo; gi != nil {
 			atomic.AddInt32(&gi.ActiveConnectionCount, 1)
 
-			netLayer.Relay(&realTargetAddr, wrc, wlc, iics.id, &gi.AllDownloadBytesSinceStart, &gi.AllUploadBytesSinceStart)
+			netLayer.RelayWithCounter(&realTargetAddr, wrc, wlc, iics.id, &gi.AllDownloadBytesSinceStart, &gi.AllUploadBytesSinceStart, &tc.counter)
 
 			atomic.AddInt32(&gi.ActiveConnectionCount, -1)
 		} else {
@@ -1768,6 +2028,7 @@ func dialClient_andRelay(iics incomingInserverConnState, targetAddr netLayer.Add
 			auc = &iics.GlobalInfo.AllUploadBytesSinceStart
 			atomic.AddInt32(ac, 1)
 
+			udp_wlc = netLayer.CountMsgConn{MsgConn: udp_wlc, Counter: &tc.counter}
 		}
 
 		if client.IsUDP_MultiChannel() {
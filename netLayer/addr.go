@@ -601,6 +601,40 @@ func ParseStrToAddr(s string) (atyp byte, addr []byte, port_uint16 uint16, err e
 	return
 }
 
+// 解析 端口列表, 如 "443,8443,20000-30000", 返回的 端口 按 给出的顺序 排列.
+func ParsePortList(s string) (ports []int, err error) {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+
+		var start, end int
+		start, err = strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "ParsePortList failed", ErrDetail: err, Data: part}
+		}
+		end = start
+		if isRange {
+			end, err = strconv.Atoi(strings.TrimSpace(to))
+			if err != nil {
+				return nil, utils.ErrInErr{ErrDesc: "ParsePortList failed", ErrDetail: err, Data: part}
+			}
+		}
+		if start <= 0 || end > 65535 || start > end {
+			return nil, utils.ErrInErr{ErrDesc: "ParsePortList failed, invalid port range", ErrDetail: utils.ErrInvalidData, Data: part}
+		}
+		for p := start; p <= end; p++ {
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "ParsePortList failed, no port given", ErrDetail: utils.ErrInvalidData, Data: s}
+	}
+	return
+}
+
 func UDPAddr_v4_to_Bytes(addr *net.UDPAddr) [6]byte {
 	ip := addr.IP.To4()
 
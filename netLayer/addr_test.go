@@ -40,3 +40,19 @@ func TestUrl(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestParsePortList(t *testing.T) {
+	ports, err := netLayer.ParsePortList("443, 8443,20000-20002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 5 || ports[0] != 443 || ports[1] != 8443 || ports[2] != 20000 || ports[4] != 20002 {
+		t.Fatal("wrong result", ports)
+	}
+
+	for _, s := range []string{"", "0", "70000", "30-20", "a-b", "1-"} {
+		if _, err := netLayer.ParsePortList(s); err == nil {
+			t.Fatal("should fail", s)
+		}
+	}
+}
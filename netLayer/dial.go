@@ -1,9 +1,9 @@
 package netLayer
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
-	"syscall"
 	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
@@ -25,7 +25,14 @@ const (
 // 如果找不到，则会使用net包的方法进行拨号（其会返回错误）。
 //
 // localAddr可为nil，如果不为nil，则其为 为 拨号 所指定的 本地地址。
+//
+// tcp 拨号 域名 时 使用 Happy Eyeballs, 见 DialWithResolver.
 func (a *Addr) Dial(sockopt *Sockopt, localAddr net.Addr) (net.Conn, error) {
+	return a.DialWithResolver(sockopt, localAddr, nil, DomainAsIs)
+}
+
+// 同 Dial, 但 tcp 拨号 只有域名 的 地址 时, 使用 dm 解析 (dm 为nil 则 使用 系统解析), 并 按 ds 以 Happy Eyeballs 的方式 拨号.
+func (a *Addr) DialWithResolver(sockopt *Sockopt, localAddr net.Addr, dm *DNSMachine, ds DomainStrategy) (net.Conn, error) {
 	var istls bool
 	var resultConn net.Conn
 	var err error
@@ -98,6 +105,16 @@ tcp:
 
 	}
 
+	if a.Name != "" && a.Port != 0 {
+		resultConn, err = DialTCPHappyEyeballs(a.Network, a.Name, a.Port, sockopt, localAddr, dm, ds)
+		if err == nil {
+			if tc, ok := resultConn.(*net.TCPConn); ok {
+				tc.SetWriteBuffer(utils.MaxPacketLen)
+			}
+		}
+		goto dialedPart
+	}
+
 defaultPart:
 	if istls {
 		//若tls到达了这里，则说明a的ip没有给出，而只给出了域名，所以上面tcp部分没有直接拨号
@@ -176,11 +193,21 @@ func (a Addr) DialWithOpt(sockopt *Sockopt, localAddr net.Addr) (net.Conn, error
 		}
 	}
 	if sockopt != nil {
-		dialer.Control = func(network, address string, c syscall.RawConn) error {
-			return c.Control(func(fd uintptr) {
-				SetSockOpt(int(fd), sockopt, a.IsUDP(), a.IsIpv6())
+		setDialerSockopt(dialer, sockopt, a.IsUDP(), a.IsIpv6())
 
-			})
+		if sockopt.MPTCP && !a.IsUDP() {
+			if a.IP == nil && a.Name != "" && a.Port != 0 {
+				//域名 需要 先解析 才能 拨号 mptcp, Happy Eyeballs 会 对 每个 解析到的 ip 尝试 mptcp
+				return DialTCPHappyEyeballs(a.Network, a.Name, a.Port, sockopt, localAddr, nil, DomainAsIs)
+			}
+			if a.IP != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+				defer cancel()
+
+				if c, ok, err := tryDialMPTCP(ctx, &net.TCPAddr{IP: a.IP, Port: a.Port}, localAddr, sockopt); ok {
+					return c, err
+				}
+			}
 		}
 	}
 
@@ -55,6 +55,16 @@ func Is_DNSQuery_returnType_ReadFatalErr(err error) bool {
 // 如果从conn中Read后成功返回, 则可能返回如下几种错误 os.ErrNotExist (表示查无此记录), dns.ErrRcode (表示dns返回的 Rcode 不是 dns.RcodeSuccess), ErrRecursion,
 // 如果不是这三个error, 那就是 从 该 conn 读取数据时出错了.
 func DNSQuery(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex, recursionCount int) (ip net.IP, ttl uint32, err error) {
+	var ips []net.IP
+	ips, ttl, err = DNSQueryAll(domain, dns_type, conn, theMux, recursionCount)
+	if len(ips) > 0 {
+		ip = ips[0]
+	}
+	return
+}
+
+// 同 DNSQuery, 但 返回 回复中 所有的 A 或 AAAA 记录, ttl 为 其中 最小的 ttl.
+func DNSQueryAll(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex, recursionCount int) (ips []net.IP, ttl uint32, err error) {
 	m := new(dns.Msg)
 	m.SetQuestion((domain), dns_type) //为了更快，不使用 dns.Fqdn, 请调用之前先确保ok
 	c := new(dns.Client)
@@ -86,23 +96,28 @@ func DNSQuery(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex
 		return
 	}
 
-	switch dns_type {
-	case dns.TypeA:
-		for _, a := range r.Answer {
-			if aa, ok := a.(*dns.A); ok {
+	for _, a := range r.Answer {
+		var ip net.IP
+		switch aa := a.(type) {
+		case *dns.A:
+			if dns_type == dns.TypeA {
 				ip = aa.A
-				ttl = aa.Hdr.Ttl
-				return
 			}
-		}
-	case dns.TypeAAAA:
-		for _, a := range r.Answer {
-			if aa, ok := a.(*dns.AAAA); ok {
+		case *dns.AAAA:
+			if dns_type == dns.TypeAAAA {
 				ip = aa.AAAA
-				ttl = aa.Hdr.Ttl
-				return
 			}
 		}
+		if ip == nil {
+			continue
+		}
+		if len(ips) == 0 || a.Header().Ttl < ttl {
+			ttl = a.Header().Ttl
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) > 0 {
+		return
 	}
 
 	//没A和4A那就查cname在不在
@@ -121,7 +136,7 @@ func DNSQuery(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex
 				err = ErrRecursion
 				return
 			}
-			return DNSQuery(dns.Fqdn(aa.Target), dns_type, conn, theMux, recursionCount+1)
+			return DNSQueryAll(dns.Fqdn(aa.Target), dns_type, conn, theMux, recursionCount+1)
 		}
 	}
 
@@ -143,10 +158,17 @@ type DnsConn struct {
 
 type IPRecord struct {
 	IP         net.IP
-	TTL        uint32 //seconds
+	IPs        []net.IP //该域名 该类型 的 全部记录, IP 为 其 第一个
+	TTL        uint32   //seconds
 	RecordTime time.Time
 }
 
+// DNSMachine 的 缓存 的 键, A 与 AAAA 分开 缓存
+type dnsCacheKey struct {
+	domain string
+	qtype  uint16
+}
+
 // dns machine维持与多个dns服务器的连接(最好是udp这种无状态的)，并可以发起dns请求。
 // 会缓存dns记录; 该设施是一个状态机, 所以叫 DNSMachine。
 // SpecialIPPollicy 用于指定特殊的 域名-ip 映射，这样遇到这种域名时，不经过dns查询，直接返回预设ip。
@@ -157,12 +179,15 @@ type DNSMachine struct {
 
 	defaultConn DnsConn
 	conns       map[string]*DnsConn
-	cache       map[string]IPRecord //cache的key统一为 未经 Fqdn包装过的域名. 即尾部没有点号
+	cache       map[dnsCacheKey]IPRecord //cache的key中的domain 统一为 未经 Fqdn包装过的域名. 即尾部没有点号
 
 	SpecialIPPollicy map[string][]netip.Addr
 
 	SpecialServerPolicy map[string]string //domain -> dns server name
 
+	Rules     []*DnsRule          //只用于 Answer, 见 dns_rule.go
+	ruleConns map[string]*DnsConn //Rules 中 action 为 server 的 规则 所用的 dns服务器, 不参与 Query
+
 	mutex sync.RWMutex //读写 conns, cache, SpecialIPPollicy, SpecialServerPollicy 时所使用的 mutex
 
 	listening bool
@@ -273,6 +298,16 @@ func (dm *DNSMachine) Query(domain string) (ip net.IP) {
 
 // 传入的domain必须是不带尾缀点号的domain, 即没有包过 Fqdn
 func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl uint32) {
+	var ips []net.IP
+	ips, ttl = dm.QueryTypeAll(domain, dns_type)
+	if len(ips) > 0 {
+		ip = ips[0]
+	}
+	return
+}
+
+// 同 QueryType, 但 返回 该类型 的 全部记录, 用于 Happy Eyeballs 拨号.
+func (dm *DNSMachine) QueryTypeAll(domain string, dns_type uint16) (ips []net.IP, ttl uint32) {
 	var generalCacheHit bool // 若读到了 cache 或 SpecialIPPollicy 的项, 则 generalCacheHit 为 true
 
 	var theDNSServerConn *DnsConn
@@ -305,24 +340,24 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 		if generalCacheHit {
 
 			if ce := utils.CanLogDebug("[DNSMachine] hit cache"); ce != nil {
-				ce.Write(zap.String("domain", domain), zap.String("ip", ip.String()))
+				ce.Write(zap.String("domain", domain), zap.Any("ips", ips))
 			}
 			return
 		}
 
-		if len(ip) > 0 {
+		if len(ips) > 0 {
 			domain = strings.TrimSuffix(domain, ".")
 			if ce := utils.CanLogDebug("[DNSMachine] will add to cache"); ce != nil {
-				ce.Write(zap.String("domain", domain), zap.String("ip", ip.String()))
+				ce.Write(zap.String("domain", domain), zap.Any("ips", ips))
 			}
 
 			dm.mutex.Lock()
 			if dm.cache == nil {
 
-				dm.cache = make(map[string]IPRecord)
+				dm.cache = make(map[dnsCacheKey]IPRecord)
 			}
 
-			dm.cache[domain] = IPRecord{IP: ip, TTL: ttl, RecordTime: time.Now()}
+			dm.cache[dnsCacheKey{domain, dns_type}] = IPRecord{IP: ips[0], IPs: ips, TTL: ttl, RecordTime: time.Now()}
 			dm.mutex.Unlock()
 		}
 	}()
@@ -338,7 +373,7 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 	if dm.cache != nil {
 
 		dm.mutex.RLock()
-		ipRecord, ok := dm.cache[domain]
+		ipRecord, ok := dm.cache[dnsCacheKey{domain, dns_type}]
 		dm.mutex.RUnlock()
 
 		if ok {
@@ -360,14 +395,17 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 			}
 
 			if ok {
-				ip = ipRecord.IP
+				ips = ipRecord.IPs
+				if len(ips) == 0 {
+					ips = []net.IP{ipRecord.IP}
+				}
 				generalCacheHit = true
 
 				return
 
 			} else {
 				dm.mutex.Lock()
-				delete(dm.cache, domain)
+				delete(dm.cache, dnsCacheKey{domain, dns_type})
 				dm.mutex.Unlock()
 			}
 		}
@@ -379,25 +417,20 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 	if dm.SpecialIPPollicy != nil {
 		if na := dm.SpecialIPPollicy[domain]; len(na) > 0 {
 
-			switch dns_type {
-			case dns.TypeA:
-				for _, a := range na {
-
-					if a.Is4() || a.Is4In6() {
-						aa := a.As4()
-						generalCacheHit = true
-						return aa[:], uint32(dm.TTLStrategy)
-					}
-				}
-			case dns.TypeAAAA:
-				for _, a := range na {
-					if a.Is6() {
-						aa := a.As16()
-						generalCacheHit = true
-						return aa[:], uint32(dm.TTLStrategy)
-					}
+			for _, a := range na {
+				switch {
+				case dns_type == dns.TypeA && (a.Is4() || a.Is4In6()):
+					aa := a.As4()
+					ips = append(ips, aa[:])
+				case dns_type == dns.TypeAAAA && a.Is6() && !a.Is4In6():
+					aa := a.As16()
+					ips = append(ips, aa[:])
 				}
 			}
+			if len(ips) > 0 {
+				generalCacheHit = true
+				return ips, uint32(dm.TTLStrategy)
+			}
 
 		}
 	}
@@ -428,7 +461,7 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 	}
 	var err error
 
-	ip, ttl, err = DNSQuery(domain, dns_type, theDNSServerConn.Conn, &theDNSServerConn.mutex, 0)
+	ips, ttl, err = DNSQueryAll(domain, dns_type, theDNSServerConn.Conn, &theDNSServerConn.mutex, 0)
 
 	if Is_DNSQuery_returnType_ReadFatalErr(err) {
 		//如果是读取的、非timeout的错误，那么我们直接认为底层连接出故障了, 我们需要重新dial
@@ -509,41 +542,195 @@ func (dm *DNSMachine) Stop() {
 }
 
 // 实现 miekg/dns.Handler, 用于监听。不要直接调用该方法。
-// 只查第一个question
 func (dm *DNSMachine) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	if r == nil || len(r.Question) == 0 {
 		return
 	}
-	name := r.Question[0].Name
-	qtype := r.Question[0].Qtype
-	noDotName := strings.TrimSuffix(name, ".")
+	w.WriteMsg(dm.Answer(r, w.RemoteAddr()))
+}
+
+/*
+Answer 应答 来自 src 的 dns请求 r, 只看 第一个 question. 用于 dns监听 以及 tun/tproxy 的 dns劫持.
+
+先按 Rules 匹配 域名 与 src, 匹配到 则 按 该规则 应答; src 可为 nil, 此时 只有 不限制 来源 的 规则 能匹配.
+
+A/AAAA 通过 QueryTypeAll 查询, 即 会 使用 hosts, 缓存 与 SpecialServerPolicy;
+查不到 时 (如 NXDOMAIN), 以及 其它 类型 的 请求, 通过 Exchange 发往 对应的 dns服务器, 原样 返回 其回复.
+hosts 中 有 该域名 但 没有 所请求 类型 的 记录 时, 返回 空回复, 而不去 上游 查询.
+*/
+func (dm *DNSMachine) Answer(r *dns.Msg, src net.Addr) *dns.Msg {
+	return dm.answer(r, dnsSrcAddr(src), 0)
+}
+
+func (dm *DNSMachine) answer(r *dns.Msg, src Addr, depth int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+
+	if len(r.Question) == 0 {
+		m.Rcode = dns.RcodeFormatError
+		return m
+	}
+	q := r.Question[0]
+	noDotName := strings.TrimSuffix(q.Name, ".")
 
 	if ce := utils.CanLogDebug("Dns got"); ce != nil {
-		ce.Write(zap.String("name", noDotName), zap.Uint16("qtype", qtype))
+		ce.Write(zap.String("name", noDotName), zap.Uint16("qtype", q.Qtype))
 	}
 
-	ip, ttl := dm.QueryType(noDotName, qtype)
+	if rule := dm.matchRule(noDotName, src); rule != nil {
+		if ce := utils.CanLogDebug("Dns rule matched"); ce != nil {
+			ce.Write(zap.String("name", noDotName), zap.String("action", rule.Action))
+		}
+		return dm.answerByRule(rule, r, m, src, depth)
+	}
 
-	if ce := utils.CanLogDebug("Dns ip for"); ce != nil {
-		ce.Write(zap.String("name", noDotName), zap.String("ip", ip.String()))
+	if q.Qclass == dns.ClassINET && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		ips, ttl := dm.QueryTypeAll(noDotName, q.Qtype)
+
+		if len(ips) > 0 || dm.hasSpecialIP(noDotName) {
+			if ce := utils.CanLogDebug("Dns ip for"); ce != nil {
+				ce.Write(zap.String("name", noDotName), zap.Any("ips", ips))
+			}
+
+			if dm.TTLStrategy != 1 {
+				ttl = uint32(dm.TTLStrategy)
+			}
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+			for _, ip := range ips {
+				if q.Qtype == dns.TypeA {
+					m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip})
+				} else {
+					m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+				}
+			}
+			return m
+		}
 	}
 
-	// 构建返回信息
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Authoritative = true
+	resp, err := dm.Exchange(r)
+	if err != nil {
+		if ce := utils.CanLogWarn("Dns exchange failed"); ce != nil {
+			ce.Write(zap.String("name", noDotName), zap.Uint16("qtype", q.Qtype), zap.Error(err))
+		}
+		m.Rcode = dns.RcodeServerFailure
+		return m
+	}
+	resp.Id = r.Id
+	return resp
+}
 
-	var dnsRR []dns.RR
+// target 是否 是 dm 所使用的 某个 dns服务器 的 地址. 以 域名 配置 的 服务器 不会 被 匹配.
+//
+// tun 开启 auto_route 时, dm 自己 向 dns服务器 发出的 请求 也会 进入 tun, 这种 流量 不能 再被 dns劫持, 否则 会 死循环.
+func (dm *DNSMachine) IsServerAddr(target Addr) bool {
+	if target.IP == nil {
+		return false
+	}
+	is := func(dc *DnsConn) bool {
+		return dc != nil && dc.raddr != nil && dc.raddr.Port == target.Port && dc.raddr.IP.Equal(target.IP)
+	}
 
-	rr := new(dns.A)
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
 
-	if dm.TTLStrategy != 1 {
-		ttl = uint32(dm.TTLStrategy)
+	if is(&dm.defaultConn) {
+		return true
+	}
+	for _, dc := range dm.conns {
+		if is(dc) {
+			return true
+		}
 	}
-	rr.Hdr = dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
-	rr.A = ip
-	dnsRR = append(dnsRR, rr)
+	return false
+}
 
-	m.Answer = dnsRR
-	w.WriteMsg(m)
+func (dm *DNSMachine) hasSpecialIP(domain string) bool {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+	return len(dm.SpecialIPPollicy[domain]) > 0
+}
+
+// 按 SpecialServerPolicy 选出 domain 所对应的 dns服务器连接. 传入的domain必须是不带尾缀点号的domain
+func (dm *DNSMachine) serverConnFor(domain string) *DnsConn {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+
+	if len(dm.conns) > 0 && len(dm.SpecialServerPolicy) > 0 {
+		if dnsServerName := dm.SpecialServerPolicy[domain]; dnsServerName != "" {
+			if serConn := dm.conns[dnsServerName]; serConn != nil {
+				return serConn
+			}
+		}
+	}
+	if dm.defaultConn.Conn == nil {
+		return nil
+	}
+	return &dm.defaultConn
+}
+
+// Exchange 将 m 发往 其第一个question 的域名 所对应的 dns服务器, 并返回原始的回复. 不经过缓存.
+//
+// 用于 A/AAAA 以外的 查询, 如 HTTPS, MX, TXT 等.
+func (dm *DNSMachine) Exchange(m *dns.Msg) (r *dns.Msg, err error) {
+	if m == nil || len(m.Question) == 0 {
+		return nil, utils.ErrNilParameter
+	}
+	domain := strings.TrimSuffix(m.Question[0].Name, ".")
+
+	theDNSServerConn := dm.serverConnFor(domain)
+	if theDNSServerConn == nil {
+		return nil, utils.ErrInErr{ErrDesc: "[DNSMachine] no server configured", ErrDetail: os.ErrNotExist}
+	}
+
+	return dm.exchangeWithConn(theDNSServerConn, m)
+}
+
+func (dm *DNSMachine) exchangeWithConn(theDNSServerConn *DnsConn, m *dns.Msg) (r *dns.Msg, err error) {
+	if theDNSServerConn == nil || theDNSServerConn.Conn == nil {
+		return nil, utils.ErrInErr{ErrDesc: "[DNSMachine] no server configured", ErrDetail: os.ErrNotExist}
+	}
+	c := new(dns.Client)
+
+	theDNSServerConn.mutex.Lock()
+	r, _, err = c.ExchangeWithConn(m, theDNSServerConn.Conn)
+	theDNSServerConn.mutex.Unlock()
+
+	if Is_DNSQuery_returnType_ReadFatalErr(err) {
+		theDNSServerConn.Conn.Close()
+		if e := theDNSServerConn.Dial(); e != nil {
+			if ce := utils.CanLogErr("[DNSMachine] Re-Dial Dns Server Failed"); ce != nil {
+				ce.Write(zap.Error(e))
+			}
+		}
+	}
+	return
+}
+
+// 查询 domain 的 HTTPS 记录, 返回其中的 ECHConfigList (即 ech 参数).
+func (dm *DNSMachine) QueryECHConfig(domain string) (echConfigList []byte, ttl uint32, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeHTTPS)
+
+	r, err := dm.Exchange(m)
+	if err != nil {
+		return
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		err = dns.ErrRcode
+		return
+	}
+	for _, a := range r.Answer {
+		h, ok := a.(*dns.HTTPS)
+		if !ok {
+			continue
+		}
+		for _, kv := range h.Value {
+			if ech, ok := kv.(*dns.SVCBECHConfig); ok && len(ech.ECH) > 0 {
+				return ech.ECH, h.Hdr.Ttl, nil
+			}
+		}
+	}
+	err = os.ErrNotExist
+	return
 }
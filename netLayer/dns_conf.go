@@ -15,6 +15,8 @@ type DnsConf struct {
 	TTLStrategy uint32         `toml:"ttl_strategy"` //0表示默认(记录永不过期), 1表示严格按照dns查询到的TTL, 其他值则为自定义的秒数，然后程序会按这个时间周期性清理缓存。
 	Hosts       map[string]any `toml:"hosts"`        //用于强制指定哪些域名会被解析为哪些具体的ip；可以为一个ip字符串，or a []string, 内可以是A,AAAA或CNAME
 	Servers     []any          `toml:"servers"`      //可以为一个地址url字符串，or a SpecialDnsServerConf; 如果第一个元素是url字符串形式，则此第一个元素将会被用作默认dns服务器
+
+	Rules []*DnsRuleConf `toml:"rules"` //作为 dns服务器 时 的 规则, 见 DnsRuleConf
 }
 
 type SpecialDnsServerConf struct {
@@ -178,6 +180,18 @@ func LoadDnsMachine(conf *DnsConf) *DNSMachine {
 		}
 	}
 
+	for i, rc := range conf.Rules {
+		rule, err := dm.LoadDnsRule(rc)
+		if err != nil {
+			if ce := utils.CanLogErr("Err, LoadDnsMachine, load rule failed"); ce != nil {
+				ce.Write(zap.Int("index", i), zap.Error(err))
+			}
+			continue
+		}
+		ok = true
+		dm.Rules = append(dm.Rules, rule)
+	}
+
 	if !ok {
 		return nil
 	}
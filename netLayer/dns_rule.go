@@ -0,0 +1,221 @@
+package netLayer
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+/*
+dns规则 只用于 DNSMachine 作为 dns服务器 (dns监听 与 tun/tproxy 的 dns劫持) 时 的 应答, 不影响 vs 自己 分流 与 拨号 时 的 解析.
+
+规则 按 顺序 匹配, 第一个 匹配的 规则 生效; 都不匹配 时, 照常 通过 hosts, 缓存 与 servers 应答.
+
+	[[dns.rules]]
+	domain = ["geosite:category-ads-all"]   # 格式 同 路由规则 的 domain; 不给出 则 匹配 所有 域名
+	source = ["192.168.1.0/24"]             # 可选, 客户端 来源, 格式 同 路由规则 的 source
+	action = "nxdomain"                     # nxdomain, block, ip, cname 或 server
+*/
+
+const (
+	DnsActionNXDomain = "nxdomain" //返回 NXDOMAIN
+	DnsActionBlock    = "block"    //A 返回 0.0.0.0, AAAA 返回 ::, 其它类型 返回 空回复
+	DnsActionIP       = "ip"       //A/AAAA 返回 给出的 ip 中 对应 类型 的, 其它类型 返回 空回复
+	DnsActionCNAME    = "cname"    //返回 指向 给出的 域名 的 CNAME, 并 附带 该域名 的 查询结果
+	DnsActionServer   = "server"   //原样 转发 给 给出的 dns服务器, 不经过 缓存
+)
+
+// 由 规则 直接 构造 的 回复 的 ttl
+var DnsRuleTTL uint32 = 60
+
+// cname 规则 嵌套 的 最大 层数
+const maxDnsCNAMEDepth = 8
+
+type DnsRuleConf struct {
+	Domains []string `toml:"domain"`
+	Sources []string `toml:"source"`
+
+	Action string   `toml:"action"`
+	IPs    []string `toml:"ip"`     //action 为 ip 时 给出
+	CNAME  string   `toml:"cname"`  //action 为 cname 时 给出
+	Server string   `toml:"server"` //action 为 server 时 给出, 格式 同 servers 中的 url, 如 udp://10.0.0.1:53
+}
+
+type DnsRule struct {
+	*RouteSet //只用到 其 域名 与 来源 的 部分
+
+	Action string
+	IPs    []netip.Addr
+	CNAME  string //Fqdn
+	Server string //dns服务器 的 名称, 即 其url
+}
+
+// 没有 域名 与 来源 限制 时 匹配 所有 请求
+func (rule *DnsRule) Match(domain string, src Addr) bool {
+	return rule.IsSourceIn(src) && rule.IsAddrIn(Addr{Name: domain})
+}
+
+// 载入 一条 规则, 若 需要 会 拨号 其 dns服务器.
+func (dm *DNSMachine) LoadDnsRule(rc *DnsRuleConf) (*DnsRule, error) {
+	rule := &DnsRule{
+		RouteSet: LoadRuleForRouteSet(&RuleConf{Domains: rc.Domains, Sources: rc.Sources}),
+		Action:   strings.ToLower(rc.Action),
+	}
+
+	switch rule.Action {
+	case DnsActionNXDomain, DnsActionBlock:
+	case DnsActionIP:
+		for _, str := range rc.IPs {
+			a, err := netip.ParseAddr(str)
+			if err != nil {
+				return nil, utils.ErrInErr{ErrDesc: "dns rule ip invalid", ErrDetail: err, Data: str}
+			}
+			rule.IPs = append(rule.IPs, a.Unmap())
+		}
+		if len(rule.IPs) == 0 {
+			return nil, utils.ErrInErr{ErrDesc: "dns rule ip required", ErrDetail: utils.ErrInvalidData}
+		}
+	case DnsActionCNAME:
+		if rc.CNAME == "" {
+			return nil, utils.ErrInErr{ErrDesc: "dns rule cname required", ErrDetail: utils.ErrInvalidData}
+		}
+		rule.CNAME = dns.Fqdn(rc.CNAME)
+	case DnsActionServer:
+		addr, err := NewAddrByURL(rc.Server)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "dns rule server url invalid", ErrDetail: err, Data: rc.Server}
+		}
+		if err = dm.addSpecialServer(rc.Server, &addr); err != nil {
+			return nil, err
+		}
+		rule.Server = rc.Server
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "dns rule action unknown", ErrDetail: utils.ErrInvalidData, Data: rc.Action}
+	}
+	return rule, nil
+}
+
+// 添加 规则 所用的 dns服务器; 若 name 已是 servers 中的 某个, 则 直接 复用 其连接.
+func (dm *DNSMachine) addSpecialServer(name string, addr *Addr) error {
+	if dm.getServerConn(name) != nil {
+		return nil
+	}
+	dcc := &DnsConn{Conn: new(dns.Conn), raddr: addr, Name: name}
+	if err := dcc.Dial(); err != nil {
+		return err
+	}
+	dm.mutex.Lock()
+	if dm.ruleConns == nil {
+		dm.ruleConns = make(map[string]*DnsConn)
+	}
+	dm.ruleConns[name] = dcc
+	dm.mutex.Unlock()
+	return nil
+}
+
+func (dm *DNSMachine) getServerConn(name string) *DnsConn {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+
+	if c := dm.ruleConns[name]; c != nil {
+		return c
+	}
+	if c := dm.conns[name]; c != nil {
+		return c
+	}
+	if dm.defaultConn.Conn != nil && dm.defaultConn.Name == name {
+		return &dm.defaultConn
+	}
+	return nil
+}
+
+func dnsSrcAddr(src net.Addr) Addr {
+	switch a := src.(type) {
+	case nil:
+	case *net.UDPAddr:
+		if a != nil {
+			return NewAddrFromUDPAddr(a)
+		}
+	case *net.TCPAddr:
+		if a != nil {
+			return NewAddrFromTCPAddr(a)
+		}
+	default:
+		if ad, err := NewAddrByHostPort(a.String()); err == nil {
+			return ad
+		}
+	}
+	return Addr{}
+}
+
+func (dm *DNSMachine) matchRule(domain string, src Addr) *DnsRule {
+	for _, rule := range dm.Rules {
+		if rule.Match(domain, src) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// 按 rule 应答 r; depth 为 cname 嵌套 层数
+func (dm *DNSMachine) answerByRule(rule *DnsRule, r *dns.Msg, m *dns.Msg, src Addr, depth int) *dns.Msg {
+	q := r.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: DnsRuleTTL}
+
+	switch rule.Action {
+	case DnsActionNXDomain:
+		m.Rcode = dns.RcodeNameError
+
+	case DnsActionBlock:
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+
+	case DnsActionIP:
+		for _, a := range rule.IPs {
+			switch {
+			case q.Qtype == dns.TypeA && a.Is4():
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: a.AsSlice()})
+			case q.Qtype == dns.TypeAAAA && a.Is6():
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: a.AsSlice()})
+			}
+		}
+
+	case DnsActionCNAME:
+		cname := &dns.CNAME{Hdr: hdr, Target: rule.CNAME}
+		cname.Hdr.Rrtype = dns.TypeCNAME
+		m.Answer = append(m.Answer, cname)
+		if q.Qtype == dns.TypeCNAME {
+			break
+		}
+		if depth >= maxDnsCNAMEDepth {
+			m.Rcode = dns.RcodeServerFailure
+			break
+		}
+		sub := new(dns.Msg)
+		sub.SetQuestion(rule.CNAME, q.Qtype)
+		resp := dm.answer(sub, src, depth+1)
+		m.Rcode = resp.Rcode
+		m.Answer = append(m.Answer, resp.Answer...)
+
+	case DnsActionServer:
+		resp, err := dm.exchangeWithConn(dm.getServerConn(rule.Server), r)
+		if err != nil {
+			if ce := utils.CanLogWarn("Dns exchange failed"); ce != nil {
+				ce.Write(zap.String("name", q.Name), zap.String("server", rule.Server), zap.Error(err))
+			}
+			m.Rcode = dns.RcodeServerFailure
+			break
+		}
+		resp.Id = r.Id
+		return resp
+	}
+	return m
+}
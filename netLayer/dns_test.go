@@ -1,11 +1,13 @@
 package netLayer_test
 
 import (
+	"net"
 	"testing"
 
 	"github.com/BurntSushi/toml"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
 )
 
 type testConfStruct struct {
@@ -93,3 +95,135 @@ servers = [
 	t.Log("record for  google.com is ", dm.Query("google.com"))
 
 }
+
+func TestDNSMachineAnswer(t *testing.T) {
+	dm := netLayer.LoadDnsMachine(&netLayer.DnsConf{Hosts: map[string]any{"www.myfake.com": "11.22.33.44"}})
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.myfake.com.", dns.TypeA)
+	r := dm.Answer(q, nil)
+	if r.Id != q.Id || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatal("wrong answer", r)
+	}
+	if a, ok := r.Answer[0].(*dns.A); !ok || a.A.String() != "11.22.33.44" {
+		t.Fatal("wrong A record", r.Answer[0])
+	}
+
+	//hosts 中 没有 AAAA 记录, 不应 去 上游 查询
+	q.SetQuestion("www.myfake.com.", dns.TypeAAAA)
+	if r = dm.Answer(q, nil); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatal("should be empty answer", r)
+	}
+
+	//没有 配置 dns服务器
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	if r = dm.Answer(q, nil); r.Rcode != dns.RcodeServerFailure {
+		t.Fatal("should be SERVFAIL", r)
+	}
+}
+
+func TestDNSMachineIsServerAddr(t *testing.T) {
+	dm := netLayer.LoadDnsMachine(&netLayer.DnsConf{Servers: []any{"udp://127.0.0.1:53"}})
+	if dm == nil {
+		t.Fatal("load failed")
+	}
+	for target, want := range map[string]bool{
+		"127.0.0.1:53":  true,
+		"127.0.0.2:53":  false,
+		"127.0.0.1:853": false,
+	} {
+		a, _ := netLayer.NewAddr(target)
+		if got := dm.IsServerAddr(a); got != want {
+			t.Fatal("wrong IsServerAddr", target, got)
+		}
+	}
+}
+
+func TestDNSRules(t *testing.T) {
+	//本地 dns服务器, 对 所有 请求 返回 一条 TXT 记录
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 10}, Txt: []string{"upstream"}})
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	dm := netLayer.LoadDnsMachine(&netLayer.DnsConf{
+		Hosts: map[string]any{"real.lan": "10.0.0.2"},
+		Rules: []*netLayer.DnsRuleConf{
+			{Domains: []string{"full:kid.com"}, Sources: []string{"192.168.1.0/24"}, Action: "nxdomain"},
+			{Domains: []string{`regexp:^ad[0-9]+\.`}, Action: "nxdomain"},
+			{Domains: []string{"domain:ads.com"}, Action: "block"},
+			{Domains: []string{"full:nas.lan"}, Action: "ip", IPs: []string{"10.0.0.1", "fd00::1"}},
+			{Domains: []string{"full:alias.lan"}, Action: "cname", CNAME: "real.lan"},
+			{Domains: []string{"full:loop.lan"}, Action: "cname", CNAME: "loop.lan"},
+			{Domains: []string{"full:txt.lan"}, Action: "server", Server: "udp://" + pc.LocalAddr().String()},
+			{Domains: []string{"full:bad.lan"}, Action: "unknown"},
+		},
+	})
+	if dm == nil || len(dm.Rules) != 7 {
+		t.Fatal("wrong rules", dm)
+	}
+
+	ask := func(name string, qtype uint16, src net.Addr) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		return dm.Answer(q, src)
+	}
+	kid := &net.UDPAddr{IP: net.ParseIP("192.168.1.5"), Port: 5353}
+
+	if r := ask("kid.com.", dns.TypeA, kid); r.Rcode != dns.RcodeNameError {
+		t.Fatal("should be NXDOMAIN", r)
+	}
+	//来源 不匹配 时 不应用 该规则, 没有 dns服务器 所以 SERVFAIL
+	if r := ask("kid.com.", dns.TypeA, &net.UDPAddr{IP: net.ParseIP("192.168.2.5"), Port: 5353}); r.Rcode != dns.RcodeServerFailure {
+		t.Fatal("should not match other source", r)
+	}
+	if r := ask("kid.com.", dns.TypeA, nil); r.Rcode != dns.RcodeServerFailure {
+		t.Fatal("should not match nil source", r)
+	}
+
+	if r := ask("ad1.example.org.", dns.TypeA, nil); r.Rcode != dns.RcodeNameError {
+		t.Fatal("regexp rule should match", r)
+	}
+	//只有 regexp 的 规则 不应 匹配 其它 域名
+	if r := ask("google.com.", dns.TypeA, nil); r.Rcode != dns.RcodeServerFailure {
+		t.Fatal("regexp rule should not match all", r)
+	}
+
+	if r := ask("x.ads.com.", dns.TypeA, kid); len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.IPv4zero) {
+		t.Fatal("should be 0.0.0.0", r)
+	}
+	if r := ask("ads.com.", dns.TypeAAAA, nil); len(r.Answer) != 1 || !r.Answer[0].(*dns.AAAA).AAAA.Equal(net.IPv6zero) {
+		t.Fatal("should be ::", r)
+	}
+	if r := ask("ads.com.", dns.TypeMX, nil); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatal("should be empty", r)
+	}
+
+	if r := ask("nas.lan.", dns.TypeA, nil); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatal("wrong ip", r)
+	}
+	if r := ask("nas.lan.", dns.TypeAAAA, nil); len(r.Answer) != 1 || r.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::1" {
+		t.Fatal("wrong ip6", r)
+	}
+
+	r := ask("alias.lan.", dns.TypeA, nil)
+	if len(r.Answer) != 2 || r.Answer[0].(*dns.CNAME).Target != "real.lan." || r.Answer[1].(*dns.A).A.String() != "10.0.0.2" {
+		t.Fatal("wrong cname", r)
+	}
+	if r = ask("loop.lan.", dns.TypeA, nil); r.Rcode != dns.RcodeServerFailure {
+		t.Fatal("cname loop should fail", r)
+	}
+
+	r = ask("txt.lan.", dns.TypeTXT, nil)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.Answer[0].(*dns.TXT).Txt[0] != "upstream" {
+		t.Fatal("should pass through upstream", r)
+	}
+}
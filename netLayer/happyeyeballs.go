@@ -0,0 +1,387 @@
+package netLayer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+/*
+Happy Eyeballs v2, 见 https://www.rfc-editor.org/rfc/rfc8305
+
+对 域名 进行 tcp 拨号 时:
+
+1. 同时 查询 A 与 AAAA (通过 DNSMachine, 没有 则 使用 系统解析);
+若 非优先 的 地址族 先返回, 则 最多 再等 HappyEyeballsResolutionDelay 给 优先 的 地址族.
+
+2. 两个 地址族 的 地址 交替 排列, 优先 的 地址族 在前; 上次 成功 连接 该域名 的 地址 排在 最前.
+
+3. 依次 发起 连接, 每隔 HappyEyeballsAttemptDelay (或 上一个 尝试 失败 时) 发起 下一个, 第一个 成功 的 连接 胜出, 其它 的 被 取消.
+*/
+
+var (
+	HappyEyeballsResolutionDelay = 50 * time.Millisecond
+	HappyEyeballsAttemptDelay    = 250 * time.Millisecond
+)
+
+var ErrNoAddressForStrategy = errors.New("no address matches the domain strategy")
+
+// DomainStrategy 决定 拨号 域名 时 使用 哪些 地址族, 以及 哪个 优先.
+type DomainStrategy uint8
+
+const (
+	DomainAsIs       DomainStrategy = iota //查询 A与AAAA, 优先 的 地址族 由 DNSMachine 的 TypeStrategy 决定, 没有 DNSMachine 时 优先 ipv6
+	DomainUseIPv4                          //只 使用 ipv4
+	DomainUseIPv6                          //只 使用 ipv6
+	DomainPreferIPv4                       //两者 都用, 优先 ipv4
+	DomainPreferIPv6                       //两者 都用, 优先 ipv6
+)
+
+var domainStrategyNames = [...]string{"AsIs", "UseIPv4", "UseIPv6", "PreferIPv4", "PreferIPv6"}
+
+func (ds DomainStrategy) String() string {
+	if int(ds) < len(domainStrategyNames) {
+		return domainStrategyNames[ds]
+	}
+	return "unknown"
+}
+
+// 不区分 大小写, 空字符串 为 AsIs
+func ParseDomainStrategy(s string) (DomainStrategy, error) {
+	if s == "" {
+		return DomainAsIs, nil
+	}
+	for i, n := range domainStrategyNames {
+		if strings.EqualFold(n, s) {
+			return DomainStrategy(i), nil
+		}
+	}
+	return DomainAsIs, utils.ErrInErr{ErrDesc: "unknown domainStrategy", ErrDetail: utils.ErrInvalidData, Data: s}
+}
+
+// 返回 是否 使用 ipv4, ipv6, 以及 是否 优先 ipv6
+func (ds DomainStrategy) families(dm *DNSMachine) (use4, use6, prefer6 bool) {
+	switch ds {
+	case DomainUseIPv4:
+		return true, false, false
+	case DomainUseIPv6:
+		return false, true, true
+	case DomainPreferIPv4:
+		return true, true, false
+	case DomainPreferIPv6:
+		return true, true, true
+	}
+	if dm == nil {
+		return true, true, true
+	}
+	switch dm.TypeStrategy {
+	case 40:
+		return true, false, false
+	case 60:
+		return false, true, true
+	case 6:
+		return true, true, true
+	default:
+		return true, true, false
+	}
+}
+
+// 记录 每个 域名 上次 成功 连接 的 地址
+var heLastGood = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+const heLastGoodMaxCount = 4096
+
+func heGetLastGood(domain string) string {
+	heLastGood.Lock()
+	defer heLastGood.Unlock()
+	return heLastGood.m[domain]
+}
+
+func heSetLastGood(domain string, ip net.IP) {
+	heLastGood.Lock()
+	defer heLastGood.Unlock()
+	if len(heLastGood.m) >= heLastGoodMaxCount {
+		heLastGood.m = make(map[string]string)
+	}
+	heLastGood.m[domain] = ip.String()
+}
+
+type heAnswer struct {
+	is6 bool
+	ips []net.IP
+	err error
+}
+
+func heLookup(ctx context.Context, dm *DNSMachine, domain string, is6 bool) (ips []net.IP, err error) {
+	if dm != nil {
+		qtype := dns.TypeA
+		if is6 {
+			qtype = dns.TypeAAAA
+		}
+		ips, _ = dm.QueryTypeAll(domain, qtype)
+		if len(ips) == 0 {
+			err = utils.ErrInErr{ErrDesc: "[DNSMachine] no record", ErrDetail: utils.ErrInvalidData, Data: domain}
+		}
+		return
+	}
+	network := "ip4"
+	if is6 {
+		network = "ip6"
+	}
+	return net.DefaultResolver.LookupIP(ctx, network, domain)
+}
+
+// 存放 尚未 尝试 的 地址, 按 地址族 交替 取出
+type heAddrQueue struct {
+	v4, v6   []net.IP
+	next6    bool
+	lastGood string
+}
+
+// 只会 加入 属于 is6 所指 地址族 的 ip
+func (q *heAddrQueue) add(is6 bool, ips []net.IP) {
+	ips = filterIPFamily(ips, is6)
+	for _, ip := range ips {
+		if ip.String() == q.lastGood {
+			//上次 成功 的 地址 放在 最前, 并 从 它 的 地址族 开始
+			ips = append([]net.IP{ip}, removeIP(ips, ip)...)
+			q.next6 = is6
+			break
+		}
+	}
+	if is6 {
+		q.v6 = append(q.v6, ips...)
+	} else {
+		q.v4 = append(q.v4, ips...)
+	}
+}
+
+func filterIPFamily(ips []net.IP, is6 bool) (result []net.IP) {
+	for _, ip := range ips {
+		if (ip.To4() == nil) == is6 {
+			result = append(result, ip)
+		}
+	}
+	return
+}
+
+func removeIP(ips []net.IP, ip net.IP) (result []net.IP) {
+	for _, x := range ips {
+		if !x.Equal(ip) {
+			result = append(result, x)
+		}
+	}
+	return
+}
+
+func (q *heAddrQueue) empty() bool { return len(q.v4) == 0 && len(q.v6) == 0 }
+
+func (q *heAddrQueue) pop() (ip net.IP) {
+	take6 := q.next6 && len(q.v6) > 0 || len(q.v4) == 0
+	if take6 {
+		ip, q.v6 = q.v6[0], q.v6[1:]
+	} else {
+		ip, q.v4 = q.v4[0], q.v4[1:]
+	}
+	q.next6 = !take6
+	return
+}
+
+type heResult struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+/*
+DialTCPHappyEyeballs 以 Happy Eyeballs v2 的方式 拨号 domain:port.
+
+network 为 "tcp4" 或 "tcp6" 时 只会 拨号 对应 地址族 的 地址, 其它值 视为 "tcp".
+dm 为 nil 时 使用 系统解析. sockopt 会 被 应用到 每一次 尝试 上.
+localAddr 若为 非nil 的 *net.TCPAddr, 则 只会 拨号 与其 地址族 相同 的 地址.
+*/
+func DialTCPHappyEyeballs(network, domain string, port int, sockopt *Sockopt, localAddr net.Addr, dm *DNSMachine, ds DomainStrategy) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+
+	use4, use6, prefer6 := ds.families(dm)
+	switch network {
+	case "tcp4":
+		use6 = false
+	case "tcp6":
+		use4 = false
+	}
+
+	dialer := &net.Dialer{}
+	if ta, ok := localAddr.(*net.TCPAddr); ok && ta != nil {
+		dialer.LocalAddr = ta
+		if ta.IP != nil && !ta.IP.IsUnspecified() {
+			if ta.IP.To4() != nil {
+				use6 = false
+			} else {
+				use4 = false
+			}
+		}
+	}
+	if !use4 && !use6 {
+		return nil, utils.ErrInErr{ErrDesc: "Happy Eyeballs failed", ErrDetail: ErrNoAddressForStrategy, Data: domain}
+	}
+
+	//缓冲为2, 使 返回后 还未 结束的 查询 不会 阻塞
+	answers := make(chan heAnswer, 2)
+	waitingAnswers := 0
+	for _, is6 := range []bool{false, true} {
+		if is6 && !use6 || !is6 && !use4 {
+			continue
+		}
+		waitingAnswers++
+		go func(is6 bool) {
+			ips, err := heLookup(ctx, dm, domain, is6)
+			answers <- heAnswer{is6: is6, ips: ips, err: err}
+		}(is6)
+	}
+	lastGood := heGetLastGood(domain)
+	if ip := net.ParseIP(lastGood); ip != nil {
+		//上次 成功 的 地址族 视为 优先
+		if is6 := ip.To4() == nil; is6 && use6 || !is6 && use4 {
+			prefer6 = is6
+		}
+	}
+
+	queue := heAddrQueue{next6: prefer6, lastGood: lastGood}
+
+	waitingPreferred := use4 && use6
+
+	results := make(chan heResult)
+	inflight := 0
+	var lastErr error
+
+	//所有 尝试 结束 后, 关闭 迟到 的 连接
+	defer func() {
+		if inflight > 0 {
+			go func(n int) {
+				for ; n > 0; n-- {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(inflight)
+		}
+	}()
+
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	resetTimer := func(d time.Duration) {
+		if timer == nil {
+			timer = time.NewTimer(d)
+		} else {
+			timer.Stop()
+			timer.Reset(d)
+		}
+		timerC = timer.C
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	canAttempt := true //为 false 时 需要 等待 timerC
+
+	for {
+		if canAttempt && !queue.empty() {
+			ip := queue.pop()
+			inflight++
+			canAttempt = false
+			resetTimer(HappyEyeballsAttemptDelay)
+
+			go func(ip net.IP) {
+				r := heResult{ip: ip}
+				r.conn, r.err = heDialOne(ctx, dialer, ip, port, sockopt)
+				results <- r
+			}(ip)
+			continue
+		}
+
+		if inflight == 0 && waitingAnswers == 0 && queue.empty() {
+			if lastErr == nil {
+				lastErr = ErrNoAddressForStrategy
+			}
+			return nil, utils.ErrInErr{ErrDesc: "Happy Eyeballs failed", ErrDetail: lastErr, Data: domain}
+		}
+
+		select {
+		case a := <-answers:
+			waitingAnswers--
+			if a.err != nil {
+				lastErr = a.err
+			}
+			queue.add(a.is6, a.ips)
+
+			if waitingPreferred && a.is6 != prefer6 && waitingAnswers > 0 && inflight == 0 && len(a.ips) > 0 {
+				//非优先 的 地址族 先到, 给 优先 的 一点 时间
+				canAttempt = false
+				resetTimer(HappyEyeballsResolutionDelay)
+			}
+			if a.is6 == prefer6 {
+				waitingPreferred = false
+				if inflight == 0 {
+					canAttempt = true
+				}
+			}
+
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				heSetLastGood(domain, r.ip)
+
+				if ce := utils.CanLogDebug("Happy Eyeballs dialed"); ce != nil {
+					ce.Write(zap.String("domain", domain), zap.String("ip", r.ip.String()))
+				}
+				cancel()
+				return r.conn, nil
+			}
+			lastErr = r.err
+			canAttempt = true
+
+		case <-timerC:
+			timerC = nil
+			canAttempt = true
+
+		case <-ctx.Done():
+			if lastErr == nil {
+				lastErr = ctx.Err()
+			}
+			return nil, utils.ErrInErr{ErrDesc: "Happy Eyeballs failed", ErrDetail: lastErr, Data: domain}
+		}
+	}
+}
+
+func heDialOne(ctx context.Context, dialer *net.Dialer, ip net.IP, port int, sockopt *Sockopt) (net.Conn, error) {
+	d := *dialer
+	isv6 := ip.To4() == nil
+	if sockopt != nil {
+		setDialerSockopt(&d, sockopt, false, isv6)
+
+		if sockopt.MPTCP {
+			if c, ok, err := tryDialMPTCP(ctx, &net.TCPAddr{IP: ip, Port: port}, d.LocalAddr, sockopt); ok {
+				return c, err
+			}
+		}
+	}
+	network := "tcp4"
+	if isv6 {
+		network = "tcp6"
+	}
+	return d.DialContext(ctx, network, (&net.TCPAddr{IP: ip, Port: port}).String())
+}
@@ -0,0 +1,96 @@
+package netLayer
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestParseDomainStrategy(t *testing.T) {
+	for i, n := range domainStrategyNames {
+		ds, err := ParseDomainStrategy(n)
+		if err != nil || ds != DomainStrategy(i) {
+			t.Fatal("parse wrong", n, ds, err)
+		}
+	}
+	if ds, err := ParseDomainStrategy("preferipv4"); err != nil || ds != DomainPreferIPv4 {
+		t.Fatal("should be case insensitive", ds, err)
+	}
+	if _, err := ParseDomainStrategy("ipv4only"); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestHappyEyeballsQueue(t *testing.T) {
+	q := heAddrQueue{next6: true, lastGood: "1.1.1.2"}
+	q.add(true, []net.IP{net.ParseIP("::1"), net.ParseIP("1.1.1.3"), net.ParseIP("::2")}) //地址族 不对 的 应被丢弃
+	q.add(false, []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("1.1.1.2")})
+
+	//上次成功的 1.1.1.2 在最前, 之后 交替
+	want := []string{"1.1.1.2", "::1", "1.1.1.1", "::2"}
+	for _, w := range want {
+		if ip := q.pop(); ip.String() != w {
+			t.Fatal("order wrong", ip, w)
+		}
+	}
+	if !q.empty() {
+		t.Fatal("should be empty")
+	}
+}
+
+// ipv6 地址 上 没有监听, 应 回落到 ipv4, 并 记住 ipv4 地址
+func TestDialTCPHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	const domain = "he.verysimple.test"
+	dm := &DNSMachine{SpecialIPPollicy: map[string][]netip.Addr{
+		domain: {netip.MustParseAddr("::1"), netip.MustParseAddr("127.0.0.1")},
+	}}
+
+	c, err := DialTCPHappyEyeballs("tcp", domain, port, nil, nil, dm, DomainPreferIPv6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra := c.RemoteAddr().(*net.TCPAddr); !ra.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatal("should fall back to ipv4", ra)
+	}
+	c.Close()
+
+	if heGetLastGood(domain) != "127.0.0.1" {
+		t.Fatal("last good not recorded", heGetLastGood(domain))
+	}
+
+	if _, err = DialTCPHappyEyeballs("tcp", domain, port, nil, nil, dm, DomainUseIPv6); err == nil {
+		t.Fatal("UseIPv6 should fail")
+	}
+
+	if _, err = DialTCPHappyEyeballs("tcp6", domain, port, nil, nil, dm, DomainPreferIPv4); err == nil {
+		t.Fatal("tcp6 should only dial ipv6 addresses")
+	}
+	c, err = DialTCPHappyEyeballs("tcp4", domain, port, nil, nil, dm, DomainPreferIPv6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	a := Addr{Network: "tcp", Name: domain, Port: port}
+	c, err = a.DialWithResolver(nil, nil, dm, DomainUseIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -15,6 +15,10 @@ type ReadWrapper struct {
 	RemainFirstBufLen int
 }
 
+func (rw *ReadWrapper) CloseWrite() error {
+	return CloseWrite(rw.Conn)
+}
+
 func (rw *ReadWrapper) Read(p []byte) (n int, err error) {
 
 	if rw.RemainFirstBufLen > 0 {
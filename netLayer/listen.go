@@ -78,23 +78,22 @@ func ListenAndAccept(network, addr string, sockopt *Sockopt, xver int, acceptFun
 
 	switch p {
 	case TCP:
-		var tcplistener *net.TCPListener
-
 		var ta *net.TCPAddr
 		ta, err = net.ResolveTCPAddr("tcp", addr)
 		if err != nil {
 			return
 		}
 
+		if sockopt != nil {
+			return listenTCPWithOpt(network, ta, sockopt, xver, acceptFunc)
+		}
+
+		var tcplistener *net.TCPListener
 		tcplistener, err = net.ListenTCP(network, ta)
 		if err != nil {
 			return
 		}
 
-		if sockopt != nil {
-			SetSockOptForListener(tcplistener, sockopt, false, ta.IP.To4() == nil)
-		}
-
 		go loopAccept(tcplistener, xver, acceptFunc)
 
 		listener = tcplistener
@@ -109,11 +108,16 @@ func ListenAndAccept(network, addr string, sockopt *Sockopt, xver int, acceptFun
 			return
 		}
 
-		listener, err = NewUDPListener(ua)
+		//udp 的 PROXY protocol 头 在 每个包 的 开头, 由 UDPListener 自己 处理, 且 只有 v2 支持 udp
+		if xver > 0 {
+			listener, err = NewUDPListenerPROXY(ua)
+		} else {
+			listener, err = NewUDPListener(ua)
+		}
 		if err != nil {
 			return
 		}
-		go loopAccept(listener, xver, acceptFunc)
+		go loopAccept(listener, 0, acceptFunc)
 
 	case UNIX:
 		// 参考 https://eli.thegreenplace.net/2019/unix-domain-sockets-in-go/
@@ -173,6 +177,83 @@ func ListenAndAccept(network, addr string, sockopt *Sockopt, xver int, acceptFun
 	return
 }
 
+// ReusePortListener 由 多个 设置了 SO_REUSEPORT 的 同地址 监听 组成, 每个 都有 自己的 accept 循环, 由 内核 分配 新连接.
+// 见 Sockopt.ReusePort. 只用于 Close 与 Addr, Accept 不可用.
+type ReusePortListener struct {
+	Listeners []net.Listener
+	utils.MultiCloser
+}
+
+func (l *ReusePortListener) Accept() (net.Conn, error) { return nil, utils.ErrUnImplemented }
+
+func (l *ReusePortListener) Addr() net.Addr { return l.Listeners[0].Addr() }
+
+// sockopt 在 bind 之前 设置, 这样 SO_REUSEPORT 与 IP_TRANSPARENT 才 有效.
+func listenTCPWithOpt(network string, ta *net.TCPAddr, sockopt *Sockopt, xver int, acceptFunc func(net.Conn)) (net.Listener, error) {
+	n := sockopt.ReusePort
+	if n < 1 {
+		n = 1
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := listenOneTCPWithOpt(network, ta, sockopt)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if i == 0 && ta.Port == 0 {
+			//随机端口 时, 其它 socket 要 监听 同一个 端口
+			newTA := *ta
+			newTA.Port = l.Addr().(*net.TCPAddr).Port
+			ta = &newTA
+		}
+		listeners = append(listeners, l)
+	}
+
+	for _, l := range listeners {
+		if sockopt.hasTCPConnOpt() {
+			go loopAccept(sockoptListener{Listener: l, sockopt: sockopt}, xver, acceptFunc)
+		} else {
+			go loopAccept(l, xver, acceptFunc)
+		}
+	}
+
+	if n == 1 {
+		return listeners[0], nil
+	}
+
+	if ce := utils.CanLogDebug("Listening tcp with SO_REUSEPORT"); ce != nil {
+		ce.Write(zap.String("addr", ta.String()), zap.Int("count", n))
+	}
+
+	rl := &ReusePortListener{Listeners: listeners}
+	for _, l := range listeners {
+		rl.Closers = append(rl.Closers, l)
+	}
+	return rl, nil
+}
+
+func listenOneTCPWithOpt(network string, ta *net.TCPAddr, sockopt *Sockopt) (net.Listener, error) {
+	if sockopt.MPTCP {
+		if l, ok, err := tryListenMPTCP(network, ta, sockopt); ok {
+			return l, err
+		}
+	}
+
+	isipv6 := ta.IP.To4() == nil
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				SetSockOpt(int(fd), sockopt, false, isipv6)
+			})
+		},
+	}
+	return lc.Listen(context.Background(), network, ta.String())
+}
+
 func (a Addr) ListenUDP_withOpt(sockopt *Sockopt) (net.PacketConn, error) {
 	var lc net.ListenConfig
 	lc.Control = func(network, address string, c syscall.RawConn) error {
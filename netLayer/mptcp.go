@@ -0,0 +1,51 @@
+package netLayer
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// 第一次 发现 内核 不支持 mptcp 后 置为 true, 之后 直接 使用 普通 tcp
+var mptcpUnsupported atomic.Bool
+
+func markMPTCPUnsupported(err error) {
+	if mptcpUnsupported.Swap(true) {
+		return
+	}
+	if ce := utils.CanLogWarn("MPTCP not supported by the system, fall back to tcp"); ce != nil {
+		ce.Write(zap.Error(err))
+	}
+}
+
+// 尝试 用 mptcp 监听. 系统 不支持 mptcp 时 返回的 ok 为 false, 调用者 应 回落 到 普通 tcp.
+func tryListenMPTCP(network string, ta *net.TCPAddr, sockopt *Sockopt) (l net.Listener, ok bool, err error) {
+	if mptcpUnsupported.Load() {
+		return nil, false, nil
+	}
+	l, err = listenMPTCP(network, ta, sockopt)
+	if err != nil && isMPTCPUnsupportedErr(err) {
+		markMPTCPUnsupported(err)
+		return nil, false, nil
+	}
+	return l, true, err
+}
+
+// 尝试 用 mptcp 拨号. 系统 不支持 mptcp 时 返回的 ok 为 false, 调用者 应 回落 到 普通 tcp.
+//
+// laddr 可为 nil.
+func tryDialMPTCP(ctx context.Context, raddr *net.TCPAddr, laddr net.Addr, sockopt *Sockopt) (c net.Conn, ok bool, err error) {
+	if mptcpUnsupported.Load() {
+		return nil, false, nil
+	}
+	la, _ := laddr.(*net.TCPAddr)
+	c, err = dialMPTCP(ctx, raddr, la, sockopt)
+	if err != nil && isMPTCPUnsupportedErr(err) {
+		markMPTCPUnsupported(err)
+		return nil, false, nil
+	}
+	return c, true, err
+}
@@ -0,0 +1,174 @@
+package netLayer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+/*
+go1.21 才 为 net.ListenConfig 与 net.Dialer 加入 SetMultipathTCP, 所以 这里 自己 创建 protocol 为 IPPROTO_MPTCP 的 socket,
+再 用 net.FileListener / net.FileConn 转为 *net.TCPListener / *net.TCPConn.
+
+mptcp 的 socket 与 普通 tcp 的 用法 完全一样, 对方 不支持 mptcp 时 内核 会 自动 使用 普通 tcp.
+*/
+
+const ipproto_MPTCP = 262
+
+// 内核 没有编译 mptcp 时 socket 返回 EPROTONOSUPPORT, sysctl net.mptcp.enabled=0 时 返回 ENOPROTOOPT
+func isMPTCPUnsupportedErr(err error) bool {
+	return errors.Is(err, syscall.EPROTONOSUPPORT) || errors.Is(err, syscall.ENOPROTOOPT) || errors.Is(err, syscall.EAFNOSUPPORT)
+}
+
+func tcpSockaddr(ta *net.TCPAddr, is6 bool) syscall.Sockaddr {
+	if ta == nil {
+		ta = &net.TCPAddr{}
+	}
+	if !is6 {
+		sa := &syscall.SockaddrInet4{Port: ta.Port}
+		copy(sa.Addr[:], ta.IP.To4())
+		return sa
+	}
+	sa := &syscall.SockaddrInet6{Port: ta.Port}
+	copy(sa.Addr[:], ta.IP.To16())
+	if ta.Zone != "" {
+		if ifi, err := net.InterfaceByName(ta.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	return sa
+}
+
+func newMPTCPSocket(is6 bool) (int, error) {
+	family := syscall.AF_INET
+	if is6 {
+		family = syscall.AF_INET6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, ipproto_MPTCP)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	return fd, nil
+}
+
+func listenMPTCP(network string, ta *net.TCPAddr, sockopt *Sockopt) (net.Listener, error) {
+	is6 := network == "tcp6" || network != "tcp4" && ta.IP.To4() == nil
+
+	fd, err := newMPTCPSocket(is6)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "mptcp-listener")
+	defer f.Close()
+
+	if is6 {
+		v6only := 0
+		if network == "tcp6" {
+			v6only = 1
+		}
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6only)
+	}
+	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	SetSockOpt(fd, sockopt, false, is6)
+
+	if err = syscall.Bind(fd, tcpSockaddr(ta, is6)); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err = syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return net.FileListener(f)
+}
+
+func dialMPTCP(ctx context.Context, raddr, laddr *net.TCPAddr, sockopt *Sockopt) (net.Conn, error) {
+	is6 := raddr.IP.To4() == nil
+
+	fd, err := newMPTCPSocket(is6)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "mptcp-conn")
+	defer f.Close()
+
+	SetSockOpt(fd, sockopt, false, is6)
+
+	if laddr != nil {
+		if err = syscall.Bind(fd, tcpSockaddr(laddr, is6)); err != nil {
+			return nil, os.NewSyscallError("bind", err)
+		}
+	}
+
+	err = syscall.Connect(fd, tcpSockaddr(raddr, is6))
+	switch err {
+	case nil:
+	case syscall.EINPROGRESS, syscall.EALREADY, syscall.EINTR:
+		if err = waitMPTCPConnect(ctx, f); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, os.NewSyscallError("connect", err)
+	}
+
+	return net.FileConn(f)
+}
+
+// 等待 非阻塞 的 connect 完成
+func waitMPTCPConnect(ctx context.Context, f *os.File) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DialTimeout)
+	}
+	f.SetWriteDeadline(deadline)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.SetWriteDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var connectErr error
+	first := true
+	err = rc.Write(func(fd uintptr) bool {
+		if first {
+			//先 等待 可写
+			first = false
+			return false
+		}
+		v, e := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if e != nil {
+			connectErr = os.NewSyscallError("getsockopt", e)
+			return true
+		}
+		switch errno := syscall.Errno(v); errno {
+		case syscall.EINPROGRESS, syscall.EALREADY, syscall.EINTR:
+			return false
+		case 0, syscall.EISCONN:
+			if _, e := syscall.Getpeername(int(fd)); e == syscall.ENOTCONN {
+				return false
+			}
+			return true
+		default:
+			connectErr = os.NewSyscallError("connect", errno)
+			return true
+		}
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return connectErr
+}
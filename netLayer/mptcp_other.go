@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package netLayer
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errMPTCPUnsupported = errors.New("mptcp is only supported on linux")
+
+func listenMPTCP(network string, ta *net.TCPAddr, sockopt *Sockopt) (net.Listener, error) {
+	return nil, errMPTCPUnsupported
+}
+
+func dialMPTCP(ctx context.Context, raddr, laddr *net.TCPAddr, sockopt *Sockopt) (net.Conn, error) {
+	return nil, errMPTCPUnsupported
+}
+
+func isMPTCPUnsupportedErr(err error) bool { return errors.Is(err, errMPTCPUnsupported) }
@@ -80,6 +80,36 @@ func (u UniTargetMsgConn) WriteMsg(bs []byte, _ Addr) error {
 	return err
 }
 
+// 实现 MsgBatchReader. underlay 为 UDPListener 得到的 UDPConn 时 才会 真正 批量 读.
+func (u UniTargetMsgConn) ReadMsgs(dst []AddrData) ([]AddrData, error) {
+	if uc, ok := u.Conn.(*UDPConn); ok {
+		start := len(dst)
+		dst, err := uc.ReadMsgs(dst)
+		for i := start; i < len(dst); i++ {
+			dst[i].Addr = u.Target
+		}
+		return dst, err
+	}
+	bs, a, err := u.ReadMsg()
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, AddrData{Data: bs, Addr: a}), nil
+}
+
+// 实现 MsgBatchWriter. underlay 为 UDPListener 得到的 UDPConn 时 才会 真正 批量 写.
+func (u UniTargetMsgConn) WriteMsgs(msgs []AddrData) error {
+	if uc, ok := u.Conn.(*UDPConn); ok {
+		return uc.writeMsgs(msgs, uc.peerAddr)
+	}
+	for _, m := range msgs {
+		if err := u.WriteMsg(m.Data, m.Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (u UniTargetMsgConn) CloseConnWithRaddr(raddr Addr) error {
 	return u.Conn.Close()
 }
@@ -93,6 +123,9 @@ type UDPMsgConn struct {
 	*net.UDPConn
 	IsServer, fullcone, closed bool
 
+	batch   *UDPBatchConn //包装 UDPConn, 读 都 经过它
+	readBuf []UDPAddrData //ReadMsgs 所用, 在 多次 调用 间 复用. ReadMsgs 只会 被 一个 goroutine 调用
+
 	symmetricMap      map[HashableAddr]*net.UDPConn
 	symmetricMapMutex sync.RWMutex
 
@@ -130,6 +163,7 @@ func NewUDPMsgConn(laddr *net.UDPAddr, fullcone bool, isserver bool, sockopt *So
 	udpConn.SetWriteBuffer(MaxUDP_packetLen)
 
 	uc.UDPConn = udpConn
+	uc.batch = NewUDPBatchConn(udpConn)
 	uc.fullcone = fullcone
 	uc.IsServer = isserver
 	if !fullcone {
@@ -145,22 +179,27 @@ func (u *UDPMsgConn) Fullcone() bool {
 	return u.fullcone
 }
 
-func (u *UDPMsgConn) readSymmetricMsgFromConn(conn *net.UDPConn, thishash HashableAddr) {
+func (u *UDPMsgConn) readSymmetricMsgFromConn(bc *UDPBatchConn, thishash HashableAddr) {
 	if ce := utils.CanLogDebug("readSymmetricMsgFromConn called"); ce != nil {
 		ce.Write(zap.String("addr", thishash.String()))
 	}
-	for {
-		bs := utils.GetPacket()
+	conn := bc.UDPConn
 
+	var msgs []UDPAddrData
+	for {
 		conn.SetReadDeadline(time.Now().Add(UDP_timeout))
 
-		n, ad, err := conn.ReadFromUDP(bs)
+		var err error
+		msgs, err = bc.ReadUDPMsgs(msgs[:0])
 
 		if err != nil || u.closed {
 			break
 		}
 
-		u.symmetricMsgReadChan <- AddrData{Data: bs[:n], Addr: NewAddrFromUDPAddr(ad)}
+		for i := range msgs {
+			u.symmetricMsgReadChan <- AddrData{Data: msgs[i].Data, Addr: NewAddrFromUDPAddr(&msgs[i].Addr)}
+			msgs[i] = UDPAddrData{}
+		}
 	}
 
 	u.symmetricMapMutex.Lock()
@@ -173,17 +212,15 @@ func (u *UDPMsgConn) readSymmetricMsgFromConn(conn *net.UDPConn, thishash Hashab
 
 func (u *UDPMsgConn) ReadMsg() ([]byte, Addr, error) {
 	if u.fullcone {
-		bs := utils.GetPacket()
-
 		u.UDPConn.SetReadDeadline(time.Now().Add(UDP_fullcone_timeout))
 
-		n, ad, err := u.UDPConn.ReadFromUDP(bs)
+		bs, ad, err := u.batch.ReadUDPMsg()
 
 		if err != nil {
 			return nil, Addr{}, err
 		}
 
-		return bs[:n], NewAddrFromUDPAddr(ad), nil
+		return bs, NewAddrFromUDPAddr(ad), nil
 	} else {
 		ad, ok := <-u.symmetricMsgReadChan
 		if ok {
@@ -216,7 +253,7 @@ func (u *UDPMsgConn) WriteMsg(bs []byte, raddr Addr) error {
 				u.symmetricMap[thishash] = u.UDPConn
 				u.symmetricMapMutex.Unlock()
 			}
-			go u.readSymmetricMsgFromConn(u.UDPConn, thishash)
+			go u.readSymmetricMsgFromConn(u.batch, thishash)
 			return err
 		}
 
@@ -235,7 +272,7 @@ func (u *UDPMsgConn) WriteMsg(bs []byte, raddr Addr) error {
 			u.symmetricMap[thishash] = theConn
 			u.symmetricMapMutex.Unlock()
 
-			go u.readSymmetricMsgFromConn(theConn, thishash)
+			go u.readSymmetricMsgFromConn(NewUDPBatchConn(theConn), thishash)
 		}
 
 	} else {
@@ -246,6 +283,66 @@ func (u *UDPMsgConn) WriteMsg(bs []byte, raddr Addr) error {
 	return err
 }
 
+// 实现 MsgBatchReader
+func (u *UDPMsgConn) ReadMsgs(dst []AddrData) ([]AddrData, error) {
+	if !u.fullcone {
+		bs, a, err := u.ReadMsg()
+		if err != nil {
+			return dst, err
+		}
+		dst = append(dst, AddrData{Data: bs, Addr: a})
+
+		for i := 1; i < UDPBatchSize; i++ {
+			select {
+			case ad, ok := <-u.symmetricMsgReadChan:
+				if !ok {
+					return dst, nil
+				}
+				ad.Addr.Network = "udp"
+				dst = append(dst, ad)
+			default:
+				return dst, nil
+			}
+		}
+		return dst, nil
+	}
+
+	u.UDPConn.SetReadDeadline(time.Now().Add(UDP_fullcone_timeout))
+
+	var err error
+	u.readBuf, err = u.batch.ReadUDPMsgs(u.readBuf[:0])
+	if err != nil {
+		return dst, err
+	}
+	for i := range u.readBuf {
+		dst = append(dst, AddrData{Data: u.readBuf[i].Data, Addr: NewAddrFromUDPAddr(&u.readBuf[i].Addr)})
+		u.readBuf[i] = UDPAddrData{}
+	}
+	return dst, nil
+}
+
+// 实现 MsgBatchWriter. symmetric 的 客户端 每个 远程地址 对应 不同的 udp连接, 所以 逐个 写.
+func (u *UDPMsgConn) WriteMsgs(msgs []AddrData) error {
+	if !u.fullcone && !u.IsServer {
+		for _, m := range msgs {
+			if err := u.WriteMsg(m.Data, m.Addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ums := make([]UDPAddrData, len(msgs))
+	for i, m := range msgs {
+		um, err := toUDPAddrData(m)
+		if err != nil {
+			return err
+		}
+		ums[i] = um
+	}
+	return u.batch.WriteUDPMsgs(ums)
+}
+
 func (u *UDPMsgConn) CloseConnWithRaddr(raddr Addr) error {
 	if !u.IsServer {
 		if u.fullcone {
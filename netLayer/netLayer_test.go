@@ -1,6 +1,7 @@
 package netLayer
 
 import (
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -8,6 +9,12 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
+// 把 c 读到的 数据 原样 写回, 读完 后 关闭 c. 可 直接 作为 ListenAndAccept 的 acceptFunc
+func echoConn(c net.Conn) {
+	io.Copy(c, c)
+	c.Close()
+}
+
 func TestIpv6(t *testing.T) {
 	t.Log("HasIpv6Interface()", HasIpv6Interface())
 }
@@ -109,6 +109,21 @@ func IsStrUDP_network(s string) bool {
 	return false
 }
 
+// CloseWriter 可以 只关闭 写入的一端 (半关闭), 对端 读到 EOF 后 依然 可以 继续 写入, 本端 也 依然 可以 继续 读取.
+// *net.TCPConn, *net.UnixConn, *tls.Conn 都 实现了 它; 包装连接 的 结构 若 能 在 协议层面 表达 半关闭, 也应 实现 它.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// 若 c 实现了 CloseWriter 则 调用 其 CloseWrite, 否则 返回 utils.ErrUnImplemented.
+// 注意 不会 通过 ConnWrapper 自动解包, 因为 包装层 可能 还有 未写出 的 数据 或 需要 发送 结束标志.
+func CloseWrite(c any) error {
+	if cw, ok := c.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return utils.ErrUnImplemented
+}
+
 // 返回它所包装前的 那一层 net.Conn, 不一定是 基本连接，
 // 所以仍然可以继续 被识别为 ConnWrapper 并继续解包.
 type ConnWrapper interface {
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin)
+// +build !linux,!darwin
+
+package netLayer
+
+// IsConnAlive 在本平台 无法 窥探 socket, 总是 返回 true.
+func IsConnAlive(c any) bool {
+	return true
+}
+
+// IsConnIdle 在本平台 无法 窥探 socket, 总是 返回 true.
+func IsConnIdle(c any) bool {
+	return true
+}
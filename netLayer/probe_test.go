@@ -0,0 +1,41 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package netLayer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsConnAlive(t *testing.T) {
+	a, b := tcpPair(t)
+	defer a.Close()
+
+	if !IsConnAlive(a) {
+		t.Fatal("should be alive")
+	}
+	if !IsConnIdle(a) {
+		t.Fatal("should be idle")
+	}
+
+	//有数据 待读 时 依然 存活, 且 数据 不会被 消耗
+	b.Write([]byte("x"))
+	time.Sleep(50 * time.Millisecond)
+	if !IsConnAlive(a) {
+		t.Fatal("should be alive with pending data")
+	}
+	if IsConnIdle(a) {
+		t.Fatal("should not be idle with pending data")
+	}
+	buf := make([]byte, 1)
+	if n, _ := a.Read(buf); n != 1 || buf[0] != 'x' {
+		t.Fatal("pending data consumed")
+	}
+
+	b.Close()
+	time.Sleep(50 * time.Millisecond)
+	if IsConnAlive(a) {
+		t.Fatal("should be dead after peer closed")
+	}
+}
@@ -0,0 +1,52 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package netLayer
+
+import (
+	"syscall"
+)
+
+// IsConnAlive 用 MSG_PEEK 非阻塞地 窥探 c 的 底层 socket, 不会 消耗 数据.
+// 对方 已关闭 (读到 EOF) 或 出错 时 返回 false; 没有数据 或 有数据 待读 时 返回 true.
+//
+// c 不是 syscall.Conn 时 总是 返回 true.
+func IsConnAlive(c any) bool {
+	alive, _ := peekConn(c)
+	return alive
+}
+
+// IsConnIdle 与 IsConnAlive 相同, 但 有数据 待读 时 也 返回 false.
+//
+// 用于 我们 还 没有 发送 任何数据 的 连接 (如 预连接池 中的), 此时 对方 发来的 数据 只可能 是 关闭前 的 回应
+// (如 回落的 400 响应 与 tls 的 close_notify), 说明 连接 即将 被 关闭.
+func IsConnIdle(c any) bool {
+	alive, hasData := peekConn(c)
+	return alive && !hasData
+}
+
+func peekConn(c any) (alive, hasData bool) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return true, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+
+	alive = true
+	var buf [1]byte
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, e := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case e == syscall.EAGAIN || e == syscall.EWOULDBLOCK:
+		case e != nil || n == 0:
+			alive = false
+		default:
+			hasData = true
+		}
+		return true
+	})
+	return alive && err == nil, hasData
+}
@@ -1,9 +1,12 @@
 package netLayer
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
 	"net"
-	"strconv"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"github.com/pires/go-proxyproto"
@@ -11,63 +14,143 @@ import (
 
 var proxyProtocolListenPolicyFunc = func(upstream net.Addr) (proxyproto.Policy, error) { return proxyproto.REQUIRE, nil }
 
-//PROXY protocol。
-//Reference： http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
-//
-//xver 必须是 1或者2, 本函数若遇到其他值会直接panic。wlc 为监听的连接，wrc为转发的连接。
-// 另外，本函数只支持tcp。proxy protocol的 v2 是支持 udp的，但是本函数不支持udp。
-func WritePROXYprotocol(xver int, wlc NetAddresser, wrc io.Writer) (n int, err error) {
-
-	clientAddr, _ := NewAddrFromAny(wlc.RemoteAddr())
-	selfAddr, _ := NewAddrFromAny(wlc.LocalAddr())
-
-	buf := utils.GetBuf()
+var ErrPROXYv1NoUDP = errors.New("PROXY protocol v1 doesn't support udp")
 
-	switch xver {
-	default:
-		panic("Invalid Xver passed to netLayer.WritePROXYprotocol")
-	case 1:
+// 可以获取 收到的 PROXY protocol 头 的 连接, 如 proxyproto.Conn 和 监听时 配置了 xver 的 UDPConn.
+type PROXYHeaderGetter interface {
+	ProxyHeader() *proxyproto.Header
+}
 
-		headStr := "PROXY TCP4 "
-		if clientAddr.IsIpv6() {
-			headStr = "PROXY TCP6 "
-		}
+/*
+NewPROXYHeader 生成 PROXY protocol 头.
+Reference： http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
 
-		buf.WriteString(headStr)
-		buf.WriteString(clientAddr.IP.String())
-		buf.WriteString(" ")
-		buf.WriteString(selfAddr.IP.String())
-		buf.WriteString(" ")
-		buf.WriteString(strconv.Itoa(clientAddr.Port))
-		buf.WriteString(" ")
-		buf.WriteString(strconv.Itoa(selfAddr.Port))
-		buf.WriteString("\r\n")
+xver 必须是 1或者2; network 为 tcp 或 udp, v1 只支持 tcp. tlvs 只用于 v2, v1 会忽略它.
 
-	case 2:
-		buf.WriteString("\x0D\x0A\x0D\x0A\x00\x0D\x0A\x51\x55\x49\x54\x0A\x21") // signature + v2 + PROXY
+src 为 客户端地址, dst 为 客户端 原本 访问的 地址. 若 两者 有一个 没有ip, 则 v1 写 "PROXY UNKNOWN", v2 写 LOCAL 命令;
+若 一个为 ipv4 一个为 ipv6, 则 统一 使用 ipv6.
+*/
+func NewPROXYHeader(xver int, network string, src, dst Addr, tlvs []proxyproto.TLV) ([]byte, error) {
+	if xver != 1 && xver != 2 {
+		return nil, utils.ErrInErr{ErrDesc: "Invalid xver for PROXY protocol", ErrDetail: utils.ErrInvalidNumber, Data: xver}
+	}
+	isudp := network == "udp"
+	if isudp && xver == 1 {
+		return nil, ErrPROXYv1NoUDP
+	}
 
-		if clientAddr.IsIpv6() {
+	h := &proxyproto.Header{
+		Version:           byte(xver),
+		Command:           proxyproto.LOCAL,
+		TransportProtocol: proxyproto.UNSPEC,
+	}
 
-			buf.WriteString("\x21\x00\x24") // AF_INET6 + STREAM + 36 bytes
+	if len(src.IP) > 0 && len(dst.IP) > 0 {
+		srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+		isv6 := srcIP == nil || dstIP == nil
+		if isv6 {
+			srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		}
 
-			buf.Write(clientAddr.IP.To16())
-			buf.Write(selfAddr.IP.To16())
+		h.Command = proxyproto.PROXY
+		switch {
+		case isudp && isv6:
+			h.TransportProtocol = proxyproto.UDPv6
+		case isudp:
+			h.TransportProtocol = proxyproto.UDPv4
+		case isv6:
+			h.TransportProtocol = proxyproto.TCPv6
+		default:
+			h.TransportProtocol = proxyproto.TCPv4
+		}
 
+		if isudp {
+			h.SourceAddr = &net.UDPAddr{IP: srcIP, Port: src.Port}
+			h.DestinationAddr = &net.UDPAddr{IP: dstIP, Port: dst.Port}
 		} else {
-			buf.WriteString("\x11\x00\x0C") // AF_INET + STREAM + 12 bytes
-			buf.Write(clientAddr.IP.To4())
-			buf.Write(selfAddr.IP.To4())
+			h.SourceAddr = &net.TCPAddr{IP: srcIP, Port: src.Port}
+			h.DestinationAddr = &net.TCPAddr{IP: dstIP, Port: dst.Port}
+		}
+	}
 
+	if xver == 2 && len(tlvs) > 0 {
+		if err := h.SetTLVs(tlvs); err != nil {
+			return nil, err
 		}
+	}
+	return h.Format()
+}
+
+// WritePROXYprotocol 向 wrc 写入 tcp 的 PROXY protocol 头. wlc 为监听的连接，wrc为转发的连接。
+func WritePROXYprotocol(xver int, wlc NetAddresser, wrc io.Writer) (n int, err error) {
+	return WritePROXYprotocolWithTLVs(xver, wlc, wrc, nil)
+}
 
-		var p1 uint16 = uint16(clientAddr.Port)
-		var p2 uint16 = uint16(selfAddr.Port)
-		buf.Write([]byte{byte(p1 >> 8), byte(p1), byte(p2 >> 8), byte(p2)})
+// 同 WritePROXYprotocol, 但 v2 时 会 附带 tlvs
+func WritePROXYprotocolWithTLVs(xver int, wlc NetAddresser, wrc io.Writer, tlvs []proxyproto.TLV) (n int, err error) {
+	clientAddr, _ := NewAddrFromAny(wlc.RemoteAddr())
+	selfAddr, _ := NewAddrFromAny(wlc.LocalAddr())
 
+	bs, err := NewPROXYHeader(xver, "tcp", clientAddr, selfAddr, tlvs)
+	if err != nil {
+		return
 	}
+	return wrc.Write(bs)
+}
+
+/*
+ReadPROXYHeaderFromPacket 读取 udp 包 开头的 PROXY protocol v2 头, 返回 头 以及 其长度.
+
+udp 时 每个包 都 带有 自己的 头. 若 包 不以 v2 的 签名 开头, 返回 proxyproto.ErrNoProxyProtocol.
+*/
+func ReadPROXYHeaderFromPacket(bs []byte) (h *proxyproto.Header, headerLen int, err error) {
+	const fixedLen = 16 //12 字节 签名 + 版本与命令 + 协议族 + 2字节 长度
 
-	n, err = wrc.Write(buf.Bytes())
-	utils.PutBuf(buf)
+	if len(bs) < fixedLen || !bytes.Equal(bs[:12], proxyproto.SIGV2) {
+		return nil, 0, proxyproto.ErrNoProxyProtocol
+	}
+	headerLen = fixedLen + int(binary.BigEndian.Uint16(bs[14:16]))
+	if len(bs) < headerLen {
+		return nil, 0, proxyproto.ErrInvalidLength
+	}
 
+	h, err = proxyproto.Read(bufio.NewReader(bytes.NewReader(bs[:headerLen])))
 	return
 }
+
+/*
+PROXYMsgConn 在 每个 写出的 udp 消息 前 添加 PROXY protocol v2 头, 目标 为 该消息 的 目标.
+
+读取时 不做 处理, 因为 PROXY protocol 是 单向的.
+*/
+type PROXYMsgConn struct {
+	MsgConn
+	Src  Addr
+	TLVs []proxyproto.TLV
+}
+
+func (c PROXYMsgConn) WriteMsg(p []byte, target Addr) error {
+	h, err := NewPROXYHeader(2, "udp", c.Src, target, c.TLVs)
+	if err != nil {
+		return err
+	}
+	return c.MsgConn.WriteMsg(append(h, p...), target)
+}
+
+// 实现 MsgBatchReader, 读取 不做 处理
+func (c PROXYMsgConn) ReadMsgs(dst []AddrData) ([]AddrData, error) {
+	return readMsgsFrom(c.MsgConn, dst)
+}
+
+// 实现 MsgBatchWriter, 每个 消息 前 都 添加 头
+func (c PROXYMsgConn) WriteMsgs(msgs []AddrData) error {
+	withHeader := make([]AddrData, len(msgs))
+	for i, m := range msgs {
+		h, err := NewPROXYHeader(2, "udp", c.Src, m.Addr, c.TLVs)
+		if err != nil {
+			return err
+		}
+		withHeader[i] = AddrData{Data: append(h, m.Data...), Addr: m.Addr}
+	}
+	return writeMsgsTo(c.MsgConn, withHeader)
+}
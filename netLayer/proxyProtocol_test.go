@@ -0,0 +1,116 @@
+package netLayer
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestPROXYHeader(t *testing.T) {
+	src := Addr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	dst := Addr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	tlvs := []proxyproto.TLV{{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("example.com")}}
+
+	bs, err := NewPROXYHeader(1, "tcp", src, Addr{IP: net.ParseIP("5.6.7.8"), Port: 80}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n" {
+		t.Fatal("v1 header wrong", string(bs))
+	}
+
+	if _, err = NewPROXYHeader(1, "udp", src, dst, nil); err != ErrPROXYv1NoUDP {
+		t.Fatal("v1 should not support udp", err)
+	}
+
+	//ipv4 与 ipv6 混合 时 统一使用 ipv6
+	bs, err = NewPROXYHeader(2, "udp", src, dst, tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("hello")
+	h, hl, err := ReadPROXYHeaderFromPacket(append(bs, payload...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hl != len(bs) {
+		t.Fatal("header len wrong", hl, len(bs))
+	}
+	if h.TransportProtocol != proxyproto.UDPv6 {
+		t.Fatal("should be UDPv6", h.TransportProtocol)
+	}
+	sa, _, ok := h.UDPAddrs()
+	if !ok || !sa.IP.Equal(src.IP) || sa.Port != src.Port {
+		t.Fatal("source wrong", h.SourceAddr)
+	}
+	got, _ := h.TLVs()
+	if len(got) != 1 || string(got[0].Value) != "example.com" {
+		t.Fatal("tlv wrong", got)
+	}
+
+	//没有ip 时 使用 LOCAL
+	bs, err = NewPROXYHeader(2, "tcp", Addr{Name: "a.com"}, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err = proxyproto.Read(bufio.NewReader(bytes.NewReader(bs)))
+	if err != nil || h.Command != proxyproto.LOCAL {
+		t.Fatal("should be LOCAL", h, err)
+	}
+
+	if _, _, err = ReadPROXYHeaderFromPacket(payload); err != proxyproto.ErrNoProxyProtocol {
+		t.Fatal("should have no header", err)
+	}
+}
+
+func TestUDPListenerPROXY(t *testing.T) {
+	ul, err := NewUDPListenerPROXY(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+
+	c, err := net.DialUDP("udp", nil, ul.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	//没有头的包 会被丢弃
+	c.Write([]byte("no header"))
+
+	src := Addr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	bs, _ := NewPROXYHeader(2, "udp", src, Addr{IP: net.ParseIP("5.6.7.8"), Port: 53}, nil)
+	c.Write(append(bs, []byte("hello")...))
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		nc, _ := ul.Accept()
+		accepted <- nc
+	}()
+
+	var nc net.Conn
+	select {
+	case nc = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no conn accepted")
+	}
+
+	if nc.RemoteAddr().String() != "1.2.3.4:1234" {
+		t.Fatal("remote addr should be the PROXY source", nc.RemoteAddr())
+	}
+	if nc.(PROXYHeaderGetter).ProxyHeader() == nil {
+		t.Fatal("should have PROXY header")
+	}
+
+	buf := make([]byte, 100)
+	nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := nc.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("read wrong", string(buf[:n]), err)
+	}
+}
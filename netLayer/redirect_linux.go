@@ -0,0 +1,108 @@
+package netLayer
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/pires/go-proxyproto"
+	"golang.org/x/sys/unix"
+)
+
+/*
+iptables 的 REDIRECT / DNAT 会 改写 tcp连接 的 目标地址, 原始 目标地址 可以 用
+getsockopt(SOL_IP, SO_ORIGINAL_DST) 或 getsockopt(SOL_IPV6, IP6T_SO_ORIGINAL_DST) 从 conntrack 中 取得.
+
+与 tproxy 不同, REDIRECT 只需要 nat表, 不需要 策略路由 与 IP_TRANSPARENT, 但 只支持 tcp.
+*/
+
+const (
+	so_ORIGINAL_DST      = 80
+	ip6t_SO_ORIGINAL_DST = 80
+)
+
+// GetOriginalDst 返回 被 iptables REDIRECT 的 tcp连接 的 原始 目标地址.
+// c 可以是 包装过的 连接, 会 解包 到 底层的 syscall.Conn.
+//
+// 连接 没有被 REDIRECT 时 (如 直接 连接 监听端口), 内核 会返回 本地地址 或 ENOENT, 此时 返回 错误.
+func GetOriginalDst(c net.Conn) (Addr, error) {
+	base := unwrapToSyscallConn(c)
+	if base == nil {
+		return Addr{}, utils.ErrInErr{ErrDesc: "GetOriginalDst, can't get syscall.Conn", ErrDetail: utils.ErrWrongParameter}
+	}
+	rc, err := base.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return Addr{}, err
+	}
+
+	//PROXY protocol 的 连接 的 LocalAddr 是 头中的 地址, 所以 要用 解包后 的
+	la, _ := base.LocalAddr().(*net.TCPAddr)
+	is4 := la != nil && la.IP.To4() != nil
+
+	var ip net.IP
+	var port int
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if is4 {
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, so_ORIGINAL_DST)
+			if sockErr == nil {
+				ip, port = parseOriginalDst4(mreq)
+			}
+			return
+		}
+		var info *unix.IPv6MTUInfo
+		info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6t_SO_ORIGINAL_DST)
+		if sockErr == nil {
+			ip, port = parseOriginalDst6(info)
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return Addr{}, utils.ErrInErr{ErrDesc: "GetOriginalDst failed", ErrDetail: err}
+	}
+
+	if la != nil && la.Port == port && la.IP.Equal(ip) {
+		return Addr{}, utils.ErrInErr{ErrDesc: "GetOriginalDst, conn is not redirected", ErrDetail: utils.ErrInvalidData, Data: la.String()}
+	}
+
+	return Addr{Network: "tcp", IP: ip, Port: port}, nil
+}
+
+// SO_ORIGINAL_DST 返回的 是 sockaddr_in, 这里 借用 大小 相同 的 IPv6Mreq 读取: 2字节 family, 2字节 网络字节序 端口, 4字节 ip
+func parseOriginalDst4(mreq *unix.IPv6Mreq) (net.IP, int) {
+	port := int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4]))
+	ip := net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+	return ip, port
+}
+
+// IP6T_SO_ORIGINAL_DST 返回的 是 sockaddr_in6, 即 IPv6MTUInfo 的 Addr 字段; 其 Port 为 网络字节序
+func parseOriginalDst6(info *unix.IPv6MTUInfo) (net.IP, int) {
+	portBytes := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	port := int(binary.BigEndian.Uint16(portBytes[:]))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, info.Addr.Addr[:])
+	return ip, port
+}
+
+// 一直 解包 (ConnWrapper, 以及 PROXY protocol 监听 得到的 连接), 直到 得到 实现了 syscall.Conn 的 连接; 没有 则 返回 nil
+func unwrapToSyscallConn(c net.Conn) net.Conn {
+	for c != nil {
+		if _, ok := c.(syscall.Conn); ok {
+			return c
+		}
+		switch x := c.(type) {
+		case ConnWrapper:
+			c = x.Upstream()
+		case *proxyproto.Conn:
+			c = x.Raw()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package netLayer
+
+import (
+	"net"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// 没有 被 REDIRECT 的 连接 应 返回 错误
+func TestGetOriginalDst(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+		if err != nil {
+			t.Log("skip", ip, err)
+			continue
+		}
+		defer l.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				accepted <- c
+			}
+		}()
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		sc := <-accepted
+		defer sc.Close()
+
+		if a, err := GetOriginalDst(sc); err == nil {
+			t.Fatal("should fail", ip, a.String())
+		} else {
+			t.Log(ip, err)
+		}
+	}
+}
+
+// 按 内核 填写 的 字节 构造 sockaddr_in 与 sockaddr_in6, 检查 解析 结果
+func TestParseOriginalDst(t *testing.T) {
+	sa4 := []byte{
+		unix.AF_INET, 0, //family, 主机字节序, 不读取
+		0x1f, 0x90, //port 8080, 网络字节序
+		93, 184, 216, 34,
+		0, 0, 0, 0, 0, 0, 0, 0, //sin_zero
+	}
+	var mreq unix.IPv6Mreq //20字节, 内核 只 写入 前 16字节
+	if len(sa4) > int(unsafe.Sizeof(mreq)) {
+		t.Fatal("IPv6Mreq too small for sockaddr_in", unsafe.Sizeof(mreq))
+	}
+	copy((*[unsafe.Sizeof(mreq)]byte)(unsafe.Pointer(&mreq))[:], sa4)
+
+	ip, port := parseOriginalDst4(&mreq)
+	if !ip.Equal(net.IPv4(93, 184, 216, 34)) || port != 8080 {
+		t.Fatal("ipv4 parse wrong", ip, port)
+	}
+
+	want6 := net.ParseIP("2001:db8::1:2")
+	sa6 := []byte{
+		unix.AF_INET6, 0,
+		0x01, 0xbb, //port 443
+		0, 0, 0, 0, //flowinfo
+	}
+	sa6 = append(sa6, want6...)
+	sa6 = append(sa6, 0, 0, 0, 0) //scope_id
+
+	var info unix.IPv6MTUInfo
+	if len(sa6) != int(unsafe.Sizeof(info.Addr)) {
+		t.Fatal("sockaddr_in6 size mismatch", unsafe.Sizeof(info.Addr))
+	}
+	copy((*[unsafe.Sizeof(info.Addr)]byte)(unsafe.Pointer(&info.Addr))[:], sa6)
+
+	ip, port = parseOriginalDst6(&info)
+	if !ip.Equal(want6) || port != 443 {
+		t.Fatal("ipv6 parse wrong", ip, port)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package netLayer
+
+import (
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// GetOriginalDst 只 支持 linux.
+func GetOriginalDst(c net.Conn) (Addr, error) {
+	return Addr{}, utils.ErrUnImplemented
+}
@@ -4,8 +4,10 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"go.uber.org/zap"
@@ -28,6 +30,24 @@ func CanWEverSplice(writeConn io.Writer) (wCanSplice bool) {
 //
 // identity只用于debug 日志输出.
 func TryCopy(writeConn io.Writer, readConn io.Reader, id uint32) (allnum int64, err error) {
+	return TryCopyWithCounter(writeConn, readConn, id, nil)
+}
+
+// TryCopyWithCounter 与 TryCopy 相同, 但若 counter 给出, 会在 拷贝过程中 实时地 将 写入的字节数 原子地 加到 counter 上.
+// splice 时 只能 分块 得知 进度, 见 spliceCountChunkLen; 若 最终 是 由 Splicer 进行的 splice, 则 只会在 拷贝结束后 一次性 加上.
+func TryCopyWithCounter(writeConn io.Writer, readConn io.Reader, id uint32, counter *uint64) (allnum int64, err error) {
+	return tryCopy(writeConn, readConn, id, counter, false)
+}
+
+// noSplice 为 true 时 不进行 splice, 以 保证 counter 是 实时的 (splice 时 只能 分块 得知 进度). 用于 Relay 的 空闲检测.
+func tryCopy(writeConn io.Writer, readConn io.Reader, id uint32, counter *uint64, noSplice bool) (allnum int64, err error) {
+	add := func(n int64) {
+		allnum += n
+		if counter != nil && n > 0 {
+			atomic.AddUint64(counter, uint64(n))
+		}
+	}
+
 	var multiWriter utils.MultiWriter
 
 	var rawReadConn syscall.RawConn
@@ -48,7 +68,7 @@ func TryCopy(writeConn io.Writer, readConn io.Reader, id uint32) (allnum int64,
 		)
 	}
 
-	if SystemCanSplice {
+	if SystemCanSplice && !(noSplice && counter != nil) {
 
 		rCanSplice := CanRSplice(readConn)
 		wCanSplice := CanWEverSplice(writeConn)
@@ -91,7 +111,7 @@ func TryCopy(writeConn io.Writer, readConn io.Reader, id uint32) (allnum int64,
 							return
 						}
 						n2, err2 := writeConn.Write(bs[:n])
-						allnum += int64(n2)
+						add(int64(n2))
 						if err2 != nil {
 							err = err2
 							return
@@ -170,7 +190,7 @@ func TryCopy(writeConn io.Writer, readConn io.Reader, id uint32) (allnum int64,
 				}
 				n, err = writeConn.Write(bs[:n])
 
-				allnum += int64(n)
+				add(int64(n))
 				if err != nil {
 					return
 				}
@@ -228,7 +248,7 @@ func TryCopy(writeConn io.Writer, readConn io.Reader, id uint32) (allnum int64,
 
 			}
 
-			allnum += thisWriteNum
+			add(thisWriteNum)
 			if writeErr != nil {
 				err = writeErr
 				return
@@ -247,12 +267,77 @@ classic:
 	if ce := utils.CanLogDebug("copying with classic method"); ce != nil {
 		ce.Write(zap.Uint32("id", id))
 	}
-copy:
+	if counter != nil {
+		//不用readv 时 也会 到 这里, 此时 依然 可能 splice
+		if CanSpliceDirectly(writeConn, readConn) {
+			goto copy
+		}
 
+		//包装 一端 以 实时计数, 会 隐藏 被包装的 一端 的 WriterTo 或 ReaderFrom.
+		// io.Copy 优先 使用 readConn 的 WriterTo, 其次 是 writeConn 的 ReaderFrom, 所以 包装 不会被 io.Copy 用到的 那一端.
+		// 不过 ReaderFrom 的实现 若 要 判断 readConn 的 具体类型 (比如 要 splice), 依然 会 因为 包装 而 退化.
+		var n int64
+		var e error
+		if _, ok := readConn.(io.WriterTo); ok {
+			n, e = io.Copy(&countWriter{Writer: writeConn, counter: counter}, readConn)
+		} else {
+			n, e = io.Copy(writeConn, &countReader{Reader: readConn, counter: counter})
+		}
+		allnum += n
+		return allnum, e
+	}
+copy:
 	//Copy内部实现 会调用 ReadFrom, 而ReadFrom 会自动进行splice,
 	// 若无splice实现则直接使用原始方法 “循环读取 并 写入”
 	// 我们的 vless/trojan 和 ws 的Conn均实现了ReadFrom方法，可以最终splice
-	return io.Copy(writeConn, readConn)
+	if counter != nil && CanSpliceDirectly(writeConn, readConn) {
+		//TCPConn.ReadFrom 对 io.LimitedReader 依然会 splice, 所以 分块拷贝 即可 在 splice 时 也 得到 进度
+		for {
+			n, e := io.CopyN(writeConn, readConn, spliceCountChunkLen)
+			add(n)
+			if e != nil {
+				if e == io.EOF {
+					e = nil
+				}
+				return allnum, e
+			}
+		}
+	}
+
+	n, e := io.Copy(writeConn, readConn)
+	add(n)
+	return allnum, e
+}
+
+// TryCopyWithCounter 在 splice 时 每拷贝 这么多 字节 更新一次 counter
+const spliceCountChunkLen = 256 * 1024
+
+// 每次 Read 后 将 读到的 字节数 原子地 加到 counter 上
+type countReader struct {
+	io.Reader
+	counter *uint64
+}
+
+func (cr *countReader) Read(p []byte) (n int, err error) {
+	n, err = cr.Reader.Read(p)
+	if n > 0 {
+		atomic.AddUint64(cr.counter, uint64(n))
+	}
+	return
+}
+
+// 每次 Write 后 将 写入的 字节数 原子地 加到 counter 上
+type countWriter struct {
+	io.Writer
+	counter *uint64
+}
+
+func (cw *countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.Writer.Write(p)
+	if n > 0 {
+		atomic.AddUint64(cw.counter, uint64(n))
+	}
+	return
 }
 
 // 类似TryCopy，但是只会读写一次; 因为只读写一次，所以没办法splice
@@ -317,71 +402,116 @@ classic:
 // UseReadv==true 时 内部使用 TryCopy 进行拷贝,
 // 会自动优选 splice，readv，不行则使用经典拷贝.
 //
-// 拷贝完成后会主动关闭双方连接.
+// 某一方向 读到 EOF 后, 若 RelayHalfClose 为 true 且 写入端 支持 CloseWrite, 则 只 半关闭 写入端, 继续 转发 另一方向;
+// 否则 主动关闭 双方连接. 双向 都结束后 也会 主动关闭 双方连接. 超时 见 RelayIdleTimeout 与 RelayHalfClose.
+//
 // 返回从 rc读取到的总字节长度（即下载流量）. 如果 downloadByteCount, uploadByteCount 给出,
 // 则会 分别原子更新 上传和下载的总字节数. identity 用于输出日志。
 func Relay(realTargetAddr *Addr, rc, lc io.ReadWriteCloser, identity uint32, downloadByteCount, uploadByteCount *uint64) int64 {
+	return RelayWithCounter(realTargetAddr, rc, lc, identity, downloadByteCount, uploadByteCount, nil)
+}
+
+// LiveCounter 记录 单个连接 实时的 上传和下载 字节数
+type LiveCounter struct {
+	Download uint64
+	Upload   uint64
+}
 
-	if utils.LogLevel == utils.Log_debug {
+// RelayWithCounter 与 Relay 相同, 但若 counter 给出, 会在 转发过程中 实时地 更新 counter.
+// downloadByteCount, uploadByteCount 依然 只在 转发结束后 才更新.
+func RelayWithCounter(realTargetAddr *Addr, rc, lc io.ReadWriteCloser, identity uint32, downloadByteCount, uploadByteCount *uint64, counter *LiveCounter) int64 {
+	//空闲检测 需要 实时的 计数, 所以 需要 空闲检测 时 不 splice
+	noSplice := relayNeedsIdleWatch()
+	if counter == nil && noSplice {
+		counter = new(LiveCounter)
+	}
+
+	var liveDownload, liveUpload *uint64
+	if counter != nil {
+		liveDownload = &counter.Download
+		liveUpload = &counter.Upload
+	}
+
+	isDebug := utils.LogLevel == utils.Log_debug
+
+	var rtaddrStr string
+	if isDebug {
+		rtaddrStr = realTargetAddr.String()
+	}
+
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			lc.Close()
+			rc.Close()
+		})
+	}
+
+	w := newRelayWatcher(counter, func() {
+		if ce := utils.CanLogDebug("Relay idle timeout"); ce != nil {
+			ce.Write(zap.Uint32("id", identity), zap.String("target", realTargetAddr.String()))
+		}
+		closeBoth()
+	})
+	w.setTimeout(RelayIdleTimeout)
+	defer w.stop()
+	upDone := make(chan struct{})
 
-		rtaddrStr := realTargetAddr.String()
-		go func() {
-			n, e := TryCopy(rc, lc, identity)
+	go func() {
+		n, e := tryCopy(rc, lc, identity, liveUpload, noSplice)
 
+		if isDebug {
 			utils.CanLogDebug("Relay End").Write(zap.Uint32("id", identity),
 				zap.String("direction", "L->R"),
 				zap.String("target", rtaddrStr),
 				zap.Int64("bytes", n),
 				zap.Error(e),
 			)
+		}
 
-			lc.Close()
-			rc.Close()
-
-			if uploadByteCount != nil {
-				atomic.AddUint64(uploadByteCount, uint64(n))
-			}
+		if isEOF(e) && RelayHalfClose && CloseWrite(rc) == nil {
+			w.setTimeout(orDuration(RelayDownlinkOnlyTimeout, RelayIdleTimeout))
+		} else {
+			closeBoth()
+		}
 
-		}()
+		if uploadByteCount != nil {
+			atomic.AddUint64(uploadByteCount, uint64(n))
+		}
+		close(upDone)
+	}()
 
-		n, e := TryCopy(lc, rc, identity)
+	n, e := tryCopy(lc, rc, identity, liveDownload, noSplice)
 
+	if isDebug {
 		utils.CanLogDebug("Relay End").Write(zap.Uint32("id", identity),
 			zap.String("direction", "R->L"),
 			zap.String("target", rtaddrStr),
 			zap.Int64("bytes", n),
 			zap.Error(e),
 		)
+	}
 
-		lc.Close()
-		rc.Close()
-
-		if downloadByteCount != nil {
-			atomic.AddUint64(downloadByteCount, uint64(n))
-		}
-		return n
-	} else {
-		go func() {
-			n, _ := TryCopy(rc, lc, identity)
-
-			lc.Close()
-			rc.Close()
-
-			if uploadByteCount != nil {
-				atomic.AddUint64(uploadByteCount, uint64(n))
-			}
-
-		}()
+	if isEOF(e) && RelayHalfClose && CloseWrite(lc) == nil {
+		//下行 已经 半关闭, 等待 上行 结束
+		w.setTimeout(orDuration(RelayUplinkOnlyTimeout, RelayIdleTimeout))
+		<-upDone
+	}
+	closeBoth()
 
-		n, _ := TryCopy(lc, rc, identity)
+	if downloadByteCount != nil {
+		atomic.AddUint64(downloadByteCount, uint64(n))
+	}
+	return n
+}
 
-		lc.Close()
-		rc.Close()
+func isEOF(e error) bool {
+	return e == nil || e == io.EOF
+}
 
-		if downloadByteCount != nil {
-			atomic.AddUint64(downloadByteCount, uint64(n))
-		}
-		return n
+func orDuration(d, fallback time.Duration) time.Duration {
+	if d > 0 {
+		return d
 	}
-
+	return fallback
 }
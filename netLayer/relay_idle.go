@@ -0,0 +1,130 @@
+package netLayer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 半关闭 后 剩下的 方向 可能 还要 传输 很久, 比如 ssh host cmd < file 在 上传完 file 后
+// 还要 等 cmd 运行 并 返回 结果, 所以 默认值 不能 太小.
+const (
+	DefaultRelayUplinkOnlyTimeout   = 30 * time.Second
+	DefaultRelayDownlinkOnlyTimeout = 30 * time.Second
+)
+
+var (
+	// Relay 时 某一方向 读到 EOF 后, 是否 尝试 只 半关闭 另一端 的 写入, 而 继续 转发 另一方向.
+	// 为 false 时 与 以前一样, 任一方向 结束 都会 直接 关闭 双方连接.
+	//
+	// 开启后 剩下的 方向 的 空闲超时 为 RelayUplinkOnlyTimeout / RelayDownlinkOnlyTimeout,
+	// 而 空闲检测 需要 实时的 计数, 所以 tcp 转发 不会再 splice.
+	//
+	// 另一端 不支持 半关闭 (没有 实现 CloseWriter) 时, 依然 直接 关闭 双方连接.
+	// 比如 ws (close帧 就是 完全关闭) 和 smux/smux2/mux.cool 的 stream.
+	RelayHalfClose bool
+
+	// Relay 双向 都 没有 数据 超过 该时间 则 关闭 双方连接. 0 表示 不超时. 大于0 时 tcp 转发 不会再 splice.
+	RelayIdleTimeout time.Duration
+
+	// 下行 已经 结束 (半关闭) 后, 上行 没有 数据 超过 该时间 则 关闭 双方连接. 0 表示 使用 RelayIdleTimeout.
+	// 只在 RelayHalfClose 时 有效. 若 与 RelayIdleTimeout 都为0, 对方 一直不关闭 时 连接 不会 被释放.
+	RelayUplinkOnlyTimeout = DefaultRelayUplinkOnlyTimeout
+
+	// 上行 已经 结束 (半关闭) 后, 下行 没有 数据 超过 该时间 则 关闭 双方连接. 0 表示 使用 RelayIdleTimeout.
+	// 只在 RelayHalfClose 时 有效.
+	RelayDownlinkOnlyTimeout = DefaultRelayDownlinkOnlyTimeout
+)
+
+// Relay 是否 需要 空闲检测. 需要时 tcp 转发 不会 splice, 因为 splice 时 计数 不是 实时的.
+func relayNeedsIdleWatch() bool {
+	return RelayIdleTimeout > 0 || (RelayHalfClose && (RelayUplinkOnlyTimeout > 0 || RelayDownlinkOnlyTimeout > 0))
+}
+
+// relayWatcher 用于 Relay 的 空闲检测. 每隔 timeout 检查一次 计数 是否 有变化, 没有变化 则 调用 onIdle,
+// 所以 实际的 超时时间 在 timeout 与 2*timeout 之间. 计数 必须 是 实时的, 见 relayNeedsIdleWatch.
+//
+// nil 的 relayWatcher 可以 安全地 调用 所有方法.
+type relayWatcher struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	timeout time.Duration
+	stopped bool
+
+	counter *LiveCounter
+	last    uint64
+
+	onIdle func()
+}
+
+// counter 为 nil 时 返回 nil
+func newRelayWatcher(counter *LiveCounter, onIdle func()) *relayWatcher {
+	if counter == nil {
+		return nil
+	}
+	return &relayWatcher{
+		counter: counter,
+		onIdle:  onIdle,
+	}
+}
+
+func (w *relayWatcher) total() uint64 {
+	return atomic.LoadUint64(&w.counter.Download) + atomic.LoadUint64(&w.counter.Upload)
+}
+
+// 设置 新的 超时时间 并 重新开始 计时. d <= 0 表示 不再 超时.
+func (w *relayWatcher) setTimeout(d time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		return
+	}
+	w.timeout = d
+	w.last = w.total()
+
+	if d <= 0 {
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(d, w.check)
+	} else {
+		w.timer.Reset(d)
+	}
+}
+
+func (w *relayWatcher) check() {
+	w.mu.Lock()
+	if w.stopped || w.timeout <= 0 {
+		w.mu.Unlock()
+		return
+	}
+	if now := w.total(); now != w.last {
+		w.last = now
+		w.timer.Reset(w.timeout)
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	w.mu.Unlock()
+
+	w.onIdle()
+}
+
+func (w *relayWatcher) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mu.Unlock()
+}
@@ -0,0 +1,219 @@
+package netLayer
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 返回 一对 互相连接的 tcp 连接
+func tcpPair(t *testing.T) (a, b *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ch := make(chan net.Conn)
+	go func() {
+		c, _ := ln.Accept()
+		ch <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-ch
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// client -> lc | Relay | rc -> target. client 写完 后 半关闭, target 读到 EOF 后 才 回复.
+func TestRelayHalfClose(t *testing.T) {
+	RelayHalfClose = true
+	defer func() { RelayHalfClose = false }()
+
+	client, lc := tcpPair(t)
+	rc, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	done := make(chan struct{})
+	go func() {
+		Relay(&Addr{Network: "tcp"}, rc, lc, 0, nil, nil)
+		close(done)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	target.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	client.CloseWrite()
+
+	req, err := io.ReadAll(target)
+	if err != nil || string(req) != "request" {
+		t.Fatal("target read wrong", string(req), err)
+	}
+	if _, err = target.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+
+	resp, err := io.ReadAll(client)
+	if err != nil || string(resp) != "response" {
+		t.Fatal("client read wrong", string(resp), err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not finished")
+	}
+}
+
+// target 读到 EOF 后 既不回复 也不关闭, 下行 的 空闲超时 到了 就 应该 关闭 双方.
+func TestRelayHalfCloseTimeout(t *testing.T) {
+	RelayHalfClose = true
+	old := RelayDownlinkOnlyTimeout
+	RelayDownlinkOnlyTimeout = 100 * time.Millisecond
+	defer func() {
+		RelayHalfClose = false
+		RelayDownlinkOnlyTimeout = old
+	}()
+
+	client, lc := tcpPair(t)
+	rc, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	done := make(chan struct{})
+	go func() {
+		Relay(&Addr{Network: "tcp"}, rc, lc, 0, nil, nil)
+		close(done)
+	}()
+
+	client.Write([]byte("request"))
+	client.CloseWrite()
+
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if req, err := io.ReadAll(target); err != nil || string(req) != "request" {
+		t.Fatal("target read wrong", string(req), err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("half closed relay not closed")
+	}
+}
+
+// 不实现 CloseWriter 的 连接, 比如 ws 和 smux 的 stream
+type noCloseWriteConn struct {
+	net.Conn
+}
+
+// target 半关闭 后, lc 无法 半关闭, 所以 Relay 应 直接 关闭 双方, 而不是 等 client 也 结束.
+func TestRelayHalfCloseFallback(t *testing.T) {
+	RelayHalfClose = true
+	defer func() { RelayHalfClose = false }()
+
+	client, lc := tcpPair(t)
+	rc, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	if err := CloseWrite(noCloseWriteConn{lc}); err == nil {
+		t.Fatal("noCloseWriteConn should not support CloseWrite")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Relay(&Addr{Network: "tcp"}, rc, noCloseWriteConn{lc}, 0, nil, nil)
+		close(done)
+	}()
+
+	target.Write([]byte("response"))
+	target.CloseWrite()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if resp, err := io.ReadAll(client); err != nil || string(resp) != "response" {
+		t.Fatal("client read wrong", string(resp), err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay should fall back to full close")
+	}
+
+	//rc 已被 完全关闭, target 读到 EOF
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(target); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	old := RelayIdleTimeout
+	RelayIdleTimeout = 100 * time.Millisecond
+	defer func() { RelayIdleTimeout = old }()
+
+	client, lc := tcpPair(t)
+	rc, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	done := make(chan struct{})
+	go func() {
+		Relay(&Addr{Network: "tcp"}, rc, lc, 0, nil, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle relay not closed")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("client should be closed")
+	}
+}
+
+type writerToReader struct {
+	io.Reader
+	used bool
+}
+
+func (r *writerToReader) WriteTo(w io.Writer) (int64, error) {
+	r.used = true
+	return io.Copy(w, r.Reader)
+}
+
+// 实时计数 时 readConn 的 WriterTo 依然 会被 使用
+func TestTryCopyWithCounterWriterTo(t *testing.T) {
+	old := UseReadv
+	UseReadv = false
+	defer func() { UseReadv = old }()
+
+	r := &writerToReader{Reader: strings.NewReader("hello")}
+	var w strings.Builder
+	var counter uint64
+	n, err := TryCopyWithCounter(&w, r, 0, &counter)
+	if err != nil || n != 5 || w.String() != "hello" {
+		t.Fatal("copy wrong", n, err, w.String())
+	}
+	if !r.used {
+		t.Fatal("WriterTo should be used")
+	}
+	if counter != 5 {
+		t.Fatal("counter wrong", counter)
+	}
+}
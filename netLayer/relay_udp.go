@@ -101,23 +101,10 @@ func RelayUDP(rc, lc MsgConn, downloadByteCount, uploadByteCount *uint64) uint64
 
 		var lcReadErr bool
 
-		for {
-			bs, raddr, err := lc.ReadMsg()
-			if err != nil {
-				lcReadErr = true
-				break
-			}
-
-			if ce := utils.CanLogDebug("RelayUDP will write to"); ce != nil {
-				ce.Write(zap.String("src addr", raddr.String()), zap.Int("len", len(bs)))
-			}
-
-			err = rc.WriteMsg(bs, raddr)
-			if err != nil {
-				break
-			}
-
-			count += uint64(len(bs))
+		if br, bw, ok := asBatchMsgConns(lc, rc); ok {
+			count, lcReadErr = relayUDPMsgs(br, bw, nil)
+		} else {
+			count, lcReadErr = relayUDPOneByOne(lc, rc)
 		}
 
 		if !isfullcone {
@@ -162,33 +149,100 @@ func relayUDP_rc_toLC(rc, lc MsgConn, downloadByteCount *uint64, mutex *sync.RWM
 
 	var count uint64
 	var rcwrong bool
+
+	if br, bw, ok := asBatchMsgConns(rc, lc); ok {
+		count, rcwrong = relayUDPMsgs(br, bw, mutex)
+	} else {
+		for {
+			bs, raddr, err := rc.ReadMsg()
+			if err != nil {
+				rcwrong = true
+				break
+			}
+
+			if mutex != nil {
+				mutex.Lock()
+				err = lc.WriteMsg(bs, raddr)
+				mutex.Unlock()
+
+			} else {
+				err = lc.WriteMsg(bs, raddr)
+
+			}
+			if err != nil {
+				break
+			}
+			count += uint64(len(bs))
+		}
+	}
+
+	if downloadByteCount != nil {
+		atomic.AddUint64(downloadByteCount, count)
+	}
+
+	return count, rcwrong
+}
+
+// 从 lc 逐个 读取 并 写入 rc. 返回 写入的 字节数, 以及 是否 是 lc 读取 出错 导致的 退出
+func relayUDPOneByOne(lc, rc MsgConn) (count uint64, lcReadErr bool) {
 	for {
-		bs, raddr, err := rc.ReadMsg()
+		bs, raddr, err := lc.ReadMsg()
 		if err != nil {
-			rcwrong = true
-			break
+			return count, true
+		}
+
+		if ce := utils.CanLogDebug("RelayUDP will write to"); ce != nil {
+			ce.Write(zap.String("src addr", raddr.String()), zap.Int("len", len(bs)))
+		}
+
+		err = rc.WriteMsg(bs, raddr)
+		if err != nil {
+			return
+		}
+
+		count += uint64(len(bs))
+	}
+}
+
+// from 可以 批量读 且 to 可以 批量写 时 返回 true
+func asBatchMsgConns(from, to MsgConn) (br MsgBatchReader, bw MsgBatchWriter, ok bool) {
+	if br, ok = from.(MsgBatchReader); !ok {
+		return
+	}
+	bw, ok = to.(MsgBatchWriter)
+	return
+}
+
+// 同 relayUDPOneByOne, 但 每次 读写 多个包, 见 UDPBatchConn. 若mutex给出，则 写入 时 会进行 锁定.
+func relayUDPMsgs(from MsgBatchReader, to MsgBatchWriter, mutex *sync.RWMutex) (count uint64, readErr bool) {
+	var msgs []AddrData
+	for {
+		var err error
+		msgs, err = from.ReadMsgs(msgs[:0])
+		if err != nil {
+			return count, true
+		}
+
+		if ce := utils.CanLogDebug("RelayUDP will write batch"); ce != nil {
+			ce.Write(zap.String("first src addr", msgs[0].Addr.String()), zap.Int("count", len(msgs)))
 		}
 
 		if mutex != nil {
 			mutex.Lock()
-			err = lc.WriteMsg(bs, raddr)
+			err = to.WriteMsgs(msgs)
 			mutex.Unlock()
-
 		} else {
-			err = lc.WriteMsg(bs, raddr)
-
+			err = to.WriteMsgs(msgs)
 		}
 		if err != nil {
-			break
+			return
 		}
-		count += uint64(len(bs))
-	}
 
-	if downloadByteCount != nil {
-		atomic.AddUint64(downloadByteCount, count)
+		for i := range msgs {
+			count += uint64(len(msgs[i].Data))
+			msgs[i] = AddrData{}
+		}
 	}
-
-	return count, rcwrong
 }
 
 // RelayUDP_separate 对 lc 读到的每一个新raddr地址 都新拨号一个rc. 这样就避开了经典的udp多路复用转发的效率低下问题.
@@ -368,3 +422,53 @@ func RelayUDP_separate(rc, lc MsgConn, firstAddr *Addr, downloadByteCount, uploa
 // type MsgConsumer interface {
 // 	ConsumeMsg(msg []byte, from, to Addr) (err error)
 // }
+
+// CountMsgConn 包装 本地一端 的 MsgConn, 在 ReadMsg 时 更新 Counter.Upload, 在 WriteMsg 时 更新 Counter.Download,
+// 用于 实时 统计 单个 udp 连接 的 流量.
+type CountMsgConn struct {
+	MsgConn
+	Counter *LiveCounter
+}
+
+func (cmc CountMsgConn) ReadMsg() ([]byte, Addr, error) {
+	bs, raddr, err := cmc.MsgConn.ReadMsg()
+	if len(bs) > 0 {
+		atomic.AddUint64(&cmc.Counter.Upload, uint64(len(bs)))
+	}
+	return bs, raddr, err
+}
+
+func (cmc CountMsgConn) WriteMsg(p []byte, peer Addr) error {
+	err := cmc.MsgConn.WriteMsg(p, peer)
+	if err == nil {
+		atomic.AddUint64(&cmc.Counter.Download, uint64(len(p)))
+	}
+	return err
+}
+
+// 实现 MsgBatchReader, 使 被包装的 MsgConn 依然 可以 批量读
+func (cmc CountMsgConn) ReadMsgs(dst []AddrData) ([]AddrData, error) {
+	start := len(dst)
+	dst, err := readMsgsFrom(cmc.MsgConn, dst)
+	var n uint64
+	for i := start; i < len(dst); i++ {
+		n += uint64(len(dst[i].Data))
+	}
+	if n > 0 {
+		atomic.AddUint64(&cmc.Counter.Upload, n)
+	}
+	return dst, err
+}
+
+// 实现 MsgBatchWriter, 使 被包装的 MsgConn 依然 可以 批量写
+func (cmc CountMsgConn) WriteMsgs(msgs []AddrData) error {
+	err := writeMsgsTo(cmc.MsgConn, msgs)
+	if err == nil {
+		var n uint64
+		for i := range msgs {
+			n += uint64(len(msgs[i].Data))
+		}
+		atomic.AddUint64(&cmc.Counter.Download, n)
+	}
+	return err
+}
@@ -50,6 +50,8 @@ type TargetDescription struct {
 	InTag string
 
 	UserIdentityStr string
+
+	Source Addr //客户端地址, 若 收到了 PROXY protocol 头, 则为 头中的 源地址
 }
 
 /*
@@ -60,7 +62,7 @@ Set 是 “集合” 的意思, 是一组相同类型的数据放到一起。
 	这里的相同点，就是它们同属于 将发往一个方向, 即同属一个路由策略。
 
 任意一个网络参数匹配后，都将发往相同的方向，由该方向OutTag 指定。
-若还给出了 InTags, Users 或 传输层, 则这些条件都通过后, 才进行网络层判断.
+若还给出了 InTags, Users, Sources 或 传输层, 则这些条件都通过后, 才进行网络层判断.
 */
 type RouteSet struct {
 	//网络层
@@ -80,6 +82,10 @@ type RouteSet struct {
 	//Users 包含所有可匹配的 用户的 identityStr
 	Users map[string]bool
 
+	//客户端 的 来源ip 范围 与 确定值
+	SourceRanger cidranger.Ranger
+	SourceIPs    map[netip.Addr]bool
+
 	//Regex是正则匹配域名.
 	Regex []*regexp.Regexp
 
@@ -119,6 +125,8 @@ func NewFullRouteSet() *RouteSet {
 		Domains:                        make(map[string]bool),
 		Full:                           make(map[string]bool),
 		Users:                          make(map[string]bool),
+		SourceRanger:                   cidranger.NewPCTrieRanger(),
+		SourceIPs:                      make(map[netip.Addr]bool),
 		Geosites:                       make([]string, 0),
 		InTags:                         make(map[string]bool),
 		Countries:                      make(map[string]bool),
@@ -153,10 +161,39 @@ func (rs *RouteSet) IsIn(td *TargetDescription) bool {
 		return false
 	}
 
+	if !rs.IsSourceIn(td.Source) {
+		return false
+	}
+
 	return rs.IsAddrIn(td.Addr)
 
 }
 
+// 没有 来源 限制 时 返回 true
+func (rs *RouteSet) IsSourceIn(a Addr) bool {
+	hasRanger := rs.SourceRanger != nil && rs.SourceRanger.Len() > 0
+	if !hasRanger && len(rs.SourceIPs) == 0 {
+		return true
+	}
+	if len(a.IP) == 0 {
+		return false
+	}
+	if ip4 := a.IP.To4(); ip4 != nil {
+		a.IP = ip4
+	}
+	if hasRanger {
+		if has, _ := rs.SourceRanger.Contains(a.IP); has {
+			return true
+		}
+	}
+	if len(rs.SourceIPs) > 0 {
+		if _, found := rs.SourceIPs[a.GetNetIPAddr()]; found {
+			return true
+		}
+	}
+	return false
+}
+
 func (rs *RouteSet) IsTransportProtocolAllowed(p uint16) bool {
 	return rs.AllowedTransportLayerProtocols&p > 0
 }
@@ -186,7 +223,7 @@ func (rs *RouteSet) IsTCPAllowed() bool {
 }
 
 func (rs *RouteSet) IsNoLimitForNetworkLayer() bool {
-	if (rs.NetRanger == nil || rs.NetRanger.Len() == 0) && len(rs.IPs) == 0 && len(rs.Match) == 0 && len(rs.Domains) == 0 && len(rs.Full) == 0 && len(rs.Countries) == 0 && len(rs.Geosites) == 0 {
+	if (rs.NetRanger == nil || rs.NetRanger.Len() == 0) && len(rs.IPs) == 0 && len(rs.Match) == 0 && len(rs.Domains) == 0 && len(rs.Full) == 0 && len(rs.Regex) == 0 && len(rs.Countries) == 0 && len(rs.Geosites) == 0 {
 		//如果仅限制了一个传输层协议，且本集合里没有任何其它内容，那就直接通过
 		return true
 	}
@@ -285,6 +322,8 @@ func (rs *RouteSet) Clone() (newOne *RouteSet) {
 		Domains:                        maps.Clone(rs.Domains),
 		Full:                           maps.Clone(rs.Full),
 		Users:                          maps.Clone(rs.Users),
+		SourceRanger:                   cidranger.NewPCTrieRanger(),
+		SourceIPs:                      maps.Clone(rs.SourceIPs),
 		Geosites:                       slices.Clone(rs.Geosites),
 		InTags:                         maps.Clone(rs.InTags),
 		OutTags:                        slices.Clone(rs.OutTags),
@@ -303,6 +342,17 @@ func (rs *RouteSet) Clone() (newOne *RouteSet) {
 		newOne.NetRanger.Insert(v)
 	}
 
+	if rs.SourceRanger != nil {
+		entries, _ = rs.SourceRanger.CoveredNetworks(*cidranger.AllIPv4)
+		for _, v := range entries {
+			newOne.SourceRanger.Insert(v)
+		}
+		ip6entries, _ = rs.SourceRanger.CoveredNetworks(*cidranger.AllIPv6)
+		for _, v := range ip6entries {
+			newOne.SourceRanger.Insert(v)
+		}
+	}
+
 	return
 }
 
@@ -22,6 +22,8 @@ type RuleConf struct {
 	IPs       []string `toml:"ip" json:"ip"`
 	Domains   []string `toml:"domain" json:"domain"`
 	Network   []string `toml:"network" json:"network"`
+
+	Sources []string `toml:"source" json:"source"` //客户端 来源ip, 格式 同 IPs
 }
 
 func (policy *RoutePolicy) LoadRulesForRoutePolicy(rules []*RuleConf) {
@@ -112,48 +114,54 @@ func LoadRuleForRouteSet(rule *RuleConf) (rs *RouteSet) {
 
 	//ip 过滤 需要 分辨 "private", cidr 和普通ip
 
-	for _, ipStr := range rule.IPs {
+	loadIPRules(rule.IPs, rs.NetRanger, rs.IPs)
+	loadIPRules(rule.Sources, rs.SourceRanger, rs.SourceIPs)
+
+	if len(rule.Network) > 0 {
+		rs.AllowedTransportLayerProtocols = 0 //因为 NewFullRouteSet 默认会同时允许 tcp和udp，所以在自定义网络层规则时，我们不用默认值。
+
+		for _, netStr := range rule.Network {
+			tp := StrToTransportProtocol(netStr)
+			rs.AllowedTransportLayerProtocols |= tp
+		}
+	}
+
+	return rs
+}
+
+// 将 ip, cidr 以及 "private" 加入 ranger 和 ips 中
+func loadIPRules(list []string, ranger cidranger.Ranger, ips map[netip.Addr]bool) {
+	for _, ipStr := range list {
 		if ipStr == "private" {
 
 			//https://www.arin.net/reference/research/statistics/address_filters/
 
 			if _, net, err := net.ParseCIDR("10.0.0.0/8"); err == nil {
-				rs.NetRanger.Insert(cidranger.NewBasicRangerEntry(*net))
+				ranger.Insert(cidranger.NewBasicRangerEntry(*net))
 			}
 			if _, net, err := net.ParseCIDR("172.16.0.0/12"); err == nil {
-				rs.NetRanger.Insert(cidranger.NewBasicRangerEntry(*net))
+				ranger.Insert(cidranger.NewBasicRangerEntry(*net))
 			}
 			if _, net, err := net.ParseCIDR("192.168.0.0/16"); err == nil {
-				rs.NetRanger.Insert(cidranger.NewBasicRangerEntry(*net))
+				ranger.Insert(cidranger.NewBasicRangerEntry(*net))
 			}
 
 			continue
 		}
 		if strings.Contains(ipStr, "/") {
 			if _, net, err := net.ParseCIDR(ipStr); err == nil {
-				rs.NetRanger.Insert(cidranger.NewBasicRangerEntry(*net))
+				ranger.Insert(cidranger.NewBasicRangerEntry(*net))
 			}
 			continue
 		}
 
 		na, e := netip.ParseAddr(ipStr)
 		if e == nil {
-			rs.IPs[na] = true
+			ips[na] = true
 		} else {
 			if ce := utils.CanLogErr("LoadRuleForRouteSet, parse ip failed"); ce != nil {
 				ce.Write(zap.String("ipStr", ipStr), zap.Error(e))
 			}
 		}
 	}
-
-	if len(rule.Network) > 0 {
-		rs.AllowedTransportLayerProtocols = 0 //因为 NewFullRouteSet 默认会同时允许 tcp和udp，所以在自定义网络层规则时，我们不用默认值。
-
-		for _, netStr := range rule.Network {
-			tp := StrToTransportProtocol(netStr)
-			rs.AllowedTransportLayerProtocols |= tp
-		}
-	}
-
-	return rs
 }
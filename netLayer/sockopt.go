@@ -3,6 +3,7 @@ package netLayer
 import (
 	"net"
 	"os"
+	"syscall"
 )
 
 // 用于 listen和 dial 配置一些底层参数.
@@ -12,6 +13,17 @@ type Sockopt struct {
 	BBR    bool   `toml:"bbr"`    //only linux
 	Device string `toml:"device"`
 
+	//only linux/darwin. 为 N 时 设置 SO_REUSEPORT, 且 N>1 时 tcp 会 同时 监听 N 个 socket, 每个 都有 自己的 accept 循环, 由 内核 分配 新连接.
+	ReusePort int `toml:"reuse_port"`
+
+	//only linux, 内核 5.6+. 监听 与 拨号 tcp 时 使用 Multipath TCP; 内核 不支持 时 自动 回落 到 普通 tcp.
+	MPTCP bool `toml:"mptcp"`
+
+	KeepAliveIdle     int `toml:"keepalive_idle"`     //秒. 连接 空闲 多久后 开始 发送 keepalive 探测. 给出 任一 keepalive 项 即 开启 keepalive
+	KeepAliveInterval int `toml:"keepalive_interval"` //秒. 探测 的 间隔
+	KeepAliveCount    int `toml:"keepalive_count"`    //连续 多少次 探测 没有回应 后 断开. only linux/darwin
+	UserTimeout       int `toml:"user_timeout"`       //毫秒. TCP_USER_TIMEOUT, 发出的数据 多久 没有被确认 就 断开. only linux
+
 	//fastopen 不予支持, 因为自己客户端在重重网关之下，不可能让层层网关都支持tcp fast open；
 	// 而自己的远程节点的话因为本来网速就很快, 也不需要fastopen，总之 因为木桶原理，慢的地方在我们层层网关, 所以fastopen 意义不大.
 
@@ -37,3 +49,53 @@ func SetSockOptForListener(tcplistener ListenerWithFile, sockopt *Sockopt, isudp
 	defer fileDescriptorSource.Close()
 	SetSockOpt(int(fileDescriptorSource.Fd()), sockopt, isudp, isipv6)
 }
+
+func (so *Sockopt) hasKeepAlive() bool {
+	return so.KeepAliveIdle > 0 || so.KeepAliveInterval > 0 || so.KeepAliveCount > 0
+}
+
+// 是否 有 需要 在 每个 tcp连接 上 设置 的 选项
+func (so *Sockopt) hasTCPConnOpt() bool {
+	return so.hasKeepAlive() || so.UserTimeout > 0
+}
+
+// 使 sockopt 在 拨号 连接前 被应用.
+func setDialerSockopt(d *net.Dialer, sockopt *Sockopt, isudp bool, isipv6 bool) {
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			SetSockOpt(int(fd), sockopt, isudp, isipv6)
+		})
+	}
+	if !isudp && sockopt.hasKeepAlive() {
+		d.KeepAlive = -1 //否则 net包 会在 连接后 用 默认值 覆盖 我们设置的 keepalive 参数
+	}
+}
+
+// 对 已建立的 tcp连接 设置 keepalive 与 user timeout
+func setTCPConnSockopt(c net.Conn, sockopt *Sockopt) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		setTCPConnOpt(int(fd), sockopt)
+	})
+}
+
+// net包 在 accept 后 会用 默认的 keepalive 参数 覆盖 从 监听socket 继承来的 设置, 所以 要 重新设置.
+type sockoptListener struct {
+	net.Listener
+	sockopt *Sockopt
+}
+
+func (l sockoptListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		setTCPConnSockopt(c, l.sockopt)
+	}
+	return c, err
+}
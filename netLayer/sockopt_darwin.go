@@ -12,6 +12,32 @@ func SetSockOpt(fd int, sockopt *Sockopt, isudp bool, isipv6 bool) {
 	if sockopt.Device != "" {
 		bindToDevice(fd, sockopt.Device, isipv6)
 	}
+
+	if sockopt.ReusePort > 0 {
+		setsockoptIntOrLog(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1, "set SO_REUSEPORT failed")
+	}
+
+	if !isudp {
+		setTCPConnOpt(fd, sockopt)
+	}
+}
+
+// darwin 没有 TCP_USER_TIMEOUT
+func setTCPConnOpt(fd int, sockopt *Sockopt) {
+	if !sockopt.hasKeepAlive() {
+		return
+	}
+	setsockoptIntOrLog(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1, "set SO_KEEPALIVE failed")
+
+	if sockopt.KeepAliveIdle > 0 {
+		setsockoptIntOrLog(fd, unix.IPPROTO_TCP, unix.TCP_KEEPALIVE, sockopt.KeepAliveIdle, "set TCP_KEEPALIVE failed")
+	}
+	if sockopt.KeepAliveInterval > 0 {
+		setsockoptIntOrLog(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, sockopt.KeepAliveInterval, "set TCP_KEEPINTVL failed")
+	}
+	if sockopt.KeepAliveCount > 0 {
+		setsockoptIntOrLog(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, sockopt.KeepAliveCount, "set TCP_KEEPCNT failed")
+	}
 }
 
 func bindToDevice(fd int, device string, is6 bool) {
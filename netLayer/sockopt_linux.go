@@ -38,6 +38,33 @@ func SetSockOpt(fd int, sockopt *Sockopt, isudp bool, isipv6 bool) {
 		}
 	}
 
+	if sockopt.ReusePort > 0 {
+		setsockoptIntOrLog(fd, syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1, "set SO_REUSEPORT failed")
+	}
+
+	if !isudp {
+		setTCPConnOpt(fd, sockopt)
+	}
+}
+
+func setTCPConnOpt(fd int, sockopt *Sockopt) {
+	if sockopt.hasKeepAlive() {
+		setsockoptIntOrLog(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1, "set SO_KEEPALIVE failed")
+
+		if sockopt.KeepAliveIdle > 0 {
+			setsockoptIntOrLog(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, sockopt.KeepAliveIdle, "set TCP_KEEPIDLE failed")
+		}
+		if sockopt.KeepAliveInterval > 0 {
+			setsockoptIntOrLog(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, sockopt.KeepAliveInterval, "set TCP_KEEPINTVL failed")
+		}
+		if sockopt.KeepAliveCount > 0 {
+			setsockoptIntOrLog(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, sockopt.KeepAliveCount, "set TCP_KEEPCNT failed")
+		}
+	}
+
+	if sockopt.UserTimeout > 0 {
+		setsockoptIntOrLog(fd, syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, sockopt.UserTimeout, "set TCP_USER_TIMEOUT failed")
+	}
 }
 
 func bindToDevice(fd int, device string) {
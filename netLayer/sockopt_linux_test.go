@@ -0,0 +1,206 @@
+package netLayer
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func getConnSockoptInt(t *testing.T, c net.Conn, level, opt int) int {
+	rc, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// 多个 accept 循环 都 应 收到 连接, 且 accept 得到的 连接 上 keepalive 参数 不应 被 net包 覆盖
+func TestListenReusePort(t *testing.T) {
+	so := &Sockopt{ReusePort: 4, KeepAliveIdle: 7, KeepAliveInterval: 3, KeepAliveCount: 2, UserTimeout: 5000}
+
+	accepted := make(chan net.Conn, 64)
+	l, err := ListenAndAccept("tcp", "127.0.0.1:0", so, 0, func(c net.Conn) {
+		accepted <- c
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	rl, ok := l.(*ReusePortListener)
+	if !ok || len(rl.Listeners) != 4 {
+		t.Fatal("should be ReusePortListener with 4 listeners", l)
+	}
+	for _, x := range rl.Listeners {
+		if x.Addr().String() != l.Addr().String() {
+			t.Fatal("should listen on the same addr", x.Addr(), l.Addr())
+		}
+	}
+
+	const connCount = 32
+	for i := 0; i < connCount; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	for i := 0; i < connCount; i++ {
+		var c net.Conn
+		select {
+		case c = <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("accept timeout", i)
+		}
+		defer c.Close()
+
+		if i > 0 {
+			continue
+		}
+		if v := getConnSockoptInt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != 7 {
+			t.Fatal("TCP_KEEPIDLE wrong", v)
+		}
+		if v := getConnSockoptInt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); v != 3 {
+			t.Fatal("TCP_KEEPINTVL wrong", v)
+		}
+		if v := getConnSockoptInt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT); v != 2 {
+			t.Fatal("TCP_KEEPCNT wrong", v)
+		}
+		if v := getConnSockoptInt(t, c, syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT); v != 5000 {
+			t.Fatal("TCP_USER_TIMEOUT wrong", v)
+		}
+	}
+
+	a := Addr{Network: "tcp", IP: net.IPv4(127, 0, 0, 1), Port: l.Addr().(*net.TCPAddr).Port}
+	c, err := a.DialWithOpt(so, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := getConnSockoptInt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != 7 {
+		t.Fatal("dialed TCP_KEEPIDLE wrong", v)
+	}
+}
+
+// 与 listenTCPWithOpt 一样 建立 多个 同地址 的 socket, 但 各自 记录 accept 到的 连接, 内核 应 把 连接 分配给 每一个.
+func TestListenReusePortDistribution(t *testing.T) {
+	so := &Sockopt{ReusePort: 4}
+	ta := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	type acceptedBy struct {
+		index int
+		c     net.Conn
+	}
+	accepted := make(chan acceptedBy, 256)
+
+	for i := 0; i < so.ReusePort; i++ {
+		l, err := listenOneTCPWithOpt("tcp", ta, so)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if i == 0 {
+			ta = l.Addr().(*net.TCPAddr)
+		}
+		go loopAccept(l, 0, func(i int) func(net.Conn) {
+			return func(c net.Conn) { accepted <- acceptedBy{index: i, c: c} }
+		}(i))
+	}
+
+	//每个 连接 的 源端口 不同, 内核 按 四元组 哈希 分配; 128个 连接 中 某个 socket 一个 都 没 分到 的 概率 可以 忽略
+	const connCount = 128
+	for i := 0; i < connCount; i++ {
+		c, err := net.Dial("tcp", ta.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	counts := make([]int, so.ReusePort)
+	for i := 0; i < connCount; i++ {
+		select {
+		case a := <-accepted:
+			counts[a.index]++
+			a.c.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatal("accept timeout", i, counts)
+		}
+	}
+	for i, n := range counts {
+		if n == 0 {
+			t.Fatal("listener got no conn", i, counts)
+		}
+	}
+	t.Log(counts)
+}
+
+func TestMPTCP(t *testing.T) {
+	so := &Sockopt{MPTCP: true}
+
+	l, err := ListenAndAccept("tcp", "127.0.0.1:0", so, 0, echoConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if mptcpUnsupported.Load() {
+		t.Skip("mptcp not supported by the kernel")
+	}
+
+	a := Addr{Network: "tcp", IP: net.IPv4(127, 0, 0, 1), Port: l.Addr().(*net.TCPAddr).Port}
+	c, err := a.DialWithOpt(so, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, ok := c.(*net.TCPConn); !ok {
+		t.Fatal("should be *net.TCPConn", c)
+	}
+	if v := getConnSockoptInt(t, c, syscall.SOL_SOCKET, syscall.SO_PROTOCOL); v != ipproto_MPTCP {
+		t.Fatal("should be mptcp", v)
+	}
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo wrong", string(buf), err)
+	}
+
+	//只有 域名 的 地址 也应 先解析 再 拨号 mptcp
+	da := Addr{Network: "tcp4", Name: "localhost", Port: a.Port}
+	dc, err := da.DialWithOpt(so, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	if v := getConnSockoptInt(t, dc, syscall.SOL_SOCKET, syscall.SO_PROTOCOL); v != ipproto_MPTCP {
+		t.Fatal("domain dial should be mptcp", v)
+	}
+
+	//没有 监听 的 端口 应 返回 错误
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	a.Port = closedPort
+	if c2, err := a.DialWithOpt(so, nil); err == nil {
+		c2.Close()
+		t.Fatal("should fail")
+	}
+}
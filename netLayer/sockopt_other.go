@@ -7,3 +7,5 @@ package netLayer
 func SetSockOpt(fd int, sockopt *Sockopt, isudp bool, isipv6 bool) {
 	utils.Warn("SetSockOpt not implemented on " + runtime.GOOS)
 }
+
+func setTCPConnOpt(fd int, sockopt *Sockopt) {}
@@ -0,0 +1,19 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package netLayer
+
+import (
+	"syscall"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+func setsockoptIntOrLog(fd, level, opt, value int, failMsg string) {
+	if err := syscall.SetsockoptInt(fd, level, opt, value); err != nil {
+		if ce := utils.CanLogErr(failMsg); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+	}
+}
@@ -17,6 +17,9 @@ func SetSockOpt(fd int, sockopt *Sockopt, isudp bool, isipv6 bool) {
 	}
 }
 
+// windows 上 暂不支持 设置 keepalive 参数 与 user timeout
+func setTCPConnOpt(fd int, sockopt *Sockopt) {}
+
 //相关讨论参考 https://github.com/xjasonlyu/tun2socks/pull/192
 
 func bindToDevice(fd int, device string, is6 bool) {
@@ -96,6 +96,14 @@ func (mc *MsgConn) SetFullcone(f bool) {
 	mc.fullcone = f
 }
 
+// 返回 发出 该udp流量 的 客户端 地址
+func (mc *MsgConn) RemoteAddr() net.Addr {
+	if mc.ourSrcAddr == nil {
+		return nil
+	}
+	return mc.ourSrcAddr
+}
+
 func (mc *MsgConn) ReadMsg() ([]byte, netLayer.Addr, error) {
 
 	must_timeoutChan := time.After(netLayer.UDP_timeout)
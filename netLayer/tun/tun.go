@@ -273,6 +273,11 @@ func (mc *UdpMsgConn) CloseConnWithRaddr(raddr netLayer.Addr) error {
 func (mc *UdpMsgConn) Close() error {
 	return mc.PacketConn.Close()
 }
+
+// 返回 最近 一次 ReadMsg 读到的 tun 中 的 源地址
+func (mc *UdpMsgConn) RemoteAddr() net.Addr {
+	return mc.tunSrcAddr
+}
 func (mc *UdpMsgConn) Fullcone() bool {
 	return false
 }
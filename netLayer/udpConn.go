@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/pires/go-proxyproto"
 )
 
 type UDPAddrData struct {
@@ -35,6 +36,10 @@ type UDPConn struct {
 
 	unread   []byte
 	isClient bool //如果realConn是用 net.DialUDP 产生的, 则为 client，否则认为是server
+
+	proxyHeader *proxyproto.Header //监听时 收到的 PROXY protocol 头, 见 NewUDPListenerPROXY
+
+	batch *UDPBatchConn //由 UDPListener 创建 时 给出, 用于 批量 写
 }
 
 // DialUDP 对raddr拨号后调用 NewUDPConn
@@ -115,6 +120,70 @@ func (uc *UDPConn) ReadMsg() ([]byte, Addr, error) {
 	}
 }
 
+// 实现 MsgBatchReader. 阻塞 读到 第一个包 后, 再 取出 已经 到达 的 包, 最多 UDPBatchSize 个.
+func (uc *UDPConn) ReadMsgs(dst []AddrData) ([]AddrData, error) {
+	bs, a, err := uc.ReadMsg()
+	if err != nil {
+		return dst, err
+	}
+	dst = append(dst, AddrData{Data: bs, Addr: a})
+
+	for i := 1; i < UDPBatchSize; i++ {
+		select {
+		case msg, ok := <-uc.inMsgChan:
+			if !ok {
+				return dst, nil
+			}
+			dst = append(dst, AddrData{Data: msg.Data, Addr: NewAddrFromUDPAddr(&msg.Addr)})
+		default:
+			return dst, nil
+		}
+	}
+	return dst, nil
+}
+
+// 实现 MsgBatchWriter. 只有 由 UDPListener 创建 的 UDPConn 会 批量 写.
+func (uc *UDPConn) WriteMsgs(msgs []AddrData) error {
+	return uc.writeMsgs(msgs, nil)
+}
+
+// to 不为 nil 时, 忽略 msgs 中的 地址, 全部 发往 to
+func (uc *UDPConn) writeMsgs(msgs []AddrData, to *net.UDPAddr) error {
+	if uc.isClient || uc.batch == nil {
+		for _, m := range msgs {
+			a := m.Addr
+			if to != nil {
+				a = NewAddrFromUDPAddr(to)
+			}
+			if err := uc.WriteMsg(m.Data, a); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	select {
+	case <-uc.writeDeadline.Wait():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+	time.Sleep(time.Millisecond) //同 WriteMsg, 不过 每批 只 等待 一次
+
+	ums := make([]UDPAddrData, len(msgs))
+	for i, m := range msgs {
+		if to != nil {
+			ums[i] = UDPAddrData{Addr: *to, Data: m.Data}
+			continue
+		}
+		um, err := toUDPAddrData(m)
+		if err != nil {
+			return err
+		}
+		ums[i] = um
+	}
+	return uc.batch.WriteUDPMsgs(ums)
+}
+
 // func (uc *UDPConn) ReadMsg() (b []byte, err error) {
 
 // 	select {
@@ -267,6 +336,17 @@ func (uc *UDPConn) CloseConnWithRaddr(_ Addr) error {
 
 }
 
-func (uc *UDPConn) LocalAddr() net.Addr         { return uc.realConn.LocalAddr() }
-func (uc *UDPConn) RemoteAddr() net.Addr        { return uc.peerAddr }
+func (uc *UDPConn) LocalAddr() net.Addr { return uc.realConn.LocalAddr() }
+
+// 若 收到了 PROXY protocol 头, 则 返回 头中的 源地址
+func (uc *UDPConn) RemoteAddr() net.Addr {
+	if uc.proxyHeader != nil && uc.proxyHeader.SourceAddr != nil {
+		return uc.proxyHeader.SourceAddr
+	}
+	return uc.peerAddr
+}
+
+// 实现 PROXYHeaderGetter, 没有 则 返回 nil
+func (uc *UDPConn) ProxyHeader() *proxyproto.Header { return uc.proxyHeader }
+
 func (uc *UDPConn) RemoteUDPAddr() *net.UDPAddr { return uc.peerAddr }
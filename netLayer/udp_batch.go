@@ -0,0 +1,175 @@
+package netLayer
+
+import (
+	"net"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+/*
+批量 读写 udp.
+
+在 linux 上, 通过 golang.org/x/net 的 ipv4/ipv6.PacketConn.ReadBatch/WriteBatch (即 recvmmsg/sendmmsg) 一次 系统调用 读写 多个包;
+若 内核 支持, 还会 开启:
+
+	UDP GRO (5.0+): 内核 将 同一来源 的 多个 等长包 合并 为 一个 交给我们, 我们 再 按 gso_size 切开;
+	UDP GSO (4.18+): 将 发往 同一地址 的 连续 等长包 合并 为 一个, 交给 内核 (或网卡) 切分.
+
+其它 系统 上, 以及 内核 不支持 时, 退化 为 每次 一个包 的 ReadFromUDP/WriteToUDP, 对 调用者 透明.
+
+quic 这种 大量 满MTU 小包 的 流量 受益 最明显.
+*/
+
+var (
+	UDPBatchSize = 16 //一次 系统调用 最多 读写 的 包数
+
+	UDPBatchDisabled bool //为 true 时, 新建的 UDPBatchConn 不使用 批量读写 与 GSO/GRO
+)
+
+// MsgBatchReader 可以 一次 读出 多个 已经 到达 的 包. 阻塞 直到 至少 读到 一个, 结果 append 到 dst 后 返回.
+type MsgBatchReader interface {
+	ReadMsgs(dst []AddrData) ([]AddrData, error)
+}
+
+// MsgBatchWriter 可以 一次 写出 多个 包.
+type MsgBatchWriter interface {
+	WriteMsgs(msgs []AddrData) error
+}
+
+// 用于 包装 MsgConn 的 类型 实现 MsgBatchReader: mc 可以 批量读 时 批量读, 否则 读 一个.
+func readMsgsFrom(mc MsgConn, dst []AddrData) ([]AddrData, error) {
+	if br, ok := mc.(MsgBatchReader); ok {
+		return br.ReadMsgs(dst)
+	}
+	bs, a, err := mc.ReadMsg()
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, AddrData{Data: bs, Addr: a}), nil
+}
+
+// 用于 包装 MsgConn 的 类型 实现 MsgBatchWriter: mc 可以 批量写 时 批量写, 否则 逐个 写.
+func writeMsgsTo(mc MsgConn, msgs []AddrData) error {
+	if bw, ok := mc.(MsgBatchWriter); ok {
+		return bw.WriteMsgs(msgs)
+	}
+	for _, m := range msgs {
+		if err := mc.WriteMsg(m.Data, m.Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+UDPBatchConn 包装 一个 *net.UDPConn, 提供 批量 读写.
+
+开启 GRO 后 内核 交给 socket 的 数据 可能 是 多个包 合并 而成 的, 所以 该 udp连接 的 所有 读取 都 必须 经过 UDPBatchConn.
+
+读到的 Data 均 来自 utils.GetPacket.
+*/
+type UDPBatchConn struct {
+	*net.UDPConn
+
+	batch batchConn //平台相关
+
+	readMutex  sync.Mutex
+	pending    []UDPAddrData //已读到 但 还未 被 ReadUDPMsg 取走 的 包
+	writeMutex sync.Mutex
+}
+
+func NewUDPBatchConn(c *net.UDPConn) *UDPBatchConn {
+	bc := &UDPBatchConn{UDPConn: c}
+	if !UDPBatchDisabled {
+		bc.batch.init(c)
+	}
+	return bc
+}
+
+// 读 一个包. 若 之前 批量 读到 的 还有 剩余, 直接 返回 剩余的.
+func (bc *UDPBatchConn) ReadUDPMsg() ([]byte, *net.UDPAddr, error) {
+	bc.readMutex.Lock()
+	defer bc.readMutex.Unlock()
+
+	for len(bc.pending) == 0 {
+		var err error
+		bc.pending, err = bc.readLocked(bc.pending[:0])
+		if err != nil && len(bc.pending) == 0 {
+			return nil, nil, err
+		}
+	}
+	m := bc.pending[0]
+	bc.pending[0] = UDPAddrData{}
+	bc.pending = bc.pending[1:]
+	return m.Data, &m.Addr, nil
+}
+
+// 批量 读. 阻塞 直到 至少 读到 一个包 或 出错, 读到的包 append 到 dst 后 返回.
+func (bc *UDPBatchConn) ReadUDPMsgs(dst []UDPAddrData) ([]UDPAddrData, error) {
+	bc.readMutex.Lock()
+	defer bc.readMutex.Unlock()
+
+	if len(bc.pending) > 0 {
+		dst = append(dst, bc.pending...)
+		for i := range bc.pending {
+			bc.pending[i] = UDPAddrData{}
+		}
+		bc.pending = bc.pending[:0]
+		return dst, nil
+	}
+	start := len(dst)
+	for {
+		var err error
+		dst, err = bc.readLocked(dst)
+		if err != nil || len(dst) > start {
+			return dst, err
+		}
+	}
+}
+
+func (bc *UDPBatchConn) readLocked(dst []UDPAddrData) ([]UDPAddrData, error) {
+	if bc.batch.ok() {
+		return bc.batch.read(dst)
+	}
+	bs := utils.GetPacket()
+	n, raddr, err := bc.UDPConn.ReadFromUDP(bs)
+	if err != nil {
+		utils.PutPacket(bs)
+		return dst, err
+	}
+	return append(dst, UDPAddrData{Addr: *raddr, Data: bs[:n]}), nil
+}
+
+// 批量 写. 发往 同一地址 的 连续 等长包 在 支持 GSO 时 会被 合并 发送.
+func (bc *UDPBatchConn) WriteUDPMsgs(msgs []UDPAddrData) error {
+	bc.writeMutex.Lock()
+	defer bc.writeMutex.Unlock()
+
+	if bc.batch.ok() && len(msgs) > 1 {
+		return bc.batch.write(msgs)
+	}
+	for i := range msgs {
+		if _, err := bc.UDPConn.WriteToUDP(msgs[i].Data, &msgs[i].Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 返回 是否 使用了 批量读写, 以及 是否 开启了 GRO 与 GSO
+func (bc *UDPBatchConn) BatchState() (batch, gro, gso bool) {
+	return bc.batch.ok(), bc.batch.gro, bc.batch.gso
+}
+
+// 有ip时 不必 像 Addr.ToUDPAddr 那样 经过 字符串 解析
+func toUDPAddrData(m AddrData) (UDPAddrData, error) {
+	if m.Addr.IP != nil {
+		return UDPAddrData{Addr: net.UDPAddr{IP: m.Addr.IP, Port: m.Addr.Port}, Data: m.Data}, nil
+	}
+	ua := m.Addr.ToUDPAddr()
+	if ua == nil {
+		return UDPAddrData{}, utils.ErrInErr{ErrDesc: "can't resolve udp addr", ErrDetail: utils.ErrInvalidData, Data: m.Addr.String()}
+	}
+	return UDPAddrData{Addr: *ua, Data: m.Data}, nil
+}
@@ -0,0 +1,219 @@
+package netLayer
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	sol_UDP     = 17
+	udp_SEGMENT = 103
+	udp_GRO     = 104
+
+	udpGSOMaxSegments = 64    //UDP_MAX_SEGMENTS
+	udpGSOMaxBytes    = 65000 //一个 GSO包 的 负载 总长 上限, udp 负载 最长 为 65507
+)
+
+// batchPacketConn 由 ipv4.PacketConn 实现.
+// ipv4 与 ipv6 的 ReadBatch/WriteBatch 实现 相同 (地址 按 sockaddr 本身 的 地址族 解析与填写), 所以 ipv6 socket 也可以用 ipv4.PacketConn.
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type batchConn struct {
+	pc       batchPacketConn
+	gro, gso bool
+
+	rmsgs []ipv4.Message
+
+	wmsgs   []ipv4.Message
+	wstarts []int //wmsgs[i] 对应的 第一个 UDPAddrData 的 下标
+	wbufs   [][]byte
+	woobs   []byte
+}
+
+func (b *batchConn) ok() bool { return b.pc != nil }
+
+func (b *batchConn) init(c *net.UDPConn) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		if syscall.SetsockoptInt(int(fd), sol_UDP, udp_GRO, 1) == nil {
+			b.gro = true
+		}
+		if _, e := syscall.GetsockoptInt(int(fd), sol_UDP, udp_SEGMENT); e == nil {
+			b.gso = true
+		}
+	})
+	b.pc = ipv4.NewPacketConn(c)
+}
+
+func (b *batchConn) read(dst []UDPAddrData) ([]UDPAddrData, error) {
+	if len(b.rmsgs) != UDPBatchSize {
+		b.rmsgs = make([]ipv4.Message, UDPBatchSize)
+		for i := range b.rmsgs {
+			b.rmsgs[i].Buffers = make([][]byte, 1)
+			if b.gro {
+				b.rmsgs[i].OOB = make([]byte, syscall.CmsgSpace(4))
+			}
+		}
+	}
+	for i := range b.rmsgs {
+		m := &b.rmsgs[i]
+		if m.Buffers[0] == nil {
+			m.Buffers[0] = utils.GetPacket()
+		}
+		m.OOB = m.OOB[:cap(m.OOB)]
+	}
+
+	n, err := b.pc.ReadBatch(b.rmsgs, 0)
+	if err != nil {
+		return dst, err
+	}
+
+	for i := 0; i < n; i++ {
+		m := &b.rmsgs[i]
+		ua, _ := m.Addr.(*net.UDPAddr)
+		if ua == nil {
+			continue
+		}
+		bs := m.Buffers[0][:m.N]
+
+		seg := 0
+		if b.gro {
+			seg = groSegmentSize(m.OOB[:m.NN])
+		}
+		if seg <= 0 || seg >= m.N {
+			dst = append(dst, UDPAddrData{Addr: *ua, Data: bs})
+			m.Buffers[0] = nil
+			continue
+		}
+
+		//内核 合并了 多个包, 第一个 直接 用 原缓存, 其它的 拷贝 出来
+		dst = append(dst, UDPAddrData{Addr: *ua, Data: bs[:seg]})
+		for off := seg; off < len(bs); off += seg {
+			end := off + seg
+			if end > len(bs) {
+				end = len(bs)
+			}
+			p := utils.GetPacket()
+			dst = append(dst, UDPAddrData{Addr: *ua, Data: p[:copy(p, bs[off:end])]})
+		}
+		m.Buffers[0] = nil
+	}
+	return dst, nil
+}
+
+func groSegmentSize(oob []byte) int {
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, c := range cmsgs {
+		if c.Header.Level == sol_UDP && c.Header.Type == udp_GRO && len(c.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&c.Data[0])))
+		}
+	}
+	return 0
+}
+
+func (b *batchConn) write(msgs []UDPAddrData) error {
+	return b.writeBatch(msgs, b.gso)
+}
+
+func (b *batchConn) writeBatch(msgs []UDPAddrData, useGSO bool) error {
+	b.wmsgs = b.wmsgs[:0]
+	b.wstarts = b.wstarts[:0]
+	b.wbufs = b.wbufs[:0]
+	b.woobs = b.woobs[:0]
+
+	for i := 0; i < len(msgs); {
+		j := i + 1
+		if useGSO {
+			j = gsoGroupEnd(msgs, i)
+		}
+
+		m := ipv4.Message{Addr: &msgs[i].Addr}
+
+		start := len(b.wbufs)
+		for k := i; k < j; k++ {
+			b.wbufs = append(b.wbufs, msgs[k].Data)
+		}
+		m.Buffers = b.wbufs[start:len(b.wbufs):len(b.wbufs)]
+
+		if j-i > 1 {
+			oobStart := len(b.woobs)
+			b.woobs = appendGSOControl(b.woobs, len(msgs[i].Data))
+			m.OOB = b.woobs[oobStart:len(b.woobs):len(b.woobs)]
+		}
+
+		b.wmsgs = append(b.wmsgs, m)
+		b.wstarts = append(b.wstarts, i)
+		i = j
+	}
+
+	for sent := 0; sent < len(b.wmsgs); {
+		n, err := b.pc.WriteBatch(b.wmsgs[sent:], 0)
+		sent += n
+		if err == nil {
+			continue
+		}
+
+		if sent < len(b.wmsgs) && len(b.wmsgs[sent].OOB) > 0 && (errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EINVAL)) {
+			//EIO: 网卡 不支持 校验和 卸载, 之后 都 不再 使用 GSO;
+			//EINVAL: 一般是 包长 超过了 MTU, 只是 这一次 不用 GSO
+			if errors.Is(err, syscall.EIO) {
+				b.gso = false
+			}
+			return b.writeBatch(msgs[b.wstarts[sent]:], false)
+		}
+		return err
+	}
+	return nil
+}
+
+// 从 msgs[i] 开始, 发往 同一地址 的 连续包, 除 最后一个 可以 较短 外 长度 都 相同 的, 可以 合并 为 一个 GSO包.
+// 返回 这一组 的 结尾 下标 (不含).
+func gsoGroupEnd(msgs []UDPAddrData, i int) int {
+	size := len(msgs[i].Data)
+	if size == 0 {
+		return i + 1
+	}
+	total := size
+	j := i + 1
+	for ; j < len(msgs) && j-i < udpGSOMaxSegments; j++ {
+		l := len(msgs[j].Data)
+		if l == 0 || l > size || total+l > udpGSOMaxBytes || !udpAddrEqual(&msgs[j].Addr, &msgs[i].Addr) {
+			break
+		}
+		total += l
+		if l < size {
+			j++
+			break
+		}
+	}
+	return j
+}
+
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.Zone == b.Zone && a.IP.Equal(b.IP)
+}
+
+func appendGSOControl(b []byte, segSize int) []byte {
+	start := len(b)
+	b = append(b, make([]byte, syscall.CmsgSpace(2))...)
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[start]))
+	h.Level = sol_UDP
+	h.Type = udp_SEGMENT
+	h.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&b[start+syscall.CmsgLen(0)])) = uint16(segSize)
+	return b
+}
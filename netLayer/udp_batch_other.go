@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package netLayer
+
+import "net"
+
+// 本平台 不支持 批量 读写, UDPBatchConn 退化 为 每次 一个包.
+type batchConn struct {
+	gro, gso bool
+}
+
+func (b *batchConn) ok() bool { return false }
+
+func (b *batchConn) init(c *net.UDPConn) {}
+
+func (b *batchConn) read(dst []UDPAddrData) ([]UDPAddrData, error) { return dst, nil }
+
+func (b *batchConn) write(msgs []UDPAddrData) error { return nil }
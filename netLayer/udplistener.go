@@ -7,6 +7,8 @@ import (
 	"sync"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/pires/go-proxyproto"
+	"go.uber.org/zap"
 )
 
 // UDPListener 实现了 net.Listener.
@@ -16,12 +18,18 @@ import (
 //
 //UDPListener can also dial a remote host by calling NewConn.
 type UDPListener struct {
-	conn *net.UDPConn
+	conn  *net.UDPConn
+	batch *UDPBatchConn //所有读取 都 经过它, 写入 由 各个 UDPConn 批量 进行 时 也 使用它
 
 	newConnChan chan *UDPConn
 	connMap     map[netip.AddrPort]*UDPConn
 	mux         sync.RWMutex
-	isclosed    bool
+	isclosed    bool //由 mux 保护
+
+	closed     chan struct{}  //Close 时 关闭, 用于 解除 dispatch 中 阻塞的 发送
+	dispatchWg sync.WaitGroup //正在 向 chan 发送 的 dispatch, Close 要等 它们 结束 后 才能 关闭 chan
+
+	acceptPROXY bool //每个包 开头 都 必须有 PROXY protocol v2 头, 否则 丢弃
 }
 
 // NewUDPListener 返回一个 *UDPListener, 该Listener实现了 net.Listener
@@ -34,10 +42,27 @@ func NewUDPListener(laddr *net.UDPAddr) (*UDPListener, error) {
 }
 
 func NewUDPListenerConn(conn *net.UDPConn) (*UDPListener, error) {
+	return newUDPListenerConn(conn, false)
+}
+
+// 同 NewUDPListener, 但 要求 每个包 开头 都有 PROXY protocol v2 头. 头 会被 去掉,
+// Accept 得到的 UDPConn 的 RemoteAddr 为 头中的 源地址, 并可用 ProxyHeader 获取 头.
+func NewUDPListenerPROXY(laddr *net.UDPAddr) (*UDPListener, error) {
+	c, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return newUDPListenerConn(c, true)
+}
+
+func newUDPListenerConn(conn *net.UDPConn, acceptPROXY bool) (*UDPListener, error) {
 	ul := new(UDPListener)
 	ul.conn = conn
+	ul.batch = NewUDPBatchConn(conn)
+	ul.acceptPROXY = acceptPROXY
 	ul.connMap = make(map[netip.AddrPort]*UDPConn)
 	ul.newConnChan = make(chan *UDPConn, 100)
+	ul.closed = make(chan struct{})
 	go ul.run()
 
 	return ul, nil
@@ -50,7 +75,14 @@ func (ul *UDPListener) NewConn(raddr *net.UDPAddr) *UDPConn {
 
 //newConn 创建一个新的 UDPConn,并存储在 ul.connMap 中
 func (ul *UDPListener) newConn(raddr *net.UDPAddr, addrport netip.AddrPort) *UDPConn {
+	return ul.newConnWithPROXY(raddr, addrport, nil)
+}
+
+// ph 为 该远程地址 发来的 第一个包 的 PROXY protocol 头, 可为 nil
+func (ul *UDPListener) newConnWithPROXY(raddr *net.UDPAddr, addrport netip.AddrPort, ph *proxyproto.Header) *UDPConn {
 	newC := NewUDPConn(raddr, ul.conn, false)
+	newC.proxyHeader = ph
+	newC.batch = ul.batch
 	ul.mux.Lock()
 	ul.connMap[addrport] = newC
 	ul.mux.Unlock()
@@ -74,20 +106,21 @@ func (ul *UDPListener) Accept() (net.Conn, error) {
 //Once closed, it cannot be used again.
 // it calls ul.CloseClients()
 func (ul *UDPListener) Close() error {
+	ul.mux.Lock()
 	if ul.isclosed {
+		ul.mux.Unlock()
 		return nil
 	}
-
 	ul.isclosed = true
+	ul.mux.Unlock()
+
+	close(ul.closed)
 
 	err := ul.conn.Close()
-	if err != nil {
-		return err
-	}
 
 	ul.closeClients()
 
-	return nil
+	return err
 }
 
 //UDPListener has a very fast way to close all the clients' connection.
@@ -96,6 +129,9 @@ func (ul *UDPListener) Close() error {
 //
 //Once closed, it cannot be used again.
 func (ul *UDPListener) closeClients() error {
+	//等 所有 dispatch 不再 发送, 否则 向 已关闭的 chan 发送 会 panic
+	ul.dispatchWg.Wait()
+
 	close(ul.newConnChan)
 
 	ul.mux.Lock()
@@ -112,39 +148,83 @@ func (ul *UDPListener) Addr() net.Addr {
 	return ul.conn.LocalAddr()
 }
 
-//循环读取udp数据，对新连接会创建 UDPConn，然后把数据通过chan 传递给UDPConn
+//循环批量读取udp数据，对新连接会创建 UDPConn，然后把数据通过chan 传递给UDPConn
 func (ul *UDPListener) run() {
-	conn := ul.conn
+	var msgs []UDPAddrData
 	for {
-		buf := utils.GetPacket()
-		n, raddr, err := conn.ReadFromUDP(buf)
-		if ul.isclosed {
+		var err error
+		msgs, err = ul.batch.ReadUDPMsgs(msgs[:0])
+		select {
+		case <-ul.closed:
 			return
+		default:
 		}
-		go func(theraddr *net.UDPAddr, thebuf []byte) {
-			addrport := UDPAddr2AddrPort(theraddr)
-			var oldConn *UDPConn
 
-			ul.mux.RLock()
-			oldConn = ul.connMap[addrport]
-			ul.mux.RUnlock()
+		for i := range msgs {
+			ul.dispatch(msgs[i].Data, &msgs[i].Addr)
+			msgs[i] = UDPAddrData{}
+		}
 
-			if oldConn == nil {
-				oldConn = ul.newConn(raddr, addrport)
-				if ul.isclosed {
-					return
-				}
+		if err != nil {
+			return
+		}
+	}
+}
 
-				ul.newConnChan <- oldConn //此时 ul 的 Accept的调用者就会收到一个新Conn
+func (ul *UDPListener) dispatch(buf []byte, raddr *net.UDPAddr) {
+	n := len(buf)
+
+	var ph *proxyproto.Header
+	if ul.acceptPROXY && n > 0 {
+		var hl int
+		var e error
+		ph, hl, e = ReadPROXYHeaderFromPacket(buf[:n])
+		if e != nil {
+			if ce := utils.CanLogDebug("UDPListener drop packet without valid PROXY header"); ce != nil {
+				ce.Write(zap.String("from", raddr.String()), zap.Error(e))
 			}
+			utils.PutPacket(buf)
+			return
+		}
+		n = copy(buf, buf[hl:n])
+	}
+
+	theraddr := *raddr
 
-			oldConn.inMsgChan <- UDPAddrData{Addr: *theraddr, Data: thebuf[:n]}
+	ul.mux.RLock()
+	if ul.isclosed {
+		ul.mux.RUnlock()
+		utils.PutPacket(buf)
+		return
+	}
+	ul.dispatchWg.Add(1)
+	ul.mux.RUnlock()
 
-		}(raddr, buf)
+	go func() {
+		defer ul.dispatchWg.Done()
 
-		if err != nil {
-			return
+		addrport := UDPAddr2AddrPort(&theraddr)
+		var oldConn *UDPConn
+
+		ul.mux.RLock()
+		oldConn = ul.connMap[addrport]
+		ul.mux.RUnlock()
+
+		if oldConn == nil {
+			oldConn = ul.newConnWithPROXY(&theraddr, addrport, ph)
+
+			select {
+			case ul.newConnChan <- oldConn: //此时 ul 的 Accept的调用者就会收到一个新Conn
+			case <-ul.closed:
+				utils.PutPacket(buf)
+				return
+			}
 		}
 
-	}
+		select {
+		case oldConn.inMsgChan <- UDPAddrData{Addr: theraddr, Data: buf[:n]}:
+		case <-ul.closed:
+			utils.PutPacket(buf)
+		}
+	}()
 }
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
 	"net"
@@ -10,9 +11,9 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/advLayer"
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
 	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
-	"github.com/xtaci/smux"
 	"go.uber.org/zap"
 )
 
@@ -34,6 +35,7 @@ type BaseInterface interface {
 	SetAddrStr(string)
 
 	GetSockopt() *netLayer.Sockopt
+	GetDomainStrategy() netLayer.DomainStrategy //for outClient
 
 	CantRoute() bool //for inServer
 
@@ -73,7 +75,7 @@ type BaseInterface interface {
 	// 判断是否有内层mux。
 	//0 为不会有 innermux, 1 为有可能有 innermux, 2 为总是使用 innerMux;
 	// 规定是，客户端 只能返回0/2， 服务端 只能返回 0/1（除非服务端协议不支持不mux的情况，此时可以返回2）。
-	// string 为 innermux内部的 代理 协议 名称。（一般用simplesocks）
+	// string 为 innermux内部的 代理 协议 名称。（一般用simplesocks; mux.cool 没有 内部代理协议, 客户端 返回 空字符串）
 	HasInnerMux() (int, string)
 }
 
@@ -95,6 +97,8 @@ type Base struct {
 	Sockopt *netLayer.Sockopt
 	Xver    int
 
+	DomainStrategy netLayer.DomainStrategy
+
 	IsFullcone bool
 
 	Tls_s   *tlsLayer.Server
@@ -112,7 +116,10 @@ type Base struct {
 
 	FallbackAddr *netLayer.Addr
 
-	Innermux *smux.Session //用于存储 client的已拨号的mux连接
+	InnerMuxConf innermux.Config
+	Innermux     *innermux.ClientPool //用于存储 client的已拨号的mux连接
+
+	WarmPool *WarmPool //for outClient, 预连接池, 可为nil
 
 	sync.Mutex
 
@@ -170,7 +177,7 @@ func (b *Base) MiddleName() string {
 	}
 	advL := b.AdvancedL
 	if b.Header != nil {
-		if advL != "ws" && advL != "grpc" {
+		if advL != "ws" && advL != "grpc" && advL != "h2" && advL != "httpupgrade" && advL != "splithttp" {
 			sb.WriteString("+http")
 		}
 	}
@@ -197,9 +204,62 @@ func (b *Base) Sniffing() bool {
 	return b.ListenConf.SniffConf.Enable
 }
 
+// 客户端 是否 使用 mux.cool 作为 内层mux
+func (b *Base) IsMuxCool() bool {
+	return b.InnerMuxConf.Type == innermux.MuxCool
+}
+
+// 是否 有 可以直接 打开新stream 的 session.
+//
+// 要 使用 session 的话 应 调用 PickInnerMuxSession, 因为 两次 选取 之间 session池 可能 已经 改变.
 func (b *Base) InnerMuxEstablished() bool {
+	return b.Innermux != nil && b.Innermux.HasAvailable()
+}
+
+// 从 session池 中 选出 用于 打开新stream 的 session, 见 innermux.ClientPool.Pick.
+//
+// 返回 nil 时 已 预留了 拨号名额, 调用者 应 拨号 新的连接 并 调用 GetClientInnerMuxSession(wrc),
+// 无论 成功 与否 最后 都要 调用 InnerMuxDialDone.
+func (b *Base) PickInnerMuxSession() innermux.Session {
+	if b.Innermux == nil {
+		b.Innermux = innermux.NewClientPool(b.InnerMuxConf)
+	}
+	return b.Innermux.Pick()
+}
+
+// 释放 PickInnerMuxSession 返回 nil 时 预留的 拨号名额
+func (b *Base) InnerMuxDialDone() {
+	if b.Innermux != nil {
+		b.Innermux.DialDone()
+	}
+}
+
+// 与 主流程 相同地 拨号 并 进行 tls层 握手, 供 需要 自行拨号 的 高级层 使用, 见 advLayer.UnderlayDialerSetter.
+//
+// 不会 使用 dns模块, 域名 由 系统 解析.
+func (b *Base) dialForAdvLayer(ctx context.Context) (net.Conn, error) {
+	addr, err := netLayer.NewAddr(b.Addr)
+	if err != nil {
+		return nil, err
+	}
+	addr.Network = b.Network()
+
+	var conn net.Conn
+	if b.LTA == nil {
+		conn, err = addr.DialWithResolver(b.Sockopt, nil, nil, b.DomainStrategy) //避免把nil的 *net.TCPAddr 装箱到 net.Addr里
+	} else {
+		conn, err = addr.DialWithResolver(b.Sockopt, b.LTA, nil, b.DomainStrategy)
+	}
+	if err != nil || !b.TLS || b.Tls_c == nil {
+		return conn, err
+	}
 
-	return b.Innermux != nil && !b.Innermux.IsClosed()
+	tlsConn, err := b.Tls_c.Handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
 // placeholder
@@ -207,44 +267,55 @@ func (b *Base) HasInnerMux() (int, string) {
 	return 0, ""
 }
 
-func (*Base) GetServerInnerMuxSession(wlc io.ReadWriteCloser) *smux.Session {
-	smuxConfig := smux.DefaultConfig()
-	smuxSession, err := smux.Server(wlc, smuxConfig)
+// 服务端 会 自动识别 客户端 所用的 mux 实现; mux.cool 则由 wlc 实现的 MuxCoolMarker 确定.
+func (b *Base) GetServerInnerMuxSession(wlc io.ReadWriteCloser) innermux.Session {
+	if mc, ok := wlc.(MuxCoolMarker); ok && mc.IsMuxCool() {
+		return innermux.NewMuxCoolServerSession(wlc)
+	}
+	session, err := innermux.NewServerSession(wlc, b.InnerMuxConf)
 	if err != nil {
-		if ce := utils.CanLogErr("smux.Server call failed"); ce != nil {
+		if ce := utils.CanLogErr("innermux.NewServerSession call failed"); ce != nil {
 			ce.Write(
 				zap.Error(err),
 			)
 		}
 		return nil
 	}
-	return smuxSession
+	return session
 }
 
-func (b *Base) CloseInnerMuxSession() {
-	if b.InnerMuxEstablished() {
-		b.Innermux.Close()
-		b.Innermux = nil
+// 关闭 s 并 将其 从 client 的 session池 中 移除.
+func (b *Base) CloseInnerMuxSession(s innermux.Session) {
+	if s == nil {
+		return
+	}
+	if b.Innermux != nil {
+		b.Innermux.Remove(s)
+	} else {
+		s.Close()
 	}
 }
 
-func (b *Base) GetClientInnerMuxSession(wrc io.ReadWriteCloser) *smux.Session {
-	if b.InnerMuxEstablished() {
-		return b.Innermux
-	} else {
-		smuxConfig := smux.DefaultConfig()
-		smuxSession, err := smux.Client(wrc, smuxConfig)
-		if err != nil {
-			if ce := utils.CanLogErr("smux.Client call failed"); ce != nil {
-				ce.Write(
-					zap.Error(err),
-				)
-			}
-			return nil
+// wrc 为 nil 时 同 PickInnerMuxSession; 否则 在 wrc 上 新建 一个 session 并 放入 池中.
+func (b *Base) GetClientInnerMuxSession(wrc io.ReadWriteCloser) innermux.Session {
+	if b.Innermux == nil {
+		b.Innermux = innermux.NewClientPool(b.InnerMuxConf)
+	}
+
+	if wrc == nil {
+		return b.Innermux.Pick()
+	}
+
+	session, err := b.Innermux.NewSession(wrc)
+	if err != nil {
+		if ce := utils.CanLogErr("innermux.NewClientSession call failed"); ce != nil {
+			ce.Write(
+				zap.Error(err),
+			)
 		}
-		b.Innermux = smuxSession
-		return smuxSession
+		return nil
 	}
+	return session
 }
 
 // return false. As a placeholder.
@@ -259,6 +330,10 @@ func (b *Base) GetSockopt() *netLayer.Sockopt {
 	return b.Sockopt
 }
 
+func (b *Base) GetDomainStrategy() netLayer.DomainStrategy {
+	return b.DomainStrategy
+}
+
 func (b *Base) setNetwork(network string) {
 
 	b.TransportLayer = network
@@ -269,12 +344,20 @@ func (b *Base) AdvancedLayer() string {
 	return b.AdvancedL
 }
 
-// try close inner mux and stop AdvS
+// try close inner mux and WarmPool, stop Tls_s and AdvS
 func (b *Base) Stop() {
 	if b.Innermux != nil {
 		b.Innermux.Close()
 	}
 
+	if b.WarmPool != nil {
+		b.WarmPool.Close()
+	}
+
+	if b.Tls_s != nil {
+		b.Tls_s.Stop()
+	}
+
 	if b.AdvS != nil {
 		b.AdvS.Stop()
 	}
@@ -337,6 +420,8 @@ func (b *Base) ConfigCommon(cc *CommonConf) {
 
 	b.AdvancedL = cc.AdvancedLayer
 
+	b.InnerMuxConf = getInnerMuxConfFromExtra(cc.Extra)
+
 	b.InitAdvLayer()
 }
 
@@ -477,22 +562,12 @@ func (b *Base) InitAdvLayer() {
 }
 
 func (d *Base) DialTCP(target netLayer.Addr) (result net.Conn, err error) {
-	if d.Sockopt != nil {
-		if d.LTA == nil {
-			result, err = target.DialWithOpt(d.Sockopt, nil) //避免把nil的 *net.TCPAddr 装箱到 net.Addr里
+	if d.LTA == nil {
+		result, err = target.DialWithResolver(d.Sockopt, nil, nil, d.DomainStrategy) //避免把nil的 *net.TCPAddr 装箱到 net.Addr里
 
-		} else {
-			result, err = target.DialWithOpt(d.Sockopt, d.LTA)
-
-		}
 	} else {
-		if d.LTA == nil {
-			result, err = target.Dial(nil, nil)
+		result, err = target.DialWithResolver(d.Sockopt, d.LTA, nil, d.DomainStrategy)
 
-		} else {
-			result, err = target.Dial(nil, d.LTA)
-
-		}
 	}
 	return
 }
@@ -506,3 +581,7 @@ func (d *Base) DialUDP(target netLayer.Addr) (mc *netLayer.UDPMsgConn, err error
 func (d *Base) SelfListen() (is bool, tcp, udp int) {
 	return
 }
+
+func (d *Base) SelfDial() bool {
+	return false
+}
@@ -66,6 +66,7 @@ type CommonConf struct {
 	UUID        string `toml:"uuid"`         //代理层用户的唯一标识，视代理层协议而定，一般使用uuid，但trojan协议是随便的password, 而socks5 和 http 则使用 user+pass 的形式。 我们为了简洁、一致，就统一放到了 这个字段里。
 	Version     int    `toml:"version"`      //可选，代理层协议版本号，vless v1 要用到。
 	EncryptAlgo string `toml:"encrypt_algo"` //内部加密算法，vmess/ss 等协议可指定
+	Flow        string `toml:"flow"`         //可选, 目前只有 vless v0 支持, 可为 xtls-rprx-vision, 需要 tls 且 不能有 高级层 和 lazy.
 
 }
 
@@ -137,6 +138,8 @@ type DialConf struct {
 
 	SendThrough string `toml:"sendThrough"` //可选，用于发送数据的 IP 地址, 可以是ip:port, 或者 tcp:ip:port\nudp:ip:port
 	Mux         bool   `toml:"mux"`         //是否使用内层mux。在某些支持mux命令的协议中（vless v1/trojan）, 开启此开关会让 dial 使用 内层mux。
+
+	DomainStrategy string `toml:"domainStrategy"` //可选, 拨号 域名 时 使用的 地址族, 可为 AsIs, UseIPv4, UseIPv6, PreferIPv4, PreferIPv6; 见 netLayer.DomainStrategy
 }
 
 type SniffConf struct {
@@ -184,6 +184,7 @@ func URLToCommonConf(u *url.URL, conf *CommonConf) error {
 	conf.Path = u.Path
 	conf.AdvancedLayer = q.Get("adv")
 	conf.EncryptAlgo = q.Get("security")
+	conf.Flow = q.Get("flow")
 
 	if q.Get("v") != "" {
 		v, e := strconv.Atoi(q.Get("v"))
@@ -252,6 +253,8 @@ func URLToDialConf(u *url.URL, conf *DialConf) error {
 		conf.Mux = true
 	}
 
+	conf.DomainStrategy = q.Get("domainStrategy")
+
 	return e
 }
 
@@ -359,6 +362,9 @@ func ToStandardUrl(cc *CommonConf, dc *DialConf, lc *ListenConf) string {
 		if dc.Mux {
 			q.Add("mux", "true")
 		}
+		if dc.DomainStrategy != "" {
+			q.Add("domainStrategy", dc.DomainStrategy)
+		}
 	}
 
 	if cc.TLS {
@@ -407,6 +413,10 @@ func ToStandardUrl(cc *CommonConf, dc *DialConf, lc *ListenConf) string {
 		q.Add("security", cc.EncryptAlgo)
 	}
 
+	if cc.Flow != "" {
+		q.Add("flow", cc.Flow)
+	}
+
 	u.RawQuery = q.Encode()
 	if cc.Tag != "" {
 		u.Fragment = cc.Tag
@@ -5,7 +5,9 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
@@ -50,6 +52,7 @@ func (CreatorCommonStruct) MultiTransportLayer() bool {
 	return false
 }
 func (CreatorCommonStruct) AfterCommonConfServer(Server) error { return nil }
+func (CreatorCommonStruct) AfterCommonConfClient(Client) error { return nil }
 
 type CreatorCommon interface {
 	//若为true，则表明该协议可同时使用tcp和udp来传输数据。direct, socks5 和 shadowsocks 都为true。
@@ -63,6 +66,7 @@ type ClientCreator interface {
 	CreatorCommon
 	//大部分通用内容都会被proxy包解析，方法只需要处理proxy包未知的内容
 	NewClient(*DialConf) (Client, error) //标准配置
+	AfterCommonConfClient(Client) error
 
 	//URLToDialConf 执行proxy自定义的非标准代码;
 	//iv: initial value, can be nil.
@@ -82,6 +86,12 @@ type ServerCreator interface {
 	//ListenConfToURL(url *ListenConf, format int) (*url.URL, error)
 }
 
+// 一个 ListenConf 可以 展开 为 多个 监听 的 ServerCreator 可以 实现 ListenConfExpander, 如 dokodemo 的 端口范围 转发.
+// 展开 得到的 每个 ListenConf 都会 单独 创建 Server 并 监听.
+type ListenConfExpander interface {
+	ExpandListenConf(*ListenConf) ([]*ListenConf, error)
+}
+
 // 规定，每个 实现Client的包必须使用本函数进行注册。
 // direct 和 reject 统一使用本包提供的方法, 自定义协议不得覆盖 direct 和 reject。
 func RegisterClient(name string, c ClientCreator) {
@@ -131,6 +141,22 @@ func newClient(creator ClientCreator, dc *DialConf, knownTls bool) (Client, erro
 	if dc.SendThrough != "" {
 		setSendThroughByNetwork(c.GetBase(), dc.SendThrough)
 	}
+	if e != nil {
+		return c, e
+	}
+	if b := c.GetBase(); b != nil {
+		b.DomainStrategy, e = netLayer.ParseDomainStrategy(dc.DomainStrategy)
+		if e != nil {
+			return c, e
+		}
+		if c.Name() != DirectName {
+			b.WarmPool = getWarmPoolFromExtra(dc.Extra)
+		}
+		if ds, ok := b.AdvC.(advLayer.UnderlayDialerSetter); ok {
+			ds.SetUnderlayDialer(b.dialForAdvLayer)
+		}
+	}
+	e = creator.AfterCommonConfClient(c)
 	return c, e
 
 }
@@ -170,10 +196,25 @@ func configCommonForClient(cli BaseInterface, dc *DialConf) error {
 	clic.DialConf = dc
 
 	clic.ConfigCommon(&dc.CommonConf)
+	clic.Innermux = innermux.NewClientPool(clic.InnerMuxConf)
 
 	return nil
 }
 
+// 若 lc 的 协议 实现了 ListenConfExpander, 返回 展开后的 ListenConf; 否则 返回 只含 lc 的 切片.
+func ExpandListenConf(lc *ListenConf) ([]*ListenConf, error) {
+	creator, ok := serverCreatorMap[lc.Protocol]
+	if !ok {
+		creator, ok = serverCreatorMap[strings.TrimSuffix(lc.Protocol, "s")]
+	}
+	if ok {
+		if e, ok := creator.(ListenConfExpander); ok {
+			return e.ExpandListenConf(lc)
+		}
+	}
+	return []*ListenConf{lc}, nil
+}
+
 func NewServer(lc *ListenConf) (Server, error) {
 	protocol := lc.Protocol
 	creator, ok := serverCreatorMap[protocol]
@@ -5,9 +5,11 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
 )
 
 const (
@@ -15,6 +17,9 @@ const (
 	DirectURL  = DirectName + "://"
 )
 
+// direct 处理 BIND 请求时, 等待 接入连接 的 最长时间
+var BindAcceptTimeout = time.Minute * 2
+
 // implements ClientCreator for direct
 type DirectCreator struct{ CreatorCommonStruct }
 
@@ -53,6 +58,9 @@ func (*DirectClient) GetCreator() ClientCreator {
 	return DirectCreator{}
 }
 
+// true
+func (*DirectClient) SelfDial() bool { return true }
+
 // 若 underlay 为nil，则会对target进行拨号, 否则返回underlay本身
 func (d *DirectClient) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (result io.ReadWriteCloser, err error) {
 	if d.Network() == "udp" {
@@ -100,3 +108,70 @@ func (d *DirectClient) EstablishUDPChannel(_ net.Conn, firstPayload []byte, targ
 
 	}
 }
+
+// 实现 BindClient. 在 通往 target 的 本地ip 上 监听 一个 随机端口, 接受 第一个 来自 target 的 连接.
+func (d *DirectClient) Bind(br BindRequest, target netLayer.Addr) (result net.Conn, err error) {
+	if d.Network() == "udp" {
+		err = errors.New("direct's network set to udp, but Bind called")
+		br.WriteBindReply(netLayer.Addr{}, err)
+		return
+	}
+
+	targetTA := target.ToTCPAddr()
+
+	laddr := &net.TCPAddr{}
+	if d.LTA != nil {
+		laddr.IP = d.LTA.IP
+	} else if targetTA != nil {
+		//通过 udp 拨号 得到 通往 target 的 本地ip, 这并不会 发送 任何数据.
+		ua := &net.UDPAddr{IP: targetTA.IP, Port: targetTA.Port}
+		if ua.Port == 0 {
+			ua.Port = 9 //bind 请求中 端口 可能 为0, 而 udp 拨号 不接受 0 端口
+		}
+		if uc, e := net.DialUDP("udp", nil, ua); e == nil {
+			laddr.IP = uc.LocalAddr().(*net.UDPAddr).IP
+			uc.Close()
+		}
+	}
+
+	ln, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		br.WriteBindReply(netLayer.Addr{}, err)
+		return
+	}
+	defer ln.Close()
+
+	if err = br.WriteBindReply(netLayer.NewAddrFromTCPAddr(ln.Addr().(*net.TCPAddr)), nil); err != nil {
+		return
+	}
+
+	ln.SetDeadline(time.Now().Add(BindAcceptTimeout))
+
+	for {
+		var c *net.TCPConn
+		c, err = ln.AcceptTCP()
+		if err != nil {
+			br.WriteBindReply(netLayer.Addr{}, err)
+			return
+		}
+		raddr := c.RemoteAddr().(*net.TCPAddr)
+
+		//若 target 给出了 确定的 ip, 则 只接受 该ip 发来的 连接
+		if targetTA != nil && !targetTA.IP.IsUnspecified() && !targetTA.IP.Equal(raddr.IP) {
+			if ce := utils.CanLogWarn("direct bind got conn from unexpected addr"); ce != nil {
+				ce.Write(
+					zap.String("expected", targetTA.IP.String()),
+					zap.String("real", raddr.String()),
+				)
+			}
+			c.Close()
+			continue
+		}
+
+		if err = br.WriteBindReply(netLayer.NewAddrFromTCPAddr(raddr), nil); err != nil {
+			c.Close()
+			return
+		}
+		return c, nil
+	}
+}
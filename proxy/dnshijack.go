@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// tun 与 tproxy 这种 自监听 的 Server 可以 实现 DNSHijacker.
+// ShouldHijackDNS 返回 true 时, 发往 target 的 tcp/udp 流量 不会被 转发, 而是 由 RoutingEnv 的 DNSMachine 应答.
+type DNSHijacker interface {
+	ShouldHijackDNS(target netLayer.Addr) bool
+}
+
+/*
+DNSHijack 为 劫持 53端口 dns流量 的 配置, 从 extra 读取:
+
+	extra.dns_hijack = true
+	extra.dns_hijack_except = ["192.168.1.1", "10.0.0.0/8"] # 可选, 发往 这些 dns服务器 的 请求 不劫持, 照常 转发
+
+nil 的 *DNSHijack 不劫持 任何流量.
+*/
+type DNSHijack struct {
+	Except []netip.Prefix
+}
+
+// 若 extra 中 没有 开启 dns_hijack, 返回 nil.
+func NewDNSHijackFromExtra(extra map[string]any) (*DNSHijack, error) {
+	if on, _ := utils.AnyToBool(extra["dns_hijack"]); !on {
+		return nil, nil
+	}
+	h := &DNSHijack{}
+
+	var list []string
+	switch v := extra["dns_hijack_except"].(type) {
+	case nil:
+	case string:
+		list = strings.Split(v, ",")
+	case []string:
+		list = v
+	case []any: //toml 解析出的 数组
+		for _, a := range v {
+			str, ok := a.(string)
+			if !ok {
+				return nil, utils.ErrInErr{ErrDesc: "dns_hijack_except must be string array", ErrDetail: utils.ErrInvalidData, Data: a}
+			}
+			list = append(list, str)
+		}
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "dns_hijack_except must be string array", ErrDetail: utils.ErrInvalidData, Data: v}
+	}
+
+	for _, str := range list {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		var p netip.Prefix
+		var err error
+		if strings.Contains(str, "/") {
+			p, err = netip.ParsePrefix(str)
+		} else {
+			var a netip.Addr
+			a, err = netip.ParseAddr(str)
+			if err == nil {
+				p = netip.PrefixFrom(a, a.BitLen())
+			}
+		}
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "dns_hijack_except invalid", ErrDetail: err, Data: str}
+		}
+		h.Except = append(h.Except, p.Masked())
+	}
+	return h, nil
+}
+
+func (h *DNSHijack) ShouldHijackDNS(target netLayer.Addr) bool {
+	if h == nil || target.Port != 53 {
+		return false
+	}
+	if len(h.Except) == 0 {
+		return true
+	}
+	a, ok := netip.AddrFromSlice(target.IP)
+	if !ok {
+		return true
+	}
+	a = a.Unmap()
+	for _, p := range h.Except {
+		if p.Contains(a) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package dokodemo
+
+import (
+	"strconv"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 读取 extra 中 的 端口列表, 可以 为 字符串 如 "10000-10100,10200", 或 单个 数字
+func getPortsExtra(extra map[string]any, key string) ([]int, error) {
+	thing := extra[key]
+	if thing == nil {
+		return nil, nil
+	}
+	var str string
+	switch v := thing.(type) {
+	case string:
+		str = v
+	default:
+		if i, ok := utils.AnyToInt64(v); ok {
+			str = strconv.FormatInt(i, 10)
+		}
+	}
+	ports, err := netLayer.ParsePortList(str)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "dokodemo extra." + key + " invalid", ErrDetail: err, Data: thing}
+	}
+	return ports, nil
+}
+
+/*
+ExpandListenConf implements proxy.ListenConfExpander.
+
+给出 extra.ports 或 network = "dual" 时, 将 lc 展开 为 每个 端口 与 传输层协议 一个 的 ListenConf;
+每个 展开后 的 目标 的 端口 按 extra.target_ports 改写, 目标 的 传输层协议 与 监听的 相同.
+
+ports 多于 一个 时, 展开后的 tag 为 原tag_端口.
+*/
+func (ServerCreator) ExpandListenConf(lc *proxy.ListenConf) ([]*proxy.ListenConf, error) {
+	ports, err := getPortsExtra(lc.Extra, "ports")
+	if err != nil {
+		return nil, err
+	}
+	if ports == nil && lc.Network != netLayer.DualNetworkName {
+		return []*proxy.ListenConf{lc}, nil
+	}
+	multiPort := len(ports) > 1
+	if ports == nil {
+		ports = []int{lc.Port}
+	}
+
+	networks := []string{lc.Network}
+	if lc.Network == netLayer.DualNetworkName {
+		networks = []string{"tcp", "udp"}
+	}
+
+	targetPorts, err := getPortsExtra(lc.Extra, "target_ports")
+	if err != nil {
+		return nil, err
+	}
+	if len(targetPorts) > 1 && len(targetPorts) != len(ports) {
+		return nil, utils.ErrInErr{ErrDesc: "dokodemo extra.target_ports count should be 1 or equal to extra.ports", ErrDetail: utils.ErrInvalidData, Data: lc.Extra["target_ports"]}
+	}
+
+	var targets []netLayer.Addr
+	if !isRedirect(lc) {
+		strs, err := getTargetStrs(lc)
+		if err != nil {
+			return nil, err
+		}
+		for _, str := range strs {
+			a, err := netLayer.NewAddrByURL(str)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, a)
+		}
+	}
+
+	var result []*proxy.ListenConf
+	for i, port := range ports {
+		for _, network := range networks {
+			nlc := *lc
+			nlc.Port = port
+			nlc.Network = network
+			if multiPort && lc.Tag != "" {
+				nlc.Tag = lc.Tag + "_" + strconv.Itoa(port)
+			}
+
+			nlc.Extra = make(map[string]any, len(lc.Extra))
+			for k, v := range lc.Extra {
+				switch k {
+				case "ports", "target_ports", "targets":
+				default:
+					nlc.Extra[k] = v
+				}
+			}
+
+			if len(targets) > 0 {
+				strs := make([]string, len(targets))
+				for j, t := range targets {
+					switch len(targetPorts) {
+					case 0:
+					case 1:
+						t.Port = targetPorts[0]
+					default:
+						t.Port = targetPorts[i]
+					}
+					if lc.Network == netLayer.DualNetworkName {
+						t.Network = network
+					}
+					strs[j] = t.UrlString()
+				}
+				nlc.TargetAddr = strs[0]
+				if len(strs) > 1 {
+					nlc.Extra["targets"] = strs[1:]
+				}
+			}
+			result = append(result, &nlc)
+		}
+	}
+	return result, nil
+}
+
+func isRedirect(lc *proxy.ListenConf) bool {
+	r, _ := utils.AnyToBool(lc.Extra["redirect"])
+	return r
+}
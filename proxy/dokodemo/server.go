@@ -3,7 +3,7 @@ Package dokodemo implements a dokodemo-door proxy.Server.
 
 Server that wants to relay data to a dokodemo target address.
 
-dokodemo 是 v2ray的 dokodemo-door 协议的实现。不含透明代理功能。
+dokodemo 是 v2ray的 dokodemo-door 协议的实现。除了 下面的 redirect 模式 外, 不含透明代理功能 (透明代理 见 proxy/tproxy)。
 
 严格来说 dokodemo-door 并不是一个 "协议", 而是一个预先指定目标的转发方式。
 
@@ -34,20 +34,70 @@ https://www.40huo.cn/blog/wireguard-over-vless.html
 就是说，任意门把客户数据的出口、自己的入口点从本地搬到了某个代理服务器的入口，然后指定了该数据的实际远程目标；就好像数据是从代理服务器直接发出的一样.
 
 到底是哪个代理服务器，由outbound（即本作的dial）以及routing配置决定的。如果没有配置routing，那就是默认走第一个dial.
+
+# Redirect 模式
+
+linux 上, 给出 extra.redirect = true 时, 不需要 target, 每个 tcp连接 的 目标 为 其 被 iptables REDIRECT 之前 的 原始目标
+(见 netLayer.GetOriginalDst). 与 tproxy 相比, 只需要 nat表, 不需要 策略路由, 监听 本身 也 不需要 CAP_NET_ADMIN, 但 只支持 tcp.
+
+嗅探 与 分流 与 其它 监听协议 一样 进行. iptables 示例 (12345 为 监听端口):
+
+	iptables -t nat -N VS_REDIRECT
+	iptables -t nat -A VS_REDIRECT -d 127.0.0.0/8 -j RETURN
+	iptables -t nat -A VS_REDIRECT -d 192.168.0.0/16 -j RETURN
+	iptables -t nat -A VS_REDIRECT -p tcp -j REDIRECT --to-ports 12345
+	iptables -t nat -A PREROUTING -p tcp -j VS_REDIRECT
+
+只 转发 局域网 其它设备 的 流量 时, 上面 就够了. 若 还要 代理 本机 发出的 流量 (OUTPUT 链), 就 必须 排除 vs 自己 拨号 的 连接, 否则 会 回环.
+推荐 以 一个 专门的 用户 (如 vs) 运行 vs, 按 uid 排除, 这样 vs 不需要 任何 特权:
+
+	iptables -t nat -A OUTPUT -p tcp -m owner ! --uid-owner vs -j VS_REDIRECT
+
+也可以 给 dial 配置 sockopt.mark (如 255) 并 按 mark 排除, 但 设置 SO_MARK 需要 CAP_NET_ADMIN, 即 vs 要以 root 运行 或 被授予 该 capability:
+
+	iptables -t nat -A OUTPUT -p tcp -m mark ! --mark 255 -j VS_REDIRECT
+
+# 端口范围 与 多目标
+
+标准配置 中, 一个 listen 可以 给出 多个 监听端口 与 多个 目标, 见 ExpandListenConf:
+
+	extra.ports = "10000-10100"         # 监听 的 端口列表, 给出后 忽略 port
+	extra.target_ports = "20000-20100"  # 可选, 与 ports 一一对应; 只给一个 端口 时 全部 转发到 该端口; 不给出 则 使用 target 中的端口
+	extra.targets = ["tcp://1.1.1.1:443", "tcp://2.2.2.2:443"]  # 可选, 追加 在 target 后 的 备选目标
+	extra.target_strategy = "failover"  # 或 roundrobin
+
+network = "dual" 时 同时 监听 tcp 与 udp.
+
+每个 端口 都是 一个 单独的 listen, tag 为 原tag_端口, 如 fwd_10000, 可用于 分流 的 fromTag.
+
+failover 时 总是 使用 第一个 可用的 目标; tcp 拨号 失败 的 目标 会 被标记 为 不可用 一段时间 (见 TargetDownDuration), 并 立即 换 下一个 目标 重试.
+roundrobin 时 依次 轮流 使用 可用的 目标. udp 无法 得知 拨号 是否 成功, 所以 只 依照 策略 选择 目标.
 */
 package dokodemo
 
 import (
 	"net"
 	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
 	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
 )
 
 const name = "dokodemo"
 
+const (
+	StrategyFailover   = "failover"
+	StrategyRoundRobin = "roundrobin"
+)
+
+// 拨号失败 的 目标 被标记为 不可用 的 时长
+var TargetDownDuration = time.Second * 30
+
 func init() {
 	proxy.RegisterServer(name, &ServerCreator{})
 }
@@ -62,23 +112,87 @@ func (ServerCreator) URLToListenConf(url *url.URL, lc *proxy.ListenConf, format
 	return lc, nil
 }
 
-// use lc.TargetAddr
+// use lc.TargetAddr, extra.targets, extra.target_strategy, 或 extra.redirect
 func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
-	ta, e := netLayer.NewAddrByURL(lc.TargetAddr)
-	if e != nil {
-		return nil, e
+	if isRedirect(lc) {
+		switch lc.Network {
+		case "", "tcp", "tcp4", "tcp6":
+		default:
+			return nil, utils.ErrInErr{ErrDesc: "dokodemo redirect only supports tcp", ErrDetail: utils.ErrInvalidData, Data: lc.Network}
+		}
+		return &Server{redirect: true}, nil
+	}
+
+	strs, err := getTargetStrs(lc)
+	if err != nil {
+		return nil, err
 	}
 	s := &Server{
-		targetAddr: ta,
+		targets: make([]netLayer.Addr, len(strs)),
+	}
+	for i, str := range strs {
+		s.targets[i], err = netLayer.NewAddrByURL(str)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.downUntil = make([]atomic.Int64, len(s.targets))
+
+	if thing := lc.Extra["target_strategy"]; thing != nil {
+		str, _ := thing.(string)
+		switch str = strings.ToLower(str); str {
+		case StrategyFailover, StrategyRoundRobin:
+			s.strategy = str
+		default:
+			return nil, utils.ErrInErr{ErrDesc: "dokodemo unknown target_strategy", ErrDetail: utils.ErrInvalidData, Data: thing}
+		}
 	}
 	return s, nil
 }
 
-// implements proxy.Server
+// 返回 target 与 extra.targets 中 给出的 所有 目标url
+func getTargetStrs(lc *proxy.ListenConf) (strs []string, err error) {
+	if lc.TargetAddr != "" {
+		strs = append(strs, lc.TargetAddr)
+	}
+	switch v := lc.Extra["targets"].(type) {
+	case nil:
+	case string:
+		for _, str := range strings.Split(v, ",") {
+			if str = strings.TrimSpace(str); str != "" {
+				strs = append(strs, str)
+			}
+		}
+	case []string:
+		strs = append(strs, v...)
+	case []any: //toml 解析出的 数组
+		for _, a := range v {
+			str, ok := a.(string)
+			if !ok {
+				return nil, utils.ErrInErr{ErrDesc: "dokodemo extra.targets must be string array", ErrDetail: utils.ErrInvalidData, Data: a}
+			}
+			strs = append(strs, str)
+		}
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "dokodemo extra.targets must be string array", ErrDetail: utils.ErrInvalidData, Data: v}
+	}
+	if len(strs) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "dokodemo no target given", ErrDetail: utils.ErrInvalidData}
+	}
+	return
+}
+
+// implements proxy.FailoverServer
 type Server struct {
 	proxy.Base
 
-	targetAddr netLayer.Addr
+	targets []netLayer.Addr
+
+	strategy  string         //为空 时 即 failover
+	rrIndex   atomic.Uint32  //roundrobin 的 下一个 序号
+	downUntil []atomic.Int64 //与 targets 对应, 目标 被标记为 不可用 的 截止时间 (UnixNano)
+
+	redirect bool //为 true 时 目标 为 连接 被 iptables REDIRECT 前 的 原始目标
 }
 
 func NewServer() (proxy.Server, error) {
@@ -88,9 +202,98 @@ func NewServer() (proxy.Server, error) {
 func (*Server) Name() string { return name }
 
 func (s *Server) Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error) {
-	if s.targetAddr.IsUDP() {
-		return nil, netLayer.UniTargetMsgConn{Conn: underlay, Target: s.targetAddr}, s.targetAddr, nil
+	if s.redirect {
+		ta, err := netLayer.GetOriginalDst(underlay)
+		if err != nil {
+			return nil, nil, netLayer.Addr{}, err
+		}
+		if ce := utils.CanLogDebug("dokodemo got redirected tcp"); ce != nil {
+			ce.Write(zap.String("->", ta.String()))
+		}
+		return underlay, nil, ta, nil
+	}
+	if len(s.targets) == 0 {
+		return nil, nil, netLayer.Addr{}, utils.ErrInErr{ErrDesc: "dokodemo no target given", ErrDetail: utils.ErrInvalidData}
+	}
+	ta := s.pickTarget()
+	if ta.IsUDP() {
+		return nil, netLayer.UniTargetMsgConn{Conn: underlay, Target: ta}, ta, nil
 	} else {
-		return underlay, nil, s.targetAddr, nil
+		return underlay, nil, ta, nil
+	}
+}
+
+func (s *Server) isDown(i int, now int64) bool {
+	return s.downUntil[i].Load() > now
+}
+
+// 依照 策略 选择 一个 可用的 目标; 都不可用 时 依然 按 策略 选择.
+func (s *Server) pickTarget() netLayer.Addr {
+	n := len(s.targets)
+	if n == 1 {
+		return s.targets[0]
+	}
+	now := time.Now().UnixNano()
+	if s.strategy != StrategyRoundRobin {
+		if j := s.nextAvailable(0, now); j >= 0 {
+			return s.targets[j]
+		}
+		return s.targets[0]
+	}
+
+	//游标 直接 越过 不可用的 目标, 这样 可用的 目标 依然 平均 轮流
+	for {
+		cur := s.rrIndex.Load()
+		j := s.nextAvailable(int(cur%uint32(n)), now)
+		if j < 0 {
+			j = int(cur % uint32(n))
+		}
+		if s.rrIndex.CompareAndSwap(cur, uint32((j+1)%n)) {
+			return s.targets[j]
+		}
+	}
+}
+
+// 从 start 开始 (包括 start) 找到 第一个 可用的 目标 的 序号, 都不可用 则 返回 -1
+func (s *Server) nextAvailable(start int, now int64) int {
+	n := len(s.targets)
+	for i := 0; i < n; i++ {
+		if j := (start + i) % n; !s.isDown(j, now) {
+			return j
+		}
+	}
+	return -1
+}
+
+func (s *Server) indexOf(a netLayer.Addr) int {
+	for i, t := range s.targets {
+		if t.Network != a.Network || t.Port != a.Port {
+			continue
+		}
+		//分流时 可能 已经 将 域名 解析 为 ip
+		if t.Name != "" && t.Name == a.Name || t.IP != nil && t.IP.Equal(a.IP) {
+			return i
+		}
+	}
+	return -1
+}
+
+// 将 failed 标记为 不可用 一段时间, 并 返回 其后的 下一个 可用 目标.
+func (s *Server) NextTarget(failed netLayer.Addr, tried int) (netLayer.Addr, bool) {
+	i := s.indexOf(failed)
+	if i < 0 {
+		return netLayer.Addr{}, false
+	}
+	s.downUntil[i].Store(time.Now().Add(TargetDownDuration).UnixNano())
+
+	n := len(s.targets)
+	if tried >= n {
+		return netLayer.Addr{}, false
+	}
+	//跳过 不可用的; 都不可用 时 依然 试 下一个
+	j := s.nextAvailable((i+1)%n, time.Now().UnixNano())
+	if j < 0 {
+		j = (i + 1) % n
 	}
+	return s.targets[j], true
 }
@@ -0,0 +1,176 @@
+package dokodemo
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+)
+
+func TestExpandListenConf(t *testing.T) {
+	lc := &proxy.ListenConf{
+		CommonConf: proxy.CommonConf{
+			Tag:      "fwd",
+			Protocol: name,
+			Network:  netLayer.DualNetworkName,
+			IP:       "127.0.0.1",
+			Extra: map[string]any{
+				"ports":           "10000-10002",
+				"target_ports":    "20000-20002",
+				"targets":         []any{"tcp://[::1]:1"},
+				"target_strategy": "roundrobin",
+			},
+		},
+		TargetAddr: "tcp://example.com:1",
+	}
+
+	lcs, err := proxy.ExpandListenConf(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lcs) != 6 {
+		t.Fatal("should expand to 3 ports * 2 networks", len(lcs))
+	}
+	for i, l := range lcs {
+		port := 10000 + i/2
+		network := []string{"tcp", "udp"}[i%2]
+
+		if l.Port != port || l.Network != network {
+			t.Fatal("wrong port or network", i, l.Port, l.Network)
+		}
+		if want := "fwd_" + []string{"10000", "10001", "10002"}[i/2]; l.Tag != want {
+			t.Fatal("wrong tag", l.Tag, want)
+		}
+		if _, has := l.Extra["ports"]; has {
+			t.Fatal("ports should be removed")
+		}
+
+		ser, err := proxy.NewServer(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := ser.(*Server)
+		if len(s.targets) != 2 || s.strategy != StrategyRoundRobin {
+			t.Fatal("wrong targets", s.targets, s.strategy)
+		}
+		for _, ta := range s.targets {
+			if ta.Port != 20000+i/2 || ta.Network != network {
+				t.Fatal("wrong target", ta.UrlString())
+			}
+		}
+		if s.targets[0].Name != "example.com" || !s.targets[1].IP.Equal(net.ParseIP("::1")) {
+			t.Fatal("wrong target host", s.targets)
+		}
+	}
+
+	if lc.Tag != "fwd" || lc.Extra["ports"] == nil {
+		t.Fatal("original conf should not be modified")
+	}
+
+	//全部 转发 到 同一 端口
+	lc.Network = "tcp"
+	lc.Extra["target_ports"] = 443
+	lcs, err = proxy.ExpandListenConf(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lcs) != 3 || lcs[2].TargetAddr != "tcp://example.com:443" {
+		t.Fatal("wrong", len(lcs), lcs[2].TargetAddr)
+	}
+
+	lc.Extra["target_ports"] = "1-2"
+	if _, err = proxy.ExpandListenConf(lc); err == nil {
+		t.Fatal("target_ports count mismatch should fail")
+	}
+
+	//没有 ports 且 不是 dual 时 不展开
+	single := &proxy.ListenConf{CommonConf: proxy.CommonConf{Protocol: name}, TargetAddr: "tcp://127.0.0.1:1"}
+	if lcs, err = proxy.ExpandListenConf(single); err != nil || len(lcs) != 1 || lcs[0] != single {
+		t.Fatal("should not expand", lcs, err)
+	}
+}
+
+func newTestServer(t *testing.T, strategy string, targets ...string) *Server {
+	lc := &proxy.ListenConf{
+		CommonConf: proxy.CommonConf{Protocol: name, Extra: map[string]any{"targets": targets}},
+	}
+	if strategy != "" {
+		lc.Extra["target_strategy"] = strategy
+	}
+	ser, err := proxy.NewServer(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ser.(*Server)
+}
+
+func TestTargetStrategy(t *testing.T) {
+	s := newTestServer(t, "", "tcp://127.0.0.1:1", "tcp://127.0.0.1:2", "tcp://127.0.0.1:3")
+
+	if _, ok := proxy.Server(s).(proxy.FailoverServer); !ok {
+		t.Fatal("should be FailoverServer")
+	}
+
+	for i := 0; i < 3; i++ {
+		if p := s.pickTarget().Port; p != 1 {
+			t.Fatal("failover should always pick the first", p)
+		}
+	}
+
+	next, ok := s.NextTarget(s.targets[0], 1)
+	if !ok || next.Port != 2 {
+		t.Fatal("wrong next", next, ok)
+	}
+	if p := s.pickTarget().Port; p != 2 {
+		t.Fatal("failed target should be skipped", p)
+	}
+
+	//分流时 域名 可能 已被 解析, 这里 ip 相同 也算 同一 目标
+	next, ok = s.NextTarget(netLayer.Addr{Network: "tcp", IP: s.targets[1].IP, Port: 2}, 2)
+	if !ok || next.Port != 3 {
+		t.Fatal("wrong next", next, ok)
+	}
+	if _, ok = s.NextTarget(s.targets[2], 3); ok {
+		t.Fatal("all targets tried, should stop")
+	}
+	if _, ok = s.NextTarget(netLayer.Addr{Network: "tcp", Name: "unknown", Port: 1}, 1); ok {
+		t.Fatal("unknown target should not have next")
+	}
+
+	//都 不可用 时 依然 返回 第一个
+	if p := s.pickTarget().Port; p != 1 {
+		t.Fatal("wrong", p)
+	}
+
+	s.downUntil[1].Store(time.Now().Add(-time.Second).UnixNano())
+	if p := s.pickTarget().Port; p != 2 {
+		t.Fatal("target should be available again", p)
+	}
+
+	rr := newTestServer(t, StrategyRoundRobin, "udp://127.0.0.1:1", "udp://127.0.0.1:2", "udp://127.0.0.1:3")
+	rr.downUntil[1].Store(time.Now().Add(time.Minute).UnixNano())
+	var got []int
+	for i := 0; i < 6; i++ {
+		got = append(got, rr.pickTarget().Port)
+	}
+	//不可用的 目标 不应 让 下一个 目标 多分到 一次
+	want := []int{1, 3, 1, 3, 1, 3}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatal("wrong roundrobin", got)
+		}
+	}
+
+	//下一个 目标 不可用 时 应 跳过 它
+	next, ok = rr.NextTarget(rr.targets[0], 1)
+	if !ok || next.Port != 3 {
+		t.Fatal("down target should be skipped", next, ok)
+	}
+
+	lc := &proxy.ListenConf{CommonConf: proxy.CommonConf{Protocol: name, Extra: map[string]any{"target_strategy": "random"}}, TargetAddr: "tcp://127.0.0.1:1"}
+	if _, err := proxy.NewServer(lc); err == nil {
+		t.Fatal("unknown strategy should fail")
+	}
+}
@@ -269,6 +269,10 @@ func (pc *ProxyConn) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+func (pc *ProxyConn) CloseWrite() error {
+	return netLayer.CloseWrite(pc.Conn)
+}
+
 // ReadFrom implements the io.ReaderFrom ReadFrom method.
 // 专门用于适配 tcp的splice.
 func (pc *ProxyConn) ReadFrom(r io.Reader) (n int64, e error) {
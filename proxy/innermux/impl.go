@@ -0,0 +1,278 @@
+package innermux
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer/h2"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/hashicorp/yamux"
+	"github.com/xtaci/smux"
+	"golang.org/x/net/http2"
+)
+
+const (
+	yamuxVersion       = 0   //yamux 每一帧 的 第一个字节
+	h2PrefaceFirstByte = 'P' //"PRI * HTTP/2.0"
+)
+
+// smux 的 Stream 没有 半关闭: Close 发送 FIN 后 就 完全关闭, 而 发送 FIN 的 接口 没有导出.
+// 所以 Stream 不实现 netLayer.CloseWriter, 开启 netLayer.RelayHalfClose 时 依然会 直接 关闭 双方.
+type smuxSession struct {
+	*smux.Session
+}
+
+func newSmuxSession(conn io.ReadWriteCloser, conf Config, version int, isClient bool) (Session, error) {
+	sc := smux.DefaultConfig()
+	sc.Version = version
+	sc.KeepAliveDisabled = conf.KeepAliveDisabled
+	if conf.KeepAliveInterval > 0 {
+		sc.KeepAliveInterval = conf.KeepAliveInterval
+	}
+	if conf.KeepAliveTimeout > 0 {
+		sc.KeepAliveTimeout = conf.KeepAliveTimeout
+	}
+	if conf.MaxReceiveBuffer > 0 {
+		sc.MaxReceiveBuffer = conf.MaxReceiveBuffer
+	}
+	if conf.MaxStreamBuffer > 0 {
+		sc.MaxStreamBuffer = conf.MaxStreamBuffer
+	}
+
+	var s *smux.Session
+	var err error
+	if isClient {
+		s, err = smux.Client(conn, sc)
+	} else {
+		s, err = smux.Server(conn, sc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return smuxSession{s}, nil
+}
+
+func (s smuxSession) OpenStream() (net.Conn, error) {
+	st, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s smuxSession) AcceptStream() (net.Conn, error) {
+	st, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+type yamuxSession struct {
+	*yamux.Session
+}
+
+func newYamuxSession(conn io.ReadWriteCloser, conf Config, isClient bool) (Session, error) {
+	yc := yamux.DefaultConfig()
+	yc.LogOutput = io.Discard
+	yc.EnableKeepAlive = !conf.KeepAliveDisabled
+	if conf.KeepAliveInterval > 0 {
+		yc.KeepAliveInterval = conf.KeepAliveInterval
+	}
+	if conf.KeepAliveTimeout > 0 {
+		yc.ConnectionWriteTimeout = conf.KeepAliveTimeout
+	}
+	if conf.MaxStreamBuffer > int(yc.MaxStreamWindowSize) {
+		yc.MaxStreamWindowSize = uint32(conf.MaxStreamBuffer)
+	}
+
+	var s *yamux.Session
+	var err error
+	if isClient {
+		s, err = yamux.Client(conn, yc)
+	} else {
+		s, err = yamux.Server(conn, yc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return yamuxSession{s}, nil
+}
+
+func (s yamuxSession) OpenStream() (net.Conn, error) {
+	st, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxStream{Stream: st}, nil
+}
+
+func (s yamuxSession) AcceptStream() (net.Conn, error) {
+	st, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxStream{Stream: st}, nil
+}
+
+/*
+yamux 的 Stream.Close 本身 就是 半关闭 (发送 FIN), 要等 对方 也 关闭 后 才 真正关闭.
+
+所以 CloseWrite 直接 调用 Stream.Close; 而 CloseWrite 之后 再 Close 时, 设置 读超时 以 解除 阻塞中的 Read,
+否则 对方 一直 不关闭 的话, Read 要等到 StreamCloseTimeout 才会返回.
+*/
+type yamuxStream struct {
+	*yamux.Stream
+	writeClosed int32
+}
+
+func (s *yamuxStream) CloseWrite() error {
+	atomic.StoreInt32(&s.writeClosed, 1)
+	return s.Stream.Close()
+}
+
+func (s *yamuxStream) Close() error {
+	if atomic.LoadInt32(&s.writeClosed) == 1 {
+		s.Stream.SetReadDeadline(time.Now())
+	}
+	return s.Stream.Close()
+}
+
+// 所有 h2mux 客户端 session 共用, 每次 DialSubConn 都直接传入 session 自己的 ClientConn
+var h2muxClient = h2.NewClient(h2.Config{
+	Path:   "/",
+	Method: http.MethodPut,
+	Hosts:  []string{"localhost"},
+}, nil)
+
+// h2 的 stream数 需要 我们自己统计
+type h2Stream struct {
+	net.Conn
+	counter   *int32
+	closeOnce sync.Once
+}
+
+func newH2Stream(c net.Conn, counter *int32) *h2Stream {
+	atomic.AddInt32(counter, 1)
+	return &h2Stream{Conn: c, counter: counter}
+}
+
+func (s *h2Stream) CloseWrite() error {
+	return netLayer.CloseWrite(s.Conn)
+}
+
+func (s *h2Stream) Close() error {
+	s.closeOnce.Do(func() {
+		atomic.AddInt32(s.counter, -1)
+	})
+	return s.Conn.Close()
+}
+
+type h2ClientSession struct {
+	conn    net.Conn
+	cc      *http2.ClientConn
+	streams int32
+}
+
+func newH2ClientSession(conn net.Conn) (Session, error) {
+	var t http2.Transport
+	cc, err := t.NewClientConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &h2ClientSession{conn: conn, cc: cc}, nil
+}
+
+func (s *h2ClientSession) OpenStream() (net.Conn, error) {
+	c, err := h2muxClient.DialSubConn(s.cc)
+	if err != nil {
+		return nil, err
+	}
+	return newH2Stream(c, &s.streams), nil
+}
+
+func (s *h2ClientSession) AcceptStream() (net.Conn, error) {
+	return nil, net.ErrClosed
+}
+
+func (s *h2ClientSession) NumStreams() int {
+	return int(atomic.LoadInt32(&s.streams))
+}
+
+func (s *h2ClientSession) IsClosed() bool {
+	st := s.cc.State()
+	return st.Closed || st.Closing
+}
+
+func (s *h2ClientSession) Close() error {
+	s.cc.Close()
+	return s.conn.Close()
+}
+
+type h2ServerSession struct {
+	conn     net.Conn
+	acceptCh chan net.Conn
+	done     chan struct{}
+	doneOnce sync.Once
+	streams  int32
+}
+
+func newH2ServerSession(conn net.Conn) Session {
+	s := &h2ServerSession{
+		conn:     conn,
+		acceptCh: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		ser := h2.NewServer(h2.Config{Path: "/", Method: http.MethodPut}, nil)
+
+		//阻塞
+		ser.StartHandle(conn, func(sc net.Conn) {
+			select {
+			case s.acceptCh <- newH2Stream(sc, &s.streams):
+			case <-s.done:
+				sc.Close()
+			}
+		}, nil)
+		s.Close()
+	}()
+	return s
+}
+
+func (s *h2ServerSession) AcceptStream() (net.Conn, error) {
+	select {
+	case c := <-s.acceptCh:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *h2ServerSession) OpenStream() (net.Conn, error) {
+	return nil, net.ErrClosed
+}
+
+func (s *h2ServerSession) NumStreams() int {
+	return int(atomic.LoadInt32(&s.streams))
+}
+
+func (s *h2ServerSession) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *h2ServerSession) Close() error {
+	s.doneOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+	return nil
+}
@@ -0,0 +1,164 @@
+/*
+Package innermux provides the inner mux sessions used by proxy protocols that support mux command (vless v1, trojan, vmess).
+
+支持的实现:
+
+	smux  (即 smux v1, 默认值, 兼容 trojan-go)
+	smux2 (smux v2, 支持 每个stream 单独的 流控)
+	yamux
+	h2mux (每个stream 为 一个 h2 请求, 复用 advLayer/h2 的实现)
+	mux.cool (v2ray/xray 的 mux, 含 xudp; 只用于 vless v0 与 vmess, 见 muxcool.go)
+
+除 mux.cool 外, 上面 任意一种 都可以 开启 padding: 连接开始时的 前16次 写入 会被加上 随机长度的填充, 以混淆 握手阶段的 长度特征.
+
+除 mux.cool 外, 服务端 根据 客户端 发来的 第一个字节 自动判断 使用的是 哪一种实现, 以及 是否开启了 padding, 所以 服务端 只需配置 窗口 与 keepalive 等参数.
+
+客户端 使用 ClientPool 保存 多个 session, 可以 限制 每个session 的 最大 stream 数, 并 按 存活时间 或 传输字节数 轮换 session,
+这样 一个 卡住的 session 不会 导致 所有 stream 都卡住.
+*/
+package innermux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.org/x/net/http2"
+)
+
+const (
+	Smux  = "smux"
+	Smux2 = "smux2"
+	Yamux = "yamux"
+	H2mux = "h2mux"
+
+	MuxCool = "mux.cool"
+)
+
+var ErrUnknownMuxType = errors.New("unknown inner mux type")
+
+type Session interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+}
+
+type Config struct {
+	Type    string //Smux, Smux2, Yamux, H2mux, MuxCool. 空字符串 等同于 Smux
+	Padding bool   //对 MuxCool 无效
+
+	//smux 的 MaxReceiveBuffer 与 MaxStreamBuffer; yamux 只使用 MaxStreamBuffer 作为 MaxStreamWindowSize. 0 表示 使用默认值
+	MaxReceiveBuffer int
+	MaxStreamBuffer  int
+
+	KeepAliveDisabled bool
+	KeepAliveInterval time.Duration //0 表示 使用默认值
+	KeepAliveTimeout  time.Duration //0 表示 使用默认值
+
+	//下面 只用于 客户端
+
+	MaxConnections int           //ClientPool 中 最多 同时使用 多少个 session, 默认为1
+	MaxStreams     int           //每个 session 最多 同时打开 多少个 stream, 0 表示 不限制
+	MaxAge         time.Duration //session 存在 超过这么久后 不再 打开新的 stream, 0 表示 不限制
+	MaxBytes       int64         //session 传输 超过这么多字节后 不再 打开新的 stream, 0 表示 不限制
+}
+
+// 新建 客户端 session. 若开启了padding, 会在 第一次写入时 发送 padding标记.
+func NewClientSession(rwc io.ReadWriteCloser, conf Config) (Session, error) {
+	conn := toNetConn(rwc)
+	if conf.Padding && conf.Type != MuxCool {
+		conn = newPaddingConn(conn, true)
+	}
+
+	switch conf.Type {
+	case "", Smux:
+		return newSmuxSession(conn, conf, 1, true)
+	case Smux2:
+		return newSmuxSession(conn, conf, 2, true)
+	case Yamux:
+		return newYamuxSession(conn, conf, true)
+	case H2mux:
+		return newH2ClientSession(conn)
+	case MuxCool:
+		return newMuxCoolSession(conn, conf, true), nil
+	}
+	return nil, utils.ErrInErr{ErrDesc: "innermux.NewClientSession failed", ErrDetail: ErrUnknownMuxType, Data: conf.Type}
+}
+
+// 新建 服务端 session. 会读取 第一个字节 来判断 客户端 使用的 mux实现, 所以 会阻塞 直到 客户端 发来数据.
+// conf.Type 与 conf.Padding 不会被使用. mux.cool 无法 自动识别, 要用 NewMuxCoolServerSession.
+func NewServerSession(rwc io.ReadWriteCloser, conf Config) (Session, error) {
+	conn := toNetConn(rwc)
+
+	first, err := readFirstByte(conn)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "innermux.NewServerSession read first byte failed", ErrDetail: err}
+	}
+
+	if first == paddingMagic {
+		conn = newPaddingConn(conn, false)
+
+		first, err = readFirstByte(conn)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "innermux.NewServerSession read first padded byte failed", ErrDetail: err}
+		}
+	}
+
+	firstBuf := []byte{first}
+
+	if first == h2PrefaceFirstByte {
+		//h2.Server 要求 第一次Read 就能读到 完整的 preface
+		firstBuf = make([]byte, len(http2.ClientPreface))
+		firstBuf[0] = first
+		_, err = io.ReadFull(conn, firstBuf[1:])
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "innermux.NewServerSession read h2 preface failed", ErrDetail: err}
+		}
+	}
+
+	conn = &netLayer.ReadWrapper{
+		Conn:              conn,
+		OptionalReader:    io.MultiReader(bytes.NewReader(firstBuf), conn),
+		RemainFirstBufLen: len(firstBuf),
+	}
+
+	switch first {
+	case 1, 2:
+		return newSmuxSession(conn, conf, int(first), false)
+	case yamuxVersion:
+		return newYamuxSession(conn, conf, false)
+	case h2PrefaceFirstByte:
+		return newH2ServerSession(conn), nil
+	}
+	return nil, utils.ErrInErr{ErrDesc: "innermux.NewServerSession failed", ErrDetail: ErrUnknownMuxType, Data: first}
+}
+
+func readFirstByte(r io.Reader) (byte, error) {
+	var bs [1]byte
+	_, err := io.ReadFull(r, bs[:])
+	return bs[0], err
+}
+
+// 一些 proxy 的 Handshake 返回的 只是 io.ReadWriteCloser, 而 h2mux 需要 net.Conn
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+func toNetConn(rwc io.ReadWriteCloser) net.Conn {
+	if c, ok := rwc.(net.Conn); ok {
+		return c
+	}
+	return rwcConn{rwc}
+}
+
+func (rwcConn) LocalAddr() net.Addr                { return nil }
+func (rwcConn) RemoteAddr() net.Addr               { return nil }
+func (rwcConn) SetDeadline(t time.Time) error      { return nil }
+func (rwcConn) SetReadDeadline(t time.Time) error  { return nil }
+func (rwcConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,462 @@
+package innermux_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func TestSmux(t *testing.T) {
+	testMux(t, innermux.Config{Type: innermux.Smux})
+}
+
+func TestSmux2(t *testing.T) {
+	testMux(t, innermux.Config{Type: innermux.Smux2})
+}
+
+func TestYamux(t *testing.T) {
+	testMux(t, innermux.Config{Type: innermux.Yamux})
+}
+
+func TestH2mux(t *testing.T) {
+	testMux(t, innermux.Config{Type: innermux.H2mux})
+}
+
+func TestSmux_padding(t *testing.T) {
+	testMux(t, innermux.Config{Type: innermux.Smux, Padding: true})
+}
+
+func TestYamux_padding(t *testing.T) {
+	testMux(t, innermux.Config{Type: innermux.Yamux, Padding: true})
+}
+
+func TestH2mux_padding(t *testing.T) {
+	testMux(t, innermux.Config{Type: innermux.H2mux, Padding: true})
+}
+
+func listenEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				s, err := innermux.NewServerSession(c, innermux.Config{})
+				if err != nil {
+					c.Close()
+					return
+				}
+				for {
+					st, err := s.AcceptStream()
+					if err != nil {
+						s.Close()
+						return
+					}
+					go func() {
+						io.Copy(st, st)
+						st.Close()
+					}()
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func echoStream(t *testing.T, s innermux.Session) {
+	st, err := s.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	data := make([]byte, 100*1024)
+	rand.Read(data)
+
+	go func() {
+		for p := data; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := st.Write(p[:n]); err != nil {
+				return
+			}
+			p = p[n:]
+		}
+	}()
+
+	st.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(st, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo data not equal")
+	}
+}
+
+func testMux(t *testing.T, conf innermux.Config) {
+	l := listenEcho(t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := innermux.NewClientSession(c, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			echoStream(t, s)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
+
+// smux 的 stream 不支持 半关闭, netLayer.Relay 会 回退到 直接关闭 双方; yamux 与 h2mux 支持.
+func TestStreamCloseWrite(t *testing.T) {
+	l := listenEcho(t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		typ       string
+		halfClose bool
+	}{
+		{innermux.Smux, false},
+		{innermux.Smux2, false},
+		{innermux.Yamux, true},
+		{innermux.H2mux, true},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := innermux.NewClientSession(c, innermux.Config{Type: tc.typ})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := s.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = netLayer.CloseWrite(st)
+		if tc.halfClose {
+			if err != nil {
+				t.Fatal(tc.typ, "should support CloseWrite", err)
+			}
+		} else if err != utils.ErrUnImplemented {
+			t.Fatal(tc.typ, "should not support CloseWrite", err)
+		}
+		st.Close()
+		s.Close()
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	l := listenEcho(t)
+	defer l.Close()
+
+	pool := innermux.NewClientPool(innermux.Config{
+		Type:           innermux.Smux2,
+		MaxConnections: 2,
+		MaxBytes:       50 * 1024,
+	})
+	defer pool.Close()
+
+	getSession := func() innermux.Session {
+		if s := pool.Pick(); s != nil {
+			return s
+		}
+		defer pool.DialDone()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := pool.NewSession(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s1 := getSession()
+	s2 := getSession()
+	if s1 == s2 {
+		t.Fatal("should dial a second session while less than MaxConnections")
+	}
+
+	s3 := getSession()
+	if s3 != s1 && s3 != s2 {
+		t.Fatal("should reuse existing session")
+	}
+
+	//超过 MaxBytes 后 s1 应被轮换掉
+	echoStream(t, s1)
+
+	if s := pool.Pick(); s != nil {
+		t.Fatal("should dial new session after rotation")
+	}
+	pool.DialDone()
+	if !s1.IsClosed() {
+		t.Fatal("drained session should be closed")
+	}
+
+	s4 := getSession()
+	if s4 == s1 || s4 == s2 {
+		t.Fatal("should be a new session")
+	}
+	echoStream(t, s4)
+
+	pool.Remove(s4)
+	if pool.Len() != 1 {
+		t.Fatal("pool len should be 1, got", pool.Len())
+	}
+}
+
+// 可用的 与 正在拨号的 session 总数 不超过 MaxConnections
+func TestClientPoolMaxConnections(t *testing.T) {
+	l := listenEcho(t)
+	defer l.Close()
+
+	pool := innermux.NewClientPool(innermux.Config{
+		Type:           innermux.Smux2,
+		MaxConnections: 1,
+		MaxStreams:     1,
+	})
+	defer pool.Close()
+
+	if s := pool.Pick(); s != nil {
+		t.Fatal("should dial first session")
+	}
+
+	//名额 已被 预留, 其它 Pick 要 等待 拨号 完成
+	picked := make(chan innermux.Session, 1)
+	go func() {
+		picked <- pool.Pick()
+	}()
+	select {
+	case <-picked:
+		t.Fatal("Pick should wait for the dialing session")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := pool.NewSession(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.DialDone()
+
+	select {
+	case s := <-picked:
+		if s != s1 {
+			t.Fatal("should get the dialed session")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pick should return after dialing")
+	}
+
+	st, err := s1.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	//达到 MaxStreams 后 也不 超过 MaxConnections, 而是 复用 负载最小的 session
+	if s := pool.Pick(); s != s1 {
+		t.Fatal("should reuse the only session when MaxConnections reached")
+	}
+	if pool.Len() != 1 {
+		t.Fatal("pool len should be 1, got", pool.Len())
+	}
+}
+
+func listenMuxCoolEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s := innermux.NewMuxCoolServerSession(c)
+			go func() {
+				for {
+					st, err := s.AcceptStream()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer st.Close()
+						if target := st.(innermux.AddrStream).Target(); !target.IsUDP() {
+							io.Copy(st, st)
+							return
+						}
+						mc := st.(netLayer.MsgConn)
+						for {
+							bs, addr, err := mc.ReadMsg()
+							if err != nil {
+								return
+							}
+							if mc.WriteMsg(bs, addr) != nil {
+								return
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestMuxCool(t *testing.T) {
+	l := listenMuxCoolEcho(t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := innermux.NewClientSession(c, innermux.Config{Type: innermux.MuxCool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	as := s.(innermux.AddrSession)
+	if _, err = as.OpenStream(); err != innermux.ErrMuxCoolNeedTarget {
+		t.Fatal("OpenStream should fail", err)
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			st, err := as.DialTCP(netLayer.Addr{Name: "example.com", Port: 80}, []byte("first"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+
+			data := make([]byte, 100*1024)
+			rand.Read(data)
+			go st.Write(data)
+
+			st.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got := make([]byte, len(data)+5)
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Error(err)
+				return
+			}
+			if string(got[:5]) != "first" || !bytes.Equal(got[5:], data) {
+				t.Error("echo data not equal")
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	target := netLayer.Addr{IP: net.IPv4(8, 8, 8, 8), Port: 53, Network: "udp"}
+	other := netLayer.Addr{IP: net.IPv4(1, 1, 1, 1), Port: 53, Network: "udp"}
+
+	mc, err := as.DialUDP(target, []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	mc.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	if err = mc.WriteMsg([]byte("def"), other); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		data string
+		addr netLayer.Addr
+	}{{"abc", target}, {"def", other}} {
+		bs, addr, err := mc.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != want.data || addr.String() != want.addr.String() {
+			t.Fatalf("got %q from %s, want %q from %s", bs, addr.String(), want.data, want.addr.String())
+		}
+	}
+}
+
+// xray 的 xudp 客户端 发出的 帧: id为0 的 New帧 带有 GlobalID, 之后的 Keep帧 带有 每包地址
+func TestMuxCool_xudp(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	s := innermux.NewMuxCoolServerSession(c2)
+	defer s.Close()
+
+	go c1.Write([]byte{
+		0, 20, 0, 0, 1, 1, 2, 0, 53, 1, 8, 8, 8, 8, 1, 2, 3, 4, 5, 6, 7, 8, 0, 3, 'a', 'b', 'c',
+		0, 12, 0, 0, 2, 1, 2, 0, 53, 1, 1, 1, 1, 1, 0, 3, 'd', 'e', 'f',
+	})
+
+	st, err := s.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := st.(innermux.AddrStream).Target(); !target.IsUDP() || target.IP.String() != "8.8.8.8" || target.Port != 53 {
+		t.Fatal("wrong target", target.UrlString())
+	}
+	mc := st.(netLayer.MsgConn)
+
+	for _, want := range []string{"abc 8.8.8.8:53", "def 1.1.1.1:53"} {
+		bs, addr, err := mc.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(bs) + " " + addr.IP.String() + ":" + strconv.Itoa(addr.Port); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	go mc.WriteMsg([]byte("xyz"), netLayer.Addr{IP: net.IPv4(1, 1, 1, 1), Port: 53, Network: "udp"})
+
+	want := []byte{0, 12, 0, 0, 2, 1, 2, 0, 53, 1, 1, 1, 1, 1, 0, 3, 'x', 'y', 'z'}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c1, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
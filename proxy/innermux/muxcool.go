@@ -0,0 +1,685 @@
+package innermux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+/*
+mux.cool 是 v2ray/xray 的 mux 协议. 与 smux 等 不同, 它的 子连接 在 New帧 中 自带 目标地址 与 网络类型,
+所以 不需要 内层代理协议 (simplesocks).
+
+帧格式:
+
+	[2字节 元数据长度][元数据][若 option 含 data: 2字节 数据长度][数据]
+
+元数据:
+
+	[2字节 session id][1字节 status][1字节 option]
+	status 为 New 时: [1字节 network][2字节 port][1字节 atyp][地址], udp 时 后面 还可能有 8字节 的 GlobalID
+	status 为 Keep 且 为 udp 时: 可选的 [1字节 network(udp)][2字节 port][1字节 atyp][地址], 即 xudp 的 每包地址
+
+xudp 中 每个 udp 数据包 都可以 带上 自己的 地址, 这样 一个 udp 子连接 就可以 向 多个 目标 收发 数据 (fullcone).
+GlobalID 会被 解析, 但 我们 不支持 xray 那种 跨连接 迁移 udp 会话 的 做法, 每个 New帧 都会 开启 一个 新的 子连接.
+*/
+
+// v2ray/xray 中 mux.cool 连接 的 伪目标地址
+const MuxCoolAddress = "v1.mux.cool"
+
+const (
+	muxCoolStatusNew       byte = 1
+	muxCoolStatusKeep      byte = 2
+	muxCoolStatusEnd       byte = 3
+	muxCoolStatusKeepAlive byte = 4
+
+	muxCoolOptionData  byte = 1
+	muxCoolOptionError byte = 2
+
+	muxCoolNetworkTCP byte = 1
+	muxCoolNetworkUDP byte = 2
+
+	muxCoolMaxMetaLen = 512
+	muxCoolMaxChunk   = 8 * 1024 //tcp 子连接 每帧 最多 携带 的 数据, 与 v2ray 一致
+
+	muxCoolRecvQueueLen = 64
+
+	muxCoolDefaultKeepAlive = 30 * time.Second
+)
+
+var (
+	ErrMuxCoolNeedTarget = errors.New("mux.cool stream must be opened with a target")
+	errMuxCoolClosed     = errors.New("mux.cool session closed")
+)
+
+// AddrSession 是 子连接 自带 目标地址 的 session (即 mux.cool). 客户端 使用 DialTCP 与 DialUDP 打开 子连接,
+// 其 OpenStream 总是 返回 ErrMuxCoolNeedTarget.
+type AddrSession interface {
+	Session
+	DialTCP(target netLayer.Addr, firstPayload []byte) (net.Conn, error)
+	DialUDP(target netLayer.Addr, firstPayload []byte) (netLayer.MsgConn, error)
+}
+
+// AddrSession 的 服务端 AcceptStream 返回的 子连接 实现 AddrStream.
+// Target().IsUDP() 时, 该 子连接 同时 实现 netLayer.MsgConn, 应 按 udp 转发.
+type AddrStream interface {
+	net.Conn
+	Target() netLayer.Addr
+}
+
+type muxCoolMeta struct {
+	id      uint16
+	status  byte
+	option  byte
+	target  netLayer.Addr //New帧 的 目标, 或 Keep帧 的 udp 每包地址; 没有时 为 空
+	network byte
+}
+
+// 依照 v2ray 的 格式 写入 port 与 地址
+func writeMuxCoolAddr(buf *bytes.Buffer, a netLayer.Addr) error {
+	abs, atyp := a.AddressBytes()
+	if atyp == 0 {
+		return utils.ErrInErr{ErrDesc: "mux.cool invalid addr", ErrDetail: utils.ErrInvalidData, Data: a.String()}
+	}
+	buf.WriteByte(byte(a.Port >> 8))
+	buf.WriteByte(byte(a.Port))
+	buf.WriteByte(atyp)
+	buf.Write(abs)
+	return nil
+}
+
+func (m *muxCoolMeta) writeTo(buf *bytes.Buffer) error {
+	start := buf.Len()
+	buf.Write([]byte{0, 0})
+	buf.WriteByte(byte(m.id >> 8))
+	buf.WriteByte(byte(m.id))
+	buf.WriteByte(m.status)
+	buf.WriteByte(m.option)
+
+	switch {
+	case m.status == muxCoolStatusNew:
+		buf.WriteByte(m.network)
+		if err := writeMuxCoolAddr(buf, m.target); err != nil {
+			return err
+		}
+		if m.network == muxCoolNetworkUDP {
+			buf.Write(make([]byte, 8)) //GlobalID, 全0 表示 没有
+		}
+	case m.status == muxCoolStatusKeep && m.network == muxCoolNetworkUDP && !m.target.IsEmpty():
+		buf.WriteByte(muxCoolNetworkUDP)
+		if err := writeMuxCoolAddr(buf, m.target); err != nil {
+			return err
+		}
+	}
+
+	bs := buf.Bytes()
+	binary.BigEndian.PutUint16(bs[start:], uint16(buf.Len()-start-2))
+	return nil
+}
+
+func readMuxCoolMeta(r io.Reader, m *muxCoolMeta) error {
+	var lenBs [2]byte
+	if _, err := io.ReadFull(r, lenBs[:]); err != nil {
+		return err
+	}
+	l := int(binary.BigEndian.Uint16(lenBs[:]))
+	if l < 4 || l > muxCoolMaxMetaLen {
+		return utils.ErrInErr{ErrDesc: "mux.cool invalid meta length", ErrDetail: utils.ErrInvalidData, Data: l}
+	}
+	bs := make([]byte, l)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return err
+	}
+
+	m.id = binary.BigEndian.Uint16(bs)
+	m.status = bs[2]
+	m.option = bs[3]
+	m.target = netLayer.Addr{}
+	m.network = 0
+
+	if m.status == muxCoolStatusNew || (m.status == muxCoolStatusKeep && l > 4 && bs[4] == muxCoolNetworkUDP) {
+		m.network = bs[4]
+		ad, err := netLayer.V2rayGetAddrFrom(bytes.NewBuffer(bs[5:]))
+		if err != nil {
+			return utils.ErrInErr{ErrDesc: "mux.cool parse addr failed", ErrDetail: err}
+		}
+		switch m.network {
+		case muxCoolNetworkTCP:
+			ad.Network = "tcp"
+		case muxCoolNetworkUDP:
+			ad.Network = "udp"
+		default:
+			return utils.ErrInErr{ErrDesc: "mux.cool unknown network", ErrDetail: utils.ErrInvalidData, Data: m.network}
+		}
+		m.target = ad
+	}
+	return nil
+}
+
+type muxCoolPacket struct {
+	data []byte
+	addr netLayer.Addr
+}
+
+type muxCoolSession struct {
+	conn     net.Conn
+	isClient bool
+
+	wm sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint16]*muxCoolStream
+	nextID  uint16
+
+	acceptCh  chan *muxCoolStream
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMuxCoolSession(conn net.Conn, conf Config, isClient bool) *muxCoolSession {
+	s := &muxCoolSession{
+		conn:     conn,
+		isClient: isClient,
+		streams:  make(map[uint16]*muxCoolStream),
+		acceptCh: make(chan *muxCoolStream),
+		closed:   make(chan struct{}),
+	}
+	go s.readLoop()
+
+	if isClient && !conf.KeepAliveDisabled {
+		interval := conf.KeepAliveInterval
+		if interval <= 0 {
+			interval = muxCoolDefaultKeepAlive
+		}
+		go s.keepAlive(interval)
+	}
+	return s
+}
+
+// 新建 mux.cool 服务端 session. mux.cool 的 第一个字节 与 yamux 的 版本号 相同, 无法 自动识别,
+// 所以 需要 代理协议 根据 自己的 命令 (vless v0 与 vmess 的 mux 命令) 来 确定.
+func NewMuxCoolServerSession(rwc io.ReadWriteCloser) Session {
+	return newMuxCoolSession(toNetConn(rwc), Config{}, false)
+}
+
+func (s *muxCoolSession) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if err := s.writeFrame(&muxCoolMeta{status: muxCoolStatusKeepAlive}, nil); err != nil {
+				s.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *muxCoolSession) writeFrame(m *muxCoolMeta, data []byte) error {
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	if data != nil {
+		m.option |= muxCoolOptionData
+	}
+	if err := m.writeTo(buf); err != nil {
+		return err
+	}
+	if data != nil {
+		buf.WriteByte(byte(len(data) >> 8))
+		buf.WriteByte(byte(len(data)))
+		buf.Write(data)
+	}
+
+	s.wm.Lock()
+	defer s.wm.Unlock()
+
+	select {
+	case <-s.closed:
+		return errMuxCoolClosed
+	default:
+	}
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+func (s *muxCoolSession) readLoop() {
+	defer s.Close()
+
+	var m muxCoolMeta
+	var lenBs [2]byte
+
+	for {
+		if err := readMuxCoolMeta(s.conn, &m); err != nil {
+			if err != io.EOF {
+				if ce := utils.CanLogDebug("mux.cool read frame failed"); ce != nil {
+					ce.Write(zap.Error(err))
+				}
+			}
+			return
+		}
+
+		var data []byte
+		if m.option&muxCoolOptionData != 0 {
+			if _, err := io.ReadFull(s.conn, lenBs[:]); err != nil {
+				return
+			}
+			data = make([]byte, binary.BigEndian.Uint16(lenBs[:]))
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				return
+			}
+		}
+
+		switch m.status {
+		case muxCoolStatusNew:
+			if s.isClient {
+				continue
+			}
+			st := s.newStream(m.id, m.target)
+			select {
+			case s.acceptCh <- st:
+			case <-s.closed:
+				return
+			}
+			if len(data) > 0 {
+				st.deliver(muxCoolPacket{data: data, addr: m.target}, s.closed)
+			}
+
+		case muxCoolStatusKeep:
+			st := s.getStream(m.id)
+			if st == nil {
+				//通知 对端 关闭 这个 子连接, 与 v2ray 一致
+				s.writeFrame(&muxCoolMeta{id: m.id, status: muxCoolStatusEnd}, nil)
+				continue
+			}
+			if len(data) > 0 {
+				st.deliver(muxCoolPacket{data: data, addr: m.target}, s.closed)
+			}
+
+		case muxCoolStatusEnd:
+			if st := s.getStream(m.id); st != nil {
+				s.removeStream(st)
+				st.remoteEnd()
+			}
+
+		case muxCoolStatusKeepAlive:
+
+		default:
+			if ce := utils.CanLogDebug("mux.cool unknown status"); ce != nil {
+				ce.Write(zap.Uint8("status", m.status))
+			}
+			return
+		}
+	}
+}
+
+func (s *muxCoolSession) newStream(id uint16, target netLayer.Addr) *muxCoolStream {
+	st := &muxCoolStream{
+		sess:   s,
+		id:     id,
+		target: target,
+		isUDP:  target.IsUDP(),
+		recvCh: make(chan muxCoolPacket, muxCoolRecvQueueLen),
+		ended:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	st.InitEasyDeadline()
+
+	s.mu.Lock()
+	if old := s.streams[id]; old != nil {
+		old.remoteEnd()
+	}
+	s.streams[id] = st
+	s.mu.Unlock()
+	return st
+}
+
+func (s *muxCoolSession) getStream(id uint16) *muxCoolStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxCoolSession) removeStream(st *muxCoolStream) {
+	s.mu.Lock()
+	if s.streams[st.id] == st {
+		delete(s.streams, st.id)
+	}
+	s.mu.Unlock()
+}
+
+// 分配 一个 未使用的 id. 0 留给 xudp.
+func (s *muxCoolSession) allocID() (uint16, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < 65535; i++ {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		if s.streams[s.nextID] == nil {
+			return s.nextID, nil
+		}
+	}
+	return 0, utils.ErrInErr{ErrDesc: "mux.cool no available session id", ErrDetail: utils.ErrFailed}
+}
+
+func (s *muxCoolSession) dial(target netLayer.Addr, firstPayload []byte) (*muxCoolStream, error) {
+	if !s.isClient {
+		return nil, net.ErrClosed
+	}
+	if s.IsClosed() {
+		return nil, errMuxCoolClosed
+	}
+	id, err := s.allocID()
+	if err != nil {
+		return nil, err
+	}
+	st := s.newStream(id, target)
+
+	m := &muxCoolMeta{
+		id:      id,
+		status:  muxCoolStatusNew,
+		target:  target,
+		network: st.network(),
+	}
+	var data []byte
+	if len(firstPayload) > 0 {
+		data = firstPayload
+		if !st.isUDP && len(data) > muxCoolMaxChunk {
+			data = data[:muxCoolMaxChunk]
+		}
+	}
+	if err := s.writeFrame(m, data); err != nil {
+		s.removeStream(st)
+		return nil, err
+	}
+	if !st.isUDP && len(firstPayload) > len(data) {
+		if _, err := st.Write(firstPayload[len(data):]); err != nil {
+			st.Close()
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+func (s *muxCoolSession) DialTCP(target netLayer.Addr, firstPayload []byte) (net.Conn, error) {
+	target.Network = "tcp"
+	return s.dial(target, firstPayload)
+}
+
+func (s *muxCoolSession) DialUDP(target netLayer.Addr, firstPayload []byte) (netLayer.MsgConn, error) {
+	target.Network = "udp"
+	return s.dial(target, firstPayload)
+}
+
+func (s *muxCoolSession) OpenStream() (net.Conn, error) {
+	return nil, ErrMuxCoolNeedTarget
+}
+
+func (s *muxCoolSession) AcceptStream() (net.Conn, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *muxCoolSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxCoolSession) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxCoolSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+
+		s.mu.Lock()
+		for id, st := range s.streams {
+			st.remoteEnd()
+			delete(s.streams, id)
+		}
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+// mux.cool 的 子连接. tcp 时 作为 net.Conn 使用; udp 时 作为 netLayer.MsgConn 使用.
+//
+// 实现 AddrStream, netLayer.MsgConn, utils.User, utils.UserAssigner
+type muxCoolStream struct {
+	netLayer.EasyDeadline
+
+	sess   *muxCoolSession
+	id     uint16
+	target netLayer.Addr
+	isUDP  bool
+
+	recvCh chan muxCoolPacket
+	remain []byte
+
+	ended     chan struct{} //对端 发来 End, 或 session 已关闭
+	endOnce   sync.Once
+	done      chan struct{} //本地 已 Close
+	closeOnce sync.Once
+
+	upstreamUser utils.User
+}
+
+func (st *muxCoolStream) network() byte {
+	if st.isUDP {
+		return muxCoolNetworkUDP
+	}
+	return muxCoolNetworkTCP
+}
+
+func (st *muxCoolStream) Target() netLayer.Addr {
+	return st.target
+}
+
+// tcp 的 数据 不能丢, 会 阻塞 读循环 直到 被读取, 与 v2ray 一致; udp 队列满了 就 丢包.
+func (st *muxCoolStream) deliver(p muxCoolPacket, sessClosed chan struct{}) {
+	if st.isUDP {
+		select {
+		case st.recvCh <- p:
+		default:
+		}
+		return
+	}
+	select {
+	case st.recvCh <- p:
+	case <-st.done:
+	case <-sessClosed:
+	}
+}
+
+func (st *muxCoolStream) remoteEnd() {
+	st.endOnce.Do(func() {
+		close(st.ended)
+	})
+}
+
+func (st *muxCoolStream) readPacket() (muxCoolPacket, error) {
+	select {
+	case p := <-st.recvCh:
+		return p, nil
+	default:
+	}
+
+	select {
+	case p := <-st.recvCh:
+		return p, nil
+	case <-st.ended:
+		//读循环 在 发送 End 信号 前 已经 放入了 所有数据
+		select {
+		case p := <-st.recvCh:
+			return p, nil
+		default:
+		}
+		return muxCoolPacket{}, io.EOF
+	case <-st.done:
+		return muxCoolPacket{}, net.ErrClosed
+	case <-st.ReadTimeoutChan():
+		return muxCoolPacket{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (st *muxCoolStream) Read(p []byte) (int, error) {
+	if len(st.remain) == 0 {
+		pk, err := st.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		st.remain = pk.data
+	}
+	n := copy(p, st.remain)
+	st.remain = st.remain[n:]
+	return n, nil
+}
+
+func (st *muxCoolStream) checkWritable() error {
+	select {
+	case <-st.done:
+		return net.ErrClosed
+	case <-st.ended:
+		return io.ErrClosedPipe
+	case <-st.WriteTimeoutChan():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+	return nil
+}
+
+func (st *muxCoolStream) Write(p []byte) (int, error) {
+	if st.isUDP {
+		if err := st.WriteMsg(p, netLayer.Addr{}); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if err := st.checkWritable(); err != nil {
+			return n, err
+		}
+		chunk := p
+		if len(chunk) > muxCoolMaxChunk {
+			chunk = chunk[:muxCoolMaxChunk]
+		}
+		if err := st.sess.writeFrame(&muxCoolMeta{id: st.id, status: muxCoolStatusKeep}, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (st *muxCoolStream) ReadMsg() ([]byte, netLayer.Addr, error) {
+	pk, err := st.readPacket()
+	if err != nil {
+		return nil, netLayer.Addr{}, err
+	}
+	if pk.addr.IsEmpty() {
+		pk.addr = st.target
+	}
+	return pk.data, pk.addr, nil
+}
+
+// peer 不为空 时 写入 xudp 的 每包地址.
+func (st *muxCoolStream) WriteMsg(data []byte, peer netLayer.Addr) error {
+	if err := st.checkWritable(); err != nil {
+		return err
+	}
+	if len(data) > 65535 {
+		return utils.ErrInErr{ErrDesc: "mux.cool udp packet too large", ErrDetail: utils.ErrInvalidData, Data: len(data)}
+	}
+	m := &muxCoolMeta{
+		id:      st.id,
+		status:  muxCoolStatusKeep,
+		network: muxCoolNetworkUDP,
+	}
+	if !peer.IsEmpty() {
+		m.target = peer
+	}
+	return st.sess.writeFrame(m, data)
+}
+
+func (st *muxCoolStream) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return st.Close()
+}
+
+func (st *muxCoolStream) Fullcone() bool {
+	return false
+}
+
+func (st *muxCoolStream) Close() error {
+	st.closeOnce.Do(func() {
+		close(st.done)
+		st.sess.removeStream(st)
+		st.sess.writeFrame(&muxCoolMeta{id: st.id, status: muxCoolStatusEnd}, nil)
+	})
+	return nil
+}
+
+func (st *muxCoolStream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *muxCoolStream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+// 实现 utils.UserAssigner
+func (st *muxCoolStream) SetUser(u utils.User) {
+	st.upstreamUser = u
+}
+
+func (st *muxCoolStream) IdentityStr() string {
+	if st.upstreamUser != nil {
+		return st.upstreamUser.IdentityStr()
+	}
+	return ""
+}
+
+func (st *muxCoolStream) IdentityBytes() []byte {
+	if st.upstreamUser != nil {
+		return st.upstreamUser.IdentityBytes()
+	}
+	return nil
+}
+
+func (st *muxCoolStream) AuthStr() string {
+	if st.upstreamUser != nil {
+		return st.upstreamUser.AuthStr()
+	}
+	return ""
+}
+
+func (st *muxCoolStream) AuthBytes() []byte {
+	if st.upstreamUser != nil {
+		return st.upstreamUser.AuthBytes()
+	}
+	return nil
+}
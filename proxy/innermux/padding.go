@@ -0,0 +1,132 @@
+package innermux
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const (
+	paddingMagic = 0xFF //smux 的 版本号, yamux 的 版本号, 以及 h2 preface 的 第一个字节 都不可能是 0xFF
+
+	paddingFrameCount = 16
+	maxPaddingLen     = 256
+	maxPaddedDataLen  = 65535
+)
+
+// paddingConn 在 每个方向的 前 paddingFrameCount 帧 加上 随机长度的 填充, 之后 直接透传.
+//
+// 帧格式: [2字节 数据长度][2字节 填充长度][数据][填充]
+type paddingConn struct {
+	net.Conn
+
+	wmu             sync.Mutex
+	writeMagic      bool
+	writeFramesLeft int
+
+	rmu            sync.Mutex
+	readFramesLeft int
+	dataRemain     int
+	padRemain      int
+}
+
+func newPaddingConn(c net.Conn, isClient bool) *paddingConn {
+	return &paddingConn{
+		Conn:            c,
+		writeMagic:      isClient,
+		writeFramesLeft: paddingFrameCount,
+		readFramesLeft:  paddingFrameCount,
+	}
+}
+
+func (pc *paddingConn) Write(p []byte) (n int, err error) {
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+
+	if pc.writeFramesLeft <= 0 {
+		return pc.Conn.Write(p)
+	}
+
+	bs := utils.GetMTU()
+	defer utils.PutBytes(bs)
+
+	for len(p) > 0 {
+		if pc.writeFramesLeft <= 0 {
+			var nn int
+			nn, err = pc.Conn.Write(p)
+			n += nn
+			return
+		}
+
+		dataLen := len(p)
+		if dataLen > maxPaddedDataLen {
+			dataLen = maxPaddedDataLen
+		}
+		padLen := rand.Intn(maxPaddingLen)
+
+		buf := bs[:0]
+		if pc.writeMagic {
+			buf = append(buf, paddingMagic)
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(dataLen))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(padLen))
+
+		if len(buf)+dataLen+padLen <= cap(bs) {
+			buf = append(buf, p[:dataLen]...)
+			buf = append(buf, make([]byte, padLen)...)
+			rand.Read(buf[len(buf)-padLen:])
+			_, err = pc.Conn.Write(buf)
+		} else {
+			pad := make([]byte, padLen)
+			rand.Read(pad)
+			_, err = (&net.Buffers{buf, p[:dataLen], pad}).WriteTo(pc.Conn)
+		}
+		if err != nil {
+			return
+		}
+
+		pc.writeMagic = false
+		pc.writeFramesLeft--
+		n += dataLen
+		p = p[dataLen:]
+	}
+	return
+}
+
+func (pc *paddingConn) Read(p []byte) (n int, err error) {
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+
+	for pc.dataRemain == 0 {
+		if pc.padRemain > 0 {
+			_, err = io.CopyN(io.Discard, pc.Conn, int64(pc.padRemain))
+			if err != nil {
+				return
+			}
+			pc.padRemain = 0
+		}
+		if pc.readFramesLeft <= 0 {
+			return pc.Conn.Read(p)
+		}
+
+		var header [4]byte
+		_, err = io.ReadFull(pc.Conn, header[:])
+		if err != nil {
+			return
+		}
+		pc.dataRemain = int(binary.BigEndian.Uint16(header[:2]))
+		pc.padRemain = int(binary.BigEndian.Uint16(header[2:]))
+		pc.readFramesLeft--
+	}
+
+	if len(p) > pc.dataRemain {
+		p = p[:pc.dataRemain]
+	}
+	n, err = pc.Conn.Read(p)
+	pc.dataRemain -= n
+	return
+}
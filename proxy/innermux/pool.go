@@ -0,0 +1,220 @@
+package innermux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientPool 保存 一个客户端 已拨号的 多个 session.
+//
+// 超过 MaxAge 或 MaxBytes 的 session 会被标记为 draining, 不再用于 打开新的stream, 等其所有 stream 都关闭后 再关闭它.
+//
+// 可用的 session 与 正在拨号的 session 的 总数 不会 超过 MaxConnections, 见 Pick.
+type ClientPool struct {
+	Config
+
+	mu       sync.Mutex
+	cond     *sync.Cond //正在拨号的 session 结束 时 通知
+	sessions []*poolEntry
+	dialing  int //Pick 预留的 拨号名额 数
+}
+
+type poolEntry struct {
+	Session
+	counter  *countConn
+	created  time.Time
+	draining bool
+}
+
+func NewClientPool(conf Config) *ClientPool {
+	if conf.MaxConnections <= 0 {
+		conf.MaxConnections = 1
+	}
+	p := &ClientPool{Config: conf}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (e *poolEntry) expired(conf *Config) bool {
+	if conf.MaxAge > 0 && time.Since(e.created) > conf.MaxAge {
+		return true
+	}
+	if conf.MaxBytes > 0 && e.counter.Count() > conf.MaxBytes {
+		return true
+	}
+	return false
+}
+
+// 清理 已关闭 与 已过期 的 session. 调用者 需持有 锁.
+func (p *ClientPool) cleanup() {
+	alive := p.sessions[:0]
+	for _, e := range p.sessions {
+		if e.IsClosed() {
+			continue
+		}
+		if !e.draining && e.expired(&p.Config) {
+			e.draining = true
+		}
+		if e.draining && e.NumStreams() == 0 {
+			e.Close()
+			continue
+		}
+		alive = append(alive, e)
+	}
+	for i := len(alive); i < len(p.sessions); i++ {
+		p.sessions[i] = nil
+	}
+	p.sessions = alive
+}
+
+/*
+选出 用于 打开新 stream 的 session.
+
+可用的 session 与 正在拨号的 session 的 总数 少于 MaxConnections 时, 返回 nil 并 预留 一个 拨号名额,
+调用者 应 在 不持有 任何锁 的 情况下 拨号, 成功后 调用 NewSession, 并 无论 成功 与否 都要 调用 DialDone.
+
+达到 MaxConnections 后, 返回 未达到 MaxStreams 的 负载最小的 session; 若 都 达到了 MaxStreams, 则 返回 负载最小的 session,
+即 此时 MaxStreams 会被 超过. 若 还没有 可用的 session, 则 等待 正在拨号的 session.
+*/
+func (p *ClientPool) Pick() Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		best, least, active := p.pick()
+
+		if active+p.dialing < p.MaxConnections {
+			p.dialing++
+			return nil
+		}
+		if best != nil {
+			return best.Session
+		}
+		if least != nil {
+			return least.Session
+		}
+		p.cond.Wait()
+	}
+}
+
+// Pick 预留的 拨号名额 使用完毕
+func (p *ClientPool) DialDone() {
+	p.mu.Lock()
+	if p.dialing > 0 {
+		p.dialing--
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// 是否 有 未达到 MaxStreams 的 可用 session. 不会 预留 拨号名额.
+func (p *ClientPool) HasAvailable() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best, _, _ := p.pick()
+	return best != nil
+}
+
+// best 为 未达到 MaxStreams 的 负载最小的 session, least 为 负载最小的 session, active 为 未 draining 的 session 数.
+// 调用者 需持有 锁.
+func (p *ClientPool) pick() (best, least *poolEntry, active int) {
+	p.cleanup()
+
+	bestNum, leastNum := 0, 0
+	for _, e := range p.sessions {
+		if e.draining {
+			continue
+		}
+		active++
+		n := e.NumStreams()
+		if least == nil || n < leastNum {
+			least = e
+			leastNum = n
+		}
+		if p.MaxStreams > 0 && n >= p.MaxStreams {
+			continue
+		}
+		if best == nil || n < bestNum {
+			best = e
+			bestNum = n
+		}
+	}
+	return
+}
+
+// 在 rwc 上 新建 一个 客户端 session 并 放入 pool 中.
+func (p *ClientPool) NewSession(rwc io.ReadWriteCloser) (Session, error) {
+	cc := &countConn{Conn: toNetConn(rwc)}
+
+	s, err := NewClientSession(cc, p.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.sessions = append(p.sessions, &poolEntry{
+		Session: s,
+		counter: cc,
+		created: time.Now(),
+	})
+	p.mu.Unlock()
+
+	return s, nil
+}
+
+// 关闭 s 并将其 从 pool 中 移除.
+func (p *ClientPool) Remove(s Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, e := range p.sessions {
+		if e.Session == s {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			break
+		}
+	}
+	s.Close()
+}
+
+func (p *ClientPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, e := range p.sessions {
+		e.Close()
+	}
+	p.sessions = nil
+	return nil
+}
+
+// 统计 session 底层连接 的 读写字节数
+type countConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return
+}
+
+func (c *countConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return
+}
+
+func (c *countConn) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// 内层mux 的配置 也是 在 extra 中给出的, 如
+//
+//	extra = { mux_type = "yamux", mux_maxConnections = 4, mux_maxStreams = 32, mux_maxAge = "10m" }
+//
+// mux_type 可选 smux(默认, 即smux v1), smux2, yamux, h2mux; mux_padding = true 开启 握手阶段的 padding.
+// 服务端 会 自动识别 客户端所用的 mux_type 与 mux_padding, 只有 窗口 与 keepalive 相关的 项 对 服务端 有效.
+//
+// mux_type 为 mux.cool 时 使用 v2ray/xray 的 mux 协议, 可以 与 标准的 v2ray/xray 服务端 互通, 只用于 vless v0 与 vmess.
+// 服务端 无需配置, vless v0 与 vmess 的 mux 命令 总是 表示 mux.cool.
+//
+// 时间 可以是 "30s" 这种字符串, 也可以是 数字 (秒数). mux_keepAliveInterval = 0 表示 关闭 keepalive.
+func getInnerMuxConfFromExtra(extra map[string]any) (c innermux.Config) {
+	if len(extra) == 0 {
+		return
+	}
+
+	if thing := extra["mux_type"]; thing != nil {
+		if str, ok := thing.(string); ok {
+			switch str {
+			case innermux.Smux, innermux.Smux2, innermux.Yamux, innermux.H2mux, innermux.MuxCool:
+				c.Type = str
+			default:
+				if ce := utils.CanLogErr("unknown mux_type, will use smux"); ce != nil {
+					ce.Write(zap.String("given", str))
+				}
+			}
+		}
+	}
+
+	if thing := extra["mux_padding"]; thing != nil {
+		c.Padding, _ = utils.AnyToBool(thing)
+	}
+
+	getInt := func(key string) int64 {
+		if thing := extra[key]; thing != nil {
+			if i, ok := utils.AnyToInt64(thing); ok && i > 0 {
+				return i
+			}
+		}
+		return 0
+	}
+
+	c.MaxReceiveBuffer = int(getInt("mux_maxReceiveBuffer"))
+	c.MaxStreamBuffer = int(getInt("mux_maxStreamBuffer"))
+	c.MaxConnections = int(getInt("mux_maxConnections"))
+	c.MaxStreams = int(getInt("mux_maxStreams"))
+	c.MaxBytes = getInt("mux_maxBytes")
+
+	if thing := extra["mux_keepAliveInterval"]; thing != nil {
+		if d, ok := utils.AnyToDuration(thing); ok {
+			if d <= 0 {
+				c.KeepAliveDisabled = true
+			} else {
+				c.KeepAliveInterval = d
+			}
+		}
+	}
+	if thing := extra["mux_keepAliveTimeout"]; thing != nil {
+		if d, ok := utils.AnyToDuration(thing); ok && d > 0 {
+			c.KeepAliveTimeout = d
+		}
+	}
+	if thing := extra["mux_maxAge"]; thing != nil {
+		if d, ok := utils.AnyToDuration(thing); ok && d > 0 {
+			c.MaxAge = d
+		}
+	}
+
+	return
+}
@@ -8,8 +8,8 @@ import (
 	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
-	"github.com/xtaci/smux"
 )
 
 // 规定，如果 proxy的server的handshake如果返回的是具有内层mux的连接，该连接要实现 MuxMarker 接口.
@@ -18,15 +18,39 @@ type MuxMarker interface {
 	IsMux() bool
 }
 
+// 内层mux 为 mux.cool 的 连接 要实现 MuxCoolMarker. mux.cool 无法 从 数据 自动识别, 只能 由 代理协议 的 命令 确定.
+type MuxCoolMarker interface {
+	IsMuxCool() bool
+}
+
 // 实现 utils.MuxMarker, utils.User
 type UserReadWrapper struct {
 	utils.User
 	netLayer.ReadWrapper
-	Mux bool
+	Mux     bool
+	MuxCool bool
 }
 
 func (w *UserReadWrapper) IsMux() bool { return w.Mux }
 
+// 实现 MuxCoolMarker
+func (w *UserReadWrapper) IsMuxCool() bool { return w.MuxCool }
+
+// socks5/socks4 的 BIND 请求: Server 的 Handshake 返回的 wlc 若 实现了 BindRequest, 则 表示 客户端 请求 的 是 BIND 而不是 CONNECT.
+// 此时 客户端 不会 发送 任何数据, 直到 收到 第二个 回复.
+type BindRequest interface {
+	net.Conn
+
+	//写入 BIND 的 回复. 第一次 调用 时 addr 为 监听地址, 第二次 为 接入的 连接 的 地址; err 不为 nil 时 写入 失败 回复.
+	WriteBindReply(addr netLayer.Addr, err error) error
+}
+
+// 支持 BIND 的 Client, 目前 只有 direct 实现.
+type BindClient interface {
+	//监听 一个 端口, 并 通过 br 依次 发送 两个 回复, 返回 第一个 接入 的 连接. target 若 有 ip, 则 只接受 来自 该 ip 的 连接.
+	Bind(br BindRequest, target netLayer.Addr) (net.Conn, error)
+}
+
 // some client may 建立tcp连接后首先由客户端读服务端的数据？虽较少见但确实存在.
 // Anyway firstpayload might not be read, and we should try to reduce this delay.
 // 也有可能是有人用 nc 来测试，也会遇到这种读不到 firstpayload 的情况
@@ -50,9 +74,11 @@ type Client interface {
 	IsUDP_MultiChannel() bool
 
 	//get/listen a useable inner mux
-	GetClientInnerMuxSession(wrc io.ReadWriteCloser) *smux.Session
+	GetClientInnerMuxSession(wrc io.ReadWriteCloser) innermux.Session
 	InnerMuxEstablished() bool
-	CloseInnerMuxSession()
+	PickInnerMuxSession() innermux.Session
+	InnerMuxDialDone()
+	CloseInnerMuxSession(innermux.Session)
 
 	//用于在拨号时选用一个特定的ip拨号。
 	LocalTCPAddr() *net.TCPAddr
@@ -60,6 +86,9 @@ type Client interface {
 
 	GetCreator() ClientCreator
 
+	//若为true, 则 vs 不会为其 拨号, Handshake 与 EstablishUDPChannel 收到的 underlay 为 nil, 由 Client 自己 拨号. direct 和 wireguard 都为 true
+	SelfDial() bool
+
 	sync.Locker //用于锁定 innerMux
 }
 
@@ -81,7 +110,7 @@ type Server interface {
 	Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error)
 
 	//get/listen a useable inner mux
-	GetServerInnerMuxSession(wlc io.ReadWriteCloser) *smux.Session
+	GetServerInnerMuxSession(wlc io.ReadWriteCloser) innermux.Session
 
 	//tproxy,tun 和 shadowsocks(udp) 都用到了 SelfListen
 	//
@@ -101,6 +130,14 @@ type UserServer interface {
 	utils.UserContainer
 }
 
+// 有 多个 备选 目标 的 Server (如 dokodemo 的 多目标 转发) 可以 实现 FailoverServer.
+// tcp 向 Handshake 返回的 目标 拨号 失败 时, vs 会 调用 NextTarget, 并 向 返回的 目标 重新 拨号, 直到 ok 为 false.
+// tried 为 该连接 已经 尝试过 的 目标 数.
+type FailoverServer interface {
+	Server
+	NextTarget(failed netLayer.Addr, tried int) (next netLayer.Addr, ok bool)
+}
+
 // FullName can fully represent the VSI model for a proxy.
 // We think tcp/udp/kcp/raw_socket is FirstName，protocol of the proxy is LastName, and the rest is  MiddleName。
 //
@@ -173,8 +210,16 @@ func getFullNameBuilder(pc BaseInterface, n string) *strings.Builder {
 	sb.WriteString(n)
 
 	if i, innerProxyName := pc.HasInnerMux(); i == 2 {
-		sb.WriteString("+smux+")
-		sb.WriteString(innerProxyName)
+		muxType := pc.GetBase().InnerMuxConf.Type
+		if muxType == "" {
+			muxType = innermux.Smux
+		}
+		sb.WriteString("+")
+		sb.WriteString(muxType)
+		if innerProxyName != "" {
+			sb.WriteString("+")
+			sb.WriteString(innerProxyName)
+		}
 
 	}
 
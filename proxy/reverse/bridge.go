@@ -0,0 +1,288 @@
+package reverse
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
+	"github.com/e1732a364fed/v2ray_simple/proxy/simplesocks"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTunnelPort = 443
+
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Second * 30
+)
+
+func init() {
+	proxy.RegisterServer(BridgeName, &BridgeCreator{})
+}
+
+type BridgeCreator struct{ proxy.CreatorCommonStruct }
+
+// true
+func (BridgeCreator) MultiTransportLayer() bool {
+	return true
+}
+
+func (BridgeCreator) URLToListenConf(u *url.URL, lc *proxy.ListenConf, format int) (*proxy.ListenConf, error) {
+	if lc == nil {
+		return nil, utils.ErrNilParameter
+	}
+	return lc, nil
+}
+
+func (BridgeCreator) AfterCommonConfServer(ps proxy.Server) error {
+	if ps.(*Bridge).InnerMuxConf.Type == innermux.MuxCool {
+		return errors.New("reverse bridge can't use mux.cool")
+	}
+	return nil
+}
+
+// lc.Host 为 伪域名, lc.Port 可省略. lc.TargetAddr 可选.
+func (BridgeCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
+	if lc.Host == "" {
+		return nil, errors.New("reverse bridge requires host as the tunnel domain")
+	}
+	s := &Bridge{
+		tunnelAddr:  netLayer.Addr{Name: lc.Host, Port: lc.Port, Network: "tcp"},
+		connections: 1,
+	}
+	if s.tunnelAddr.Port == 0 {
+		s.tunnelAddr.Port = defaultTunnelPort
+	}
+
+	if lc.TargetAddr != "" {
+		ta, err := netLayer.NewAddrByURL(lc.TargetAddr)
+		if err != nil {
+			return nil, err
+		}
+		s.targetAddr = &ta
+	}
+
+	if thing := lc.Extra["connections"]; thing != nil {
+		if i, ok := utils.AnyToInt64(thing); ok && i > 0 {
+			s.connections = int(i)
+		}
+	}
+	return s, nil
+}
+
+// implements proxy.ListenerServer. 并不 监听, 而是 主动 建立 bridge 连接.
+type Bridge struct {
+	proxy.Base
+
+	tunnelAddr  netLayer.Addr
+	targetAddr  *netLayer.Addr
+	connections int
+
+	mu       sync.Mutex
+	closed   bool
+	shutdown chan struct{}
+	sessions map[innermux.Session]struct{}
+	pipes    map[net.Conn]struct{}
+}
+
+func (*Bridge) Name() string { return BridgeName }
+
+func (s *Bridge) SelfListen() (is bool, tcp, udp int) {
+	return true, 1, 1
+}
+
+func (s *Bridge) Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error) {
+	return nil, nil, netLayer.Addr{}, utils.ErrUnImplemented
+}
+
+func (s *Bridge) StartListen(tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) io.Closer {
+	s.mu.Lock()
+	s.closed = false
+	s.shutdown = make(chan struct{})
+	s.sessions = make(map[innermux.Session]struct{})
+	s.pipes = make(map[net.Conn]struct{})
+	s.mu.Unlock()
+
+	for i := 0; i < s.connections; i++ {
+		go s.keepConnection(i, tcpFunc, udpFunc)
+	}
+	return s
+}
+
+func (s *Bridge) Close() error {
+	s.Stop()
+	return nil
+}
+
+func (s *Bridge) Stop() {
+	s.mu.Lock()
+	if !s.closed && s.shutdown != nil {
+		s.closed = true
+		close(s.shutdown)
+		for se := range s.sessions {
+			se.Close()
+		}
+		for p := range s.pipes {
+			p.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	s.Base.Stop()
+}
+
+// 保持 一个 bridge 连接, 断开后 重连
+func (s *Bridge) keepConnection(index int, tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) {
+	delay := minRetryDelay
+	for {
+		start := time.Now()
+		err := s.runConnection(tcpFunc, udpFunc)
+
+		select {
+		case <-s.shutdown:
+			return
+		default:
+		}
+
+		//连接 存活了 足够久, 说明 之前 是 正常的, 立即 重连
+		if time.Since(start) > maxRetryDelay {
+			delay = minRetryDelay
+		}
+
+		if ce := utils.CanLogWarn("reverse bridge connection lost, will reconnect"); ce != nil {
+			ce.Write(
+				zap.String("tag", s.Tag),
+				zap.Int("index", index),
+				zap.Duration("after", delay),
+				zap.Error(err),
+			)
+		}
+
+		select {
+		case <-s.shutdown:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (s *Bridge) track(p net.Conn, se innermux.Session, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add && s.closed {
+		return false
+	}
+	if p != nil {
+		if add {
+			s.pipes[p] = struct{}{}
+		} else {
+			delete(s.pipes, p)
+		}
+	}
+	if se != nil {
+		if add {
+			s.sessions[se] = struct{}{}
+		} else {
+			delete(s.sessions, se)
+		}
+	}
+	return true
+}
+
+// 通过 tcpFunc 建立 一个 发往 tunnelAddr 的 连接, 在其上 作为 内层mux 的 服务端, 直到 连接 断开.
+func (s *Bridge) runConnection(tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) error {
+	local, remote := net.Pipe()
+	if !s.track(local, nil, true) {
+		local.Close()
+		remote.Close()
+		return nil
+	}
+	defer func() {
+		local.Close()
+		s.track(local, nil, false)
+	}()
+
+	go tcpFunc(netLayer.TCPRequestInfo{Conn: remote, Target: s.tunnelAddr})
+
+	if _, err := local.Write(helloBytes); err != nil {
+		return utils.ErrInErr{ErrDesc: "reverse bridge write hello failed", ErrDetail: err}
+	}
+
+	session, err := innermux.NewServerSession(local, s.InnerMuxConf)
+	if err != nil {
+		return err
+	}
+	if !s.track(nil, session, true) {
+		session.Close()
+		return nil
+	}
+	defer func() {
+		session.Close()
+		s.track(nil, session, false)
+	}()
+
+	if ce := utils.CanLogInfo("reverse bridge connected"); ce != nil {
+		ce.Write(zap.String("tag", s.Tag), zap.String("tunnel", s.tunnelAddr.String()))
+	}
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return err
+		}
+		go s.handleStream(stream, tcpFunc, udpFunc)
+	}
+}
+
+// 读取 portal 通过 simplesocks 传来的 目标, 然后 交给 分流
+func (s *Bridge) handleStream(stream net.Conn, tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) {
+	var ss simplesocks.Server
+	conn, msgConn, target, err := ss.Handshake(stream)
+	if err != nil {
+		if ce := utils.CanLogErr("reverse bridge handshake stream failed"); ce != nil {
+			ce.Write(zap.String("tag", s.Tag), zap.Error(err))
+		}
+		stream.Close()
+		return
+	}
+
+	if ta := s.targetAddr; ta != nil && ta.IsUDP() == target.IsUDP() {
+		target = *ta
+		if msgConn != nil {
+			msgConn = fixedTargetMsgConn{MsgConn: msgConn, target: target}
+		}
+	}
+
+	if ce := utils.CanLogDebug("reverse bridge got stream"); ce != nil {
+		ce.Write(zap.String("tag", s.Tag), zap.String("target", target.String()))
+	}
+
+	if msgConn != nil {
+		udpFunc(netLayer.UDPRequestInfo{MsgConn: msgConn, Target: target})
+	} else {
+		tcpFunc(netLayer.TCPRequestInfo{Conn: conn, Target: target})
+	}
+}
+
+// 把 读到的 每个 udp 消息 的 目标 都 改为 target
+type fixedTargetMsgConn struct {
+	netLayer.MsgConn
+	target netLayer.Addr
+}
+
+func (mc fixedTargetMsgConn) ReadMsg() ([]byte, netLayer.Addr, error) {
+	bs, _, err := mc.MsgConn.ReadMsg()
+	return bs, mc.target, err
+}
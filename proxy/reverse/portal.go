@@ -0,0 +1,229 @@
+package reverse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
+	"github.com/e1732a364fed/v2ray_simple/proxy/simplesocks"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+var ErrNoBridge = errors.New("reverse portal has no bridge connection")
+
+func init() {
+	proxy.RegisterClient(PortalName, PortalCreator{})
+}
+
+type PortalCreator struct{ proxy.CreatorCommonStruct }
+
+// true
+func (PortalCreator) MultiTransportLayer() bool {
+	return true
+}
+
+func (PortalCreator) URLToDialConf(u *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
+	if dc == nil {
+		return nil, utils.ErrNilParameter
+	}
+	return dc, nil
+}
+
+// dc.Host 为 伪域名, 与 bridge 的 host 相同.
+func (PortalCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
+	if dc.Host == "" {
+		return nil, errors.New("reverse portal requires host as the tunnel domain")
+	}
+	if dc.TLS || dc.AdvancedLayer != "" {
+		return nil, errors.New("reverse portal can't use tls or advLayer")
+	}
+	if dc.Network == "" {
+		dc.Network = netLayer.DualNetworkName
+	}
+	return &Portal{
+		domain:   dc.Host,
+		sessions: make(map[innermux.Session]struct{}),
+	}, nil
+}
+
+func (PortalCreator) AfterCommonConfClient(pc proxy.Client) error {
+	if pc.(*Portal).InnerMuxConf.Type == innermux.MuxCool {
+		return errors.New("reverse portal can't use mux.cool")
+	}
+	return nil
+}
+
+// implements proxy.Client. 目标 为 domain 的 请求 会被 保存 为 bridge 连接, 其它 请求 通过 bridge 连接 发往 bridge.
+type Portal struct {
+	proxy.Base
+
+	domain string
+
+	mu       sync.Mutex
+	sessions map[innermux.Session]struct{}
+}
+
+func (*Portal) Name() string { return PortalName }
+
+func (*Portal) GetCreator() proxy.ClientCreator {
+	return PortalCreator{}
+}
+
+// true
+func (*Portal) SelfDial() bool { return true }
+
+// 关闭 所有 bridge 连接
+func (c *Portal) Stop() {
+	c.mu.Lock()
+	for se := range c.sessions {
+		se.Close()
+	}
+	c.sessions = make(map[innermux.Session]struct{})
+	c.mu.Unlock()
+
+	c.Base.Stop()
+}
+
+// 目前 可用的 bridge 连接 数
+func (c *Portal) BridgeCount() (n int) {
+	c.mu.Lock()
+	for se := range c.sessions {
+		if !se.IsClosed() {
+			n++
+		}
+	}
+	c.mu.Unlock()
+	return
+}
+
+// underlay 会被 忽略.
+func (c *Portal) Handshake(_ net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	if target.Name == c.domain {
+		return c.acceptBridge(firstPayload), nil
+	}
+
+	stream, err := c.openStream()
+	if err != nil {
+		return nil, err
+	}
+	var ssc simplesocks.Client
+	rc, err := ssc.Handshake(stream, firstPayload, target)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// underlay 会被 忽略.
+func (c *Portal) EstablishUDPChannel(_ net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	stream, err := c.openStream()
+	if err != nil {
+		return nil, err
+	}
+	ssc := simplesocks.Client{}
+	ssc.IsFullcone = c.IsFullcone
+	mc, err := ssc.EstablishUDPChannel(stream, firstPayload, target)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return mc, nil
+}
+
+// 返回 一个 pipe 的 一端 交给 调用者 转发, 在 另一端 上 读取 hello 后 建立 内层mux 的 客户端.
+func (c *Portal) acceptBridge(firstPayload []byte) net.Conn {
+	local, remote := net.Pipe()
+
+	var conn net.Conn = local
+	if len(firstPayload) > 0 {
+		fp := make([]byte, len(firstPayload))
+		copy(fp, firstPayload)
+		utils.PutBytes(firstPayload)
+
+		conn = &netLayer.ReadWrapper{
+			Conn:              local,
+			OptionalReader:    io.MultiReader(bytes.NewReader(fp), local),
+			RemainFirstBufLen: len(fp),
+		}
+	}
+
+	go func() {
+		local.SetReadDeadline(time.Now().Add(helloTimeout))
+		err := readHello(conn)
+		local.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			if ce := utils.CanLogErr("reverse portal got invalid bridge connection"); ce != nil {
+				ce.Write(zap.String("tag", c.Tag), zap.Error(err))
+			}
+			local.Close()
+			return
+		}
+
+		session, err := innermux.NewClientSession(conn, c.InnerMuxConf)
+		if err != nil {
+			if ce := utils.CanLogErr("reverse portal create session failed"); ce != nil {
+				ce.Write(zap.String("tag", c.Tag), zap.Error(err))
+			}
+			local.Close()
+			return
+		}
+
+		c.mu.Lock()
+		c.sessions[session] = struct{}{}
+		n := len(c.sessions)
+		c.mu.Unlock()
+
+		if ce := utils.CanLogInfo("reverse portal got bridge"); ce != nil {
+			ce.Write(zap.String("tag", c.Tag), zap.Int("count", n))
+		}
+	}()
+
+	return remote
+}
+
+// 在 当前 子连接数 最少 的 bridge 连接 上 打开 一个 stream. 顺便 清理 已关闭 的 bridge 连接.
+func (c *Portal) openStream() (net.Conn, error) {
+	for {
+		var best innermux.Session
+
+		c.mu.Lock()
+		for se := range c.sessions {
+			if se.IsClosed() {
+				delete(c.sessions, se)
+				continue
+			}
+			if best == nil || se.NumStreams() < best.NumStreams() {
+				best = se
+			}
+		}
+		c.mu.Unlock()
+
+		if best == nil {
+			return nil, ErrNoBridge
+		}
+
+		stream, err := best.OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+
+		if ce := utils.CanLogWarn("reverse portal open stream failed, will try another bridge"); ce != nil {
+			ce.Write(zap.String("tag", c.Tag), zap.Error(err))
+		}
+
+		best.Close()
+		c.mu.Lock()
+		delete(c.sessions, best)
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Package reverse implements reverse tunnel (bridge and portal), like the reverse proxy of v2ray.
+
+用于 将 NAT 后面 (没有 公网入口) 的 机器上 的 服务 发布 到 公网.
+
+bridge 是 一个 proxy.Server (自监听), 位于 内网 机器, 它 主动 发起 通往 伪域名 的 连接,
+这些 连接 与 普通 请求 一样 经过 分流, 从 任意 dial 发往 公网 上的 portal, 并 在 断开后 自动 重连.
+
+portal 是 一个 proxy.Client, 位于 公网 机器. 目标 为 伪域名 的 请求 被 分流到 portal 时, 该连接 就会 被 保存 为 一个 bridge 连接;
+其它 被 分流到 portal 的 请求 (一般 来自 某个 listen tag, 如 一个 dokodemo), 都 会 通过 某个 bridge 连接 发回 bridge.
+
+bridge 连接 上 使用 内层mux (见 proxy/innermux, 可以用 extra 中的 mux_type 等 配置), 每个 子连接 使用 simplesocks 传递 目标地址,
+bridge 收到 子连接 后, 再 将 其 作为 一个 新的 请求 交给 分流, 一般 分流到 direct.
+若 bridge 配置了 target, 则 总是 使用 该目标.
+
+一个 portal 可以 同时 连接 多个 bridge (或 一个 bridge 的 多个 连接), 新的 子连接 总会 选择 当前 子连接数 最少 的 bridge 连接.
+
+# Example
+
+bridge 端 (内网):
+
+	[[listen]]
+	protocol = "bridge"
+	tag = "bridge"
+	host = "reverse.internal"           # 伪域名, 与 portal 的 host 相同
+	target = "tcp://127.0.0.1:80"       # 可选
+	extra = { connections = 2 }         # 同时 保持 几个 bridge 连接, 默认为 1
+
+	[[dial]]
+	protocol = "vlesss"
+	tag = "to_portal"
+	# ...
+
+	[[route]]
+	fromTag = ["bridge"]
+	domain = ["full:reverse.internal"]
+	toTag = "to_portal"
+
+	[[route]]
+	fromTag = ["bridge"]
+	toTag = "direct"
+
+portal 端 (公网):
+
+	[[listen]]
+	protocol = "vlesss"
+	tag = "tunnel_in"
+	# ...
+
+	[[listen]]
+	protocol = "dokodemo"
+	tag = "public"
+	port = 8080
+	target = "tcp://127.0.0.1:80"       # bridge 没有 配置 target 时, bridge 会 拨号 这个 地址
+
+	[[dial]]
+	protocol = "portal"
+	tag = "portal"
+	host = "reverse.internal"
+
+	[[route]]
+	domain = ["full:reverse.internal"]
+	toTag = "portal"
+
+	[[route]]
+	fromTag = ["public"]
+	toTag = "portal"
+*/
+package reverse
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const (
+	BridgeName = "bridge"
+	PortalName = "portal"
+)
+
+// bridge 连接 建立后 bridge 首先 发送 的 数据. 这保证了 各种 dial 协议 都会 立即 发出 握手数据,
+// 让 portal 端 及时 得到 bridge 连接.
+var helloBytes = []byte{'v', 's', 'r', 'b', 1}
+
+const helloTimeout = time.Second * 10
+
+func readHello(r io.Reader) error {
+	var bs [5]byte
+	if _, err := io.ReadFull(r, bs[:]); err != nil {
+		return utils.ErrInErr{ErrDesc: "reverse read bridge hello failed", ErrDetail: err}
+	}
+	if !bytes.Equal(bs[:], helloBytes) {
+		return utils.ErrInErr{ErrDesc: "reverse bridge hello not match", ErrDetail: utils.ErrInvalidData, Data: bs}
+	}
+	return nil
+}
@@ -58,6 +58,10 @@ func (c *TCPConn) Upstream() net.Conn {
 	return c.Conn
 }
 
+func (c *TCPConn) CloseWrite() error {
+	return netLayer.CloseWrite(c.Conn)
+}
+
 // 当底层链接可以暴露为 tcp或 unix链接时，返回true
 func (c *TCPConn) EverPossibleToSpliceRead() bool {
 	if netLayer.IsTCP(c.Conn) != nil {
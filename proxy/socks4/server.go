@@ -0,0 +1,228 @@
+package socks4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 请求头 最短为 8字节 + USERID 结尾的 0
+const minRequestLen = 9
+
+func init() {
+	proxy.RegisterServer(Name, &ServerCreator{})
+}
+
+type ServerCreator struct{ proxy.CreatorCommonStruct }
+
+func (ServerCreator) URLToListenConf(u *url.URL, lc *proxy.ListenConf, format int) (*proxy.ListenConf, error) {
+	if format != proxy.UrlStandardFormat {
+		return lc, utils.ErrUnImplemented
+	}
+	if lc == nil {
+		lc = &proxy.ListenConf{}
+	}
+	return lc, nil
+}
+
+// lc.UUID 与 lc.Users 中的 user 都 作为 允许的 USERID.
+func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
+	s := NewServer()
+	if str := lc.UUID; str != "" {
+		s.AddUser(utils.NewUserPass(utils.UserConf{User: str}))
+	}
+	for _, uc := range lc.Users {
+		if uc.User != "" {
+			s.AddUser(utils.NewUserPass(uc))
+		}
+	}
+	return s, nil
+}
+
+type Server struct {
+	proxy.Base
+	*utils.MultiUserMap
+
+	TrustClient bool //同 socks5.Server 的 TrustClient
+}
+
+func NewServer() *Server {
+	s := &Server{
+		MultiUserMap: utils.NewMultiUserMap(),
+	}
+	s.StoreKeyByStr = true
+	return s
+}
+
+func (*Server) Name() string { return Name }
+
+func (s *Server) Handshake(underlay net.Conn) (result net.Conn, udpChannel netLayer.MsgConn, targetAddr netLayer.Addr, returnErr error) {
+	if !s.TrustClient {
+		if err := netLayer.SetCommonReadTimeout(underlay); err != nil {
+			returnErr = err
+			return
+		}
+		defer netLayer.PersistConn(underlay)
+	}
+
+	bs := utils.GetMTU()
+	defer utils.PutBytes(bs)
+
+	var n, consumed int
+	var cmd byte
+	var userID string
+	for {
+		m, err := underlay.Read(bs[n:])
+		n += m
+		if err != nil {
+			returnErr = fmt.Errorf("socks4 failed to read request: %w, %d", err, n)
+			return
+		}
+
+		var ok bool
+		cmd, targetAddr, userID, consumed, ok, returnErr = ParseRequest(bs[:n])
+		if returnErr != nil {
+			return
+		}
+		if ok {
+			break
+		}
+		if n == len(bs) {
+			returnErr = utils.ErrInErr{ErrDesc: "socks4 request too long", ErrDetail: utils.ErrInvalidData, Data: n}
+			return
+		}
+	}
+
+	if len(s.IDMap) > 0 && !s.HasUserByStr(userID) {
+		writeReply(underlay, RepUserIDMismatch, netLayer.Addr{})
+		returnErr = utils.ErrInErr{ErrDesc: "socks4 userid not match", ErrDetail: utils.ErrInvalidData, Data: userID}
+		return
+	}
+
+	result = underlay
+	if consumed < n {
+		//客户端 不应 在 收到 回复 之前 发送 数据, 不过 还是 保留 一下
+		rest := utils.GetBytes(n - consumed)
+		copy(rest, bs[consumed:n])
+		result = &netLayer.ReadWrapper{
+			Conn:              underlay,
+			OptionalReader:    io.MultiReader(&pooledBytesReader{bs: rest}, underlay),
+			RemainFirstBufLen: len(rest),
+		}
+	}
+
+	switch cmd {
+	case CmdConnect:
+		if _, err := underlay.Write([]byte{replyVersion, RepGranted, 0, 0, 0, 0, 0, 0}); err != nil {
+			returnErr = fmt.Errorf("socks4 failed to write reply: %w", err)
+			return
+		}
+		return result, nil, targetAddr, nil
+
+	case CmdBind:
+		return &BindConn{Conn: result}, nil, targetAddr, nil
+
+	default:
+		writeReply(underlay, RepRejected, netLayer.Addr{})
+		returnErr = fmt.Errorf("socks4 unsuppoted command %v", cmd)
+		return
+	}
+}
+
+// 读完 后 将 bs 放回 pool. ReadWrapper 在 读完 RemainFirstBufLen 后 就 不再 读 OptionalReader,
+// 所以 要在 读到 最后一个字节 时 就 放回, 而不是 等到 返回 io.EOF 时.
+type pooledBytesReader struct {
+	bs  []byte
+	off int
+}
+
+func (r *pooledBytesReader) Read(p []byte) (int, error) {
+	if r.bs == nil {
+		return 0, io.EOF
+	}
+	n := copy(p, r.bs[r.off:])
+	r.off += n
+	if r.off == len(r.bs) {
+		utils.PutBytes(r.bs)
+		r.bs = nil
+	}
+	return n, nil
+}
+
+// ParseRequest 解析 socks4/4a 的 请求. 若 数据 不完整, 则 ok 为 false 且 err 为 nil.
+// consumed 为 请求头 的 长度.
+func ParseRequest(bs []byte) (cmd byte, targetAddr netLayer.Addr, userID string, consumed int, ok bool, err error) {
+	if len(bs) > 0 && bs[0] != Version4 {
+		err = fmt.Errorf("unsupported socks version %v", bs[0])
+		return
+	}
+	if len(bs) < minRequestLen {
+		return
+	}
+	cmd = bs[1]
+	targetAddr.Network = "tcp"
+	targetAddr.Port = int(bs[2])<<8 | int(bs[3])
+
+	idEnd := bytes.IndexByte(bs[8:], 0)
+	if idEnd < 0 {
+		return
+	}
+	userID = string(bs[8 : 8+idEnd])
+	consumed = 8 + idEnd + 1
+
+	ip := bs[4:8]
+
+	//socks4a: ip 为 0.0.0.x (x 不为0) 时, USERID 之后 跟着 以0结尾的 域名
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		nameEnd := bytes.IndexByte(bs[consumed:], 0)
+		if nameEnd < 0 {
+			return
+		}
+		if nameEnd == 0 {
+			err = errors.New("socks4a got empty domain")
+			return
+		}
+		targetAddr.Name = string(bs[consumed : consumed+nameEnd])
+		consumed += nameEnd + 1
+
+		if ip := net.ParseIP(targetAddr.Name); ip != nil {
+			targetAddr.IP = ip
+		}
+	} else {
+		targetAddr.IP = net.IPv4(ip[0], ip[1], ip[2], ip[3]).To4()
+	}
+	ok = true
+	return
+}
+
+func writeReply(w io.Writer, rep byte, addr netLayer.Addr) error {
+	reply := [8]byte{replyVersion, rep, byte(addr.Port >> 8), byte(addr.Port)}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		copy(reply[4:], ip4)
+	}
+	_, err := w.Write(reply[:])
+	return err
+}
+
+// 实现 proxy.BindRequest, 用于 BIND 命令. socks4 只能 回复 ipv4 地址.
+type BindConn struct {
+	net.Conn
+}
+
+func (bc *BindConn) CloseWrite() error {
+	return netLayer.CloseWrite(bc.Conn)
+}
+
+func (bc *BindConn) WriteBindReply(addr netLayer.Addr, err error) error {
+	if err != nil {
+		return writeReply(bc.Conn, RepRejected, netLayer.Addr{})
+	}
+	return writeReply(bc.Conn, RepGranted, addr)
+}
@@ -0,0 +1,143 @@
+package socks4_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/socks4"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func TestParseRequest(t *testing.T) {
+	//socks4: 1.2.3.4:80, userid "abc"
+	req := []byte{4, 1, 0, 80, 1, 2, 3, 4, 'a', 'b', 'c', 0}
+	for i := 0; i < len(req); i++ {
+		_, _, _, _, ok, err := socks4.ParseRequest(req[:i])
+		if ok || err != nil {
+			t.Fatal("short request should not be ok", i, err)
+		}
+	}
+	cmd, addr, id, consumed, ok, err := socks4.ParseRequest(req)
+	if !ok || err != nil || cmd != socks4.CmdConnect || id != "abc" || consumed != len(req) {
+		t.Fatal("parse failed", ok, err, cmd, id, consumed)
+	}
+	if !addr.IP.Equal(net.IPv4(1, 2, 3, 4)) || addr.Port != 80 {
+		t.Fatal("addr wrong", addr)
+	}
+
+	//socks4a: example.com:443, 空 userid
+	req = append([]byte{4, 2, 1, 187, 0, 0, 0, 1, 0}, "example.com\x00"...)
+	if _, _, _, _, ok, _ = socks4.ParseRequest(req[:len(req)-1]); ok {
+		t.Fatal("4a without domain end should not be ok")
+	}
+	cmd, addr, id, consumed, ok, err = socks4.ParseRequest(req)
+	if !ok || err != nil || cmd != socks4.CmdBind || id != "" || consumed != len(req) {
+		t.Fatal("parse 4a failed", ok, err, cmd, id, consumed)
+	}
+	if addr.Name != "example.com" || addr.IP != nil || addr.Port != 443 {
+		t.Fatal("4a addr wrong", addr)
+	}
+
+	if _, _, _, _, _, err = socks4.ParseRequest([]byte{5, 1, 0}); err == nil {
+		t.Fatal("socks5 should fail")
+	}
+}
+
+func TestUserID(t *testing.T) {
+	utils.InitLog("")
+
+	s, err := socks4.ServerCreator{}.NewServer(&proxy.ListenConf{CommonConf: proxy.CommonConf{UUID: "user1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"user1", "user2"} {
+		c1, c2 := net.Pipe()
+
+		type result struct {
+			conn net.Conn
+			addr netLayer.Addr
+			err  error
+		}
+		resultChan := make(chan result, 1)
+		go func() {
+			conn, _, addr, err := s.Handshake(c2)
+			resultChan <- result{conn, addr, err}
+		}()
+
+		req := append([]byte{4, 1, 0, 80, 0, 0, 0, 9}, id+"\x00localhost\x00"...)
+		go c1.Write(req)
+
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(c1, reply); err != nil {
+			t.Fatal(err)
+		}
+		r := <-resultChan
+
+		if id == "user1" {
+			if r.err != nil || reply[1] != socks4.RepGranted {
+				t.Fatal("user1 should be granted", r.err, reply)
+			}
+			if r.addr.Name != "localhost" || r.addr.Port != 80 {
+				t.Fatal("addr wrong", r.addr)
+			}
+
+			go c1.Write([]byte("hello"))
+			bs := make([]byte, 5)
+			if _, err := io.ReadFull(r.conn, bs); err != nil || !bytes.Equal(bs, []byte("hello")) {
+				t.Fatal("read after handshake failed", err, bs)
+			}
+		} else {
+			if r.err == nil || reply[1] != socks4.RepUserIDMismatch {
+				t.Fatal("user2 should be rejected", r.err, reply)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+// 与 请求 一起 到达 的 数据 应 在 握手 后 先被 读到
+func TestEarlyData(t *testing.T) {
+	if utils.ZapLogger == nil {
+		utils.InitLog("")
+	}
+
+	s, err := socks4.ServerCreator{}.NewServer(&proxy.ListenConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	req := append([]byte{4, 1, 0, 80, 1, 2, 3, 4, 0}, "early"...)
+	go func() {
+		c1.Write(req)
+		io.ReadFull(c1, make([]byte, 8))
+		c1.Write([]byte("later"))
+	}()
+
+	conn, _, _, err := s.Handshake(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//分 小块 读, 剩余 数据 读完 后 应 接着 读 底层 连接
+	var got []byte
+	bs := make([]byte, 3)
+	for len(got) < len("earlylater") {
+		n, err := conn.Read(bs)
+		if err != nil {
+			t.Fatal(err, string(got))
+		}
+		got = append(got, bs[:n]...)
+	}
+	if string(got) != "earlylater" {
+		t.Fatal("got wrong data", string(got))
+	}
+}
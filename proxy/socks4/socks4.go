@@ -0,0 +1,36 @@
+/*
+Package socks4 provides socks4 and socks4a server for proxy.Server.
+
+socks4 只支持 tcp 与 ipv4, 没有 密码验证, 只有一个 USERID 字段; 本包 只是为了 兼容 一些 只支持 socks4/4a 的 老工具.
+
+若 配置了 用户, 则 USERID 必须 与 某个 用户的 user 相同, 否则 返回 93 (userid 不匹配).
+
+支持 CONNECT 和 BIND 命令, BIND 只在 分流到 direct 时 可用, 见 proxy.BindRequest
+
+# Reference
+
+socks4: https://www.openssh.com/txt/socks4.protocol
+
+socks4a: https://www.openssh.com/txt/socks4a.protocol
+*/
+package socks4
+
+const Name = "socks4"
+
+// socks4 version number.
+const Version4 = 0x04
+
+// SOCKS4 request commands
+const (
+	CmdConnect = 0x01
+	CmdBind    = 0x02
+)
+
+// SOCKS4 reply codes. 回复中的 版本号 为 0
+const (
+	RepGranted             = 90
+	RepRejected            = 91
+	RepIdentdFailed        = 92
+	RepUserIDMismatch      = 93
+	replyVersion      byte = 0
+)
@@ -0,0 +1,91 @@
+package socks5_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/socks5"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 模拟 ftp 主动模式: 客户端 发出 BIND 请求, 目标 连接 第一个回复 中的 地址, 之后 双向转发
+func TestBind(t *testing.T) {
+	utils.InitLog("")
+
+	s := socks5.NewServer()
+	direct := &proxy.DirectClient{}
+
+	c1, c2 := net.Pipe()
+
+	//等待 转发 结束, 以免 其 日志 与 下一个测试的 InitLog 竞争
+	relayDone := make(chan struct{})
+	defer func() {
+		c1.Close()
+		<-relayDone
+	}()
+
+	go func() {
+		defer close(relayDone)
+		wlc, _, targetAddr, err := s.Handshake(c2)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		br, ok := wlc.(proxy.BindRequest)
+		if !ok {
+			t.Error("bind should return BindRequest")
+			return
+		}
+		rc, err := direct.Bind(br, targetAddr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		netLayer.Relay(&targetAddr, rc, br, 0, nil, nil)
+	}()
+
+	go c1.Write([]byte{socks5.Version5, 1, socks5.AuthNone})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c1, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	go c1.Write([]byte{socks5.Version5, socks5.CmdBind, 0, socks5.ATypIP4, 127, 0, 0, 1, 0, 0})
+
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(c1, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5.RepSucceeded || reply[3] != socks5.ATypIP4 {
+		t.Fatal("first reply wrong", reply)
+	}
+	bindAddr := &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	tc, err := net.DialTCP("tcp", nil, bindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	if _, err := io.ReadFull(c1, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5.RepSucceeded || int(reply[8])<<8|int(reply[9]) != tc.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatal("second reply wrong", reply)
+	}
+
+	go tc.Write([]byte("from target"))
+	bs := make([]byte, 11)
+	if _, err := io.ReadFull(c1, bs); err != nil || !bytes.Equal(bs, []byte("from target")) {
+		t.Fatal("read from target failed", err, bs)
+	}
+
+	go c1.Write([]byte("from client"))
+	if _, err := io.ReadFull(tc, bs); err != nil || !bytes.Equal(bs, []byte("from client")) {
+		t.Fatal("read from client failed", err, bs)
+	}
+}
@@ -286,7 +286,10 @@ For:
 	//  比如百度就是  [5 1 0 3 13 119 119 119 46 98]
 
 	cmd := bs[1]
-	if cmd == CmdBind {
+	switch cmd {
+	case CmdConnect, CmdBind, CmdUDPAssociate:
+	default:
+		underlay.Write([]byte{Version5, RepCommandNotSupported, 0, ATypIP4, 0, 0, 0, 0, 0, 0})
 		returnErr = fmt.Errorf("unsuppoted command %v", cmd)
 		return
 	}
@@ -390,6 +393,23 @@ For:
 		}
 		return nil, uc, clientFutureAddr, nil
 
+	} else if cmd == CmdBind {
+
+		//BIND 的 两个 回复 由 实际 监听 的 Client 通过 BindConn 写入
+
+		if ip := net.ParseIP(theName); ip != nil {
+			theIP = ip
+		}
+
+		targetAddr = netLayer.Addr{
+			IP:      theIP,
+			Name:    theName,
+			Port:    thePort,
+			Network: "tcp",
+		}
+
+		return &BindConn{Conn: underlay}, nil, targetAddr, nil
+
 	} else {
 
 		_, err = underlay.Write(commmonTCP_HandshakeReply)
@@ -416,6 +436,38 @@ For:
 
 }
 
+// 实现 proxy.BindRequest, 用于 BIND 命令
+type BindConn struct {
+	net.Conn
+}
+
+func (bc *BindConn) CloseWrite() error {
+	return netLayer.CloseWrite(bc.Conn)
+}
+
+func (bc *BindConn) WriteBindReply(addr netLayer.Addr, err error) error {
+	if err != nil {
+		_, e := bc.Conn.Write([]byte{Version5, RepGeneralFailure, 0, ATypIP4, 0, 0, 0, 0, 0, 0})
+		return e
+	}
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{Version5, 0, 0})
+	if ip4 := addr.IP.To4(); ip4 != nil || addr.IP == nil {
+		buf.WriteByte(ATypIP4)
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		buf.Write(ip4)
+	} else {
+		buf.WriteByte(ATypIP6)
+		buf.Write(addr.IP.To16())
+	}
+	buf.WriteByte(byte(addr.Port >> 8))
+	buf.WriteByte(byte(addr.Port))
+	_, e := bc.Conn.Write(buf.Bytes())
+	return e
+}
+
 // 用于socks5服务端的 udp连接, 实现 netLayer.MsgConn
 type ServerUDPConn struct {
 	*net.UDPConn
@@ -1,7 +1,9 @@
 /*
 Package socks5 provies socks5 proxy for proxy.Client and proxy.Server.
 
-Supports USER/PASSWORD authentication.
+Supports USER/PASSWORD authentication, and CONNECT/BIND/UDP ASSOCIATE commands.
+
+BIND 命令 只在 分流到 direct 时 可用, 见 proxy.BindRequest .
 
 # Reference
 
@@ -22,7 +24,7 @@ https://datatracker.ietf.org/doc/html/rfc1929
 纵观各种代理协议，vless/vmess/trojan/shadowsocks协议 都借鉴了socks5，有不少类似的地方。
 所以 制作代理, 有必要先学习socks5标准。
 
-关于socks4, 它太简单了, 既不支持udp, 也不支持ipv6, 也没有验证功能, 所以本作不予支持
+关于socks4, 它太简单了, 既不支持udp, 也不支持ipv6, 也没有验证功能, 只为了 兼容 一些 老的 工具 而 在 proxy/socks4 中 提供 服务端.
 */
 package socks5
 
@@ -46,6 +48,13 @@ const (
 	CmdUDPAssociate = 0x03
 )
 
+// SOCKS reply codes as defined in RFC 1928 section 6
+const (
+	RepSucceeded           = 0x00
+	RepGeneralFailure      = 0x01
+	RepCommandNotSupported = 0x07
+)
+
 // SOCKS address types as defined in RFC 1928 section 4
 //
 //	Note: vmess/vless用的是123，而这里用的是134，所以是不一样的。
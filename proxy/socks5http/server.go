@@ -1,7 +1,9 @@
 /*
 Package socks5http provides listening both socks5 and http at one port.
 
-This package imports proxy/socks5 and proxy/http package.
+This package imports proxy/socks5, proxy/socks4 and proxy/http package.
+
+首字节 为 4 的 请求 会被 当作 socks4/4a 处理.
 
 # Naming
 
@@ -27,6 +29,7 @@ import (
 	"net/url"
 
 	"github.com/e1732a364fed/v2ray_simple/proxy/http"
+	"github.com/e1732a364fed/v2ray_simple/proxy/socks4"
 	"github.com/e1732a364fed/v2ray_simple/proxy/socks5"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 
@@ -62,16 +65,18 @@ func (ServerCreator) NewServer(dc *proxy.ListenConf) (proxy.Server, error) {
 
 func newServer() *Server {
 	return &Server{
-		hs: http.NewServer(),
-		ss: socks5.NewServer(),
+		hs:  http.NewServer(),
+		ss:  socks5.NewServer(),
+		s4s: socks4.NewServer(),
 	}
 }
 
 type Server struct {
 	proxy.Base
 
-	hs *http.Server
-	ss *socks5.Server
+	hs  *http.Server
+	ss  *socks5.Server
+	s4s *socks4.Server
 }
 
 func (*Server) Name() string {
@@ -97,6 +102,10 @@ func (s *Server) Handshake(underlay net.Conn) (newconn net.Conn, msgConn netLaye
 			RemainFirstBufLen: buf.Len(),
 		}
 
+		if bs := buf.Bytes(); len(bs) > 0 && bs[0] == socks4.Version4 {
+			return s.s4s.Handshake(newConn)
+		}
+
 		return s.ss.Handshake(newConn)
 	}
 
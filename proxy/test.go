@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
@@ -384,3 +385,111 @@ func TestUDP(protocol string, version int, proxyPort string, use_multi int, t *t
 	}
 
 }
+
+// 使用 mux.cool 作为 内层mux, 在 同一个 连接上 分别 打开 tcp 与 udp 子连接, 服务端 回显.
+func TestMuxCool(protocol string, port string, t *testing.T) {
+	utils.LogLevel = utils.Log_debug
+	utils.InitLog("")
+
+	url := protocol + "://a684455c-b14f-11ea-bf0d-42010aaa0003@127.0.0.1:" + port + "?mux=true&extra.mux_type=mux.cool"
+
+	server, e := ServerFromURL(url)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer server.Stop()
+	client, e := ClientFromURL(url)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if i, innerProxyName := client.HasInnerMux(); i != 2 || innerProxyName != "" {
+		t.Fatal("client should use mux.cool", i, innerProxyName)
+	}
+
+	listener, err := net.Listen("tcp", server.AddrStr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		lc, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer lc.Close()
+
+		wlc, _, _, err := server.Handshake(lc)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if mc, ok := wlc.(MuxCoolMarker); !ok || !mc.IsMuxCool() {
+			t.Error("server should get mux.cool")
+			return
+		}
+		session := server.GetServerInnerMuxSession(wlc)
+		if session == nil {
+			t.Error("nil mux.cool session")
+			return
+		}
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				if target := stream.(innermux.AddrStream).Target(); !target.IsUDP() {
+					io.Copy(stream, stream)
+					return
+				}
+				mc := stream.(netLayer.MsgConn)
+				for {
+					bs, addr, err := mc.ReadMsg()
+					if err != nil {
+						return
+					}
+					mc.WriteMsg(bs, addr)
+				}
+			}()
+		}
+	}()
+
+	rc, err := net.Dial("tcp", server.AddrStr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	wrc, err := client.Handshake(rc, nil, netLayer.Addr{Name: "dummy.com", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, ok := client.GetClientInnerMuxSession(wrc).(innermux.AddrSession)
+	if !ok {
+		t.Fatal("client session should be mux.cool")
+	}
+	defer session.Close()
+
+	stream, err := session.DialTCP(netLayer.Addr{Name: "dummy.com", Port: 80}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var hello [5]byte
+	if _, err = io.ReadFull(stream, hello[:]); err != nil || string(hello[:]) != "hello" {
+		t.Fatal("tcp echo failed", string(hello[:]), err)
+	}
+
+	udpTarget := netLayer.Addr{IP: net.IPv4(8, 8, 8, 8), Port: 53, Network: "udp"}
+	mc, err := session.DialUDP(udpTarget, []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	bs, addr, err := mc.ReadMsg()
+	if err != nil || string(bs) != "world" || addr.String() != udpTarget.String() {
+		t.Fatal("udp echo failed", string(bs), addr.String(), err)
+	}
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"crypto/tls"
+	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/advLayer"
 	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
@@ -73,10 +74,20 @@ func prepareTLS_forClient(com BaseInterface, dc *DialConf) error {
 		Minver:       getTlsMinVerFromExtra(dc.Extra),
 		Maxver:       getTlsMaxVerFromExtra(dc.Extra),
 		CipherSuites: getTlsCipherSuitesFromExtra(dc.Extra),
+		SessionCache: getTlsSessionCacheFromExtra(dc.Extra),
 		Extra:        dc.Extra,
 	}
+	var err error
+	conf.ECHConfigList, conf.ECHFromDNS, err = getTlsECHFromExtra(dc.Extra)
+	if err != nil {
+		return err
+	}
 
 	clic.Tls_c = tlsLayer.NewClient(conf)
+
+	if ts, ok := clic.AdvC.(advLayer.TlsConfigSetter); ok {
+		ts.SetTlsConfig(tlsLayer.GetTlsConfig(false, conf))
+	}
 	return nil
 }
 
@@ -106,6 +117,8 @@ func prepareTLS_forServer(com BaseInterface, lc *ListenConf) error {
 		CipherSuites:     getTlsCipherSuitesFromExtra(lc.Extra),
 		Extra:            lc.Extra,
 	}
+	conf.TicketKeyFile, conf.TicketKeyInterval = getTlsTicketKeyFromExtra(lc.Extra)
+	conf.ECHKeyFile = getTlsECHKeyFileFromExtra(lc.Extra)
 
 	tlsserver, err := tlsLayer.NewServer(conf)
 
@@ -208,3 +221,65 @@ func getTlsCipherSuitesFromExtra(extra map[string]any) []uint16 {
 
 	return nil
 }
+
+func getTlsSessionCacheFromExtra(extra map[string]any) bool {
+	if len(extra) > 0 {
+		if thing := extra["tls_sessionCache"]; thing != nil {
+			if is, ok := utils.AnyToBool(thing); ok && is {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// 返回 ticket key 文件 以及 轮换周期
+func getTlsTicketKeyFromExtra(extra map[string]any) (fn string, interval time.Duration) {
+	if len(extra) > 0 {
+		if thing := extra["tls_ticketKeyFile"]; thing != nil {
+			if str, ok := thing.(string); ok {
+				fn = str
+			}
+		}
+		if thing := extra["tls_ticketKeyRotate"]; thing != nil {
+			if d, ok := utils.AnyToDuration(thing); ok {
+				interval = d
+			} else {
+				if ce := utils.CanLogErr("parse tls_ticketKeyRotate failed"); ce != nil {
+					ce.Write(zap.Any("given", thing))
+				}
+			}
+		}
+	}
+	return
+}
+
+// tls_ech 可为 "dns", 或 ECHConfigList 的 base64, 或 gech命令生成的 ech config 文件
+func getTlsECHFromExtra(extra map[string]any) (list []byte, fromDNS bool, err error) {
+	if len(extra) > 0 {
+		if thing := extra["tls_ech"]; thing != nil {
+			str, ok := thing.(string)
+			if !ok || str == "" {
+				return
+			}
+			if str == "dns" {
+				fromDNS = true
+				return
+			}
+			list, err = tlsLayer.ParseECHConfigList(str)
+		}
+	}
+	return
+}
+
+func getTlsECHKeyFileFromExtra(extra map[string]any) string {
+	if len(extra) > 0 {
+		if thing := extra["tls_echKeyFile"]; thing != nil {
+			if str, ok := thing.(string); ok {
+				return str
+			}
+		}
+	}
+	return ""
+}
@@ -39,6 +39,11 @@ func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
 			s.shouldSetRoute = true
 		}
 	}
+	var err error
+	if s.dnsHijack, err = proxy.NewDNSHijackFromExtra(lc.Extra); err != nil {
+		return nil, err
+	}
+
 	return s, nil
 }
 
@@ -59,6 +64,8 @@ type Server struct {
 
 	tm *tproxy.Machine
 	sync.Once
+
+	dnsHijack *proxy.DNSHijack
 }
 
 func NewServer() (proxy.Server, error) {
@@ -67,6 +74,11 @@ func NewServer() (proxy.Server, error) {
 }
 func (*Server) Name() string { return name }
 
+// implements proxy.DNSHijacker
+func (s *Server) ShouldHijackDNS(target netLayer.Addr) bool {
+	return s.dnsHijack.ShouldHijackDNS(target)
+}
+
 func (s *Server) SelfListen() (is bool, tcp, udp int) {
 	udp = -1
 	tcp = 1
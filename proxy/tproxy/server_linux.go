@@ -38,6 +38,11 @@ func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
 			s.shouldSetIPTable = true
 		}
 	}
+	var err error
+	if s.dnsHijack, err = proxy.NewDNSHijackFromExtra(lc.Extra); err != nil {
+		return nil, err
+	}
+
 	return s, nil
 }
 
@@ -62,6 +67,8 @@ type Server struct {
 
 	tm *tproxy.Machine
 	sync.Once
+
+	dnsHijack *proxy.DNSHijack
 }
 
 func NewServer() (proxy.Server, error) {
@@ -70,6 +77,11 @@ func NewServer() (proxy.Server, error) {
 }
 func (*Server) Name() string { return name }
 
+// implements proxy.DNSHijacker
+func (s *Server) ShouldHijackDNS(target netLayer.Addr) bool {
+	return s.dnsHijack.ShouldHijackDNS(target)
+}
+
 func (s *Server) SelfListen() (is bool, tcp, udp int) {
 	switch n := s.Network(); n {
 	case "", netLayer.DualNetworkName:
@@ -47,6 +47,14 @@ func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
 	return &c, nil
 }
 
+// trojan 的 mux 与 trojan-go 一致, 不支持 mux.cool
+func (ClientCreator) AfterCommonConfClient(pc proxy.Client) error {
+	if c := pc.(*Client); c.use_mux && c.IsMuxCool() {
+		return utils.ErrInErr{ErrDesc: "trojan doesn't support mux.cool", ErrDetail: utils.ErrUnImplemented}
+	}
+	return nil
+}
+
 type Client struct {
 	proxy.Base
 	User
@@ -9,7 +9,7 @@ import (
 )
 
 // trojan比较简洁，这个 UserTCPConn 只是用于读取握手读取时读到的剩余的缓存。
-// 实现 net.Conn, io.ReaderFrom, utils.User, utils.MultiWriter, netLayer.Splicer, netLayer.ConnWrapper
+// 实现 net.Conn, io.ReaderFrom, utils.User, utils.MultiWriter, netLayer.Splicer, netLayer.ConnWrapper, netLayer.CloseWriter
 type UserTCPConn struct {
 	net.Conn
 	User
@@ -28,6 +28,10 @@ func (c *UserTCPConn) Upstream() net.Conn {
 	return c.Conn
 }
 
+func (c *UserTCPConn) CloseWrite() error {
+	return netLayer.CloseWrite(c.Conn)
+}
+
 func (c *UserTCPConn) Read(p []byte) (int, error) {
 	if c.remainFirstBufLen > 0 {
 		n, err := c.optionalReader.Read(p)
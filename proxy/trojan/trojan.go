@@ -238,7 +238,7 @@ func GenerateOfficialDraftShareURL(dialconf *proxy.DialConf) string {
 		q.Add("type", dialconf.AdvancedLayer)
 
 		switch dialconf.AdvancedLayer {
-		case "ws":
+		case "ws", "h2", "httpupgrade", "splithttp":
 			if dialconf.Path != "" {
 				q.Add("path", dialconf.Path)
 			}
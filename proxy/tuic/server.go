@@ -0,0 +1,336 @@
+package tuic
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	advquic "github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"go.uber.org/zap"
+)
+
+func init() {
+	proxy.RegisterServer(Name, &ServerCreator{})
+}
+
+type ServerCreator struct{ proxy.CreatorCommonStruct }
+
+func (ServerCreator) URLToListenConf(u *url.URL, lc *proxy.ListenConf, format int) (*proxy.ListenConf, error) {
+	if format != proxy.UrlStandardFormat {
+		return lc, utils.ErrUnImplemented
+	}
+	if lc == nil {
+		lc = &proxy.ListenConf{}
+	}
+	if p, set := u.User.Password(); set {
+		lc.Users = append(lc.Users, utils.UserConf{
+			User: u.User.Username(),
+			Pass: p,
+		})
+	}
+	return lc, nil
+}
+
+func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
+	if err := useQuic(&lc.CommonConf); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		MultiUserMap: utils.NewMultiUserMap(),
+		authTimeout:  getAuthTimeoutFromExtra(lc.Extra),
+	}
+	s.TheIDBytesLen = utils.UUID_BytesLen
+
+	if str := lc.UUID; str != "" {
+		u, err := NewUserByStr(str)
+		if err != nil {
+			return nil, err
+		}
+		s.AddUser(u)
+	}
+	if len(lc.Users) > 0 {
+		s.LoadUsers(InitUsers(lc.Users))
+	}
+	return s, nil
+}
+
+func (ServerCreator) AfterCommonConfServer(ps proxy.Server) error {
+	s := ps.(*Server)
+	qs, ok := s.AdvS.(*advquic.Server)
+	if !ok {
+		return utils.ErrInErr{ErrDesc: "tuic requires quic advLayer"}
+	}
+	qs.SetConnHandler(s.handleConn)
+	return nil
+}
+
+// implements proxy.UserServer
+type Server struct {
+	proxy.Base
+
+	*utils.MultiUserMap
+
+	authTimeout time.Duration
+
+	conns sync.Map //quic.Connection -> *serverConn
+}
+
+func (*Server) Name() string {
+	return Name
+}
+
+// 一个 quic连接 的 状态
+type serverConn struct {
+	tuicConn
+
+	authed   chan struct{}
+	authOnce sync.Once
+	user     utils.User
+}
+
+func (sc *serverConn) waitAuth(timeout time.Duration) bool {
+	select {
+	case <-sc.authed:
+		return true
+	default:
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-sc.authed:
+		return true
+	case <-t.C:
+	case <-sc.Context().Done():
+	}
+	return false
+}
+
+// implements advquic.ConnHandler
+func (s *Server) handleConn(conn quic.Connection, newSubConnFunc func(net.Conn)) {
+	sc := &serverConn{authed: make(chan struct{})}
+	sc.init(conn)
+	sc.newSession = func(assocID uint16) *udpSession {
+		return s.newSession(sc, assocID, newSubConnFunc)
+	}
+	s.conns.Store(conn, sc)
+
+	go func() {
+		if !sc.waitAuth(s.authTimeout) && sc.Context().Err() == nil {
+			if ce := utils.CanLogWarn("tuic auth timeout"); ce != nil {
+				ce.Write(zap.String("raddr", conn.RemoteAddr().String()))
+			}
+			conn.CloseWithError(0, "")
+		}
+	}()
+
+	go s.acceptUniStreams(sc)
+	go s.receiveDatagrams(sc)
+
+	go func() {
+		<-conn.Context().Done()
+		s.conns.Delete(conn)
+		sc.closeAllSessions()
+	}()
+}
+
+func (s *Server) acceptUniStreams(sc *serverConn) {
+	for {
+		str, err := sc.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := s.handleUniStream(sc, str); err != nil {
+				str.CancelRead(0)
+				if ce := utils.CanLogDebug("tuic handle uni stream failed"); ce != nil {
+					ce.Write(zap.Error(err))
+				}
+			}
+		}()
+	}
+}
+
+func (s *Server) handleUniStream(sc *serverConn, str quic.ReceiveStream) error {
+	var hb [2]byte
+	if _, err := io.ReadFull(str, hb[:]); err != nil {
+		return err
+	}
+	if hb[0] != Version {
+		return utils.ErrInErr{ErrDesc: "tuic version wrong", ErrDetail: utils.ErrInvalidData, Data: hb[0]}
+	}
+
+	switch hb[1] {
+	case CmdAuthenticate:
+		return s.authenticate(sc, str)
+
+	case CmdPacket:
+		if !sc.waitAuth(s.authTimeout) {
+			return utils.ErrInErr{ErrDesc: "tuic packet before auth"}
+		}
+		return sc.readPacket(str, UdpRelayModeQuic)
+
+	case CmdDissociate:
+		if !sc.waitAuth(s.authTimeout) {
+			return utils.ErrInErr{ErrDesc: "tuic dissociate before auth"}
+		}
+		var ib [2]byte
+		if _, err := io.ReadFull(str, ib[:]); err != nil {
+			return err
+		}
+		if us := sc.removeSession(binary.BigEndian.Uint16(ib[:])); us != nil {
+			us.closeLocal()
+		}
+		return nil
+
+	default:
+		return utils.ErrInErr{ErrDesc: "tuic unknown command on uni stream", ErrDetail: utils.ErrInvalidData, Data: hb[1]}
+	}
+}
+
+func (s *Server) authenticate(sc *serverConn, r io.Reader) error {
+	var bs [utils.UUID_BytesLen + tokenLen]byte
+	if _, err := io.ReadFull(r, bs[:]); err != nil {
+		return err
+	}
+
+	user := s.HasUserByBytes(bs[:utils.UUID_BytesLen])
+	if user == nil {
+		sc.CloseWithError(0, "")
+		return utils.ErrInErr{ErrDesc: "tuic user not found", ErrDetail: utils.ErrInvalidData, Data: utils.UUIDToStr(bs[:utils.UUID_BytesLen])}
+	}
+
+	tlsState := sc.ConnectionState().TLS
+	token, err := user.(User).token(&tlsState)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(token, bs[utils.UUID_BytesLen:]) != 1 {
+		sc.CloseWithError(0, "")
+		return utils.ErrInErr{ErrDesc: "tuic token not match", ErrDetail: utils.ErrInvalidData, Data: user.IdentityStr()}
+	}
+
+	sc.authOnce.Do(func() {
+		sc.user = user
+		close(sc.authed)
+	})
+	return nil
+}
+
+func (s *Server) receiveDatagrams(sc *serverConn) {
+	for {
+		msg, err := sc.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		select {
+		case <-sc.authed:
+			sc.handleDatagram(msg)
+		default:
+			//0-rtt 时 datagram 可能 先于 认证 到达
+			go func() {
+				if sc.waitAuth(s.authTimeout) {
+					sc.handleDatagram(msg)
+				}
+			}()
+		}
+	}
+}
+
+// 收到 未知 ASSOC_ID 的 Packet 时 新建 会话, 并在 收到 第一个完整的包 后 交给 newSubConnFunc, 由 Handshake 返回.
+func (s *Server) newSession(sc *serverConn, assocID uint16, newSubConnFunc func(net.Conn)) *udpSession {
+	if newSubConnFunc == nil {
+		return nil
+	}
+
+	sc.mu.Lock()
+	us := sc.sessions[assocID]
+	if us == nil {
+		us = newUDPSession(&sc.tuicConn, assocID, UdpRelayModeNative, false)
+		us.onFirstPacket = func(addr netLayer.Addr) {
+			newSubConnFunc(&udpSessionConn{session: us, target: addr, user: sc.user})
+		}
+		sc.sessions[assocID] = us
+	}
+	sc.mu.Unlock()
+	return us
+}
+
+func (s *Server) getConn(underlay net.Conn) (*serverConn, error) {
+	qc, ok := underlay.(interface{ Connection() quic.Connection })
+	if !ok {
+		return nil, errNotQuicStream
+	}
+	v, ok := s.conns.Load(qc.Connection())
+	if !ok {
+		return nil, utils.ErrInErr{ErrDesc: "tuic quic connection not found"}
+	}
+	return v.(*serverConn), nil
+}
+
+func (s *Server) Handshake(underlay net.Conn) (result net.Conn, msgConn netLayer.MsgConn, targetAddr netLayer.Addr, returnErr error) {
+	if uc, ok := underlay.(*udpSessionConn); ok {
+		msgConn = uc.session
+		if uc.user != nil {
+			msgConn = &userMsgConn{MsgConn: uc.session, User: uc.user}
+		}
+		targetAddr = uc.target
+		return
+	}
+
+	sc, err := s.getConn(underlay)
+	if err != nil {
+		returnErr = err
+		return
+	}
+	if !sc.waitAuth(s.authTimeout) {
+		returnErr = utils.ErrInErr{ErrDesc: "tuic connect before auth", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+
+	if err := netLayer.SetCommonReadTimeout(underlay); err != nil {
+		returnErr = err
+		return
+	}
+	defer netLayer.PersistConn(underlay)
+
+	var hb [2]byte
+	if _, err = io.ReadFull(underlay, hb[:]); err != nil {
+		returnErr = utils.ErrInErr{ErrDesc: "tuic read header failed", ErrDetail: err}
+		return
+	}
+	if hb[0] != Version || hb[1] != CmdConnect {
+		returnErr = utils.ErrInErr{ErrDesc: "tuic wrong header on bidi stream", ErrDetail: utils.ErrInvalidData, Data: hb}
+		return
+	}
+
+	targetAddr, ok, err := readAddr(underlay)
+	if err != nil || !ok {
+		returnErr = utils.ErrInErr{ErrDesc: "tuic read addr failed", ErrDetail: err}
+		return
+	}
+	targetAddr.Network = "tcp"
+
+	result = &UserConn{Conn: underlay, User: sc.user}
+	return
+}
+
+// 带有 用户信息 的 tcp 连接
+type UserConn struct {
+	net.Conn
+	utils.User
+}
+
+type userMsgConn struct {
+	netLayer.MsgConn
+	utils.User
+}
@@ -0,0 +1,242 @@
+/*
+Package tuic implements tuic v5 protocol for proxy.Client and proxy.Server.
+
+tuic 直接 运行在 quic 之上, 所以 本包 依赖 advLayer/quic, 使用 tuic 时 adv 会被 自动设为 quic.
+
+See https://github.com/EAimTY/tuic/blob/dev/SPEC.md
+
+# Commands
+
+所有 命令 都以 VER(1字节, 0x05) TYPE(1字节) 开头:
+
+	Authenticate 0x00: UUID(16) TOKEN(32), 由 客户端 在 单向stream 上 发送.
+	Connect      0x01: ADDR, 由 客户端 在 双向stream 上 发送, 之后 该stream 就用于 tcp 数据的 转发.
+	Packet       0x02: ASSOC_ID(2) PKT_ID(2) FRAG_TOTAL(1) FRAG_ID(1) SIZE(2) ADDR, 后接 SIZE字节 的 udp数据.
+	Dissociate   0x03: ASSOC_ID(2), 由 客户端 在 单向stream 上 发送, 表示 某 udp会话 结束.
+	Heartbeat    0x04: 无, 由 客户端 以 datagram 发送.
+
+TOKEN 是 以 UUID 为 label, 以 密码 为 context 导出的 32字节 TLS Keying Material (RFC 5705).
+
+Packet 在 native 模式下 使用 datagram 发送, 超过 datagram 大小 的包 会被 分片, 只有 第一个分片 带有 地址;
+在 quic 模式下 每个包 单独 使用 一个 单向stream 发送, 不分片. 服务端 使用 客户端 所用的 模式 回复.
+
+ADDR 格式为 TYPE(1) ADDR PORT(2), TYPE: 0xff 无地址(此时 没有 ADDR 与 PORT), 0x00 域名(首字节为长度), 0x01 ipv4, 0x02 ipv6.
+*/
+package tuic
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+const Name = "tuic"
+
+const Version = 0x05
+
+const (
+	CmdAuthenticate = 0x00
+	CmdConnect      = 0x01
+	CmdPacket       = 0x02
+	CmdDissociate   = 0x03
+	CmdHeartbeat    = 0x04
+)
+
+const (
+	ATypNone   = 0xff
+	ATypDomain = 0x00
+	ATypIP4    = 0x01
+	ATypIP6    = 0x02
+)
+
+const (
+	UdpRelayModeNative = "native"
+	UdpRelayModeQuic   = "quic"
+)
+
+const (
+	tokenLen = 32
+
+	defaultHeartbeat   = time.Second * 10
+	defaultAuthTimeout = time.Second * 3
+
+	maxDatagramSize     = 1150 //与 advLayer/quic 的 datagram 一样, 给 quic 的帧头 与 包头 留出空间
+	packetHeaderLen     = 2 + 2 + 2 + 1 + 1 + 2
+	maxReassemblePerSes = 64
+	reassembleTimeout   = time.Second * 10
+	recvQueueSize       = 256
+)
+
+var (
+	errSessionClosed = errors.New("tuic udp session closed")
+	errNotQuicStream = errors.New("tuic underlay is not a quic stream")
+)
+
+// implements utils.UserWithPass. IdentityBytes 为 16字节 的 uuid.
+type User struct {
+	uuid     utils.V2rayUser
+	password []byte
+}
+
+func NewUser(uuidStr, password string) (User, error) {
+	uuid, err := utils.NewV2rayUser(uuidStr)
+	if err != nil {
+		return User{}, err
+	}
+	return User{uuid: uuid, password: []byte(password)}, nil
+}
+
+// uuid: "user:xxxx\npass:xxxx", 与 socks5 的格式 一致.
+func NewUserByStr(str string) (User, error) {
+	ok, uuid, pass := utils.CommonSplit(str, "user", "pass")
+	if !ok {
+		return User{}, utils.ErrInErr{ErrDesc: "tuic uuid format should be user:<uuid>\\npass:<password>", ErrDetail: utils.ErrInvalidData}
+	}
+	return NewUser(uuid, pass)
+}
+
+func (u User) IdentityStr() string {
+	return u.uuid.IdentityStr()
+}
+
+func (u User) IdentityBytes() []byte {
+	return u.uuid[:]
+}
+
+func (u User) AuthStr() string {
+	return u.IdentityStr() + "\n" + string(u.password)
+}
+
+func (u User) AuthBytes() []byte {
+	return []byte(u.AuthStr())
+}
+
+func (u User) GetPassword() []byte {
+	return u.password
+}
+
+// TlsExporter 即 tls.ConnectionState 的 ExportKeyingMaterial 方法
+type TlsExporter interface {
+	ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error)
+}
+
+func (u User) token(e TlsExporter) ([]byte, error) {
+	return e.ExportKeyingMaterial(string(u.uuid[:]), u.password, tokenLen)
+}
+
+func InitUsers(uc []utils.UserConf) (us []utils.User) {
+	for _, theuc := range uc {
+		u, err := NewUser(theuc.User, theuc.Pass)
+		if err != nil {
+			if ce := utils.CanLogErr("tuic: invalid user, skipped"); ce != nil {
+				ce.Write(zap.String("user", theuc.User), zap.Error(err))
+			}
+			continue
+		}
+		us = append(us, u)
+	}
+	return
+}
+
+func appendAddr(bs []byte, addr *netLayer.Addr) []byte {
+	if addr == nil {
+		return append(bs, ATypNone)
+	}
+	if len(addr.IP) > 0 {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			bs = append(bs, ATypIP4)
+			bs = append(bs, ip4...)
+		} else {
+			bs = append(bs, ATypIP6)
+			bs = append(bs, addr.IP.To16()...)
+		}
+	} else {
+		bs = append(bs, ATypDomain, byte(len(addr.Name)))
+		bs = append(bs, addr.Name...)
+	}
+	return binary.BigEndian.AppendUint16(bs, uint16(addr.Port))
+}
+
+// 返回的 ok 为 false 表示 ATypNone
+func readAddr(r io.Reader) (addr netLayer.Addr, ok bool, err error) {
+	var ab [1]byte
+	if _, err = io.ReadFull(r, ab[:]); err != nil {
+		return
+	}
+	switch ab[0] {
+	case ATypNone:
+		return
+	case ATypIP4:
+		ip := make(net.IP, net.IPv4len)
+		if _, err = io.ReadFull(r, ip); err != nil {
+			return
+		}
+		addr.IP = ip
+	case ATypIP6:
+		ip := make(net.IP, net.IPv6len)
+		if _, err = io.ReadFull(r, ip); err != nil {
+			return
+		}
+		addr.IP = ip
+	case ATypDomain:
+		if _, err = io.ReadFull(r, ab[:]); err != nil {
+			return
+		}
+		name := make([]byte, ab[0])
+		if _, err = io.ReadFull(r, name); err != nil {
+			return
+		}
+		addr.Name = string(name)
+	default:
+		err = utils.ErrInErr{ErrDesc: "tuic unknown addr type", ErrDetail: utils.ErrInvalidData, Data: ab[0]}
+		return
+	}
+
+	var pb [2]byte
+	if _, err = io.ReadFull(r, pb[:]); err != nil {
+		return
+	}
+	addr.Port = int(binary.BigEndian.Uint16(pb[:]))
+	ok = true
+	return
+}
+
+func getHeartbeatFromExtra(extra map[string]any) time.Duration {
+	if thing := extra["tuic_heartbeat"]; thing != nil {
+		if d, ok := utils.AnyToDuration(thing); ok && d > 0 {
+			return d
+		}
+	}
+	return defaultHeartbeat
+}
+
+func getAuthTimeoutFromExtra(extra map[string]any) time.Duration {
+	if thing := extra["tuic_authTimeout"]; thing != nil {
+		if d, ok := utils.AnyToDuration(thing); ok && d > 0 {
+			return d
+		}
+	}
+	return defaultAuthTimeout
+}
+
+func getUdpRelayModeFromExtra(extra map[string]any) string {
+	if thing := extra["tuic_udpRelayMode"]; thing != nil {
+		if str, ok := thing.(string); ok {
+			switch str {
+			case UdpRelayModeNative, UdpRelayModeQuic:
+				return str
+			default:
+				if ce := utils.CanLogErr("tuic: unknown tuic_udpRelayMode, will use native"); ce != nil {
+					ce.Write(zap.String("given", str))
+				}
+			}
+		}
+	}
+	return UdpRelayModeNative
+}
@@ -0,0 +1,199 @@
+package tuic_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/tuic"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func init() {
+	utils.InitLog("")
+}
+
+const testUUID = "user:a684455c-b14f-11ea-bf0d-42010aaa0003\npass:verysimple"
+
+func TestTCP(t *testing.T) {
+	testTuic(t, tuic.UdpRelayModeNative, false)
+}
+
+func TestUDP_native(t *testing.T) {
+	testTuic(t, tuic.UdpRelayModeNative, true)
+}
+
+func TestUDP_quic(t *testing.T) {
+	testTuic(t, tuic.UdpRelayModeQuic, true)
+}
+
+func TestWrongPassword(t *testing.T) {
+	port := netLayer.RandPort(true, true, 0)
+	startEchoServer(t, port)
+
+	c := newClient(t, port, tuic.UdpRelayModeNative, "user:a684455c-b14f-11ea-bf0d-42010aaa0003\npass:wrong")
+	rw := connect(t, c, []byte("hello"))
+	defer rw.Close()
+
+	buf := make([]byte, 5)
+	if conn, ok := rw.(net.Conn); ok {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	}
+	if _, err := io.ReadFull(rw, buf); err == nil {
+		t.Fatal("should fail with wrong password")
+	}
+}
+
+func startEchoServer(t *testing.T, port int) {
+	s, err := proxy.NewServer(&proxy.ListenConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: tuic.Name,
+			Host:     "127.0.0.1",
+			Port:     port,
+			UUID:     testUUID,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closer := s.GetAdvServer().(advLayer.SuperMuxServer).StartListen(func(c net.Conn) {
+		wlc, udpConn, _, err := s.Handshake(c)
+		if err != nil {
+			c.Close()
+			return
+		}
+		if wlc != nil {
+			io.Copy(wlc, wlc)
+			wlc.Close()
+			return
+		}
+		defer udpConn.Close()
+		for {
+			bs, raddr, err := udpConn.ReadMsg()
+			if err != nil {
+				return
+			}
+			if err = udpConn.WriteMsg(bs, raddr); err != nil {
+				return
+			}
+		}
+	})
+	if closer == nil {
+		t.Fatal("tuic listen failed")
+	}
+	t.Cleanup(func() { closer.Close() })
+}
+
+func newClient(t *testing.T, port int, mode, uuid string) proxy.Client {
+	c, err := proxy.NewClient(&proxy.DialConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: tuic.Name,
+			Host:     "127.0.0.1",
+			Port:     port,
+			UUID:     uuid,
+			Insecure: true,
+			Extra:    map[string]any{"tuic_udpRelayMode": mode},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func dialSubConn(t *testing.T, c proxy.Client) net.Conn {
+	muxC := c.GetAdvClient().(advLayer.MuxClient)
+	cc, err := muxC.GetCommonConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := muxC.DialSubConn(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func connect(t *testing.T, c proxy.Client, firstPayload []byte) io.ReadWriteCloser {
+	rw, err := c.Handshake(dialSubConn(t, c), firstPayload, netLayer.Addr{Network: "tcp", Name: "example.com", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rw
+}
+
+func testTuic(t *testing.T, mode string, isudp bool) {
+	port := netLayer.RandPort(true, true, 0)
+	startEchoServer(t, port)
+
+	c := newClient(t, port, mode, testUUID)
+
+	if !isudp {
+		rw := connect(t, c, []byte("hello"))
+		defer rw.Close()
+
+		data := make([]byte, 100*1024)
+		rand.Read(data)
+		go rw.Write(data)
+
+		rw.(net.Conn).SetReadDeadline(time.Now().Add(10 * time.Second))
+		got := make([]byte, len("hello")+len(data))
+		if _, err := io.ReadFull(rw, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, append([]byte("hello"), data...)) {
+			t.Fatal("echo data not equal")
+		}
+		return
+	}
+
+	target := netLayer.Addr{Network: "udp", IP: net.IPv4(1, 1, 1, 1), Port: 53}
+
+	first := []byte("first")
+	mc, err := c.EstablishUDPChannel(dialSubConn(t, c), first, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	mc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	bs, raddr, err := mc.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, first) || raddr.String() != target.String() {
+		t.Fatal("first packet wrong", string(bs), raddr.String())
+	}
+
+	//大于 datagram 大小 的包 在 native 模式下 会被 分片
+	for i, size := range []int{100, 1000, 5000, 20000} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		var got []byte
+		for try := 0; try < 5 && got == nil; try++ {
+			if err := mc.WriteMsg(data, target); err != nil {
+				t.Fatal(err)
+			}
+			mc.SetReadDeadline(time.Now().Add(time.Second))
+			got, raddr, err = mc.ReadMsg()
+			if err != nil {
+				got = nil
+				t.Log("retry", i, err)
+			}
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("echo data not equal", i, len(got), size)
+		}
+		if raddr.String() != target.String() {
+			t.Fatal("wrong addr", raddr.String())
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package tuic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"go.uber.org/zap"
+)
+
+// 客户端 与 服务端 的 quic连接 共有的部分: udp会话 的 管理, 以及 Packet 命令 的 收发.
+type tuicConn struct {
+	quic.Connection
+
+	mu       sync.Mutex
+	sessions map[uint16]*udpSession
+
+	//服务端 收到 未知 ASSOC_ID 的 Packet 时 调用, 返回 nil 表示 丢弃; 客户端 为 nil
+	newSession func(assocID uint16) *udpSession
+}
+
+func (tc *tuicConn) init(conn quic.Connection) {
+	tc.Connection = conn
+	tc.sessions = make(map[uint16]*udpSession)
+}
+
+func (tc *tuicConn) getSession(assocID uint16) *udpSession {
+	tc.mu.Lock()
+	s := tc.sessions[assocID]
+	tc.mu.Unlock()
+
+	if s == nil && tc.newSession != nil {
+		s = tc.newSession(assocID)
+	}
+	return s
+}
+
+func (tc *tuicConn) removeSession(assocID uint16) *udpSession {
+	tc.mu.Lock()
+	s := tc.sessions[assocID]
+	delete(tc.sessions, assocID)
+	tc.mu.Unlock()
+	return s
+}
+
+func (tc *tuicConn) sessionCount() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return len(tc.sessions)
+}
+
+func (tc *tuicConn) closeAllSessions() {
+	tc.mu.Lock()
+	ss := tc.sessions
+	tc.sessions = make(map[uint16]*udpSession)
+	tc.mu.Unlock()
+
+	for _, s := range ss {
+		s.closeLocal()
+	}
+}
+
+// 读取 Packet 命令 VER TYPE 之后的部分 并 交给 对应的 会话. 对 datagram 与 单向stream 都适用.
+func (tc *tuicConn) readPacket(r io.Reader, mode string) error {
+	var hb [packetHeaderLen - 2]byte
+	if _, err := io.ReadFull(r, hb[:]); err != nil {
+		return err
+	}
+	assocID := binary.BigEndian.Uint16(hb[0:])
+	pktID := binary.BigEndian.Uint16(hb[2:])
+	total, index := hb[4], hb[5]
+	size := binary.BigEndian.Uint16(hb[6:])
+
+	addr, hasAddr, err := readAddr(r)
+	if err != nil {
+		return err
+	}
+	if total == 0 || index >= total {
+		return utils.ErrInErr{ErrDesc: "tuic invalid fragment", ErrDetail: utils.ErrInvalidData, Data: [2]byte{index, total}}
+	}
+	if index == 0 && !hasAddr {
+		return utils.ErrInErr{ErrDesc: "tuic first fragment without addr", ErrDetail: utils.ErrInvalidData}
+	}
+
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return err
+	}
+
+	s := tc.getSession(assocID)
+	if s == nil {
+		return nil
+	}
+	addr.Network = "udp"
+	s.handleFragment(pktID, total, index, addr, payload, mode)
+	return nil
+}
+
+// 处理 收到的 datagram, 可能是 Packet 或 Heartbeat
+func (tc *tuicConn) handleDatagram(msg []byte) {
+	if len(msg) < 2 || msg[0] != Version {
+		return
+	}
+	switch msg[1] {
+	case CmdHeartbeat:
+	case CmdPacket:
+		if err := tc.readPacket(bytes.NewReader(msg[2:]), UdpRelayModeNative); err != nil {
+			if ce := utils.CanLogDebug("tuic read datagram packet failed"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+		}
+	default:
+		if ce := utils.CanLogDebug("tuic got unknown datagram"); ce != nil {
+			ce.Write(zap.Uint8("cmd", msg[1]))
+		}
+	}
+}
+
+func (tc *tuicConn) sendPacket(assocID, pktID uint16, data []byte, addr netLayer.Addr, mode string) error {
+	if mode == UdpRelayModeQuic {
+		bs := make([]byte, 0, packetHeaderLen+1+1+255+2+len(data))
+		bs = appendPacketHeader(bs, assocID, pktID, 1, 0, len(data))
+		bs = appendAddr(bs, &addr)
+		bs = append(bs, data...)
+
+		str, err := tc.OpenUniStream()
+		if err != nil {
+			return err
+		}
+		_, err = str.Write(bs)
+		str.Close()
+		return err
+	}
+
+	bs := appendAddr(nil, &addr)
+	firstCap := maxDatagramSize - packetHeaderLen - len(bs)
+	restCap := maxDatagramSize - packetHeaderLen - 1
+
+	count := 1
+	if len(data) > firstCap {
+		count += (len(data) - firstCap + restCap - 1) / restCap
+	}
+	if count > 255 {
+		return utils.ErrInErr{ErrDesc: "tuic udp packet too large", ErrDetail: utils.ErrInvalidData, Data: len(data)}
+	}
+
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	for i := 0; i < count; i++ {
+		var part []byte
+		if i == 0 {
+			part = data
+			if len(part) > firstCap {
+				part = part[:firstCap]
+			}
+		} else {
+			start := firstCap + (i-1)*restCap
+			end := start + restCap
+			if end > len(data) {
+				end = len(data)
+			}
+			part = data[start:end]
+		}
+
+		buf.Reset()
+		buf.Write(appendPacketHeader(make([]byte, 0, packetHeaderLen), assocID, pktID, count, i, len(part)))
+		if i == 0 {
+			buf.Write(bs)
+		} else {
+			buf.WriteByte(ATypNone)
+		}
+		buf.Write(part)
+
+		if err := tc.SendMessage(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendPacketHeader(bs []byte, assocID, pktID uint16, total, index, size int) []byte {
+	bs = append(bs, Version, CmdPacket)
+	bs = binary.BigEndian.AppendUint16(bs, assocID)
+	bs = binary.BigEndian.AppendUint16(bs, pktID)
+	bs = append(bs, byte(total), byte(index))
+	return binary.BigEndian.AppendUint16(bs, uint16(size))
+}
+
+type udpPacket struct {
+	data []byte
+	addr netLayer.Addr
+}
+
+type fragmentBuf struct {
+	parts   [][]byte
+	got     int
+	addr    netLayer.Addr
+	created time.Time
+}
+
+// implements netLayer.MsgConn. 即 tuic 的 一个 udp会话 (association).
+type udpSession struct {
+	netLayer.EasyDeadline
+
+	tc       *tuicConn
+	assocID  uint16
+	isClient bool
+
+	mode      atomic.Value //string, 服务端 会 使用 最后收到的包 的 模式 回复
+	nextPktID uint32
+
+	recvCh    chan udpPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	fragMu sync.Mutex
+	frags  map[uint16]*fragmentBuf
+
+	onClose func() //客户端 用于 发送 Dissociate
+
+	onFirstPacket func(addr netLayer.Addr) //服务端 用于 在 收到 第一个完整的包 后 将 会话 交给 newSubConnFunc
+	firstOnce     sync.Once
+}
+
+func newUDPSession(tc *tuicConn, assocID uint16, mode string, isClient bool) *udpSession {
+	s := &udpSession{
+		tc:       tc,
+		assocID:  assocID,
+		isClient: isClient,
+		recvCh:   make(chan udpPacket, recvQueueSize),
+		closed:   make(chan struct{}),
+		frags:    make(map[uint16]*fragmentBuf),
+	}
+	s.mode.Store(mode)
+	s.InitEasyDeadline()
+	return s
+}
+
+func (s *udpSession) handleFragment(pktID uint16, total, index byte, addr netLayer.Addr, payload []byte, mode string) {
+	if !s.isClient {
+		s.mode.Store(mode)
+	}
+
+	if total == 1 {
+		s.deliver(udpPacket{data: payload, addr: addr})
+		return
+	}
+
+	s.fragMu.Lock()
+	fb := s.frags[pktID]
+	if fb == nil {
+		if len(s.frags) >= maxReassemblePerSes {
+			now := time.Now()
+			for k, v := range s.frags {
+				if now.Sub(v.created) > reassembleTimeout {
+					delete(s.frags, k)
+				}
+			}
+			if len(s.frags) >= maxReassemblePerSes {
+				s.frags = make(map[uint16]*fragmentBuf)
+			}
+		}
+		fb = &fragmentBuf{parts: make([][]byte, total), created: time.Now()}
+		s.frags[pktID] = fb
+	}
+	if int(total) != len(fb.parts) || fb.parts[index] != nil {
+		s.fragMu.Unlock()
+		return
+	}
+	fb.parts[index] = payload
+	fb.got++
+	if index == 0 {
+		fb.addr = addr
+	}
+	complete := fb.got == len(fb.parts)
+	if complete {
+		delete(s.frags, pktID)
+	}
+	s.fragMu.Unlock()
+
+	if complete {
+		s.deliver(udpPacket{data: bytes.Join(fb.parts, nil), addr: fb.addr})
+	}
+}
+
+func (s *udpSession) deliver(p udpPacket) {
+	if s.onFirstPacket != nil {
+		s.firstOnce.Do(func() {
+			go s.onFirstPacket(p.addr)
+		})
+	}
+	select {
+	case s.recvCh <- p:
+	case <-s.closed:
+	default:
+		//接收队列满了 就 丢包, 与 udp 的行为 一致
+	}
+}
+
+func (s *udpSession) ReadMsg() ([]byte, netLayer.Addr, error) {
+	select {
+	case p := <-s.recvCh:
+		return p.data, p.addr, nil
+	case <-s.closed:
+		return nil, netLayer.Addr{}, errSessionClosed
+	case <-s.ReadTimeoutChan():
+		return nil, netLayer.Addr{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *udpSession) WriteMsg(data []byte, peer netLayer.Addr) error {
+	select {
+	case <-s.closed:
+		return errSessionClosed
+	case <-s.WriteTimeoutChan():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+	pktID := uint16(atomic.AddUint32(&s.nextPktID, 1))
+	return s.tc.sendPacket(s.assocID, pktID, data, peer, s.mode.Load().(string))
+}
+
+func (s *udpSession) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return s.Close()
+}
+
+func (s *udpSession) Fullcone() bool {
+	return true
+}
+
+// 只关闭 本地的 会话, 不通知 对端
+func (s *udpSession) closeLocal() (first bool) {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		first = true
+	})
+	return
+}
+
+func (s *udpSession) Close() error {
+	if !s.closeLocal() {
+		return nil
+	}
+	s.tc.removeSession(s.assocID)
+	if s.onClose != nil {
+		s.onClose()
+	}
+	return nil
+}
+
+// 服务端 用它 把 新的 udp会话 交给 newSubConnFunc, Server.Handshake 会 识别它.
+type udpSessionConn struct {
+	session *udpSession
+	target  netLayer.Addr
+	user    utils.User
+}
+
+func (uc *udpSessionConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (uc *udpSessionConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (uc *udpSessionConn) Close() error                { return uc.session.Close() }
+func (uc *udpSessionConn) LocalAddr() net.Addr         { return uc.session.tc.LocalAddr() }
+func (uc *udpSessionConn) RemoteAddr() net.Addr        { return uc.session.tc.RemoteAddr() }
+
+func (uc *udpSessionConn) SetDeadline(t time.Time) error      { return nil }
+func (uc *udpSessionConn) SetReadDeadline(t time.Time) error  { return nil }
+func (uc *udpSessionConn) SetWriteDeadline(t time.Time) error { return nil }
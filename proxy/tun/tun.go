@@ -126,6 +126,11 @@ func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
 		}
 	}
 
+	var err error
+	if s.dnsHijack, err = proxy.NewDNSHijackFromExtra(lc.Extra); err != nil {
+		return nil, err
+	}
+
 	return s, nil
 }
 
@@ -159,10 +164,17 @@ type Server struct {
 	devName, realIP, selfip, dns string //selfip 只在 darwin 上用到
 	autoRoute                    bool
 	autoRouteDirectList          []string
+
+	dnsHijack *proxy.DNSHijack
 }
 
 func (*Server) Name() string { return name }
 
+// implements proxy.DNSHijacker
+func (s *Server) ShouldHijackDNS(target netLayer.Addr) bool {
+	return s.dnsHijack.ShouldHijackDNS(target)
+}
+
 func (s *Server) SelfListen() (is bool, tcp, udp int) {
 	switch n := s.Network(); n {
 	case "", netLayer.DualNetworkName:
@@ -10,6 +10,7 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
 	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
 )
 
 func init() {
@@ -31,13 +32,29 @@ func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
 	}
 
 	v := dc.Version
+
+	//v0 的 mux 只能是 mux.cool, 在 AfterCommonConfClient 中 检查
+	c.use_mux = dc.Mux
+
+	switch dc.Flow {
+	case "":
+	case FlowVision, FlowVisionUDP443:
+		if v != 0 {
+			return nil, utils.ErrInErr{ErrDesc: "vless flow only supported in v0", Data: dc.Flow}
+		}
+		if dc.AdvancedLayer != "" || dc.Lazy {
+			return nil, utils.ErrInErr{ErrDesc: "vless flow can't be used with advLayer or lazy", Data: dc.Flow}
+		}
+		c.flow = dc.Flow
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "vless flow not supported", ErrDetail: utils.ErrUnImplemented, Data: dc.Flow}
+	}
+
 	if v > 0 {
 
 		if v == 1 {
 			c.version = 1
 
-			c.use_mux = dc.Mux
-
 			if dc.Extra != nil {
 				if thing := dc.Extra["vless1_udp_multi"]; thing != nil {
 					if udp_multi, ok := thing.(bool); ok && udp_multi {
@@ -54,6 +71,25 @@ func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
 	return &c, nil
 }
 
+func (ClientCreator) AfterCommonConfClient(pc proxy.Client) error {
+	c := pc.(*Client)
+	if c.flow != "" && !c.IsUseTLS() {
+		return utils.ErrInErr{ErrDesc: "vless flow requires tls", Data: c.flow}
+	}
+	if c.use_mux {
+		switch {
+		case c.version == 1 && c.IsMuxCool():
+			return utils.ErrInErr{ErrDesc: "vless mux.cool only supported in v0"}
+		case c.version == 0 && !c.IsMuxCool():
+			if ce := utils.CanLogWarn("vless v0 only supports mux.cool, mux is ignored"); ce != nil {
+				ce.Write(zap.String("mux_type", c.InnerMuxConf.Type))
+			}
+			c.use_mux = false
+		}
+	}
+	return nil
+}
+
 func (ClientCreator) URLToDialConf(url *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
 	switch format {
 	case proxy.UrlStandardFormat:
@@ -82,6 +118,8 @@ type Client struct {
 
 	udp_multi bool
 	use_mux   bool
+
+	flow string
 }
 
 func (*Client) GetCreator() proxy.ClientCreator {
@@ -101,15 +139,15 @@ func (c *Client) GetUser() utils.User {
 	return c.user
 }
 
-// 我们只支持 vless v1 的 mux
+// v1 的 mux 为 smux等 + simplesocks, v0 的 mux 为 mux.cool
 func (c *Client) HasInnerMux() (int, string) {
-	if c.version == 1 && c.use_mux {
-		return 2, "simplesocks"
-
-	} else {
+	if !c.use_mux {
 		return 0, ""
-
 	}
+	if c.version == 0 {
+		return 2, ""
+	}
+	return 2, "simplesocks"
 }
 
 func (c *Client) IsUDP_MultiChannel() bool {
@@ -118,6 +156,10 @@ func (c *Client) IsUDP_MultiChannel() bool {
 }
 
 func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	if c.flow != "" {
+		return c.handshakeVision(underlay, firstPayload, target)
+	}
+
 	var err error
 
 	port := target.Port
@@ -131,11 +173,14 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 		buf = c.getBufWithCmd(CmdTCP)
 	}
 
-	buf.WriteByte(byte(uint16(port) >> 8))
-	buf.WriteByte(byte(uint16(port) << 8 >> 8))
+	//mux.cool 的 请求头 不含 地址
+	if !c.use_mux || c.version != 0 {
+		buf.WriteByte(byte(uint16(port) >> 8))
+		buf.WriteByte(byte(uint16(port) << 8 >> 8))
 
-	buf.WriteByte(atyp)
-	buf.Write(addr)
+		buf.WriteByte(atyp)
+		buf.Write(addr)
+	}
 
 	if len(firstPayload) > 0 {
 		buf.Write(firstPayload)
@@ -174,7 +219,53 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 
 }
 
+// 请求头 与 firstPayload 的 填充块 一起 发送; 没有 firstPayload 时 发送 一个 长填充 的 空块, 以 隐藏 请求头 的 长度.
+func (c *Client) handshakeVision(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	tc, err := getVisionTlsConn(underlay)
+	if err != nil {
+		return nil, err
+	}
+
+	uc := &UserTCPConn{
+		Conn:      underlay,
+		V2rayUser: c.user,
+		version:   0,
+	}
+	vc, err := newVisionConn(uc, tc, c.user, false)
+	if err != nil {
+		return nil, err
+	}
+
+	//与 xray 一致, mux.cool 也可以 带上 vision, 此时 请求头 不含 地址
+	var buf *bytes.Buffer
+	if c.use_mux {
+		buf = c.getBufWithCmd(CmdMux)
+	} else {
+		buf = c.getBufWithCmd(CmdTCP)
+		WriteAddrTo(buf, target)
+	}
+
+	if len(firstPayload) > 0 {
+		vc.filter.filter(firstPayload)
+		vc.padTo(buf, firstPayload, true)
+		utils.PutBytes(firstPayload)
+	} else {
+		vc.writeBlock(buf, nil, visionCmdContinue, true)
+	}
+
+	_, err = underlay.Write(buf.Bytes())
+	utils.PutBuf(buf)
+
+	if err != nil {
+		return nil, err
+	}
+	return vc, nil
+}
+
 func (c *Client) EstablishUDPChannel(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	if c.flow == FlowVision && target.Port == 443 {
+		return nil, utils.ErrInErr{ErrDesc: "vless vision rejects udp 443, use flow " + FlowVisionUDP443 + " to allow it"}
+	}
 
 	buf := c.getBufWithCmd(CmdUDP)
 	port := target.Port
@@ -212,7 +303,11 @@ func (c *Client) getBufWithCmd(cmd byte) *bytes.Buffer {
 	buf.WriteByte(byte(c.version)) //version
 	buf.Write(c.user[:])
 	if v == 0 {
-		buf.WriteByte(0) //addon length
+		if c.flow != "" && cmd != CmdUDP {
+			buf.Write(visionAddons) //udp 不使用 vision, 与 xray 一致
+		} else {
+			buf.WriteByte(0) //addon length
+		}
 	} else {
 		switch {
 		default:
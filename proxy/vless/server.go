@@ -10,6 +10,7 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"go.uber.org/zap"
 )
@@ -41,6 +42,14 @@ func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
 		us := utils.InitV2rayUsers(lc.Users)
 		s.LoadUsers(us)
 	}
+
+	switch lc.Flow {
+	case "":
+	case FlowVision:
+		s.vision = true
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "vless flow not supported", ErrDetail: utils.ErrUnImplemented, Data: lc.Flow}
+	}
 	return s, nil
 
 }
@@ -93,15 +102,13 @@ type Server struct {
 	*utils.MultiUserMap
 
 	onlyV0 bool
+
+	vision bool //若为true, 则 v0 的 tcp请求 必须 使用 vision, 与 xray 一致
 }
 
+// v0 的 mux 为 mux.cool, v1 的 mux 为 smux等 + simplesocks
 func (s *Server) HasInnerMux() (int, string) {
-	if s.onlyV0 {
-		return 0, ""
-
-	} else {
-		return 1, "simplesocks"
-	}
+	return 1, "simplesocks"
 }
 
 func (*Server) CanFallback() bool {
@@ -141,6 +148,7 @@ func (s *Server) Handshake(underlay net.Conn) (tcpConn net.Conn, msgConn netLaye
 
 	readbuf := bytes.NewBuffer(readbs[:wholeReadLen])
 	var use_udp_multi bool
+	var flow string
 
 	goto realPart
 
@@ -185,16 +193,20 @@ realPart:
 			return
 		}
 		if addonLenByte != 0 {
-			//v2ray的vless中没有对应的任何处理。
-			//v2ray 的 vless 虽然有一个没用的Flow，但是 EncodeBodyAddons里根本没向里写任何数据。所以理论上正常这部分始终应该为0
-			if ce := utils.CanLogWarn("Vless potential illegal client"); ce != nil {
-				ce.Write(zap.Uint8("addonLenByte", addonLenByte))
-			}
+			//xray 的 vision 会在这里 写入 protobuf 编码的 Flow
 
-			if tmpbs := readbuf.Next(int(addonLenByte)); len(tmpbs) != int(addonLenByte) {
+			tmpbs := readbuf.Next(int(addonLenByte))
+			if len(tmpbs) != int(addonLenByte) {
 				returnErr = errors.New("vless short read in addon")
 				return
 			}
+			if flow, err = decodeAddons(tmpbs); err != nil {
+				if ce := utils.CanLogWarn("Vless potential illegal client"); ce != nil {
+					ce.Write(zap.Uint8("addonLenByte", addonLenByte), zap.Error(err))
+				}
+				returnErr = err
+				return
+			}
 		}
 	} else {
 		addonFlagByte, err := readbuf.ReadByte()
@@ -222,18 +234,15 @@ realPart:
 
 	switch commandByte {
 	case CmdMux:
-
-		//verysimple 没有实现 mux.cool,  因为 v2ray的 mux.cool 有很多问题, 本作不会支持v0 的mux
+		ismux = true
 
 		if version == 0 {
-			returnErr = errors.New("mux for vless v0 is not supported by verysimple")
-			return // 这个就不回落了.
-		} else {
-			//v1我们将采用 smux+simplesocks 的方式
-
-			ismux = true
-
+			//v0 的 mux 为 mux.cool, 请求头 不含 地址, 与 xray 一致
+			targetAddr = netLayer.Addr{Name: innermux.MuxCoolAddress}
+			break
 		}
+		//v1我们将采用 smux+simplesocks 的方式
+
 		fallthrough
 
 	case CmdTCP, CmdUDP:
@@ -256,7 +265,13 @@ realPart:
 		goto errorPart
 	}
 
-	if ismux {
+	if version == 0 {
+		if returnErr = s.checkFlow(flow, commandByte); returnErr != nil {
+			return
+		}
+	}
+
+	if ismux && version != 0 {
 		mm := &proxy.UserReadWrapper{
 			Mux:  true,
 			User: utils.V2rayUser(thisUUIDBytes),
@@ -312,8 +327,54 @@ realPart:
 		if mw, ok := underlay.(utils.MultiWriter); ok {
 			uc.mw = mw
 		}
-		return uc, nil, targetAddr, nil
+
+		if flow == FlowVision {
+			tc, err := getVisionTlsConn(underlay)
+			if err != nil {
+				returnErr = err
+				return
+			}
+			vc, err := newVisionConn(uc, tc, thisUUIDBytes, true)
+			if err != nil {
+				returnErr = err
+				return
+			}
+			tcpConn = vc
+		} else {
+			tcpConn = uc
+		}
+
+		if ismux {
+			tcpConn = &proxy.UserReadWrapper{
+				Mux:         true,
+				MuxCool:     true,
+				User:        utils.V2rayUser(thisUUIDBytes),
+				ReadWrapper: netLayer.ReadWrapper{Conn: tcpConn},
+			}
+		}
+		return tcpConn, nil, targetAddr, nil
 
 	}
 
 }
+
+// 与 xray 一致: 开启 vision 的 服务端 拒绝 不带 vision 的 tcp请求, 未开启的 拒绝 带 vision 的 请求; vision 不支持 udp.
+// mux.cool 可以 带上 vision (xray 用于 xudp).
+func (s *Server) checkFlow(flow string, cmd byte) error {
+	switch flow {
+	case FlowVision:
+		if !s.vision {
+			return utils.ErrInErr{ErrDesc: "Vless flow not enabled on this server", ErrDetail: utils.ErrInvalidData, Data: flow}
+		}
+		if cmd != CmdTCP && cmd != CmdMux {
+			return utils.ErrInErr{ErrDesc: "Vless vision only supports tcp", ErrDetail: utils.ErrInvalidData, Data: cmd}
+		}
+	case "":
+		if s.vision && cmd == CmdTCP {
+			return utils.ErrInErr{ErrDesc: "Vless server requires flow " + FlowVision, ErrDetail: utils.ErrInvalidData}
+		}
+	default:
+		return utils.ErrInErr{ErrDesc: "Vless unknown flow", ErrDetail: utils.ErrInvalidData, Data: flow}
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ package vless
 
 import (
 	"bytes"
-	"errors"
 	"io"
 	"net"
 	"syscall"
@@ -11,7 +10,7 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
-// 实现 net.Conn, io.ReaderFrom, utils.User, utils.MultiWriter, utils.MultiReader, netLayer.Splicer, netLayer.ConnWrapper, netLayer.SpliceReader
+// 实现 net.Conn, io.ReaderFrom, utils.User, utils.MultiWriter, utils.MultiReader, netLayer.Splicer, netLayer.ConnWrapper, netLayer.SpliceReader, netLayer.CloseWriter
 type UserTCPConn struct {
 	net.Conn
 
@@ -43,6 +42,16 @@ func (c *UserTCPConn) Upstream() net.Conn {
 	return c.Conn
 }
 
+// 若 v0 服务端 还没有 写过 回复头, 会 先写入 回复头, 然后 半关闭 底层连接.
+func (c *UserTCPConn) CloseWrite() error {
+	if !c.canDirectWrite() {
+		if _, err := c.Write(nil); err != nil {
+			return err
+		}
+	}
+	return netLayer.CloseWrite(c.Conn)
+}
+
 // 当前连接状态是否可以直接写入底层Conn而不经任何改动/包装
 func (c *UserTCPConn) canDirectWrite() bool {
 	return c.version == 1 || (c.version == 0 && !(c.isServerEnd && !c.isntFirstPacket))
@@ -227,25 +236,20 @@ func (c *UserTCPConn) Read(p []byte) (int, error) {
 	} else if c.version == 0 {
 
 		if !c.isntFirstPacket {
-			//先读取响应头
+			//先读取响应头. 单独读取, 以免 p 较小 时 (如 mux.cool 读帧头) 丢失 后面的数据
 
 			c.isntFirstPacket = true
 
-			bs := utils.GetPacket()
-			n, e := c.Conn.Read(bs)
-
-			if e != nil {
-				utils.PutPacket(bs)
-				return 0, e
+			var head [2]byte
+			if _, e := io.ReadFull(c.Conn, head[:]); e != nil {
+				return 0, utils.ErrInErr{ErrDesc: "vless read response head failed", ErrDetail: e}
 			}
-
-			if n < 2 {
-				utils.PutPacket(bs)
-				return 0, errors.New("vless response head too short")
+			if head[1] > 0 {
+				if _, e := io.CopyN(io.Discard, c.Conn, int64(head[1])); e != nil {
+					return 0, utils.ErrInErr{ErrDesc: "vless read response addons failed", ErrDetail: e}
+				}
 			}
-			n = copy(p, bs[2:n])
-			utils.PutPacket(bs)
-			return n, nil
+			return c.Conn.Read(p)
 
 		} else {
 			return c.Conn.Read(p)
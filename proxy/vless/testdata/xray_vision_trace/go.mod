@@ -0,0 +1,6 @@
+// 独立 的 模块, 只 用于 重新生成 vision_test.go 中 的 xray 数据, 不属于 v2ray_simple 的 构建.
+module xray_vision_trace
+
+go 1.21
+
+require github.com/xtls/xray-core v1.8.4
@@ -0,0 +1,82 @@
+/*
+本程序 用 xray-core v1.8.4 生成 proxy/vless/vision_test.go 中 的 xrayVision* 常量.
+
+	cd proxy/vless/testdata/xray_vision_trace
+	go mod tidy
+	go run .
+
+输出 即为 可以 直接 粘贴 到 vision_test.go 的 const 块. 填充 长度 由 xray 随机 选取, 所以 每次 生成 的 数据 都 不同,
+测试 只 依赖 其 格式, 不 依赖 具体 长度.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/proxy/vless"
+	"github.com/xtls/xray-core/proxy/vless/encoding"
+)
+
+// 与 vision_test.go 中 的 visionTestUUID 相同
+const visionTestUUID = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+
+func bufOf(s string) *buf.Buffer {
+	if s == "" {
+		return nil
+	}
+	b := buf.New()
+	b.WriteString(s)
+	return b
+}
+
+// 每行 48字节, 与 vision_test.go 中 的 格式 相同
+func printConst(name, comment string, bs []byte) {
+	fmt.Printf("\t// %s\n\t%s = \"\" +\n", comment, name)
+	h := hex.EncodeToString(bs)
+	for len(h) > 96 {
+		fmt.Printf("\t\t%q +\n", h[:96])
+		h = h[96:]
+	}
+	fmt.Printf("\t\t%q\n\n", h)
+}
+
+func main() {
+	id, err := uuid.ParseString(visionTestUUID)
+	if err != nil {
+		panic(err)
+	}
+	ctx := context.Background()
+
+	var header bytes.Buffer
+	err = encoding.EncodeRequestHeader(&header, &protocol.RequestHeader{
+		Version: 0,
+		Command: protocol.RequestCommandTCP,
+		Address: net.DomainAddress("example.com"),
+		Port:    443,
+		User:    &protocol.MemoryUser{Account: &vless.MemoryAccount{ID: protocol.NewID(id), Flow: vless.XRV}},
+	}, &encoding.Addons{Flow: vless.XRV})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("\t// 目标 为 example.com:443 的 tcp 请求头, flow 为 xtls-rprx-vision\n\txrayVisionRequestHeader = %q\n\n", hex.EncodeToString(header.Bytes()))
+
+	//XtlsPadding 只在 第一块 写入 用户id, 之后 会 把 u 置为 nil
+	u := id.Bytes()
+	var trace []byte
+	trace = append(trace, encoding.XtlsPadding(bufOf("hello"), encoding.CommandPaddingContinue, &u, false, ctx).Bytes()...)
+	trace = append(trace, encoding.XtlsPadding(nil, encoding.CommandPaddingContinue, &u, false, ctx).Bytes()...)
+	trace = append(trace, encoding.XtlsPadding(bufOf("abc"), encoding.CommandPaddingEnd, &u, false, ctx).Bytes()...)
+	trace = append(trace, "tail"...)
+	printConst("xrayVisionUnpaddingTrace", `依次 为 XtlsPadding("hello", continue), XtlsPadding(nil, continue), XtlsPadding("abc", end) 的 输出, 之后 为 不填充 的 "tail"`, trace)
+
+	u = id.Bytes()
+	direct := encoding.XtlsPadding(bufOf("abc"), encoding.CommandPaddingDirect, &u, false, ctx).Bytes()
+	printConst("xrayVisionDirectTrace", `XtlsPadding("abc", direct) 的 输出`, direct)
+}
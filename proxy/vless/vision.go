@@ -0,0 +1,540 @@
+package vless
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+/*
+xtls-rprx-vision 流控, 与 xray 兼容. 只用于 vless v0 + tls, 且 不能有 高级层.
+
+当 内层流量 也是 tls 时, 在 内层 tls 握手阶段 给每个包 加上 随机长度的 填充, 以 消除 tls in tls 的 长度特征;
+内层 tls 开始发送 应用数据 后, 若 内层为 tls1.3, 则 不再使用 外层 tls 加密, 直接 读写 外层tls 的 底层连接 (可以 splice), 因为 内层数据 本身 已经 加密过了.
+
+填充块 格式: [1字节 command][2字节 内容长度][2字节 填充长度][内容][填充], 每个方向 的 第一个 填充块 前 有 16字节 的 uuid.
+command 为 0 表示 之后 还是 填充块; 为 1 表示 填充结束, 之后 的 数据 照常 通过 外层tls 传输; 为 2 表示 填充结束, 并且 之后 直接读写 底层连接.
+
+请求头 中 的 addon 为 protobuf 编码的 Addons{ Flow string = 1; Seed bytes = 2 }, 我们 只用到 Flow.
+
+参考 https://github.com/XTLS/Xray-core/blob/main/proxy/vless/encoding/encoding.go
+*/
+
+const (
+	FlowVision = "xtls-rprx-vision"
+
+	//与 xray 一样, vision 默认 拒绝 udp 443 (即 quic), 以 让 浏览器 回落到 tcp; 客户端 使用 该flow 则 允许. 请求头 中 依然 发送 FlowVision
+	FlowVisionUDP443 = FlowVision + "-udp443"
+)
+
+const (
+	visionCmdContinue byte = iota
+	visionCmdEnd
+	visionCmdDirect
+)
+
+const (
+	visionBlockSize       = 8192 //xray 的 buf.Size, 填充块 不会 超过这个长度
+	visionMaxContentLen   = visionBlockSize - 21
+	visionPacketsToFilter = 8 //只 嗅探 前几个包 的 内层tls 握手
+
+	tlsHandshakeTypeClientHello = 1
+	tlsHandshakeTypeServerHello = 2
+)
+
+var (
+	tls13SupportedVersions  = []byte{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04}
+	tlsClientHandShakeStart = []byte{0x16, 0x03}
+	tlsServerHandShakeStart = []byte{0x16, 0x03, 0x03}
+	tlsApplicationDataStart = []byte{0x17, 0x03, 0x03}
+
+	visionAddons = encodeAddons(FlowVision)
+
+	visionZeroPadding [visionBlockSize]byte
+)
+
+// 返回 v0 请求头 中 的 addon 部分, 包括 长度字节.
+func encodeAddons(flow string) []byte {
+	if flow == "" {
+		return []byte{0}
+	}
+	return append([]byte{byte(2 + len(flow)), 0x0a, byte(len(flow))}, flow...)
+}
+
+// 解析 protobuf 编码的 addons, 只取出 Flow, 忽略 其它字段.
+func decodeAddons(bs []byte) (flow string, err error) {
+	for len(bs) > 0 {
+		key, n := binary.Uvarint(bs)
+		if n <= 0 {
+			return "", utils.ErrInErr{ErrDesc: "vless addons invalid key", ErrDetail: utils.ErrInvalidData}
+		}
+		bs = bs[n:]
+
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(bs); n <= 0 {
+				return "", utils.ErrInErr{ErrDesc: "vless addons invalid varint", ErrDetail: utils.ErrInvalidData}
+			}
+			bs = bs[n:]
+		case 2:
+			l, n := binary.Uvarint(bs)
+			if n <= 0 || uint64(len(bs)-n) < l {
+				return "", utils.ErrInErr{ErrDesc: "vless addons invalid length", ErrDetail: utils.ErrInvalidData}
+			}
+			bs = bs[n:]
+			if key>>3 == 1 {
+				flow = string(bs[:l])
+			}
+			bs = bs[l:]
+		default:
+			return "", utils.ErrInErr{ErrDesc: "vless addons unsupported wire type", ErrDetail: utils.ErrInvalidData, Data: key & 7}
+		}
+	}
+	return
+}
+
+// vision 只能 直接 用在 tls 上, 且 外层tls 必须是 1.3
+func getVisionTlsConn(underlay net.Conn) (tlsLayer.Conn, error) {
+	tc, ok := underlay.(tlsLayer.Conn)
+	if !ok {
+		return nil, utils.ErrInErr{ErrDesc: "vless vision requires underlay to be tls directly"}
+	}
+	if v := tc.GetTlsVersion(); v != tls.VersionTLS13 {
+		return nil, utils.ErrInErr{ErrDesc: "vless vision requires outer tls 1.3", Data: v}
+	}
+	return tc, nil
+}
+
+// 嗅探 内层tls 的 握手, 读写 两个方向 共用 一个. 见 xray 的 XtlsFilterTls
+type visionFilter struct {
+	sync.Mutex
+
+	packetsToFilter int
+
+	isTLS          bool
+	isTLS12orAbove bool
+	enableXtls     bool //内层 为 tls1.3 且 密码套件 不是 TLS_AES_128_CCM_8_SHA256 时 才能 直接拷贝
+
+	cipher               uint16
+	remainingServerHello int
+}
+
+func (f *visionFilter) filter(b []byte) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.packetsToFilter <= 0 {
+		return
+	}
+	f.packetsToFilter--
+
+	if len(b) >= 6 {
+		if bytes.Equal(b[:3], tlsServerHandShakeStart) && b[5] == tlsHandshakeTypeServerHello {
+			f.remainingServerHello = (int(b[3])<<8 | int(b[4])) + 5
+			f.isTLS12orAbove = true
+			f.isTLS = true
+
+			if len(b) >= 79 && f.remainingServerHello >= 79 {
+				sessionIdLen := int(b[43])
+				if i := 43 + sessionIdLen + 1; len(b) >= i+2 {
+					f.cipher = uint16(b[i])<<8 | uint16(b[i+1])
+				}
+			}
+		} else if bytes.Equal(b[:2], tlsClientHandShakeStart) && b[5] == tlsHandshakeTypeClientHello {
+			f.isTLS = true
+		}
+	}
+
+	if f.remainingServerHello > 0 {
+		end := f.remainingServerHello
+		if end > len(b) {
+			end = len(b)
+		}
+		f.remainingServerHello -= len(b)
+
+		if bytes.Contains(b[:end], tls13SupportedVersions) {
+			f.enableXtls = f.cipher >= 0x1301 && f.cipher <= 0x1304
+			f.packetsToFilter = 0
+
+			if ce := utils.CanLogDebug("vless vision found tls 1.3"); ce != nil {
+				ce.Write(zap.Uint16("cipher", f.cipher), zap.Bool("direct", f.enableXtls))
+			}
+
+		} else if f.remainingServerHello <= 0 {
+			f.packetsToFilter = 0
+
+			if ce := utils.CanLogDebug("vless vision found tls 1.2"); ce != nil {
+				ce.Write()
+			}
+		}
+	}
+}
+
+func (f *visionFilter) state() (isTLS, isTLS12orAbove, enableXtls bool, packetsToFilter int) {
+	f.Lock()
+	defer f.Unlock()
+	return f.isTLS, f.isTLS12orAbove, f.enableXtls, f.packetsToFilter
+}
+
+func (f *visionFilter) filtering() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.packetsToFilter > 0
+}
+
+// 与 xray 的 ReshapeMultiBuffer 一致: 返回 p 的 开头 一块, 不超过 visionMaxContentLen,
+// 长块 尽量 在 最后一个 tls 应用数据记录 的 开头 处 切开.
+func nextVisionChunk(p []byte) []byte {
+	if len(p) > visionBlockSize {
+		p = p[:visionBlockSize]
+	}
+	if len(p) < visionMaxContentLen {
+		return p
+	}
+	i := bytes.LastIndex(p, tlsApplicationDataStart)
+	if i <= 0 || i > visionMaxContentLen {
+		i = visionBlockSize / 2
+	}
+	return p[:i]
+}
+
+// VisionConn 实现 xtls-rprx-vision 流控.
+// 实现 net.Conn, io.ReaderFrom, utils.User, netLayer.Splicer, netLayer.SpliceReader
+//
+// 读写 可以 分别 在 两个 goroutine 中 进行, 但 读 与 读, 写 与 写 不能 并发.
+type VisionConn struct {
+	net.Conn //填充阶段 通过它 读写, 即 UserTCPConn
+
+	utils.V2rayUser
+
+	rawConn  net.Conn //外层tls 的 底层连接, 直接拷贝 时 读写 它
+	input    *bytes.Reader
+	rawInput *bytes.Buffer
+
+	filter visionFilter
+
+	writeUUID    bool
+	isFirstWrite bool //服务端 的 第一次写 一定是 填充块, 与 xray 一致
+	writePadding bool
+	writeDirect  bool
+
+	readPadding bool
+	readDirect  bool
+	readErr     error
+
+	remainingCommand int
+	remainingContent int
+	remainingPadding int
+	currentCommand   byte
+
+	readBuf     []byte
+	readPending bytes.Buffer
+}
+
+func newVisionConn(inner net.Conn, tc tlsLayer.Conn, user utils.V2rayUser, isServerEnd bool) (*VisionConn, error) {
+	raw, input, rawInput := tc.GetRawWithBuffers()
+	if raw == nil {
+		return nil, utils.ErrInErr{ErrDesc: "vless vision can't get raw conn of tls"}
+	}
+
+	vc := &VisionConn{
+		Conn:      inner,
+		V2rayUser: user,
+		rawConn:   raw,
+		input:     input,
+		rawInput:  rawInput,
+
+		writeUUID:    true,
+		isFirstWrite: isServerEnd,
+		writePadding: true,
+		readPadding:  true,
+
+		remainingCommand: -1,
+		remainingContent: -1,
+		remainingPadding: -1,
+	}
+	vc.filter.packetsToFilter = visionPacketsToFilter
+	vc.filter.remainingServerHello = -1
+
+	return vc, nil
+}
+
+// 把 content 作为 一个 填充块 写入 buf
+func (vc *VisionConn) writeBlock(buf *bytes.Buffer, content []byte, cmd byte, longPadding bool) {
+	contentLen := len(content)
+
+	var paddingLen int
+	if contentLen < 900 && longPadding {
+		paddingLen = rand.Intn(500) + 900 - contentLen
+	} else {
+		paddingLen = rand.Intn(256)
+	}
+	if paddingLen > visionMaxContentLen-contentLen {
+		paddingLen = visionMaxContentLen - contentLen
+	}
+
+	if vc.writeUUID {
+		vc.writeUUID = false
+		buf.Write(vc.V2rayUser[:])
+	}
+	buf.Write([]byte{cmd, byte(contentLen >> 8), byte(contentLen), byte(paddingLen >> 8), byte(paddingLen)})
+	buf.Write(content)
+	buf.Write(visionZeroPadding[:paddingLen])
+}
+
+// 把 p 分块 填充后 写入 buf. 若 填充 在 某一块 结束, 则 返回 p 中 剩下的 不再填充 的部分, 以及 之后 是否 直接 读写 底层连接.
+// 若 onlyContinue, 则 所有块 都 不会 结束填充.
+func (vc *VisionConn) padTo(buf *bytes.Buffer, p []byte, onlyContinue bool) (rest []byte, direct bool) {
+	isTLS, isTLS12orAbove, enableXtls, packetsToFilter := vc.filter.state()
+
+	for len(p) > 0 {
+		chunk := nextVisionChunk(p)
+		p = p[len(chunk):]
+
+		cmd := visionCmdContinue
+		if !onlyContinue {
+			if isTLS && len(chunk) >= 6 && bytes.Equal(chunk[:3], tlsApplicationDataStart) {
+				cmd = visionCmdEnd
+				if enableXtls {
+					cmd = visionCmdDirect
+					direct = true
+				}
+			} else if !isTLS12orAbove && packetsToFilter <= 1 {
+				//与 xray 一样, 为了兼容 早期的 vision, 非tls 时 提前一个包 结束填充
+				cmd = visionCmdEnd
+			}
+		}
+
+		vc.writeBlock(buf, chunk, cmd, isTLS)
+
+		if cmd != visionCmdContinue {
+			vc.writePadding = false
+			return p, direct
+		}
+	}
+	return nil, false
+}
+
+func (vc *VisionConn) Write(p []byte) (int, error) {
+	if vc.writeDirect {
+		return vc.rawConn.Write(p)
+	}
+	if !vc.writePadding {
+		return vc.Conn.Write(p)
+	}
+
+	vc.filter.filter(p)
+
+	buf := utils.GetBuf()
+	rest, direct := vc.padTo(buf, p, vc.isFirstWrite)
+	vc.isFirstWrite = false
+
+	if !direct {
+		buf.Write(rest)
+		rest = nil
+	}
+	_, err := vc.Conn.Write(buf.Bytes())
+	utils.PutBuf(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	if direct {
+		vc.writeDirect = true
+
+		if ce := utils.CanLogDebug("vless vision write direct"); ce != nil {
+			ce.Write(zap.Int("rest", len(rest)))
+		}
+
+		if len(rest) > 0 {
+			if _, err = vc.rawConn.Write(rest); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// 去掉 b 中 的 填充, 把 内容 写入 readPending. 见 xray 的 XtlsUnpadding
+func (vc *VisionConn) unpad(b []byte) {
+	if vc.remainingCommand == -1 && vc.remainingContent == -1 && vc.remainingPadding == -1 {
+		if len(b) >= 21 && bytes.Equal(b[:16], vc.V2rayUser[:]) {
+			b = b[16:]
+			vc.remainingCommand = 5
+		} else {
+			vc.readPending.Write(b)
+			return
+		}
+	}
+
+	for len(b) > 0 {
+		if vc.remainingCommand > 0 {
+			data := b[0]
+			b = b[1:]
+			switch vc.remainingCommand {
+			case 5:
+				vc.currentCommand = data
+			case 4:
+				vc.remainingContent = int(data) << 8
+			case 3:
+				vc.remainingContent |= int(data)
+			case 2:
+				vc.remainingPadding = int(data) << 8
+			case 1:
+				vc.remainingPadding |= int(data)
+			}
+			vc.remainingCommand--
+
+		} else if vc.remainingContent > 0 {
+			n := vc.remainingContent
+			if n > len(b) {
+				n = len(b)
+			}
+			vc.readPending.Write(b[:n])
+			b = b[n:]
+			vc.remainingContent -= n
+
+		} else if vc.remainingPadding > 0 {
+			n := vc.remainingPadding
+			if n > len(b) {
+				n = len(b)
+			}
+			b = b[n:]
+			vc.remainingPadding -= n
+		}
+
+		if vc.remainingCommand <= 0 && vc.remainingContent <= 0 && vc.remainingPadding <= 0 {
+			if vc.currentCommand == visionCmdContinue {
+				vc.remainingCommand = 5
+			} else {
+				vc.remainingCommand = -1
+				vc.remainingContent = -1
+				vc.remainingPadding = -1
+
+				vc.readPending.Write(b)
+				return
+			}
+		}
+	}
+}
+
+func (vc *VisionConn) updateReadState() {
+	switch {
+	case vc.remainingCommand > 0 || vc.remainingContent > 0 || vc.remainingPadding > 0 || vc.currentCommand == visionCmdContinue:
+		vc.readPadding = true
+	case vc.currentCommand == visionCmdEnd:
+		vc.readPadding = false
+	case vc.currentCommand == visionCmdDirect:
+		vc.readPadding = false
+		vc.readDirect = true
+
+		if ce := utils.CanLogDebug("vless vision read direct"); ce != nil {
+			ce.Write()
+		}
+	default:
+		vc.readPadding = false
+
+		if ce := utils.CanLogWarn("vless vision unknown command"); ce != nil {
+			ce.Write(zap.Uint8("cmd", vc.currentCommand))
+		}
+	}
+}
+
+func (vc *VisionConn) Read(p []byte) (int, error) {
+	if vc.readPending.Len() > 0 {
+		return vc.readPending.Read(p)
+	}
+	if vc.readErr != nil {
+		return 0, vc.readErr
+	}
+
+	if vc.readDirect {
+		//外层tls 中 还缓存着的数据 要先读完
+		if vc.input != nil {
+			if vc.input.Len() > 0 {
+				return vc.input.Read(p)
+			}
+			vc.input = nil
+		}
+		if vc.rawInput != nil {
+			if vc.rawInput.Len() > 0 {
+				return vc.rawInput.Read(p)
+			}
+			vc.rawInput = nil
+		}
+		return vc.rawConn.Read(p)
+	}
+
+	if !vc.readPadding && !vc.filter.filtering() {
+		vc.readBuf = nil
+		return vc.Conn.Read(p)
+	}
+
+	if vc.readBuf == nil {
+		vc.readBuf = make([]byte, utils.MaxPacketLen)
+	}
+
+	for {
+		n, err := vc.Conn.Read(vc.readBuf)
+		if n > 0 {
+			vc.unpad(vc.readBuf[:n])
+			vc.updateReadState()
+
+			if vc.readPending.Len() > 0 {
+				vc.filter.filter(vc.readPending.Bytes())
+			}
+		}
+		if err != nil {
+			vc.readErr = err
+		}
+
+		if vc.readPending.Len() > 0 {
+			return vc.readPending.Read(p)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if vc.readDirect {
+			return vc.Read(p)
+		}
+	}
+}
+
+func (vc *VisionConn) EverPossibleToSpliceWrite() bool {
+	return netLayer.IsTCP(vc.rawConn) != nil
+}
+
+func (vc *VisionConn) CanSpliceWrite() (bool, *net.TCPConn) {
+	if vc.writeDirect {
+		if tc := netLayer.IsTCP(vc.rawConn); tc != nil {
+			return true, tc
+		}
+	}
+	return false, nil
+}
+
+func (vc *VisionConn) EverPossibleToSpliceRead() bool {
+	return netLayer.IsTCP(vc.rawConn) != nil || netLayer.IsUnix(vc.rawConn) != nil
+}
+
+func (vc *VisionConn) CanSpliceRead() (bool, *net.TCPConn, *net.UnixConn) {
+	if vc.readDirect && vc.readPending.Len() == 0 && vc.readErr == nil &&
+		(vc.input == nil || vc.input.Len() == 0) && (vc.rawInput == nil || vc.rawInput.Len() == 0) {
+
+		return netLayer.ReturnSpliceRead(vc.rawConn)
+	}
+	return false, nil, nil
+}
+
+func (vc *VisionConn) ReadFrom(r io.Reader) (written int64, err error) {
+	return netLayer.TryReadFrom_withSplice(vc, vc, r, func() bool { return vc.writeDirect })
+}
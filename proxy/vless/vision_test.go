@@ -0,0 +1,454 @@
+package vless
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const visionTestUUID = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+
+// 把 c 读到的 数据 原样 写回, 读完 后 关闭 c
+func echoConn(c net.Conn) {
+	io.Copy(c, c)
+	c.Close()
+}
+
+// 对 ln 接受的 每个 连接 原样 写回 读到的 数据, ln 关闭 后 停止
+func serveEcho(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go echoConn(c)
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+// 每次 Read 返回 一段 事先给定的 数据, 写入的 数据 记录在 written 中
+type chunkConn struct {
+	net.Conn
+	chunks  [][]byte
+	written bytes.Buffer
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	c.chunks[0] = c.chunks[0][n:]
+	if len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func (c *chunkConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func newTestVisionConn(t *testing.T, inner, raw net.Conn, isServerEnd bool) *VisionConn {
+	user, err := utils.NewV2rayUser(visionTestUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &VisionConn{
+		Conn:             inner,
+		V2rayUser:        user,
+		rawConn:          raw,
+		writeUUID:        true,
+		isFirstWrite:     isServerEnd,
+		writePadding:     true,
+		readPadding:      true,
+		remainingCommand: -1,
+		remainingContent: -1,
+		remainingPadding: -1,
+	}
+	vc.filter.packetsToFilter = visionPacketsToFilter
+	vc.filter.remainingServerHello = -1
+	return vc
+}
+
+// 以下 数据 均由 xray-core v1.8.4 的 proxy/vless/encoding 中 的 EncodeRequestHeader 与 XtlsPadding 生成, 原样 记录, 未作 修改;
+// 填充 的 长度 是 xray 随机 选取 的. 用户id 为 visionTestUUID.
+//
+// 生成 的 程序 在 testdata/xray_vision_trace 中, 在 该目录 执行 go mod tidy && go run . 即可 重新生成 整个 const 块.
+const (
+	// 目标 为 example.com:443 的 tcp 请求头, flow 为 xtls-rprx-vision
+	xrayVisionRequestHeader = "00a684455cb14f11eabf0d42010aaa0003120a1078746c732d727072782d766973696f6e0101bb020b6578616d706c652e636f6d"
+
+	// 依次 为 XtlsPadding("hello", continue), XtlsPadding(nil, continue), XtlsPadding("abc", end) 的 输出, 之后 为 不填充 的 "tail"
+	xrayVisionUnpaddingTrace = "" +
+		"a684455cb14f11eabf0d42010aaa000300000500e968656c6c6f00000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000052000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"00000000000000000000010003009d616263000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000007461696c"
+
+	// XtlsPadding("abc", direct) 的 输出
+	xrayVisionDirectTrace = "" +
+		"a684455cb14f11eabf0d42010aaa000302000300b4616263000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+		"000000000000000000000000"
+)
+
+func TestVisionRequestHeader(t *testing.T) {
+	xray := mustHex(t, xrayVisionRequestHeader)
+
+	c, err := ClientCreator{}.NewClient(&proxy.DialConf{CommonConf: proxy.CommonConf{UUID: visionTestUUID, Flow: FlowVision}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := c.(*Client).getBufWithCmd(CmdTCP)
+	WriteAddrTo(buf, netLayer.Addr{Name: "example.com", Port: 443})
+	if !bytes.Equal(buf.Bytes(), xray) {
+		t.Fatalf("header not equal\n%x\n%x", buf.Bytes(), xray)
+	}
+
+	flow, err := decodeAddons(xray[18 : 18+18])
+	if err != nil || flow != FlowVision {
+		t.Fatal("decode addons failed", flow, err)
+	}
+
+	//带有 Seed 字段 时 也要 能 正确 取出 Flow
+	flow, err = decodeAddons(mustHex(t, "12020102"+"0a10"+hex.EncodeToString([]byte(FlowVision))))
+	if err != nil || flow != FlowVision {
+		t.Fatal("decode addons with seed failed", flow, err)
+	}
+
+	if _, err = decodeAddons([]byte{0x0a, 0x10, 'x'}); err == nil {
+		t.Fatal("short addons should fail")
+	}
+}
+
+// xray 发出的 填充流: 两个 continue块 (第二个 为 空), 一个 end块, 之后 为 不填充 的 数据. 在 每一个 位置 分成 两次 读到.
+//
+// 与 xray 相同, 首次 读到的 数据 不足 21字节 时 不会 被 识别 为 填充流, 所以 从 21 开始.
+func TestVisionUnpadding(t *testing.T) {
+	trace := mustHex(t, xrayVisionUnpaddingTrace)
+	want := "helloabctail"
+
+	for split := 21; split <= len(trace); split++ {
+		cc := &chunkConn{chunks: [][]byte{trace[:split], trace[split:]}}
+		vc := newTestVisionConn(t, cc, nil, false)
+
+		got, err := io.ReadAll(vc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("split %d, got %q", split, got)
+		}
+		if vc.readPadding || vc.readDirect {
+			t.Fatal("state wrong after end block", split)
+		}
+	}
+}
+
+// direct 块 之后, 要 依次 读出 tls 的 input, rawInput 和 底层连接 中的 数据
+func TestVisionUnpaddingDirect(t *testing.T) {
+	trace := mustHex(t, xrayVisionDirectTrace)
+
+	cc := &chunkConn{chunks: [][]byte{trace}}
+	raw := &chunkConn{chunks: [][]byte{[]byte("raw")}}
+	vc := newTestVisionConn(t, cc, raw, false)
+	vc.input = bytes.NewReader([]byte("input"))
+	vc.rawInput = bytes.NewBufferString("rawInput")
+
+	got, err := io.ReadAll(vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcinputrawInputraw" {
+		t.Fatalf("got %q", got)
+	}
+	if !vc.readDirect {
+		t.Fatal("should be direct")
+	}
+}
+
+// 一个 tls1.3 的 ServerHello, 密码套件为 TLS_AES_128_GCM_SHA256
+func fakeServerHello() []byte {
+	var hs []byte
+	hs = append(hs, 0x03, 0x03)
+	hs = append(hs, make([]byte, 32)...) //random
+	hs = append(hs, 32)
+	hs = append(hs, make([]byte, 32)...) //session id
+	hs = append(hs, 0x13, 0x01, 0)
+	hs = append(hs, 0, 6, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04)
+
+	bs := []byte{0x16, 0x03, 0x03, 0, 0, 2, 0, byte(len(hs) >> 8), byte(len(hs))}
+	l := len(hs) + 4
+	bs[3], bs[4] = byte(l>>8), byte(l)
+	return append(bs, hs...)
+}
+
+func TestVisionPadding(t *testing.T) {
+	inner := &chunkConn{}
+	raw := &chunkConn{}
+	vc := newTestVisionConn(t, inner, raw, true)
+
+	serverHello := fakeServerHello()
+	appData := append([]byte{0x17, 0x03, 0x03, 0, 5}, []byte("12345")...)
+	big := make([]byte, 20000)
+	rand.Read(big)
+
+	for _, p := range [][]byte{serverHello, big, appData, []byte("after")} {
+		if _, err := vc.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !vc.writeDirect || vc.writePadding {
+		t.Fatal("should write direct after tls1.3 application data")
+	}
+	if raw.written.String() != "after" {
+		t.Fatalf("raw got %q", raw.written.Bytes())
+	}
+
+	padded := inner.written.Bytes()
+	if !bytes.Equal(padded[:16], vc.V2rayUser[:]) {
+		t.Fatal("first block should start with uuid")
+	}
+	//检查 每个块 都 不超过 visionBlockSize
+	for rest := padded[16:]; len(rest) > 0; {
+		contentLen := int(rest[1])<<8 | int(rest[2])
+		paddingLen := int(rest[3])<<8 | int(rest[4])
+		if 5+contentLen+paddingLen > visionBlockSize {
+			t.Fatal("block too long", contentLen, paddingLen)
+		}
+		rest = rest[5+contentLen+paddingLen:]
+	}
+
+	reader := newTestVisionConn(t, &chunkConn{chunks: [][]byte{padded}}, &chunkConn{chunks: [][]byte{raw.written.Bytes()}}, false)
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append(serverHello, big...), appData...), "after"...)
+	if !bytes.Equal(got, want) {
+		t.Fatal("unpadded data not equal", len(got), len(want))
+	}
+}
+
+// 通过 真实的 tls1.3 外层, 内层 也是 tls1.3, 两端 都应 切换到 直接读写 底层连接.
+func TestVisionTLS(t *testing.T) {
+	utils.InitLog("")
+
+	port := netLayer.RandPortStr(true, false)
+	url := "vlesss://" + visionTestUUID + "@localhost:" + port + "?insecure=1&flow=" + FlowVision
+
+	server, err := proxy.ServerFromURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client, err := proxy.ClientFromURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//内层 tls 服务端, 回显
+	targetLn, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: tlsLayer.GenerateRandomTLSCert(),
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targetLn.Close()
+	go serveEcho(targetLn)
+
+	ln, err := net.Listen("tcp", server.AddrStr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverVC := make(chan *VisionConn, 1)
+	go func() {
+		lc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		tlsConn, err := server.GetTLS_Server().Handshake(lc)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		wlc, _, _, err := server.Handshake(tlsConn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		serverVC <- wlc.(*VisionConn)
+
+		rc, err := net.Dial("tcp", targetLn.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		go func() {
+			netLayer.TryCopy(rc, wlc, 0)
+			rc.Close()
+		}()
+		netLayer.TryCopy(wlc, rc, 0)
+		wlc.Close()
+	}()
+
+	cc, err := net.Dial("tcp", server.AddrStr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn, err := client.GetTLS_Client().Handshake(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrc, err := client.Handshake(tlsConn, nil, netLayer.Addr{Name: "dummy.com", Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := wrc.(*VisionConn)
+	defer vc.Close()
+
+	inner := tls.Client(vc, &tls.Config{InsecureSkipVerify: true})
+	inner.SetDeadline(time.Now().Add(10 * time.Second))
+
+	data := make([]byte, 100*1024)
+	rand.Read(data)
+	go inner.Write(data)
+
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(inner, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo data not equal")
+	}
+
+	if !vc.writeDirect || !vc.readDirect {
+		t.Fatal("client should be direct", vc.writeDirect, vc.readDirect)
+	}
+	svc := <-serverVC
+	if !svc.writeDirect || !svc.readDirect {
+		t.Fatal("server should be direct", svc.writeDirect, svc.readDirect)
+	}
+}
+
+// 与 xray 一致, mux.cool 可以 带上 vision
+func TestVisionMuxCool(t *testing.T) {
+	utils.InitLog("")
+
+	port := netLayer.RandPortStr(true, false)
+	url := "vlesss://" + visionTestUUID + "@localhost:" + port + "?insecure=1&flow=" + FlowVision + "&mux=true&extra.mux_type=mux.cool"
+
+	server, err := proxy.ServerFromURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client, err := proxy.ClientFromURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := client.HasInnerMux(); i != 2 {
+		t.Fatal("client should use mux.cool", i)
+	}
+
+	ln, err := net.Listen("tcp", server.AddrStr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		lc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer lc.Close()
+		tlsConn, err := server.GetTLS_Server().Handshake(lc)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		wlc, _, _, err := server.Handshake(tlsConn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		session := server.GetServerInnerMuxSession(wlc)
+		if session == nil {
+			t.Error("nil mux.cool session")
+			return
+		}
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go echoConn(stream)
+		}
+	}()
+
+	cc, err := net.Dial("tcp", server.AddrStr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	tlsConn, err := client.GetTLS_Client().Handshake(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrc, err := client.Handshake(tlsConn, nil, netLayer.Addr{Name: "dummy.com", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := wrc.(*VisionConn); !ok {
+		t.Fatal("client should use vision")
+	}
+	session, ok := client.GetClientInnerMuxSession(wrc).(innermux.AddrSession)
+	if !ok {
+		t.Fatal("client session should be mux.cool")
+	}
+	defer session.Close()
+
+	stream, err := session.DialTCP(netLayer.Addr{Name: "dummy.com", Port: 80}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	var hello [5]byte
+	if _, err = io.ReadFull(stream, hello[:]); err != nil || string(hello[:]) != "hello" {
+		t.Fatal("echo wrong", string(hello[:]), err)
+	}
+}
@@ -1,6 +1,8 @@
 /*
 	Package vless implements vless v0/v1 for proxy.Client and proxy.Server.
 
+v0 支持 xray 的 xtls-rprx-vision 流控, 见 vision.go
+
 vless的客户端配置 分享url文档：
 https://github.com/XTLS/Xray-core/discussions/716
 */
@@ -76,11 +78,14 @@ func GenerateXrayShareURL(dc *proxy.DialConf) string {
 
 		//}
 	}
+	if dc.Flow != "" {
+		q.Add("flow", dc.Flow)
+	}
 	if dc.AdvancedLayer != "" {
 		q.Add("type", dc.AdvancedLayer)
 
 		switch dc.AdvancedLayer {
-		case "ws":
+		case "ws", "h2", "httpupgrade", "splithttp":
 			if dc.Path != "" {
 				q.Add("path", dc.Path)
 			}
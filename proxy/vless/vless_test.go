@@ -26,3 +26,7 @@ func TestVLess1_udp(t *testing.T) {
 func TestVLess1_udp_multi(t *testing.T) {
 	proxy.TestUDP("vless", 1, netLayer.RandPortStr_safe(true, true), 1, t)
 }
+
+func TestVLess0_muxcool(t *testing.T) {
+	proxy.TestMuxCool("vless", netLayer.RandPortStr_safe(true, false), t)
+}
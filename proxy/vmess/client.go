@@ -100,14 +100,15 @@ func (*Client) GetCreator() proxy.ClientCreator {
 	return ClientCreator{}
 }
 
+// mux_type 为 mux.cool 时 使用 v2ray 的 mux.cool, 否则 使用 smux等 + simplesocks
 func (c *Client) HasInnerMux() (int, string) {
-	if c.use_mux {
-		return 2, "simplesocks"
-
-	} else {
+	if !c.use_mux {
 		return 0, ""
-
 	}
+	if c.IsMuxCool() {
+		return 2, ""
+	}
+	return 2, "simplesocks"
 }
 
 func (c *Client) specifySecurityByStr(security string) error {
@@ -179,7 +180,11 @@ func (c *Client) commonHandshake(underlay net.Conn, firstPayload []byte, target
 	var err error
 
 	if c.use_mux {
-		err = conn.handshake(CMDMux_VS, firstPayload)
+		if c.IsMuxCool() {
+			err = conn.handshake(CMDMux_Cool, firstPayload)
+		} else {
+			err = conn.handshake(CMDMux_VS, firstPayload)
+		}
 		conn.use_mux = true
 
 	} else {
@@ -279,14 +284,16 @@ func (c *ClientConn) handshake(cmd byte, firstpayload []byte) error {
 	buf.WriteByte(0) // reserved
 	buf.WriteByte(cmd)
 
-	// target
-	err := binary.Write(buf, binary.BigEndian, c.port)
-	if err != nil {
-		return err
-	}
+	// target, mux.cool 没有
+	if cmd != CMDMux_Cool {
+		err := binary.Write(buf, binary.BigEndian, c.port)
+		if err != nil {
+			return err
+		}
 
-	buf.WriteByte(c.atyp)
-	buf.Write(c.addr)
+		buf.WriteByte(c.atyp)
+		buf.Write(c.addr)
+	}
 
 	// padding
 	if paddingLen > 0 {
@@ -297,7 +304,7 @@ func (c *ClientConn) handshake(cmd byte, firstpayload []byte) error {
 	}
 
 	fnv1a := fnv.New32a()
-	_, err = fnv1a.Write(buf.Bytes())
+	_, err := fnv1a.Write(buf.Bytes())
 	if err != nil {
 		return err
 	}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innermux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -249,10 +250,10 @@ func (s *Server) Handshake(underlay net.Conn) (tcpConn net.Conn, msgConn netLaye
 		}
 		targetAddr = ad
 
-		//verysimple 不支持v2ray中的 vmess 的 mux.cool
-
-	case cmd_muxcool_unimplemented:
-		returnErr = utils.ErrInErr{ErrDesc: "Vmess mux.cool is not supported by verysimple ", ErrDetail: utils.ErrInvalidData}
+	case CMDMux_Cool:
+		ismux = true
+		sc.ismuxcool = true
+		targetAddr = netLayer.Addr{Name: innermux.MuxCoolAddress}
 
 	case CMDMux_VS:
 		ismux = true
@@ -338,7 +339,7 @@ type ServerConn struct {
 	dataReader io.Reader
 	dataWriter io.Writer
 
-	ismux bool
+	ismux, ismuxcool bool
 }
 
 // 实现 proxy.MuxMarker
@@ -346,6 +347,11 @@ func (s *ServerConn) IsMux() bool {
 	return s.ismux
 }
 
+// 实现 proxy.MuxCoolMarker
+func (s *ServerConn) IsMuxCool() bool {
+	return s.ismuxcool
+}
+
 func (s *ServerConn) aead_encodeRespHeader(outBuf *bytes.Buffer) error {
 	BodyKey := sha256.Sum256(s.reqBodyKey[:])
 	copy(s.respBodyKey[:], BodyKey[:16])
@@ -58,9 +58,9 @@ const (
 
 // v2ray CMD types
 const (
-	CmdTCP                    byte = 1
-	CmdUDP                    byte = 2
-	cmd_muxcool_unimplemented byte = 3 //mux.cool的command的定义 在 v2ray源代码的 common/protocol/headers.go 的 RequestCommandMux。
+	CmdTCP      byte = 1
+	CmdUDP      byte = 2
+	CMDMux_Cool byte = 3 //mux.cool的command的定义 在 v2ray源代码的 common/protocol/headers.go 的 RequestCommandMux。 请求头 不含 地址
 
 	CMDMux_VS byte = 4 //新定义的值，用于使用我们vs的mux方式
 )
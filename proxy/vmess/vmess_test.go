@@ -18,3 +18,7 @@ func TestTCP_none(t *testing.T) {
 func TestUDP(t *testing.T) {
 	proxy.TestUDP("vmess", 0, netLayer.RandPortStr_safe(true, true), 0, t)
 }
+
+func TestMuxCool(t *testing.T) {
+	proxy.TestMuxCool("vmess", netLayer.RandPortStr_safe(true, false), t)
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// 预连接 的 配置 也是 在 extra 中给出的, 如
+//
+//	extra = { preconnect = 2, preconnect_idleTimeout = "30s" }
+//
+// preconnect 为 保持的 空闲连接 数量, 0 表示 不使用.
+// preconnect_idleTimeout 为 空闲连接 的 最长 存活时间, 超过 就 丢弃, 默认 2秒.
+// 服务端 会 关闭 握手前 长时间 没有数据 的 连接 (本作的 服务端 为 netLayer.CommonReadTimeout, 即 4秒), 所以 不要 超过 服务端的 握手超时.
+func getWarmPoolFromExtra(extra map[string]any) *WarmPool {
+	if len(extra) == 0 {
+		return nil
+	}
+	var size int64
+	if thing := extra["preconnect"]; thing != nil {
+		size, _ = utils.AnyToInt64(thing)
+	}
+	if size <= 0 {
+		return nil
+	}
+
+	idle := DefaultWarmPoolIdleTimeout
+	if thing := extra["preconnect_idleTimeout"]; thing != nil {
+		if d, ok := utils.AnyToDuration(thing); ok && d > 0 {
+			idle = d
+		}
+	}
+	return NewWarmPool(int(size), idle)
+}
+
+const (
+	DefaultWarmPoolIdleTimeout = netLayer.DefaultCommonReadTimeout / 2
+
+	warmPoolRetryDelay = 5 * time.Second //预连接 失败 后, 过这么久 才会 再次 尝试
+
+	warmPoolMinProbeInterval = time.Second //探测 空闲连接 的 最短 间隔
+	warmPoolMaxProbeInterval = 10 * time.Second
+)
+
+type warmConn struct {
+	conn net.Conn //已经 完成 tcp/tls/高级层 握手 的 连接
+	raw  net.Conn //最底层 的 连接, 用于 探测 是否 已被 关闭
+	t    time.Time
+}
+
+/*
+WarmPool 为 一个 outClient 保持 若干个 预先拨号好的 空闲连接, 这些连接 已经 完成了 tcp/tls/高级层 的 握手,
+但 尚未 进行 代理层 握手. 这样 新的请求 只需 进行 代理层 握手, 可以 减少 首字节 延迟.
+
+被取走 后 会 异步 补充. 空闲连接 会被 定期 探测, 超时, 已被 对方 关闭 或 收到了 数据 的 会被 丢弃
+(我们 还没 发送 任何数据, 对方 发来的 只可能 是 关闭前 的 回应).
+
+连接 在 探测 之后 依然 可能 被 关闭, 所以 调用者 在 取出的 连接 上 握手 失败 时 应 重新拨号 再试 一次.
+
+拨号 函数 由 SetDialFunc 给出, 因为 拨号 所需的 DNSMachine 等 只有 在 转发 时 才 知道;
+所以 第一次 请求 之后 才会 开始 预连接. 之后 一直 使用 第一次 给出的 拨号函数, 所以 只适用于
+拨号地址 固定 的 client (即 有 AddrStr 的 代理client, 不能是 direct).
+*/
+type WarmPool struct {
+	Size        int
+	IdleTimeout time.Duration
+
+	hits, misses, discarded uint64
+
+	mutex      sync.Mutex
+	dial       func() (conn, raw net.Conn, err error)
+	idle       []warmConn
+	dialing    int
+	retryAfter time.Time
+	closed     bool
+	done       chan struct{} //Close 时 关闭, 用于 结束 探测 goroutine
+}
+
+func NewWarmPool(size int, idleTimeout time.Duration) *WarmPool {
+	return &WarmPool{Size: size, IdleTimeout: idleTimeout}
+}
+
+// 只有 第一次 调用 有效, 之后 开始 预连接. f 拨号的 目标 与 使用的 DNSMachine 在 整个 池 的 生命周期 内 不会 改变.
+func (p *WarmPool) SetDialFunc(f func() (conn, raw net.Conn, err error)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.dial != nil || p.closed {
+		return
+	}
+	p.dial = f
+	p.done = make(chan struct{})
+
+	interval := p.IdleTimeout / 2
+	if interval > warmPoolMaxProbeInterval {
+		interval = warmPoolMaxProbeInterval
+	} else if interval < warmPoolMinProbeInterval {
+		interval = warmPoolMinProbeInterval
+	}
+	go p.probeLoop(interval, p.done)
+
+	p.fillLocked()
+}
+
+func (p *WarmPool) probeLoop(interval time.Duration, done chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if !p.probe() {
+				return
+			}
+		}
+	}
+}
+
+// 取出 一个 可用的 空闲连接, 没有 则 返回 nil.
+func (p *WarmPool) Get() net.Conn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var result net.Conn
+	for len(p.idle) > 0 {
+		//先取 最早的, 它 最可能 快要 超时
+		wc := p.idle[0]
+		p.idle = p.idle[1:]
+
+		if p.usable(wc) {
+			result = wc.conn
+			break
+		}
+		wc.conn.Close()
+		atomic.AddUint64(&p.discarded, 1)
+	}
+
+	if result != nil {
+		atomic.AddUint64(&p.hits, 1)
+	} else {
+		atomic.AddUint64(&p.misses, 1)
+	}
+	p.fillLocked()
+	return result
+}
+
+func (p *WarmPool) usable(wc warmConn) bool {
+	return time.Since(wc.t) < p.IdleTimeout && netLayer.IsConnIdle(wc.raw)
+}
+
+// 丢弃 不可用的 空闲连接 并 补充. 返回 false 表示 已关闭
+func (p *WarmPool) probe() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	kept := p.idle[:0]
+	for _, wc := range p.idle {
+		if p.usable(wc) {
+			kept = append(kept, wc)
+		} else {
+			wc.conn.Close()
+			atomic.AddUint64(&p.discarded, 1)
+		}
+	}
+	for i := len(kept); i < len(p.idle); i++ {
+		p.idle[i] = warmConn{}
+	}
+	p.idle = kept
+
+	p.fillLocked()
+	return true
+}
+
+func (p *WarmPool) fillLocked() {
+	if p.closed || p.dial == nil || time.Now().Before(p.retryAfter) {
+		return
+	}
+	for n := p.Size - len(p.idle) - p.dialing; n > 0; n-- {
+		p.dialing++
+		go p.dialOne()
+	}
+}
+
+func (p *WarmPool) dialOne() {
+	conn, raw, err := p.dial()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.dialing--
+
+	if err != nil {
+		p.retryAfter = time.Now().Add(warmPoolRetryDelay)
+
+		if ce := utils.CanLogDebug("WarmPool dial failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return
+	}
+	if p.closed {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, warmConn{conn: conn, raw: raw, t: time.Now()})
+}
+
+// 关闭 所有 空闲连接, 之后 不再 预连接.
+func (p *WarmPool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.done != nil {
+		close(p.done)
+	}
+	for _, wc := range p.idle {
+		wc.conn.Close()
+	}
+	p.idle = nil
+}
+
+// 返回 空闲连接数, 命中数, 未命中数, 丢弃数
+func (p *WarmPool) Stats() (idle int, hits, misses, discarded uint64) {
+	p.mutex.Lock()
+	idle = len(p.idle)
+	p.mutex.Unlock()
+
+	return idle, atomic.LoadUint64(&p.hits), atomic.LoadUint64(&p.misses), atomic.LoadUint64(&p.discarded)
+}
@@ -0,0 +1,61 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// 服务端 在 我们 握手前 发来 数据 (如 回落的 响应) 的 空闲连接 即将 被关闭, 不应 被 取出.
+func TestWarmPoolDiscardReadable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	peers := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			peers <- c
+		}
+	}()
+
+	p := NewWarmPool(1, time.Minute)
+	defer p.Close()
+	p.SetDialFunc(func() (net.Conn, net.Conn, error) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		return c, c, err
+	})
+
+	peer := <-peers
+	defer peer.Close()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if idle, _, _, _ := p.Stats(); idle == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pool not filled")
+		}
+	}
+
+	peer.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	if c := p.Get(); c != nil {
+		t.Fatal("conn with pending data should be discarded")
+	}
+	if _, _, _, discarded := p.Stats(); discarded != 1 {
+		t.Fatal("wrong discarded count", discarded)
+	}
+	if second := <-peers; second != nil {
+		second.Close()
+	}
+}
@@ -0,0 +1,251 @@
+package wireguard
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.zx2c4.com/wireguard/device"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+func init() {
+	proxy.RegisterClient(Name, ClientCreator{})
+}
+
+type ClientCreator struct{ proxy.CreatorCommonStruct }
+
+// wireguard://<base64 private key>@host:port?publicKey=xxx&address=10.0.0.2/32&reserved=1,2,3&mtu=1420
+func (ClientCreator) URLToDialConf(u *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
+	if format != proxy.UrlStandardFormat {
+		return dc, utils.ErrUnImplemented
+	}
+	if dc == nil {
+		dc = &proxy.DialConf{}
+	}
+	if dc.Extra == nil {
+		dc.Extra = make(map[string]any)
+	}
+
+	if pk := u.User.Username(); pk != "" {
+		dc.Extra["wg_privateKey"] = pk
+	}
+
+	q := u.Query()
+	for _, k := range []string{"publicKey", "preSharedKey"} {
+		if v := q.Get(k); v != "" {
+			dc.Extra["wg_"+k] = v
+		}
+	}
+	if v := q.Get("address"); v != "" {
+		dc.Extra["wg_address"] = splitComma(v)
+	}
+	if v := q.Get("allowedIPs"); v != "" {
+		dc.Extra["wg_allowedIPs"] = splitComma(v)
+	}
+	for _, k := range []string{"mtu", "keepAlive", "listenPort"} {
+		if v := q.Get(k); v != "" {
+			dc.Extra["wg_"+k] = v
+		}
+	}
+	if v := q.Get("reserved"); v != "" {
+		var rs []int
+		for _, str := range splitComma(v) {
+			i, ok := utils.AnyToInt64(str)
+			if !ok {
+				return dc, utils.ErrInErr{ErrDesc: "wireguard reserved invalid", Data: v}
+			}
+			rs = append(rs, int(i))
+		}
+		dc.Extra["wg_reserved"] = rs
+	}
+	return dc, nil
+}
+
+func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
+	if dc.TLS || dc.AdvancedLayer != "" {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard can't use tls or advLayer"}
+	}
+	if dc.Network == "" {
+		dc.Network = "udp"
+	}
+
+	conf, err := getConfFromExtra(dc.Extra, dc.GetAddrStrForListenOrDial())
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conf.uapiString(); err != nil {
+		return nil, err
+	}
+
+	return &Client{conf: conf}, nil
+}
+
+// wireguard 的 设备 与 网络栈 在 第一次 使用时 才 建立.
+type Client struct {
+	proxy.Base
+
+	conf *Conf
+
+	mu   sync.Mutex
+	dev  *device.Device
+	tnet *netTun
+}
+
+func (*Client) Name() string { return Name }
+
+func (*Client) GetCreator() proxy.ClientCreator {
+	return ClientCreator{}
+}
+
+// true
+func (*Client) SelfDial() bool { return true }
+
+func (c *Client) getNet() (*netTun, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tnet != nil {
+		return c.tnet, nil
+	}
+
+	uapi, err := c.conf.uapiString()
+	if err != nil {
+		return nil, err
+	}
+
+	tnet, err := newNetTun(c.conf.Address, c.conf.MTU)
+	if err != nil {
+		return nil, err
+	}
+
+	dev := device.NewDevice(tnet, newBind(c.conf.Reserved), newLogger(c.GetTag()))
+	if err = dev.IpcSet(uapi); err != nil {
+		dev.Close()
+		return nil, utils.ErrInErr{ErrDesc: "wireguard IpcSet failed", ErrDetail: err}
+	}
+	if err = dev.Up(); err != nil {
+		dev.Close()
+		return nil, utils.ErrInErr{ErrDesc: "wireguard device up failed", ErrDetail: err}
+	}
+
+	c.dev = dev
+	c.tnet = tnet
+	return tnet, nil
+}
+
+// 关闭 wireguard 设备
+func (c *Client) Stop() {
+	c.mu.Lock()
+	if c.dev != nil {
+		c.dev.Close() //会 关闭 tnet
+		c.dev = nil
+		c.tnet = nil
+	}
+	c.mu.Unlock()
+
+	c.Base.Stop()
+}
+
+// underlay 会被 忽略, 在 wireguard 隧道中 拨号 target
+func (c *Client) Handshake(_ net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	tnet, err := c.getNet()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), netLayer.DefaultDialTimeout)
+	defer cancel()
+
+	conn, err := tnet.dialTCP(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if len(firstPayload) > 0 {
+		_, err = conn.Write(firstPayload)
+		utils.PutBytes(firstPayload)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// underlay 会被 忽略, 在 wireguard 隧道中 监听 一个 udp 端口, 可以 发往 任意地址.
+func (c *Client) EstablishUDPChannel(_ net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	tnet, err := c.getNet()
+	if err != nil {
+		return nil, err
+	}
+
+	ua, err := tnet.resolveUDP(target)
+	if err != nil {
+		return nil, err
+	}
+
+	uc, err := tnet.listenUDP(0, ua.IP.To4() == nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mc := &udpMsgConn{UDPConn: uc, tnet: tnet}
+	if len(firstPayload) > 0 {
+		if _, err = uc.WriteTo(firstPayload, ua); err != nil {
+			uc.Close()
+			return nil, err
+		}
+	}
+	return mc, nil
+}
+
+// implements netLayer.MsgConn
+type udpMsgConn struct {
+	*gonet.UDPConn
+	tnet *netTun
+}
+
+func (mc *udpMsgConn) ReadMsg() ([]byte, netLayer.Addr, error) {
+	bs := utils.GetPacket()
+	n, ad, err := mc.ReadFrom(bs)
+	if err != nil {
+		return nil, netLayer.Addr{}, err
+	}
+	ua, _ := ad.(*net.UDPAddr)
+	if ua == nil {
+		return bs[:n], netLayer.Addr{}, nil
+	}
+	return bs[:n], netLayer.NewAddrFromUDPAddr(ua), nil
+}
+
+func (mc *udpMsgConn) WriteMsg(p []byte, peera netLayer.Addr) error {
+	ua, err := mc.tnet.resolveUDP(peera)
+	if err != nil {
+		return err
+	}
+	_, err = mc.WriteTo(p, ua)
+	return err
+}
+
+func (mc *udpMsgConn) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return mc.Close()
+}
+
+func (mc *udpMsgConn) Fullcone() bool {
+	return false
+}
+
+func splitComma(str string) (ss []string) {
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ss = append(ss, s)
+		}
+	}
+	return
+}
@@ -0,0 +1,268 @@
+package wireguard
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+/*
+netTun 是 一个 用户态的 tun.Device, 交给 wireguard-go 的 device 使用.
+
+wireguard-go 自带的 tun/netstack 依赖的 gvisor 版本 与 netLayer/tun 所用的 不一致, 无法 一起编译, 所以 这里 按 同样的思路 用 本项目 所用的 gvisor 实现了一遍.
+
+wireguard 解密后的 ip包 通过 Write 注入 gvisor 网络栈; 网络栈 发出的 ip包 通过 WriteNotify 放入 incomingPacket, 再由 wireguard 的 Read 取走 并 加密发送.
+我们 在 网络栈 上 拨号 tcp/udp, 就相当于 通过 wireguard 隧道 拨号, 不需要 内核的 tun设备, 也不需要 root 权限.
+*/
+type netTun struct {
+	ep             *channel.Endpoint
+	stack          *stack.Stack
+	events         chan tun.Event
+	incomingPacket chan *bufferv2.View
+	done           chan struct{}
+	mtu            int
+
+	hasV4, hasV6 bool
+
+	closeMu sync.RWMutex //Close 之后 wireguard 可能 还会 调用 Write, 此时 网络栈 已经 移除了 网卡, 不能 再 注入.
+	closed  bool
+}
+
+const nicID = 1
+
+func newNetTun(localAddresses []netip.Addr, mtu int) (*netTun, error) {
+	t := &netTun{
+		ep: channel.New(1024, uint32(mtu), ""),
+		stack: stack.New(stack.Options{
+			NetworkProtocols: []stack.NetworkProtocolFactory{
+				ipv4.NewProtocol,
+				ipv6.NewProtocol,
+			},
+			TransportProtocols: []stack.TransportProtocolFactory{
+				tcp.NewProtocol,
+				udp.NewProtocol,
+				icmp.NewProtocol4,
+				icmp.NewProtocol6,
+			},
+			HandleLocal: true,
+		}),
+		events:         make(chan tun.Event, 10),
+		incomingPacket: make(chan *bufferv2.View),
+		done:           make(chan struct{}),
+		mtu:            mtu,
+	}
+	t.ep.AddNotify(t)
+
+	if ex := t.stack.CreateNIC(nicID, t.ep); ex != nil {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard CreateNIC failed", Data: ex.String()}
+	}
+
+	for _, ip := range localAddresses {
+		pa := tcpip.ProtocolAddress{
+			AddressWithPrefix: tcpip.Address(ip.AsSlice()).WithPrefix(),
+		}
+		if ip.Is4() {
+			pa.Protocol = ipv4.ProtocolNumber
+			t.hasV4 = true
+		} else {
+			pa.Protocol = ipv6.ProtocolNumber
+			t.hasV6 = true
+		}
+		if ex := t.stack.AddProtocolAddress(nicID, pa, stack.AddressProperties{}); ex != nil {
+			return nil, utils.ErrInErr{ErrDesc: "wireguard AddProtocolAddress failed", Data: ex.String()}
+		}
+	}
+	if t.hasV4 {
+		t.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: nicID})
+	}
+	if t.hasV6 {
+		t.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: nicID})
+	}
+
+	t.events <- tun.EventUp
+	return t, nil
+}
+
+func (t *netTun) Name() (string, error) {
+	return Name, nil
+}
+
+func (t *netTun) File() *os.File {
+	return nil
+}
+
+func (t *netTun) Events() chan tun.Event {
+	return t.events
+}
+
+func (t *netTun) MTU() (int, error) {
+	return t.mtu, nil
+}
+
+func (t *netTun) Flush() error {
+	return nil
+}
+
+// 读取 网络栈 发出的 ip包
+func (t *netTun) Read(buf []byte, offset int) (int, error) {
+	var view *bufferv2.View
+	select {
+	case view = <-t.incomingPacket:
+	case <-t.done:
+		return 0, os.ErrClosed
+	}
+	n, err := view.Read(buf[offset:])
+	view.Release()
+	return n, err
+}
+
+// 把 wireguard 解密后的 ip包 注入 网络栈
+func (t *netTun) Write(buf []byte, offset int) (int, error) {
+	packet := buf[offset:]
+	if len(packet) == 0 {
+		return 0, nil
+	}
+
+	t.closeMu.RLock()
+	defer t.closeMu.RUnlock()
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: bufferv2.MakeWithData(packet)})
+	switch packet[0] >> 4 {
+	case 4:
+		t.ep.InjectInbound(header.IPv4ProtocolNumber, pkb)
+	case 6:
+		t.ep.InjectInbound(header.IPv6ProtocolNumber, pkb)
+	}
+	pkb.DecRef()
+
+	return len(buf), nil
+}
+
+// implements channel.Notification
+func (t *netTun) WriteNotify() {
+	pkt := t.ep.Read()
+	if pkt.IsNil() {
+		return
+	}
+
+	view := pkt.ToView()
+	pkt.DecRef()
+
+	select {
+	case t.incomingPacket <- view:
+	case <-t.done:
+		view.Release()
+	}
+}
+
+func (t *netTun) Close() error {
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	t.stack.RemoveNIC(nicID)
+
+	close(t.events)
+
+	t.ep.Close()
+
+	close(t.done)
+	return nil
+}
+
+// 若 addr 为 域名, 则 会 先在本地 解析, 并 优先使用 隧道 支持的 ip版本.
+func (t *netTun) fullAddr(addr netLayer.Addr) (fa tcpip.FullAddress, pn tcpip.NetworkProtocolNumber, err error) {
+	ip := addr.IP
+	if len(ip) == 0 {
+		var ips []net.IP
+		ips, err = net.LookupIP(addr.Name)
+		if err != nil {
+			return
+		}
+		for _, theIP := range ips {
+			if theIP.To4() != nil {
+				if t.hasV4 {
+					ip = theIP
+					break
+				}
+			} else if t.hasV6 && ip == nil {
+				ip = theIP
+			}
+		}
+		if ip == nil {
+			err = utils.ErrInErr{ErrDesc: "wireguard no usable ip for domain", Data: addr.Name}
+			return
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		fa.Addr = tcpip.Address(ip4)
+		pn = ipv4.ProtocolNumber
+	} else {
+		fa.Addr = tcpip.Address(ip.To16())
+		pn = ipv6.ProtocolNumber
+	}
+	fa.NIC = nicID
+	fa.Port = uint16(addr.Port)
+	return
+}
+
+func (t *netTun) dialTCP(ctx context.Context, addr netLayer.Addr) (net.Conn, error) {
+	fa, pn, err := t.fullAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := gonet.DialContextTCP(ctx, t.stack, fa, pn)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// 返回的 UDPConn 没有 连接 到 任何地址, 可以 向 任意地址 发送, 以便 实现 fullcone.
+func (t *netTun) listenUDP(port int, v6 bool) (*gonet.UDPConn, error) {
+	pn := ipv4.ProtocolNumber
+	if v6 {
+		pn = ipv6.ProtocolNumber
+	}
+	return gonet.DialUDP(t.stack, &tcpip.FullAddress{NIC: nicID, Port: uint16(port)}, nil, pn)
+}
+
+func (t *netTun) listenTCP(port int, v6 bool) (*gonet.TCPListener, error) {
+	pn := ipv4.ProtocolNumber
+	if v6 {
+		pn = ipv6.ProtocolNumber
+	}
+	return gonet.ListenTCP(t.stack, tcpip.FullAddress{NIC: nicID, Port: uint16(port)}, pn)
+}
+
+func (t *netTun) resolveUDP(addr netLayer.Addr) (*net.UDPAddr, error) {
+	fa, _, err := t.fullAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: net.IP(fa.Addr), Port: int(fa.Port)}, nil
+}
@@ -0,0 +1,295 @@
+/*
+Package wireguard implements a wireguard proxy.Client with a userspace network stack.
+
+wireguard 只有 客户端, 用于 把 流量 通过 wireguard 隧道 发往 某个 wireguard 节点 (比如 warp), 可以 用于 任何 inbound 的 路由.
+
+wireguard 协议本身 由 wireguard-go 实现, 而 隧道 内的 tcp/udp 则 由 gvisor 网络栈 在 进程内 处理, 见 netstack.go;
+所以 不需要 创建 内核的 网卡, 也不需要 root 权限. vs 不会 为 wireguard 拨号, 它 自己 监听 一个 udp 端口 与 对端 通信.
+
+# Config
+
+	[[dial]]
+	protocol = "wireguard"
+	host = "engage.cloudflareclient.com"  # 对端 的 地址, 即 wg 配置中 Peer 的 Endpoint
+	port = 2408
+	extra = { wg_privateKey = "base64", wg_address = ["172.16.0.2/32", "fd01:5ca1:ab1e::2/128"], wg_publicKey = "base64" }
+
+extra 中 可配置的项:
+
+	wg_privateKey   本地 私钥, base64, 必须给出
+	wg_address      本地 在 隧道 中 的 地址, 字符串 或 字符串数组, 可以 带 前缀长度, 必须给出
+	wg_mtu          默认 1420
+	wg_listenPort   本地 监听的 udp 端口, 默认 随机
+	wg_reserved     3个 整数, 会被 写入 每个 wireguard 包 的 第 1~3 字节 (即 协议中 的 保留字段), warp 用到了这个.
+	wg_publicKey, wg_preSharedKey, wg_allowedIPs, wg_keepAlive
+	                 对端 的 公钥, 预共享密钥, 允许的ip (默认 0.0.0.0/0 与 ::/0), 持久保活 的 秒数.
+	wg_peers        多个对端 时 使用, 为 数组, 每一项 可配置 publicKey, preSharedKey, endpoint, allowedIPs, keepAlive;
+	                 给出 wg_peers 时 上面 的 单个对端 的 配置 与 host/port 都 不再使用.
+*/
+package wireguard
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const Name = "wireguard"
+
+const defaultMTU = 1420
+
+type PeerConf struct {
+	PublicKey    string
+	PreSharedKey string
+	Endpoint     string
+	AllowedIPs   []string
+	KeepAlive    int
+}
+
+type Conf struct {
+	PrivateKey string
+	Address    []netip.Addr
+	MTU        int
+	ListenPort int
+	Reserved   []byte
+	Peers      []PeerConf
+}
+
+// endpoint 为 dial 配置中 host:port, 只在 没有 wg_peers 时 使用.
+func getConfFromExtra(extra map[string]any, endpoint string) (*Conf, error) {
+	c := &Conf{MTU: defaultMTU}
+
+	c.PrivateKey, _ = extra["wg_privateKey"].(string)
+	if c.PrivateKey == "" {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard wg_privateKey not given"}
+	}
+
+	for _, str := range anyToStrSlice(extra["wg_address"]) {
+		addr, err := parseAddress(str)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "wireguard wg_address invalid", ErrDetail: err, Data: str}
+		}
+		c.Address = append(c.Address, addr)
+	}
+	if len(c.Address) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard wg_address not given"}
+	}
+
+	if thing := extra["wg_mtu"]; thing != nil {
+		if mtu, ok := utils.AnyToInt64(thing); ok && mtu > 0 {
+			c.MTU = int(mtu)
+		}
+	}
+	if thing := extra["wg_listenPort"]; thing != nil {
+		if port, ok := utils.AnyToInt64(thing); ok && port > 0 && port < 65536 {
+			c.ListenPort = int(port)
+		}
+	}
+	if thing := extra["wg_reserved"]; thing != nil {
+		rs, ok := utils.AnyToUInt16Array(thing)
+		if !ok || len(rs) != 3 {
+			return nil, utils.ErrInErr{ErrDesc: "wireguard wg_reserved should be 3 numbers", Data: thing}
+		}
+		c.Reserved = []byte{byte(rs[0]), byte(rs[1]), byte(rs[2])}
+	}
+
+	if things, ok := extra["wg_peers"].([]map[string]any); ok {
+		for _, m := range things {
+			c.Peers = append(c.Peers, getPeerConf(m, "", ""))
+		}
+	} else if things, ok := extra["wg_peers"].([]any); ok {
+		for _, thing := range things {
+			if m, ok := thing.(map[string]any); ok {
+				c.Peers = append(c.Peers, getPeerConf(m, "", ""))
+			}
+		}
+	} else {
+		c.Peers = append(c.Peers, getPeerConf(extra, "wg_", endpoint))
+	}
+
+	for _, p := range c.Peers {
+		if p.PublicKey == "" {
+			return nil, utils.ErrInErr{ErrDesc: "wireguard peer publicKey not given"}
+		}
+	}
+	return c, nil
+}
+
+// prefix 为 "wg_" 时 从 extra 中 读取 单个对端 的 配置, 此时 key 首字母 大写, 如 wg_publicKey
+func getPeerConf(m map[string]any, prefix, endpoint string) (p PeerConf) {
+	key := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + strings.ToLower(k[:1]) + k[1:]
+	}
+
+	p.PublicKey, _ = m[key("publicKey")].(string)
+	p.PreSharedKey, _ = m[key("preSharedKey")].(string)
+	p.Endpoint, _ = m[key("endpoint")].(string)
+	if p.Endpoint == "" {
+		p.Endpoint = endpoint
+	}
+	p.AllowedIPs = anyToStrSlice(m[key("allowedIPs")])
+	if len(p.AllowedIPs) == 0 {
+		p.AllowedIPs = []string{"0.0.0.0/0", "::/0"}
+	}
+	if thing := m[key("keepAlive")]; thing != nil {
+		if ka, ok := utils.AnyToInt64(thing); ok && ka > 0 {
+			p.KeepAlive = int(ka)
+		}
+	}
+	return
+}
+
+func anyToStrSlice(thing any) (ss []string) {
+	switch v := thing.(type) {
+	case string:
+		if v != "" {
+			ss = append(ss, v)
+		}
+	case []string:
+		ss = v
+	case []any:
+		for _, a := range v {
+			if str, ok := a.(string); ok {
+				ss = append(ss, str)
+			}
+		}
+	}
+	return
+}
+
+// 可以是 "10.0.0.2" 或 "10.0.0.2/32"
+func parseAddress(str string) (netip.Addr, error) {
+	if strings.Contains(str, "/") {
+		p, err := netip.ParsePrefix(str)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		return p.Addr(), nil
+	}
+	return netip.ParseAddr(str)
+}
+
+// base64 的 key 转为 wireguard uapi 所用的 hex
+func keyToHex(k string) (string, error) {
+	bs, err := base64.StdEncoding.DecodeString(k)
+	if err != nil {
+		return "", err
+	}
+	if len(bs) != device.NoisePublicKeySize {
+		return "", utils.ErrInErr{ErrDesc: "wireguard key length wrong", ErrDetail: utils.ErrInvalidData, Data: len(bs)}
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+// 生成 wireguard-go 的 IpcSet 所用的 配置, 见 https://www.wireguard.com/xplatform/#configuration-protocol
+func (c *Conf) uapiString() (string, error) {
+	var sb strings.Builder
+
+	k, err := keyToHex(c.PrivateKey)
+	if err != nil {
+		return "", utils.ErrInErr{ErrDesc: "wireguard wg_privateKey invalid", ErrDetail: err}
+	}
+	sb.WriteString("private_key=" + k + "\n")
+	if c.ListenPort > 0 {
+		sb.WriteString("listen_port=" + strconv.Itoa(c.ListenPort) + "\n")
+	}
+
+	for _, p := range c.Peers {
+		k, err = keyToHex(p.PublicKey)
+		if err != nil {
+			return "", utils.ErrInErr{ErrDesc: "wireguard peer publicKey invalid", ErrDetail: err}
+		}
+		sb.WriteString("public_key=" + k + "\n")
+
+		if p.PreSharedKey != "" {
+			k, err = keyToHex(p.PreSharedKey)
+			if err != nil {
+				return "", utils.ErrInErr{ErrDesc: "wireguard peer preSharedKey invalid", ErrDetail: err}
+			}
+			sb.WriteString("preshared_key=" + k + "\n")
+		}
+
+		if p.Endpoint != "" {
+			//wireguard-go 只接受 ip:port
+			ua, err := net.ResolveUDPAddr("udp", p.Endpoint)
+			if err != nil {
+				return "", utils.ErrInErr{ErrDesc: "wireguard resolve peer endpoint failed", ErrDetail: err, Data: p.Endpoint}
+			}
+			sb.WriteString("endpoint=" + ua.String() + "\n")
+		}
+		if p.KeepAlive > 0 {
+			sb.WriteString("persistent_keepalive_interval=" + strconv.Itoa(p.KeepAlive) + "\n")
+		}
+		for _, ip := range p.AllowedIPs {
+			sb.WriteString("allowed_ip=" + ip + "\n")
+		}
+	}
+	return sb.String(), nil
+}
+
+// 把 reserved 写入 发出的 每个包 的 第 1~3 字节, 并 在 收到的包 中 清零, 否则 wireguard-go 会 认为 包 无效.
+type reservedBind struct {
+	conn.Bind
+	reserved []byte
+}
+
+func (b *reservedBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return fns, actualPort, err
+	}
+	for i, fn := range fns {
+		fn := fn
+		fns[i] = func(bs []byte) (n int, ep conn.Endpoint, err error) {
+			n, ep, err = fn(bs)
+			if n > 3 {
+				bs[1], bs[2], bs[3] = 0, 0, 0
+			}
+			return
+		}
+	}
+	return fns, actualPort, nil
+}
+
+func (b *reservedBind) Send(bs []byte, ep conn.Endpoint) error {
+	if len(bs) > 3 {
+		copy(bs[1:4], b.reserved)
+	}
+	return b.Bind.Send(bs, ep)
+}
+
+func newBind(reserved []byte) conn.Bind {
+	b := conn.NewDefaultBind()
+	if len(reserved) == 0 {
+		return b
+	}
+	return &reservedBind{Bind: b, reserved: reserved}
+}
+
+// 把 wireguard-go 的日志 转到 utils 的日志 中
+func newLogger(tag string) *device.Logger {
+	return &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			if ce := utils.CanLogDebug("wireguard"); ce != nil {
+				ce.Write(zap.String("tag", tag), zap.String("msg", fmt.Sprintf(format, args...)))
+			}
+		},
+		Errorf: func(format string, args ...any) {
+			if ce := utils.CanLogErr("wireguard"); ce != nil {
+				ce.Write(zap.String("tag", tag), zap.String("msg", fmt.Sprintf(format, args...)))
+			}
+		},
+	}
+}
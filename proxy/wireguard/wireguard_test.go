@@ -0,0 +1,164 @@
+package wireguard
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.org/x/crypto/curve25519"
+)
+
+func init() {
+	utils.InitLog("")
+}
+
+// 对 ln 接受的 每个 连接 原样 写回 读到的 数据, ln 关闭 后 停止
+func serveEcho(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(c, c)
+			c.Close()
+		}()
+	}
+}
+
+func genKeyPair(t *testing.T) (priv, pub string) {
+	var k [32]byte
+	if _, err := rand.Read(k[:]); err != nil {
+		t.Fatal(err)
+	}
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+
+	p, err := curve25519.X25519(k[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(k[:]), base64.StdEncoding.EncodeToString(p)
+}
+
+func newPeer(t *testing.T, priv, peerPub, addr, peerAddr string, port, peerPort int) *Client {
+	c, err := proxy.NewClient(&proxy.DialConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: Name,
+			Host:     "127.0.0.1",
+			Port:     peerPort,
+			Extra: map[string]any{
+				"wg_privateKey": priv,
+				"wg_publicKey":  peerPub,
+				"wg_address":    addr + "/32",
+				"wg_allowedIPs": []any{peerAddr + "/32"},
+				"wg_listenPort": port,
+				"wg_reserved":   []any{int64(1), int64(2), int64(3)},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Stop)
+	return c.(*Client)
+}
+
+// 两个 进程内 的 wireguard 节点 互为对端, a 通过 隧道 访问 b 的 网络栈 上 监听的 tcp 与 udp 端口.
+func TestLoopback(t *testing.T) {
+	privA, pubA := genKeyPair(t)
+	privB, pubB := genKeyPair(t)
+	portA := netLayer.RandPort(true, true, 0)
+	portB := netLayer.RandPort(true, true, 0)
+
+	a := newPeer(t, privA, pubB, "10.0.0.1", "10.0.0.2", portA, portB)
+	b := newPeer(t, privB, pubA, "10.0.0.2", "10.0.0.1", portB, portA)
+
+	tnetB, err := b.getNet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tnetB.listenTCP(80, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+
+	uc, err := tnetB.listenUDP(53, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := uc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			uc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	tcpTarget := netLayer.Addr{Network: "tcp", IP: net.IPv4(10, 0, 0, 2), Port: 80}
+
+	rw, err := a.Handshake(nil, []byte("hello"), tcpTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	go rw.Write(data)
+
+	rw.(net.Conn).SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len("hello")+len(data))
+	if _, err = io.ReadFull(rw, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append([]byte("hello"), data...)) {
+		t.Fatal("tcp echo data not equal")
+	}
+
+	udpTarget := netLayer.Addr{Network: "udp", IP: net.IPv4(10, 0, 0, 2), Port: 53}
+
+	mc, err := a.EstablishUDPChannel(nil, []byte("first"), udpTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			if err = mc.WriteMsg([]byte("msg"+strconv.Itoa(i)), udpTarget); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		bs, raddr, err := mc.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "first"
+		if i > 0 {
+			want = "msg" + strconv.Itoa(i)
+		}
+		if string(bs) != want {
+			t.Fatal("udp echo data not equal", string(bs), want)
+		}
+		if raddr.String() != udpTarget.String() {
+			t.Fatal("udp echo addr wrong", raddr.String())
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package v2ray_simple_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/pires/go-proxyproto"
+)
+
+// 客户端 发送 带 PROXY 头 的 udp 包 给 xver=2 的 dokodemo, 再 经 xver=2 的 direct 发往 目标,
+// 目标 收到的 头中 源地址 应为 客户端 在 头中 声明的 地址.
+func TestPROXYProtocolUDP(t *testing.T) {
+	if utils.ZapLogger == nil {
+		utils.InitLog("")
+	}
+
+	const confFormatStr = `
+[[listen]]
+protocol = "dokodemo"
+network = "udp"
+host = "127.0.0.1"
+port = %s
+xver = 2
+target = "udp://127.0.0.1:%d"
+
+[[dial]]
+protocol = "direct"
+xver = 2
+`
+
+	targetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targetConn.Close()
+
+	listenPort := netLayer.RandPortStr(false, true)
+
+	conf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(confFormatStr, listenPort, targetConn.LocalAddr().(*net.UDPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := proxy.NewServer(conf.Listen[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := proxy.NewClient(conf.Dial[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := v2ray_simple.ListenSer(server, client, nil, nil)
+	if c == nil {
+		t.Fatal("listen failed")
+	}
+	defer c.Close()
+
+	conn, err := net.Dial("udp", "127.0.0.1:"+listenPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	realSrc := netLayer.Addr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	h, _ := netLayer.NewPROXYHeader(2, "udp", realSrc, netLayer.Addr{IP: net.ParseIP("127.0.0.1"), Port: 1}, nil)
+	if _, err = conn.Write(append(h, []byte("hello")...)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	targetConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := targetConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, hl, err := netLayer.ReadPROXYHeaderFromPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SourceAddr.String() != "1.2.3.4:1234" {
+		t.Fatal("source wrong", got.SourceAddr)
+	}
+	if string(buf[hl:n]) != "hello" {
+		t.Fatal("payload wrong", string(buf[hl:n]))
+	}
+	tlvs, _ := got.TLVs()
+	if len(tlvs) == 0 {
+		t.Fatal("should have unique id tlv")
+	}
+}
+
+// tun/tproxy 这种 自监听 的 inbound 不经过 回落, 拨号时 应 使用 dial 配置的 xver 发送 PROXY 头.
+func TestPROXYProtocolSelfListen(t *testing.T) {
+	//上一个测试 的 监听 可能 还在 写日志, 不要 重新 初始化
+	if utils.ZapLogger == nil {
+		utils.InitLog("")
+	}
+
+	conf, err := proxy.LoadStandardConfFromTomlStr(`
+[[dial]]
+protocol = "direct"
+xver = 2
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := proxy.NewClient(conf.Dial[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	s := &fakeSelfListenServer{}
+	closer := v2ray_simple.ListenSer(s, client, nil, nil)
+	if closer == nil || s.tcpFunc == nil {
+		t.Fatal("listen failed")
+	}
+
+	//tun/tproxy 拿到的 连接
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	userConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer userConn.Close()
+	inConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta := target.Addr().(*net.TCPAddr)
+	go s.tcpFunc(netLayer.TCPRequestInfo{Conn: inConn, Target: netLayer.Addr{Network: "tcp", IP: ta.IP, Port: ta.Port}})
+
+	if _, err = userConn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	tc, err := target.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	tc.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	br := bufio.NewReader(tc)
+	h, err := proxyproto.Read(br)
+	if err != nil {
+		t.Fatal("target should get PROXY header", err)
+	}
+	if h.SourceAddr.String() != userConn.LocalAddr().String() {
+		t.Fatal("source wrong", h.SourceAddr, userConn.LocalAddr())
+	}
+	payload := make([]byte, 5)
+	if _, err = io.ReadFull(br, payload); err != nil || string(payload) != "hello" {
+		t.Fatal("payload wrong", string(payload), err)
+	}
+}
@@ -0,0 +1,158 @@
+package v2ray_simple_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/reverse"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// bridge 通过 vless 连接 portal, 然后 portal 的 dokodemo 收到的 连接 经 bridge 发往 回显服务器
+func TestReverse(t *testing.T) {
+	if utils.ZapLogger == nil {
+		utils.InitLog("")
+	}
+
+	const bridgeConfFormatStr = `
+[[listen]]
+protocol = "bridge"
+tag = "bridge"
+host = "reverse.internal"
+extra = { connections = 2 }
+
+[[dial]]
+protocol = "direct"
+
+[[dial]]
+protocol = "vless"
+tag = "to_portal"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+
+[[route]]
+fromTag = ["bridge"]
+domain = ["full:reverse.internal"]
+toTag = "to_portal"
+`
+
+	const portalConfFormatStr = `
+[[listen]]
+protocol = "vless"
+tag = "tunnel_in"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+
+[[listen]]
+protocol = "dokodemo"
+tag = "public"
+host = "127.0.0.1"
+port = %s
+target = "tcp://127.0.0.1:%s"
+
+[[dial]]
+protocol = "direct"
+
+[[dial]]
+protocol = "portal"
+tag = "portal"
+host = "reverse.internal"
+
+[[route]]
+domain = ["full:reverse.internal"]
+toTag = "portal"
+
+[[route]]
+fromTag = ["public"]
+toTag = "portal"
+`
+
+	echoLn := listenEcho(t)
+	defer echoLn.Close()
+	echoPort := fmt.Sprint(echoLn.Addr().(*net.TCPAddr).Port)
+
+	tunnelPort := netLayer.RandPortStr(true, false)
+	publicPort := netLayer.RandPortStr(true, false)
+
+	load := func(str string) (servers []proxy.Server, defaultClient proxy.Client, env *proxy.RoutingEnv) {
+		conf, err := proxy.LoadStandardConfFromTomlStr(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re := proxy.LoadEnvFromStandardConf(&conf, "")
+		env = &re
+		for _, dc := range conf.Dial {
+			c, err := proxy.NewClient(dc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if defaultClient == nil {
+				defaultClient = c
+			}
+			if tag := c.GetTag(); tag != "" {
+				env.SetClient(tag, c)
+			}
+		}
+		for _, lc := range conf.Listen {
+			s, err := proxy.NewServer(lc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			servers = append(servers, s)
+		}
+		return
+	}
+
+	portalServers, portalDefault, portalEnv := load(fmt.Sprintf(portalConfFormatStr, tunnelPort, publicPort, echoPort))
+	for _, s := range portalServers {
+		c := v2ray_simple.ListenSer(s, portalDefault, portalEnv, nil)
+		if c == nil {
+			t.Fatal("portal listen failed")
+		}
+		defer c.Close()
+	}
+
+	bridgeServers, bridgeDefault, bridgeEnv := load(fmt.Sprintf(bridgeConfFormatStr, tunnelPort))
+	c := v2ray_simple.ListenSer(bridgeServers[0], bridgeDefault, bridgeEnv, nil)
+	if c == nil {
+		t.Fatal("bridge listen failed")
+	}
+	defer c.Close()
+
+	portal := portalEnv.GetClient("portal").(*reverse.Portal)
+	for i := 0; portal.BridgeCount() < 2; i++ {
+		if i > 50 {
+			t.Fatal("bridge not connected", portal.BridgeCount())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+publicPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		msg := []byte(fmt.Sprint("hello reverse ", i))
+		if _, err = conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(msg) {
+			t.Fatal("echo not equal", string(got))
+		}
+		conn.Close()
+	}
+}
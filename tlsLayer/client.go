@@ -23,6 +23,10 @@ type Client struct {
 
 	shadowTlsPassword string
 	utlsFingerprint   utls.ClientHelloID
+
+	sessionCache *sessionCache
+
+	ech *echClientState
 }
 
 func NewClient(conf Conf) *Client {
@@ -33,6 +37,33 @@ func NewClient(conf Conf) *Client {
 
 	c.alpnList = conf.AlpnList
 
+	if conf.SessionCache {
+		c.sessionCache = newSessionCache(0)
+	}
+
+	if len(conf.ECHConfigList) > 0 || conf.ECHFromDNS {
+		switch conf.Tls_type {
+		case UTls_t:
+			//utls 的指纹 与 ech 不兼容, 此时我们 使用 golang 的 tls
+			if ce := utils.CanLogWarn("ech is not supported with utls, will use golang tls instead"); ce != nil {
+				ce.Write(zap.String("host", conf.Host))
+			}
+			conf.Tls_type = Tls_t
+			c.tlsType = Tls_t
+		case ShadowTls_t, ShadowTls2_t:
+			if ce := utils.CanLogWarn("ech is not supported with shadowTls, ignored"); ce != nil {
+				ce.Write(zap.String("host", conf.Host))
+			}
+		}
+		if conf.Tls_type == Tls_t {
+			c.ech = &echClientState{
+				host:    conf.Host,
+				fromDNS: conf.ECHFromDNS && len(conf.ECHConfigList) == 0,
+				static:  conf.ECHConfigList,
+			}
+		}
+	}
+
 	switch conf.Tls_type {
 	case ShadowTls2_t:
 		fallthrough
@@ -105,6 +136,10 @@ func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
 			c.utlsFingerprint = utls.HelloChrome_Auto
 		}
 
+		if c.sessionCache != nil {
+			configCopy.ClientSessionCache = addrKeyedUSessionCache{c: c.sessionCache.utlsCache, addr: remoteAddrStr(underlay)}
+		}
+
 		utlsConn := utls.UClient(underlay, &configCopy, c.utlsFingerprint)
 		err = utlsConn.Handshake()
 		if err != nil {
@@ -116,9 +151,36 @@ func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
 			tlsType: UTls_t,
 		}
 	case Tls_t:
-		officialConn := tls.Client(underlay, c.tlsConfig)
+		config := c.tlsConfig
+		if c.sessionCache != nil || c.ech != nil {
+			config = config.Clone()
+		}
+		if c.sessionCache != nil {
+			config.ClientSessionCache = addrKeyedSessionCache{c: c.sessionCache.tlsCache, addr: remoteAddrStr(underlay)}
+		}
+		if c.ech != nil {
+			if !ECHSupported {
+				err = utils.ErrInErr{ErrDesc: "ech is configured, but this build does not support it", ErrDetail: utils.ErrUnImplemented}
+				return
+			}
+			var list []byte
+			list, err = c.ech.getConfigList()
+			if err != nil {
+				return
+			}
+			//ech 只能用于 tls1.3
+			config.MinVersion = tls.VersionTLS13
+			setECHClientConfig(config, list)
+		}
+
+		officialConn := tls.Client(underlay, config)
 		err = officialConn.Handshake()
 		if err != nil {
+			if c.ech != nil {
+				if retry := echRetryConfigList(err); len(retry) > 0 {
+					c.ech.storeRetry(retry)
+				}
+			}
 			return
 		}
 
@@ -161,3 +223,10 @@ func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
 
 	return
 }
+
+func remoteAddrStr(c net.Conn) string {
+	if ra := c.RemoteAddr(); ra != nil {
+		return ra.String()
+	}
+	return ""
+}
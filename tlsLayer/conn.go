@@ -1,10 +1,14 @@
 package tlsLayer
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"net"
+	"reflect"
 	"unsafe"
 
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	utls "github.com/refraction-networking/utls"
 )
 
@@ -23,6 +27,33 @@ type Conn interface {
 	GetTeeConn() *TeeConn
 	GetAlpn() string
 	GetSni() string
+	GetTlsVersion() uint16
+	GetCipherSuite() uint16
+
+	//返回 对方 发来的 证书, 以及 是否 通过了 验证
+	GetPeerCertificates() (certs []*x509.Certificate, verified bool)
+
+	//返回 tls 的底层连接, 以及 tls 内部 的 两个读缓存: input 为 已解密 但 还未被读走 的数据, rawInput 为 已从底层读到 但 还未解密 的数据.
+	// 用于 xtls vision 这种 中途 不再使用tls 而 直接读写 底层连接 的情况, 切换前 必须 先把 两个缓存 读完.
+	// 若 无法获取 则 三者 均为 nil
+	GetRawWithBuffers() (raw net.Conn, input *bytes.Reader, rawInput *bytes.Buffer)
+}
+
+// tls.Conn 与 utls.Conn 中 input 与 rawInput 字段的 偏移; 若 上游 改了 字段名或类型, 则为 0, 此时 GetRawWithBuffers 返回 nil.
+var tlsInputOffset, tlsRawInputOffset, utlsInputOffset, utlsRawInputOffset uintptr
+
+func init() {
+	tlsInputOffset, tlsRawInputOffset = getInputOffsets(reflect.TypeOf((*tls.Conn)(nil)).Elem())
+	utlsInputOffset, utlsRawInputOffset = getInputOffsets(reflect.TypeOf((*utls.Conn)(nil)).Elem())
+}
+
+func getInputOffsets(t reflect.Type) (input, rawInput uintptr) {
+	i, ok1 := t.FieldByName("input")
+	r, ok2 := t.FieldByName("rawInput")
+	if !ok1 || !ok2 || i.Type != reflect.TypeOf(bytes.Reader{}) || r.Type != reflect.TypeOf(bytes.Buffer{}) {
+		return
+	}
+	return i.Offset, r.Offset
 }
 
 type conn struct {
@@ -59,6 +90,11 @@ func (c *conn) GetTeeConn() *TeeConn {
 
 }
 
+// 发送 close_notify, 对端 会 读到 EOF. 实现 netLayer.CloseWriter
+func (c *conn) CloseWrite() error {
+	return netLayer.CloseWrite(c.Conn)
+}
+
 // return c.Conn.ConnectionState().NegotiatedProtocol
 func (c *conn) GetAlpn() string {
 
@@ -101,3 +137,82 @@ func (c *conn) GetSni() string {
 	return ""
 
 }
+
+func (c *conn) GetTlsVersion() uint16 {
+	switch c.tlsType {
+	case UTls_t:
+		cc := (*utls.Conn)(c.ptr)
+		if cc == nil {
+			return 0
+		}
+		return cc.ConnectionState().Version
+	case Tls_t:
+		cc := (*tls.Conn)(c.ptr)
+		if cc == nil {
+			return 0
+		}
+		return cc.ConnectionState().Version
+
+	}
+	return 0
+}
+
+func (c *conn) GetCipherSuite() uint16 {
+	switch c.tlsType {
+	case UTls_t:
+		cc := (*utls.Conn)(c.ptr)
+		if cc == nil {
+			return 0
+		}
+		return cc.ConnectionState().CipherSuite
+	case Tls_t:
+		cc := (*tls.Conn)(c.ptr)
+		if cc == nil {
+			return 0
+		}
+		return cc.ConnectionState().CipherSuite
+
+	}
+	return 0
+}
+
+func (c *conn) GetPeerCertificates() (certs []*x509.Certificate, verified bool) {
+	switch c.tlsType {
+	case UTls_t:
+		cc := (*utls.Conn)(c.ptr)
+		if cc == nil {
+			return
+		}
+		cs := cc.ConnectionState()
+		return cs.PeerCertificates, len(cs.VerifiedChains) > 0
+	case Tls_t:
+		cc := (*tls.Conn)(c.ptr)
+		if cc == nil {
+			return
+		}
+		cs := cc.ConnectionState()
+		return cs.PeerCertificates, len(cs.VerifiedChains) > 0
+
+	}
+	return
+}
+
+func (c *conn) GetRawWithBuffers() (raw net.Conn, input *bytes.Reader, rawInput *bytes.Buffer) {
+	if c.ptr == nil {
+		return
+	}
+	var i, r uintptr
+	switch c.tlsType {
+	case UTls_t:
+		i, r = utlsInputOffset, utlsRawInputOffset
+	case Tls_t:
+		i, r = tlsInputOffset, tlsRawInputOffset
+	}
+	if i == 0 || r == 0 {
+		return
+	}
+	raw = (*faketlsconn)(c.ptr).conn
+	input = (*bytes.Reader)(unsafe.Add(c.ptr, i))
+	rawInput = (*bytes.Buffer)(unsafe.Add(c.ptr, r))
+	return
+}
@@ -0,0 +1,160 @@
+//go:build go1.24
+
+package tlsLayer
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"os"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	echVersion = 0xfe0d
+
+	hpkeKEM_X25519_SHA256 = 0x0020
+	hpkeKDF_SHA256        = 0x0001
+	hpkeAEAD_AES128GCM    = 0x0001
+	hpkeAEAD_ChaCha20     = 0x0003
+
+	ECHKeysPEMType    = "ECH KEYS"
+	ECHConfigsPEMType = "ECH CONFIGS"
+)
+
+const ECHSupported = true
+
+/*
+GenerateECHKeyPair 生成一对 x25519 的 ECH key 和 ECHConfig, publicName 为 客户端 外层 ClientHello 所使用的 sni.
+
+keysPEM 给服务端用, 格式为 若干个 ( uint16长度 + 私钥, uint16长度 + ECHConfig );
+configListPEM 给客户端用, 内容为 ECHConfigList, 与 dns HTTPS记录中的 ech 参数 相同.
+*/
+func GenerateECHKeyPair(publicName string) (keysPEM, configListPEM []byte, err error) {
+	if publicName == "" || len(publicName) > 255 {
+		err = utils.ErrInErr{ErrDesc: "ech public name invalid", ErrDetail: utils.ErrInvalidData, Data: publicName}
+		return
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	var idbs [1]byte
+	rand.Read(idbs[:])
+
+	config := marshalECHConfig(idbs[0], priv.PublicKey().Bytes(), publicName)
+
+	var kb cryptobyte.Builder
+	kb.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(priv.Bytes())
+	})
+	kb.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(config)
+	})
+
+	var cb cryptobyte.Builder
+	cb.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(config)
+	})
+
+	keysPEM = pem.EncodeToMemory(&pem.Block{Type: ECHKeysPEMType, Bytes: kb.BytesOrPanic()})
+	configListPEM = pem.EncodeToMemory(&pem.Block{Type: ECHConfigsPEMType, Bytes: cb.BytesOrPanic()})
+	return
+}
+
+func marshalECHConfig(id uint8, pubKey []byte, publicName string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(echVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(id)
+		b.AddUint16(hpkeKEM_X25519_SHA256)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(pubKey)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(hpkeKDF_SHA256)
+			b.AddUint16(hpkeAEAD_AES128GCM)
+			b.AddUint16(hpkeKDF_SHA256)
+			b.AddUint16(hpkeAEAD_ChaCha20)
+		})
+		b.AddUint8(0) //maximum_name_length
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) //extensions
+	})
+	return b.BytesOrPanic()
+}
+
+// 从 GenerateECHKeyPair 生成的 keysPEM 格式的文件中 读取 服务端的 ECH key.
+func LoadECHKeys(fn string) (keys []tls.EncryptedClientHelloKey, err error) {
+	bs, err := os.ReadFile(utils.GetFilePath(fn))
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(bs)
+	if block == nil || block.Type != ECHKeysPEMType {
+		err = utils.ErrInErr{ErrDesc: "ech key file is not a valid '" + ECHKeysPEMType + "' pem", ErrDetail: utils.ErrInvalidData, Data: fn}
+		return
+	}
+	s := cryptobyte.String(block.Bytes)
+	for !s.Empty() {
+		var k, c cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&k) || !s.ReadUint16LengthPrefixed(&c) {
+			err = utils.ErrInErr{ErrDesc: "ech key file malformed", ErrDetail: utils.ErrInvalidData, Data: fn}
+			return nil, err
+		}
+		keys = append(keys, tls.EncryptedClientHelloKey{
+			PrivateKey:  k,
+			Config:      c,
+			SendAsRetry: true,
+		})
+	}
+	return
+}
+
+// 接受 ECHConfigList 的 base64, 或者 GenerateECHKeyPair 生成的 configListPEM 格式的文件
+func ParseECHConfigList(str string) ([]byte, error) {
+	if utils.FileExist(utils.GetFilePath(str)) {
+		bs, err := os.ReadFile(utils.GetFilePath(str))
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(bs)
+		if block == nil || block.Type != ECHConfigsPEMType {
+			return nil, utils.ErrInErr{ErrDesc: "ech config file is not a valid '" + ECHConfigsPEMType + "' pem", ErrDetail: utils.ErrInvalidData, Data: str}
+		}
+		return block.Bytes, nil
+	}
+	return decodeECHBase64(str)
+}
+
+func setECHClientConfig(c *tls.Config, echConfigList []byte) {
+	c.EncryptedClientHelloConfigList = echConfigList
+}
+
+func setECHServerKeys(c *tls.Config, keyFile string) error {
+	keys, err := LoadECHKeys(keyFile)
+	if err != nil {
+		return err
+	}
+	c.EncryptedClientHelloKeys = keys
+	return nil
+}
+
+func echAccepted(cs tls.ConnectionState) bool {
+	return cs.ECHAccepted
+}
+
+// 若服务端拒绝了我们的ECH 且 给出了新的配置, 返回该配置
+func echRetryConfigList(err error) []byte {
+	var re *tls.ECHRejectionError
+	if errors.As(err, &re) {
+		return re.RetryConfigList
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package tlsLayer
+
+import (
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// 从dns获取的 ECHConfigList 至少缓存这么久, 防止 ttl 过小 导致 每次拨号都查询
+const minECHConfigTTL = time.Minute
+
+// ECHConfigResolver 从 dns 的 HTTPS 记录中 获取 ECHConfigList, *netLayer.DNSMachine 实现了它.
+type ECHConfigResolver interface {
+	QueryECHConfig(domain string) (echConfigList []byte, ttl uint32, err error)
+}
+
+func decodeECHBase64(str string) ([]byte, error) {
+	str = strings.TrimSpace(str)
+	bs, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		bs, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(str, "="))
+	}
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "ech config list is neither a file nor valid base64", ErrDetail: err, Data: str}
+	}
+	return bs, nil
+}
+
+// 客户端的 ech 状态
+type echClientState struct {
+	host    string
+	fromDNS bool
+	static  []byte
+
+	mu       sync.Mutex
+	resolver ECHConfigResolver
+	cached   []byte
+	expire   time.Time
+}
+
+func (e *echClientState) setResolver(r ECHConfigResolver) {
+	e.mu.Lock()
+	e.resolver = r
+	e.mu.Unlock()
+}
+
+func (e *echClientState) getConfigList() ([]byte, error) {
+	if !e.fromDNS {
+		return e.static, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.cached != nil && time.Now().Before(e.expire) {
+		return e.cached, nil
+	}
+	if e.resolver == nil {
+		return nil, utils.ErrInErr{ErrDesc: "ech is set to fetch config from dns, but no dns is configured", ErrDetail: utils.ErrInvalidData, Data: e.host}
+	}
+	list, ttl, err := e.resolver.QueryECHConfig(e.host)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "Failed in querying ech config from dns", ErrDetail: err, Data: e.host}
+	}
+	e.storeLocked(list, time.Duration(ttl)*time.Second)
+
+	if ce := utils.CanLogDebug("got ech config from dns"); ce != nil {
+		ce.Write(zap.String("host", e.host), zap.Uint32("ttl", ttl))
+	}
+	return list, nil
+}
+
+// 服务端拒绝 ECH 并发来 retry config 时, 用它替换缓存
+func (e *echClientState) storeRetry(list []byte) {
+	if !e.fromDNS {
+		return
+	}
+	e.mu.Lock()
+	e.storeLocked(list, minECHConfigTTL)
+	e.mu.Unlock()
+}
+
+func (e *echClientState) storeLocked(list []byte, ttl time.Duration) {
+	if ttl < minECHConfigTTL {
+		ttl = minECHConfigTTL
+	}
+	e.cached = list
+	e.expire = time.Now().Add(ttl)
+}
+
+// 当 ech 配置为 从dns获取 时 返回 true
+func (c *Client) NeedECHResolver() bool {
+	return c.ech != nil && c.ech.fromDNS
+}
+
+func (c *Client) SetECHResolver(r ECHConfigResolver) {
+	if c.ech != nil {
+		c.ech.setResolver(r)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !go1.24
+
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+const ECHSupported = false
+
+var errECHNotSupported = errors.New("ech requires go1.24 or later")
+
+func GenerateECHKeyPair(publicName string) (keysPEM, configListPEM []byte, err error) {
+	err = errECHNotSupported
+	return
+}
+
+func ParseECHConfigList(str string) ([]byte, error) {
+	return nil, errECHNotSupported
+}
+
+func setECHClientConfig(c *tls.Config, echConfigList []byte) {}
+
+func setECHServerKeys(c *tls.Config, keyFile string) error {
+	return errECHNotSupported
+}
+
+func echAccepted(cs tls.ConnectionState) bool {
+	return false
+}
+
+func echRetryConfigList(err error) []byte {
+	return nil
+}
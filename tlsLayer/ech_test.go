@@ -0,0 +1,94 @@
+//go:build go1.24
+
+package tlsLayer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 记录服务端读到的原始数据
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (rc *recordConn) Read(p []byte) (int, error) {
+	n, err := rc.Conn.Read(p)
+	rc.buf.Write(p[:n])
+	return n, err
+}
+
+// 外层 ClientHello 的 sni 应为 public name, 而服务端 解密后 得到的是 真实的 sni
+func TestECH(t *testing.T) {
+	const publicName = "public.example.com"
+	const innerName = "inner.example.com"
+
+	keys, configs, err := GenerateECHKeyPair(publicName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFn := filepath.Join(dir, "ech.pem")
+	configFn := filepath.Join(dir, "ech_config.pem")
+	os.WriteFile(keyFn, keys, 0600)
+	os.WriteFile(configFn, configs, 0600)
+
+	list, err := ParseECHConfigList(configFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(Conf{
+		Host:       innerName,
+		ECHKeyFile: keyFn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client := NewClient(Conf{
+		Host:          innerName,
+		Insecure:      true,
+		ECHConfigList: list,
+	})
+
+	c, sc := net.Pipe()
+	defer c.Close()
+
+	rc := &recordConn{Conn: sc}
+	serverNameChan := make(chan string, 1)
+	go func() {
+		defer sc.Close()
+		tc, err := server.Handshake(rc)
+		if err != nil {
+			t.Log("server handshake failed", err)
+			serverNameChan <- ""
+			return
+		}
+		serverNameChan <- tc.(*conn).Conn.(*tls.Conn).ConnectionState().ServerName
+		tc.Write([]byte("hello"))
+	}()
+
+	tc, err := client.Handshake(c)
+	if err != nil {
+		t.Fatal("client handshake failed", err)
+	}
+	if !echAccepted(tc.(*conn).Conn.(*tls.Conn).ConnectionState()) {
+		t.Fatal("ech not accepted")
+	}
+	if sn := <-serverNameChan; sn != innerName {
+		t.Fatal("server got wrong inner sni", sn)
+	}
+
+	var cs ComSniff
+	cs.CommonDetect(rc.buf.Bytes(), true, true)
+	if cs.SniffedServerName != publicName {
+		t.Fatal("outer sni should be the public name, got", cs.SniffedServerName)
+	}
+}
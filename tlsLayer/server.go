@@ -17,6 +17,8 @@ type Server struct {
 	//用于shadowTls，使用shadowTls时 我们不使用 tlsConfig
 	serverName string
 	shadowpass string
+
+	ticketKeyManager *TicketKeyManager
 }
 
 // 如 certFile, keyFile 有一项没给出，则会自动生成随机证书
@@ -51,11 +53,32 @@ func NewServer(conf Conf) (*Server, error) {
 	} else {
 		s.tlsConfig = GetTlsConfig(true, conf)
 
+		if conf.TicketKeyFile != "" {
+			m, err := NewTicketKeyManager(conf.TicketKeyFile, conf.TicketKeyInterval, s.tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			m.Start()
+			s.ticketKeyManager = m
+		}
+
+		if conf.ECHKeyFile != "" {
+			if err := setECHServerKeys(s.tlsConfig, conf.ECHKeyFile); err != nil {
+				s.Stop()
+				return nil, err
+			}
+		}
 	}
 
 	return s, nil
 }
 
+func (s *Server) Stop() {
+	if s.ticketKeyManager != nil {
+		s.ticketKeyManager.Stop()
+	}
+}
+
 // tls时返回 tlsLayer.Conn, shadowTls1时返回原 clientConn, shadowTls2时返回 FakeAppDataConn
 func (s *Server) Handshake(clientConn net.Conn) (result net.Conn, err error) {
 
@@ -0,0 +1,202 @@
+package tlsLayer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	utls "github.com/refraction-networking/utls"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultSessionCacheCapacity = 128
+
+	DefaultTicketKeyRotateInterval = time.Hour * 24
+
+	//加密总是使用 当前周期的key, 解密时 还会接受 之前 ticketKeyHistoryLen-1 个周期的 key.
+	ticketKeyHistoryLen = 3
+)
+
+/*
+客户端的 session 缓存.
+
+golang 的tls 默认以 sni 为缓存的键，若sni为空才用地址；而我们的 同一个sni 有可能对应多个服务器（比如多个dial使用同一个域名但不同ip），
+此时缓存会相互覆盖。所以我们将 sni 和 服务端地址 一同作为键.
+*/
+type sessionCache struct {
+	tlsCache  tls.ClientSessionCache
+	utlsCache utls.ClientSessionCache
+}
+
+func newSessionCache(capacity int) *sessionCache {
+	if capacity <= 0 {
+		capacity = DefaultSessionCacheCapacity
+	}
+	return &sessionCache{
+		tlsCache:  tls.NewLRUClientSessionCache(capacity),
+		utlsCache: utls.NewLRUClientSessionCache(capacity),
+	}
+}
+
+func sessionCacheKey(key, addr string) string {
+	if addr == "" || key == addr {
+		return key
+	}
+	return key + "|" + addr
+}
+
+// implements tls.ClientSessionCache
+type addrKeyedSessionCache struct {
+	c    tls.ClientSessionCache
+	addr string
+}
+
+func (a addrKeyedSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return a.c.Get(sessionCacheKey(sessionKey, a.addr))
+}
+
+func (a addrKeyedSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	a.c.Put(sessionCacheKey(sessionKey, a.addr), cs)
+}
+
+// implements utls.ClientSessionCache
+type addrKeyedUSessionCache struct {
+	c    utls.ClientSessionCache
+	addr string
+}
+
+func (a addrKeyedUSessionCache) Get(sessionKey string) (*utls.ClientSessionState, bool) {
+	return a.c.Get(sessionCacheKey(sessionKey, a.addr))
+}
+
+func (a addrKeyedUSessionCache) Put(sessionKey string, cs *utls.ClientSessionState) {
+	a.c.Put(sessionCacheKey(sessionKey, a.addr), cs)
+}
+
+/*
+TicketKeyManager 管理服务端的 session ticket key.
+
+我们从 文件中读取一个 共享的 secret, 然后用 HMAC-SHA256(secret, 周期序号) 派生出每个周期的key.
+
+这样, 同一域名后面的多个实例 只要使用相同的文件 和 相同的 rotate 周期, 就会在同一时刻 使用相同的key, 无需相互通信 即可 接受彼此签发的 ticket。
+
+每次轮换时 都会重新读取文件, 所以 直接替换文件内容 即可 更换 secret.
+*/
+type TicketKeyManager struct {
+	fileName string
+	interval time.Duration
+
+	config *tls.Config
+
+	mu     sync.Mutex
+	secret []byte
+
+	stopOnce sync.Once
+	stopChan chan struct{}
+}
+
+// 若 interval <=0, 则使用 DefaultTicketKeyRotateInterval
+func NewTicketKeyManager(fileName string, interval time.Duration, config *tls.Config) (*TicketKeyManager, error) {
+	if interval <= 0 {
+		interval = DefaultTicketKeyRotateInterval
+	} else if interval < time.Second {
+		interval = time.Second
+	}
+	m := &TicketKeyManager{
+		fileName: fileName,
+		interval: interval,
+		config:   config,
+		stopChan: make(chan struct{}),
+	}
+	if err := m.loadSecret(); err != nil {
+		return nil, err
+	}
+	m.update(time.Now())
+	return m, nil
+}
+
+// 文件内容可以为任意格式, 我们取其 sha256 作为 secret, 不过为了安全, 内容最好是 至少32字节的随机数据.
+func (m *TicketKeyManager) loadSecret() error {
+	bs, err := os.ReadFile(utils.GetFilePath(m.fileName))
+	if err != nil {
+		return utils.ErrInErr{ErrDesc: "Failed in reading tls ticket key file", ErrDetail: err, Data: m.fileName}
+	}
+	bs = bytes.TrimSpace(bs)
+	if len(bs) == 0 {
+		return utils.ErrInErr{ErrDesc: "tls ticket key file is empty", ErrDetail: utils.ErrInvalidData, Data: m.fileName}
+	}
+	sum := sha256.Sum256(bs)
+
+	m.mu.Lock()
+	m.secret = sum[:]
+	m.mu.Unlock()
+	return nil
+}
+
+// 返回 t 所在周期 及之前周期的 key, 第一个为 当前周期的 key.
+func (m *TicketKeyManager) KeysAt(t time.Time) [][32]byte {
+	m.mu.Lock()
+	secret := m.secret
+	m.mu.Unlock()
+
+	epoch := uint64(t.Unix() / int64(m.interval/time.Second))
+
+	keys := make([][32]byte, 0, ticketKeyHistoryLen)
+	for i := uint64(0); i < ticketKeyHistoryLen && i <= epoch; i++ {
+		var epochBs [8]byte
+		binary.BigEndian.PutUint64(epochBs[:], epoch-i)
+
+		h := hmac.New(sha256.New, secret)
+		h.Write(epochBs[:])
+
+		var k [32]byte
+		copy(k[:], h.Sum(nil))
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (m *TicketKeyManager) update(t time.Time) {
+	m.config.SetSessionTicketKeys(m.KeysAt(t))
+}
+
+// non-blocking. 在每个周期的开始时 重新读取文件并更新 key.
+func (m *TicketKeyManager) Start() {
+	go func() {
+		for {
+			now := time.Now()
+			sec := int64(m.interval / time.Second)
+			next := time.Unix((now.Unix()/sec+1)*sec, 0)
+
+			select {
+			case <-m.stopChan:
+				return
+			case <-time.After(next.Sub(now)):
+			}
+
+			if err := m.loadSecret(); err != nil {
+				if ce := utils.CanLogErr("TicketKeyManager reload failed, will keep using old secret"); ce != nil {
+					ce.Write(zap.Error(err))
+				}
+			}
+			m.update(time.Now())
+
+			if ce := utils.CanLogDebug("TicketKeyManager rotated tls ticket keys"); ce != nil {
+				ce.Write(zap.String("file", m.fileName))
+			}
+		}
+	}()
+}
+
+func (m *TicketKeyManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopChan)
+	})
+}
@@ -0,0 +1,94 @@
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 两个使用相同 ticket key 文件的服务端 应能接受彼此签发的 ticket
+func TestSessionResumptionAcrossServers(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "ticket.key")
+	if err := os.WriteFile(fn, []byte("0123456789abcdef0123456789abcdef"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newServer := func() *Server {
+		s, err := NewServer(Conf{
+			Host:              "example.com",
+			TicketKeyFile:     fn,
+			TicketKeyInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s1, s2 := newServer(), newServer()
+	defer s1.Stop()
+	defer s2.Stop()
+
+	client := NewClient(Conf{
+		Host:         "example.com",
+		Insecure:     true,
+		SessionCache: true,
+	})
+
+	dial := func(s *Server) bool {
+		c, sc := net.Pipe()
+		defer c.Close()
+
+		go func() {
+			defer sc.Close()
+			tc, err := s.Handshake(sc)
+			if err != nil {
+				t.Log("server handshake failed", err)
+				return
+			}
+			tc.Write([]byte("hello"))
+		}()
+
+		tc, err := client.Handshake(c)
+		if err != nil {
+			t.Fatal("client handshake failed", err)
+		}
+
+		//tls1.3 的 ticket 是在握手后发送的, 需要读一下才能收到
+		var hello [5]byte
+		if _, err := io.ReadFull(tc, hello[:]); err != nil {
+			t.Fatal(err)
+		}
+		return tc.(*conn).Conn.(*tls.Conn).ConnectionState().DidResume
+	}
+
+	if dial(s1) {
+		t.Fatal("first handshake should not resume")
+	}
+	if !dial(s2) {
+		t.Fatal("second handshake should resume with ticket issued by another server")
+	}
+}
+
+func TestTicketKeysRotate(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "ticket.key")
+	os.WriteFile(fn, []byte("secret"), 0600)
+
+	m, err := NewTicketKeyManager(fn, time.Hour, &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1e9, 0)
+	k1 := m.KeysAt(now)
+	k2 := m.KeysAt(now.Add(time.Hour))
+
+	if len(k1) != ticketKeyHistoryLen {
+		t.Fatal("wrong key count", len(k1))
+	}
+	if k1[0] == k2[0] || k1[0] != k2[1] {
+		t.Fatal("keys not rotated correctly")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
@@ -67,6 +68,16 @@ type Conf struct {
 	RejectUnknownSni bool //only server
 	CipherSuites     []uint16
 
+	SessionCache bool //only client, 开启后 会缓存 session 以便 重连时 进行 session resumption
+
+	TicketKeyFile     string        //only server, 若给出, 则从该文件派生 session ticket key, 以便多个实例共享ticket
+	TicketKeyInterval time.Duration //only server, ticket key 的轮换周期
+
+	ECHConfigList []byte //only client, 若给出, 则使用 ECH, 外层 sni 为其中的 public name
+	ECHFromDNS    bool   //only client, 从 Host 的 dns HTTPS记录 获取 ECHConfigList
+
+	ECHKeyFile string //only server, 由 GenerateECHKeyPair 生成的 keys 文件
+
 	Extra map[string]any //用于shadowTls
 }
 
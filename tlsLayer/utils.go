@@ -67,3 +67,18 @@ func StrToCipherSuite(str string) uint16 {
 	}
 	return 0
 }
+
+// 返回 与 openssl / haproxy 相同格式 的 版本名, 如 "TLSv1.3"; 未知版本 返回 ""
+func VersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return ""
+}
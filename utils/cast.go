@@ -4,6 +4,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func StrPositive(value string) bool {
@@ -137,6 +138,19 @@ func AnyToFloat64(a any) (float64, bool) {
 	return 0, false
 }
 
+// 字符串 按 time.ParseDuration 解析, 如 "1h30m"; 数字 则视为 秒数.
+func AnyToDuration(a any) (time.Duration, bool) {
+	if str, ok := a.(string); ok {
+		if d, err := time.ParseDuration(str); err == nil {
+			return d, true
+		}
+	}
+	if f, ok := AnyToFloat64(a); ok {
+		return time.Duration(f * float64(time.Second)), true
+	}
+	return 0, false
+}
+
 func AnyToUInt16Array(a any) ([]uint16, bool) {
 	switch value := a.(type) {
 
@@ -196,6 +210,16 @@ func AnyToUInt16Array(a any) ([]uint16, bool) {
 			vv = append(vv, uint16(v))
 		}
 		return vv, true
+	case []any: //toml 解析出的 数组
+		var vv []uint16
+		for _, v := range value {
+			i, ok := AnyToInt64(v)
+			if !ok {
+				return nil, false
+			}
+			vv = append(vv, uint16(i))
+		}
+		return vv, true
 	}
 	return nil, false
 }
@@ -0,0 +1,91 @@
+package v2ray_simple
+
+import (
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+)
+
+/*
+是否 可以 为 client 的 本次 拨号 使用 预连接池 (proxy.WarmPool).
+
+lazy tls 需要 在 tls握手 时 记录 原始数据, PROXY protocol 头 与 每个 进入的连接 相关,
+而 grpc/quic 这种 mux 的 高级层 本身 就 复用 连接, 所以 这几种 情况 都 不使用 预连接池.
+
+预连接池 一直 使用 第一次 请求 时 的 拨号地址, 所以 没有 固定 地址 的 client (如 direct) 也 不使用.
+
+内层mux 是 可以 使用的, 此时 预连接 会被 用于 建立 新的 mux 会话.
+*/
+func (iics *incomingInserverConnState) canUseWarmPool(client proxy.Client, realTargetAddr netLayer.Addr, isTlsLazy_clientEnd bool) bool {
+	if b := client.GetBase(); b == nil || b.WarmPool == nil {
+		return false
+	}
+	if client.AddrStr() == "" || isTlsLazy_clientEnd || iics.tcpXver(client, true) > 0 {
+		return false
+	}
+	switch realTargetAddr.Network {
+	case "", "tcp":
+	default:
+		return false
+	}
+	if client.AdvancedLayer() != "" {
+		if ac := client.GetAdvClient(); ac == nil || ac.IsMux() || ac.IsSuper() {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+为 预连接池 拨号, 依次 进行 tcp拨号, tls握手, header层 包装 和 单路高级层 握手, 与 dialClient 中 代理层握手 之前 的 步骤 相同.
+
+单路高级层 (如ws) 握手时 不会 使用 0-rtt, 因为 此时 还 没有 首包.
+*/
+func dialWarmConn(client proxy.Client, realTargetAddr netLayer.Addr, dm *netLayer.DNSMachine) (conn, raw net.Conn, err error) {
+	var na net.Addr
+	if lta := client.LocalTCPAddr(); lta != nil {
+		na = lta
+	}
+
+	raw, err = realTargetAddr.DialWithResolver(client.GetSockopt(), na, dm, client.GetDomainStrategy())
+	if err != nil {
+		return
+	}
+	conn = raw
+
+	defer func() {
+		if err != nil {
+			raw.Close()
+			conn = nil
+		}
+	}()
+
+	if client.IsUseTLS() {
+		tlsClient := client.GetTLS_Client()
+		if tlsClient.NeedECHResolver() && dm != nil {
+			tlsClient.SetECHResolver(dm)
+		}
+
+		conn, err = tlsClient.Handshake(conn)
+		if err != nil {
+			return
+		}
+	}
+
+	advClient := client.GetAdvClient()
+
+	if header := client.HasHeader(); header != nil && !(advClient != nil && advClient.CanHandleHeaders()) {
+		conn = &httpLayer.HeaderConn{
+			Conn: conn,
+			H:    header,
+		}
+	}
+
+	if client.AdvancedLayer() != "" {
+		conn, err = advClient.(advLayer.SingleClient).Handshake(conn, 0)
+	}
+	return
+}
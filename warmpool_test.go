@@ -0,0 +1,117 @@
+package v2ray_simple_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// dokodemo -> vless(preconnect) -> vless -> direct -> 回显服务器. 第一个请求 之后 的 请求 应 命中 预连接池
+func TestWarmPool(t *testing.T) {
+	if utils.ZapLogger == nil {
+		utils.InitLog("")
+	}
+
+	const confFormatStr = `
+[[listen]]
+protocol = "dokodemo"
+host = "127.0.0.1"
+port = %s
+target = "tcp://127.0.0.1:%s"
+
+[[listen]]
+protocol = "vless"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+
+[[dial]]
+protocol = "vless"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+extra = { preconnect = 2 }
+
+[[dial]]
+protocol = "direct"
+`
+
+	echoLn := listenEcho(t)
+	defer echoLn.Close()
+	echoPort := fmt.Sprint(echoLn.Addr().(*net.TCPAddr).Port)
+	listenPort := netLayer.RandPortStr(true, false)
+	serverPort := netLayer.RandPortStr(true, false)
+
+	conf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(confFormatStr, listenPort, echoPort, serverPort, serverPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []proxy.Client
+	for i := range conf.Listen {
+		server, err := proxy.NewServer(conf.Listen[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := proxy.NewClient(conf.Dial[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Stop()
+		clients = append(clients, client)
+
+		c := v2ray_simple.ListenSer(server, client, nil, nil)
+		if c == nil {
+			t.Fatal("listen failed")
+		}
+		defer c.Close()
+	}
+
+	pool := clients[0].GetBase().WarmPool
+	if pool == nil {
+		t.Fatal("should have WarmPool")
+	}
+
+	request := func(msg string) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+listenPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err = conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+			t.Fatal("echo wrong", string(buf), err)
+		}
+	}
+
+	request("first")
+
+	for i := 0; ; i++ {
+		if idle, _, _, _ := pool.Stats(); idle == 2 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("pool not filled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	request("second")
+	request("third")
+
+	if _, hits, misses, _ := pool.Stats(); hits != 2 || misses != 1 {
+		t.Fatal("hits/misses wrong", hits, misses)
+	}
+}